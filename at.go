@@ -11,8 +11,10 @@ type APN struct {
 	Address           string
 }
 
-// Stats contains basic operational statistics
+// Stats contains basic operational statistics. Drivers fill in the values
+// the module reports and set the others to Unknown.
 type Stats struct {
+	// received signal power, the RSRP on LTE, expressed in tenth of dBm
 	SignalPower int
 	//  total power within receive bandwidth expressed in tenth of dBm
 	TotalPower int
@@ -24,18 +26,27 @@ type Stats struct {
 	RXTime int
 	// physical ID of the cell providing service to the module
 	CellID int
-	// TODO(borud): document
+	// coverage enhancement level (0-3). Higher levels repeat transmissions
+	// to reach the cell in poor coverage at the cost of power and
+	// throughput.
 	ECL int
 	//  last SNR value expressed in tenth of dB
 	SNR int
-	// TODO(borud): document
+	// E-UTRA absolute radio frequency channel number of the serving cell
 	EARFCN int
-	// TODO(borud): document
+	// physical cell ID (0-503) of the serving cell
 	PCI int
 	//  last RSRQ value expressed in tenth of dB
 	RSRQ int
 }
 
+// DeviceInfo identifies the module and the firmware it runs
+type DeviceInfo struct {
+	Manufacturer    string
+	Model           string
+	FirmwareVersion string
+}
+
 // ReceivedData contains the data received from an UDP connection
 type ReceivedData struct {
 	Socket    int
@@ -79,6 +90,7 @@ type Device interface {
 
 	// GetAddr returns the context identifier (CID) and address
 	// currently allocated to the device. This (usually) invokes the AT+CGPADDR command.
+	// Devices with several contexts list them through ContextManager.
 	GetAddr() (int, string, error)
 
 	// SetRadio turns the radio on if on is true and off is on is false. This (usually) invokes the AT+CFUN
@@ -117,3 +129,58 @@ type Device interface {
 	// never created, an error result code will be issued.
 	CloseUDPSocket(socket int) error
 }
+
+// ReceiveNotifier is implemented by devices that signal when data arrives
+// on a socket.
+type ReceiveNotifier interface {
+	// OnReceive registers a handler that is called with each message
+	// received on the socket. The payload is fetched from the device as
+	// soon as the device signals that data has arrived (+NSONMI on the
+	// N211, +QIURC: "recv" on the BG95 and #XAPOLL on the nRF91). Passing
+	// a nil handler removes the handler.
+	OnReceive(socket int, handler func(*ReceivedData)) error
+}
+
+// SocketInfo describes a socket the device has open
+type SocketInfo struct {
+	Socket int
+	// Protocol is "udp" or "tcp"
+	Protocol string
+}
+
+// SocketLister is implemented by devices that keep track of the sockets
+// they have opened.
+type SocketLister interface {
+	// ListSockets returns the open sockets sorted by socket
+	ListSockets() []SocketInfo
+}
+
+// StatsReader is implemented by devices that report operational
+// statistics.
+type StatsReader interface {
+	// GetStats returns the current statistics
+	GetStats() (*Stats, error)
+}
+
+// InfoReader is implemented by devices that can identify the module and
+// the firmware version.
+type InfoReader interface {
+	// GetDeviceInfo returns the manufacturer, model and firmware version.
+	// This (usually) invokes the AT+CGMI, AT+CGMM and AT+CGMR commands.
+	GetDeviceInfo() (*DeviceInfo, error)
+}
+
+// Rebooter is implemented by devices that can reboot the module
+type Rebooter interface {
+	// Reboot reboots the module. Settings that aren't stored in the
+	// module are lost.
+	Reboot() error
+}
+
+// Commander is implemented by devices that give access to their command
+// interface, ie to send commands the driver has no method for. Commands
+// that change the state of the module may confuse the driver.
+type Commander interface {
+	// CommandInterface returns the command interface of the device
+	CommandInterface() *CommandInterface
+}
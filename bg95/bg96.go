@@ -1,33 +1,98 @@
 package bg95
 
-import "github.com/lab5e/at"
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lab5e/at"
+	"github.com/lab5e/at/mqtt"
+)
 
 // DefaultBaudRate is the default baud rate for the BG95 UART
 const DefaultBaudRate = 115200
 
+// rebootTimeout is how long Reboot waits for the module to come back
+const rebootTimeout = time.Minute
+
 type bg95 struct {
 	at.DefaultImplementation
 
-	cmd *at.CommandInterface
+	cmd       *at.CommandInterface
+	receivers at.ReceiveHandlers
+	dns       at.DNSCache
+
+	mu      sync.Mutex
+	connIDs map[int]bool
+	tcp     map[int]*tcpSocket
+
+	mqttMsgID     int
+	mqttOnMessage func(*mqtt.Message)
+	mqttOnLost    func()
+
+	// dnsMu serializes lookups since the results aren't tagged with the
+	// host name
+	dnsMu sync.Mutex
 }
 
 func New(serialDevice string, baudRate int) at.Device {
 	cmdIF := at.NewCommandInterface(serialDevice, baudRate)
+	// The result of a send is "SEND OK" or "SEND FAIL" instead of OK
 	cmdIF.AddErrorOutput("SEND FAIL")
-	cmdIF.AddSplitChars(">")
 	cmdIF.AddSuccessOutput("SEND OK")
-	return &bg95{
+	d := &bg95{
 		DefaultImplementation: at.DefaultImplementation{Cmd: cmdIF},
 		cmd:                   cmdIF,
+		connIDs:               make(map[int]bool),
+		tcp:                   make(map[int]*tcpSocket),
 	}
+	cmdIF.AddURCHandler("+QIURC: ", d.handleQIURC)
+	cmdIF.AddURCHandler("+QSSLURC: ", d.handleQSSLURC)
+	cmdIF.AddURCHandler("+QMTRECV: ", d.handleQMTRECV)
+	cmdIF.AddURCHandler("+QMTSTAT: ", d.handleQMTSTAT)
+	return d
 }
 
 func (d *bg95) Start() error {
 	if err := d.Cmd.Start(); err != nil {
 		return err
 	}
+	return d.configure()
+}
+
+// Reboot restarts the module with AT+CFUN=1,1 and sets it up again when
+// it reports RDY. The connections don't survive the reboot.
+func (d *bg95) Reboot() error {
+	ready, unsubscribe := d.cmd.Subscribe("RDY", 1)
+	defer unsubscribe()
+
+	if err := d.cmd.Transact("AT+CFUN=1,1", nil); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	for _, t := range d.tcp {
+		t.SetState(at.ConnClosed)
+	}
+	d.mu.Unlock()
+
+	if err := at.WaitURC(context.Background(), ready, rebootTimeout, func(string) (bool, error) {
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	return d.configure()
+}
+
+// configure sets up the module. The settings are lost when the module
+// reboots.
+func (d *bg95) configure() error {
 	// BG95 has echo turned on by default. Turn off
-	return d.Cmd.Transact("ATE0", func(s string) error {
+	if err := d.Cmd.Transact("ATE0", func(s string) error {
 		return nil
-	})
+	}); err != nil {
+		return err
+	}
+	// Return received data as hex so binary payloads survive the line
+	// based parsing of the responses.
+	return d.Cmd.Transact(`AT+QICFG="dataformat",0,1`, nil)
 }
@@ -0,0 +1,109 @@
+package bg95
+
+import (
+	"strings"
+
+	"github.com/lab5e/at"
+)
+
+// GetCellInfo reads the serving cell with AT+QENG="servingcell" and the
+// neighbour cells with AT+QENG="neighbourcell". There is no serving cell
+// while the module is searching.
+func (d *bg95) GetCellInfo() (*at.CellInfo, error) {
+	serving, err := d.servingCell()
+	if err != nil {
+		return nil, err
+	}
+	info := &at.CellInfo{Serving: serving}
+
+	err = d.cmd.Transact(`AT+QENG="neighbourcell"`, func(s string) error {
+		// +QENG: "neighbourcell intra"|"neighbourcell inter","LTE",<earfcn>,
+		// <PCID>,<RSRQ>,<RSRP>,<RSSI>,<SINR>,...
+		st := strings.TrimPrefix(s, `+QENG: "neighbourcell`)
+		if st == s {
+			return nil
+		}
+		fields := strings.Split(st, ",")
+		if len(fields) < 8 || at.TrimQuotes(fields[1]) != "LTE" {
+			return nil
+		}
+		cell := at.UnknownCell()
+		cell.EARFCN = at.ParseMeasurement(fields[2])
+		cell.PCI = at.ParseMeasurement(fields[3])
+		cell.RSRQ = tenths(at.ParseMeasurement(fields[4]))
+		cell.RSRP = tenths(at.ParseMeasurement(fields[5]))
+		cell.SINR = sinr(at.ParseMeasurement(fields[7]))
+		info.Neighbours = append(info.Neighbours, cell)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// servingCell reads the serving cell with AT+QENG="servingcell". It
+// returns nil if the module isn't camped on an LTE cell.
+func (d *bg95) servingCell() (*at.Cell, error) {
+	var serving *at.Cell
+	err := d.cmd.Transact(`AT+QENG="servingcell"`, func(s string) error {
+		// +QENG: "servingcell",<state>,"eMTC",<is_tdd>,<MCC>,<MNC>,
+		// <cellID>,<PCID>,<earfcn>,<freq_band_ind>,<UL_bandwidth>,
+		// <DL_bandwidth>,<TAC>,<RSRP>,<RSRQ>,<RSSI>,<SINR>,<srxlev>
+		//
+		// +QENG: "servingcell",<state>,"NBIoT",<is_tdd>,<MCC>,<MNC>,
+		// <cellID>,<PCID>,<earfcn>,<freq_band_ind>,<TAC>,<RSRP>,<RSRQ>,
+		// <RSSI>,<SINR>,<srxlev>
+		st := strings.TrimPrefix(s, `+QENG: "servingcell",`)
+		if st == s {
+			return nil
+		}
+		fields := strings.Split(st, ",")
+		if len(fields) < 2 {
+			return nil
+		}
+
+		// tac is the index of the TAC, which is followed by RSRP, RSRQ,
+		// RSSI and SINR. NB-IoT doesn't report the bandwidths.
+		var tac int
+		switch at.TrimQuotes(fields[1]) {
+		case "eMTC":
+			tac = 11
+		case "NBIoT":
+			tac = 9
+		default:
+			return nil
+		}
+		if len(fields) < tac+5 {
+			return nil
+		}
+		cell := at.UnknownCell()
+		cell.CellID = at.ParseHexMeasurement(fields[5])
+		cell.PCI = at.ParseMeasurement(fields[6])
+		cell.EARFCN = at.ParseMeasurement(fields[7])
+		cell.TAC = at.ParseHexMeasurement(fields[tac])
+		cell.RSRP = tenths(at.ParseMeasurement(fields[tac+1]))
+		cell.RSRQ = tenths(at.ParseMeasurement(fields[tac+2]))
+		cell.SINR = sinr(at.ParseMeasurement(fields[tac+4]))
+		serving = &cell
+		return nil
+	})
+	return serving, err
+}
+
+// tenths converts whole dBm or dB values to tenths
+func tenths(n int) int {
+	if n == at.Unknown {
+		return n
+	}
+	return n * 10
+}
+
+// sinr converts the SINR reported by the module to tenths of dB. The
+// module reports 0-250 for -20 to 30 dB.
+func sinr(n int) int {
+	if n == at.Unknown || n < 0 || n > 250 {
+		return at.Unknown
+	}
+	return 2*n - 200
+}
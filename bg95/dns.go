@@ -0,0 +1,78 @@
+package bg95
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lab5e/at"
+)
+
+// resolveTimeout is how long to wait for the result of AT+QIDNSGIP when
+// the context has no deadline.
+const resolveTimeout = 60 * time.Second
+
+// dnsgipPrefix is the prefix of the URCs with the result of AT+QIDNSGIP
+const dnsgipPrefix = `+QIURC: "dnsgip",`
+
+// Resolve resolves the host name with AT+QIDNSGIP. The results are
+// cached for the TTL reported by the module.
+func (d *bg95) Resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if ips := d.dns.Lookup(host); ips != nil {
+		return ips, nil
+	}
+
+	d.dnsMu.Lock()
+	defer d.dnsMu.Unlock()
+
+	urcs, unsubscribe := d.cmd.Subscribe(dnsgipPrefix, 16)
+	defer unsubscribe()
+
+	if err := d.cmd.Transact(fmt.Sprintf(`AT+QIDNSGIP=1,"%s"`, host), nil); err != nil {
+		return nil, err
+	}
+
+	// The first URC is +QIURC: "dnsgip",<err>,<IP_count>,<DNS_ttl>
+	// followed by one +QIURC: "dnsgip","<IP_addr>" per address.
+	var ips []net.IP
+	var ttl time.Duration
+	count := -1
+	err := at.WaitURC(ctx, urcs, at.ContextTimeout(ctx, resolveTimeout), func(s string) (bool, error) {
+		fields := strings.Split(strings.TrimPrefix(s, dnsgipPrefix), ",")
+		if count < 0 {
+			if len(fields) != 3 {
+				return false, errors.New("could not parse AT+QIDNSGIP result")
+			}
+			if code := strings.TrimSpace(fields[0]); code != "0" {
+				return false, &net.DNSError{Err: "error code " + code + " returned from module", Name: host}
+			}
+			var err error
+			count, err = strconv.Atoi(strings.TrimSpace(fields[1]))
+			if err != nil {
+				return false, errors.New("invalid address count")
+			}
+			seconds, err := strconv.Atoi(strings.TrimSpace(fields[2]))
+			if err != nil {
+				return false, errors.New("invalid TTL")
+			}
+			ttl = time.Duration(seconds) * time.Second
+			return count == 0, nil
+		}
+		if ip := net.ParseIP(at.TrimQuotes(strings.TrimSpace(fields[0]))); ip != nil {
+			ips = append(ips, ip)
+		}
+		return len(ips) >= count, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ips) > 0 {
+		d.dns.Store(host, ips, ttl)
+	}
+	return ips, nil
+}
@@ -0,0 +1,255 @@
+package bg95
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lab5e/at"
+)
+
+// fileTransferTimeout is how long the module waits for the data during
+// uploads and how long we wait for the data during downloads
+const fileTransferTimeout = 60 * time.Second
+
+// fileInfo is an entry in the output of AT+QFLST
+type fileInfo struct {
+	name string
+	size int
+}
+
+// listFiles lists the files in the user file system (UFS) matching the
+// pattern.
+func (d *bg95) listFiles(pattern string) ([]fileInfo, error) {
+	var ret []fileInfo
+	err := d.cmd.Transact(fmt.Sprintf(`AT+QFLST="%s"`, pattern), func(s string) error {
+		// +QFLST: "<filename>",<file_size>
+		st := strings.TrimPrefix(s, "+QFLST: ")
+		if st == s {
+			return nil
+		}
+		fields := strings.Split(st, ",")
+		if len(fields) != 2 {
+			return errors.New("could not parse AT+QFLST response")
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return errors.New("invalid file size")
+		}
+		ret = append(ret, fileInfo{
+			name: strings.TrimPrefix(at.TrimQuotes(fields[0]), "UFS:"),
+			size: size,
+		})
+		return nil
+	})
+	return ret, err
+}
+
+// uploadFile writes the data to a file in the user file system. Existing
+// files must be deleted first.
+func (d *bg95) uploadFile(name string, data []byte) error {
+	uploaded, checksum := -1, -1
+	cmd := fmt.Sprintf(`AT+QFUPL="%s",%d,%d`, name, len(data), int(fileTransferTimeout/time.Second))
+	err := d.cmd.TransactTimeout(cmd, fileTransferTimeout, func(s string) error {
+		if s == "CONNECT" {
+			d.cmd.SendBytes(data)
+			return nil
+		}
+		// +QFUPL: <upload_size>,<checksum>
+		if st := strings.TrimPrefix(s, "+QFUPL: "); st != s {
+			var err error
+			uploaded, checksum, err = parseTransferResult(st)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if uploaded != len(data) {
+		return fmt.Errorf("module stored %d of %d bytes", uploaded, len(data))
+	}
+	if checksum != fileChecksum(data) {
+		return errors.New("checksum mismatch for uploaded file")
+	}
+	return nil
+}
+
+// downloadFile reads a file of the given size from the user file system
+func (d *bg95) downloadFile(name string, size int) ([]byte, error) {
+	downloaded, checksum := -1, -1
+	cmd := fmt.Sprintf(`AT+QFDWL="%s"`, name)
+	data, err := d.cmd.TransactData(cmd, "CONNECT", size, fileTransferTimeout, func(s string) error {
+		// +QFDWL: <download_size>,<checksum>
+		if st := strings.TrimPrefix(s, "+QFDWL: "); st != s {
+			var err error
+			downloaded, checksum, err = parseTransferResult(st)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if downloaded != size {
+		return nil, fmt.Errorf("module sent %d of %d bytes", downloaded, size)
+	}
+	if checksum != fileChecksum(data) {
+		return nil, errors.New("checksum mismatch for downloaded file")
+	}
+	return data, nil
+}
+
+// deleteFile removes a file from the user file system
+func (d *bg95) deleteFile(name string) error {
+	return d.cmd.Transact(fmt.Sprintf(`AT+QFDEL="%s"`, name), nil)
+}
+
+// parseTransferResult parses the size and hex checksum reported after
+// uploads and downloads
+func parseTransferResult(s string) (int, int, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) != 2 {
+		return 0, 0, errors.New("could not parse file transfer result")
+	}
+	size, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+	if err != nil {
+		return 0, 0, errors.New("invalid transfer size")
+	}
+	checksum, err := strconv.ParseUint(strings.TrimSpace(fields[1]), 16, 16)
+	if err != nil {
+		return 0, 0, errors.New("invalid transfer checksum")
+	}
+	return size, int(checksum), nil
+}
+
+// fileChecksum is the checksum the module reports for file transfers. It
+// is the XOR of the data as 16 bit big endian words with the last byte
+// padded with zero if the length is odd.
+func fileChecksum(data []byte) int {
+	var sum uint16
+	for i := 0; i < len(data); i += 2 {
+		word := uint16(data[i]) << 8
+		if i+1 < len(data) {
+			word |= uint16(data[i+1])
+		}
+		sum ^= word
+	}
+	return int(sum)
+}
+
+// The user file system is exposed through at.FileSystem. The file names
+// are passed to the module in quotes so names with quotes are rejected
+// along with wildcards that would match more than one file.
+
+// Stat returns information about the file
+func (d *bg95) Stat(name string) (os.FileInfo, error) {
+	f, err := d.stat("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return at.NewFileInfo(f.name, int64(f.size)), nil
+}
+
+// ReadDir lists the files in the user file system. The only directory is
+// the root.
+func (d *bg95) ReadDir(name string) ([]os.FileInfo, error) {
+	if name != "." && name != "" {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+	files, err := d.listFiles("*")
+	if err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].name < files[j].name
+	})
+	ret := make([]os.FileInfo, len(files))
+	for i, f := range files {
+		ret[i] = at.NewFileInfo(f.name, int64(f.size))
+	}
+	return ret, nil
+}
+
+// ReadFile reads the file from the module
+func (d *bg95) ReadFile(name string) ([]byte, error) {
+	f, err := d.stat("read", name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := d.downloadFile(f.name, f.size)
+	if err != nil {
+		return nil, &os.PathError{Op: "read", Path: name, Err: err}
+	}
+	return data, nil
+}
+
+// Open reads the file from the module and returns it for reading
+func (d *bg95) Open(name string) (at.File, error) {
+	f, err := d.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := d.downloadFile(f.name, f.size)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return at.NewFile(at.NewFileInfo(f.name, int64(f.size)), data), nil
+}
+
+// WriteFile writes the file to the module, replacing any existing file
+func (d *bg95) WriteFile(name string, data []byte) error {
+	if !validFileName(name) {
+		return &os.PathError{Op: "write", Path: name, Err: os.ErrInvalid}
+	}
+	files, err := d.listFiles(name)
+	if err != nil {
+		return &os.PathError{Op: "write", Path: name, Err: err}
+	}
+	if len(files) > 0 {
+		if err := d.deleteFile(name); err != nil {
+			return &os.PathError{Op: "write", Path: name, Err: err}
+		}
+	}
+	if err := d.uploadFile(name, data); err != nil {
+		return &os.PathError{Op: "write", Path: name, Err: err}
+	}
+	return nil
+}
+
+// Remove removes the file from the module
+func (d *bg95) Remove(name string) error {
+	if _, err := d.stat("remove", name); err != nil {
+		return err
+	}
+	if err := d.deleteFile(name); err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return nil
+}
+
+// stat looks up the file and returns errors for the operation as
+// *os.PathError
+func (d *bg95) stat(op string, name string) (fileInfo, error) {
+	if !validFileName(name) {
+		return fileInfo{}, &os.PathError{Op: op, Path: name, Err: os.ErrInvalid}
+	}
+	files, err := d.listFiles(name)
+	if err != nil {
+		return fileInfo{}, &os.PathError{Op: op, Path: name, Err: err}
+	}
+	for _, f := range files {
+		if f.name == name {
+			return f, nil
+		}
+	}
+	return fileInfo{}, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+func validFileName(name string) bool {
+	return at.ValidFileName(name) && !strings.ContainsAny(name, "*?")
+}
@@ -0,0 +1,81 @@
+package bg95
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lab5e/at"
+)
+
+// fotaTimeout is how long a firmware update may take when the context has
+// no deadline. Downloads over NB-IoT are slow.
+const fotaTimeout = time.Hour
+
+// fotaPrefix is the prefix of the URCs reporting the update progress
+const fotaPrefix = `+QIND: "FOTA",`
+
+// UpdateFirmware downloads the delta firmware package with AT+QFOTADL and
+// follows the +QIND: "FOTA" URCs. The module reboots while it applies the
+// update and reports RDY when it is back.
+func (d *bg95) UpdateFirmware(ctx context.Context, url string, progress func(at.FOTAEvent)) error {
+	urcs, unsubscribe := d.cmd.Subscribe(fotaPrefix, 16)
+	defer unsubscribe()
+	ready, unsubscribeReady := d.cmd.Subscribe("RDY", 4)
+	defer unsubscribeReady()
+
+	if err := d.cmd.Transact(fmt.Sprintf(`AT+QFOTADL="%s"`, url), nil); err != nil {
+		return err
+	}
+
+	err := at.WaitURC(ctx, urcs, at.ContextTimeout(ctx, fotaTimeout), func(s string) (bool, error) {
+		// +QIND: "FOTA","<stage>"[,<percent or error>]
+		fields := strings.Split(strings.TrimPrefix(s, fotaPrefix), ",")
+		value := -1
+		if len(fields) > 1 {
+			if n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(fields[1]), "%")); err == nil {
+				value = n
+			}
+		}
+
+		switch at.TrimQuotes(fields[0]) {
+		case "HTTPSTART", "FTPSTART":
+			progress(at.FOTAEvent{State: at.FOTADownloading, Progress: 0})
+		case "DOWNLOADING":
+			progress(at.FOTAEvent{State: at.FOTADownloading, Progress: value})
+		case "HTTPEND", "FTPEND":
+			if value != 0 {
+				return false, fmt.Errorf("firmware download failed with error %d", value)
+			}
+			progress(at.FOTAEvent{State: at.FOTADownloaded, Progress: 100})
+		case "START":
+			progress(at.FOTAEvent{State: at.FOTAUpdating, Progress: 0})
+		case "UPDATING":
+			progress(at.FOTAEvent{State: at.FOTAUpdating, Progress: value})
+		case "END":
+			if value != 0 {
+				return false, fmt.Errorf("firmware update failed with error %d", value)
+			}
+			return true, nil
+		}
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The module has rebooted while downloading too so skip the RDYs
+	// seen so far
+	for len(ready) > 0 {
+		<-ready
+	}
+	progress(at.FOTAEvent{State: at.FOTARebooting, Progress: -1})
+	if err := at.WaitURC(ctx, ready, at.ContextTimeout(ctx, at.FOTARebootTimeout), func(string) (bool, error) {
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	return d.configure()
+}
@@ -0,0 +1,243 @@
+package bg95
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lab5e/at"
+	"github.com/lab5e/at/mqtt"
+)
+
+// mqttClientIdx is the MQTT client index used in the module. We only use
+// one of the six clients.
+const mqttClientIdx = 0
+
+// mqttTimeout is how long to wait for MQTT results when the context has
+// no deadline. The module gives up on the broker after the packet timeout
+// (default 5 s) and three retries.
+const mqttTimeout = 75 * time.Second
+
+// MQTTConnect opens a network connection to the broker with AT+QMTOPEN
+// and connects with AT+QMTCONN.
+func (d *bg95) MQTTConnect(ctx context.Context, opts *mqtt.Options, onMessage func(*mqtt.Message), onLost func()) error {
+	d.mu.Lock()
+	d.mqttOnMessage = onMessage
+	d.mqttOnLost = onLost
+	d.mu.Unlock()
+
+	keepAlive := int(opts.KeepAlive / time.Second)
+	if keepAlive == 0 {
+		keepAlive = 120
+	}
+	cleanSession := 0
+	if opts.CleanSession {
+		cleanSession = 1
+	}
+
+	cmds := []string{
+		fmt.Sprintf(`AT+QMTCFG="version",%d,4`, mqttClientIdx),
+		fmt.Sprintf(`AT+QMTCFG="keepalive",%d,%d`, mqttClientIdx, keepAlive),
+		fmt.Sprintf(`AT+QMTCFG="session",%d,%d`, mqttClientIdx, cleanSession),
+		// Include the payload and its length in +QMTRECV
+		fmt.Sprintf(`AT+QMTCFG="recv/mode",%d,0,1`, mqttClientIdx),
+		// Return received payloads as hex, like we do for sockets
+		fmt.Sprintf(`AT+QMTCFG="dataformat",%d,0,1`, mqttClientIdx),
+	}
+	if opts.TLS != nil {
+		if err := d.configureSSLContext(opts.TLS); err != nil {
+			return err
+		}
+		cmds = append(cmds, fmt.Sprintf(`AT+QMTCFG="ssl",%d,1,%d`, mqttClientIdx, opts.TLS.SecurityTag))
+	} else {
+		cmds = append(cmds, fmt.Sprintf(`AT+QMTCFG="ssl",%d,0`, mqttClientIdx))
+	}
+	for _, cmd := range cmds {
+		if err := d.cmd.Transact(cmd, nil); err != nil {
+			return err
+		}
+	}
+
+	// +QMTOPEN: <client_idx>,<result>
+	err := d.mqttTransact(ctx, fmt.Sprintf(`AT+QMTOPEN=%d,"%s",%d`, mqttClientIdx, opts.Host, opts.Port), nil, "+QMTOPEN: ",
+		func(fields []string) (bool, error) {
+			return true, mqttResult(fields[1])
+		})
+	if err != nil {
+		return err
+	}
+
+	connect := fmt.Sprintf(`AT+QMTCONN=%d,"%s"`, mqttClientIdx, opts.ClientID)
+	if opts.Username != "" {
+		connect += fmt.Sprintf(`,"%s","%s"`, opts.Username, opts.Password)
+	}
+	// +QMTCONN: <client_idx>,<result>[,<ret_code>]
+	return d.mqttTransact(ctx, connect, nil, "+QMTCONN: ", func(fields []string) (bool, error) {
+		if err := mqttResult(fields[1]); err != nil {
+			return false, err
+		}
+		if len(fields) > 2 && strings.TrimSpace(fields[2]) != "0" {
+			return false, fmt.Errorf("broker refused connection with return code %s", strings.TrimSpace(fields[2]))
+		}
+		return true, nil
+	})
+}
+
+// MQTTDisconnect disconnects from the broker with AT+QMTDISC
+func (d *bg95) MQTTDisconnect(ctx context.Context) error {
+	// +QMTDISC: <client_idx>,<result>
+	return d.mqttTransact(ctx, fmt.Sprintf("AT+QMTDISC=%d", mqttClientIdx), nil, "+QMTDISC: ",
+		func(fields []string) (bool, error) {
+			return true, mqttResult(fields[1])
+		})
+}
+
+// MQTTPublish publishes the message with AT+QMTPUBEX
+func (d *bg95) MQTTPublish(ctx context.Context, msg *mqtt.Message) error {
+	msgID := 0
+	if msg.QoS > mqtt.AtMostOnce {
+		msgID = d.nextMQTTMsgID()
+	}
+	retain := 0
+	if msg.Retain {
+		retain = 1
+	}
+
+	cmd := fmt.Sprintf(`AT+QMTPUBEX=%d,%d,%d,%d,"%s",%d`, mqttClientIdx, msgID, msg.QoS, retain, msg.Topic, len(msg.Payload))
+	// +QMTPUBEX: <client_idx>,<msgID>,<result>[,<value>]
+	return d.mqttTransact(ctx, cmd, msg.Payload, "+QMTPUBEX: ", func(fields []string) (bool, error) {
+		if len(fields) < 3 || strings.TrimSpace(fields[1]) != strconv.Itoa(msgID) {
+			return false, nil
+		}
+		return true, mqttResult(fields[2])
+	})
+}
+
+// MQTTSubscribe subscribes to the topic with AT+QMTSUB
+func (d *bg95) MQTTSubscribe(ctx context.Context, topic string, qos mqtt.QoS) error {
+	msgID := d.nextMQTTMsgID()
+	cmd := fmt.Sprintf(`AT+QMTSUB=%d,%d,"%s",%d`, mqttClientIdx, msgID, topic, qos)
+	// +QMTSUB: <client_idx>,<msgID>,<result>[,<value>]
+	return d.mqttTransact(ctx, cmd, nil, "+QMTSUB: ", func(fields []string) (bool, error) {
+		if len(fields) < 3 || strings.TrimSpace(fields[1]) != strconv.Itoa(msgID) {
+			return false, nil
+		}
+		if err := mqttResult(fields[2]); err != nil {
+			return false, err
+		}
+		// The value is the granted QoS or 128 if the broker rejected it
+		if len(fields) > 3 && strings.TrimSpace(fields[3]) == "128" {
+			return false, errors.New("broker rejected subscription")
+		}
+		return true, nil
+	})
+}
+
+// MQTTUnsubscribe unsubscribes from the topic with AT+QMTUNS
+func (d *bg95) MQTTUnsubscribe(ctx context.Context, topic string) error {
+	msgID := d.nextMQTTMsgID()
+	cmd := fmt.Sprintf(`AT+QMTUNS=%d,%d,"%s"`, mqttClientIdx, msgID, topic)
+	// +QMTUNS: <client_idx>,<msgID>,<result>
+	return d.mqttTransact(ctx, cmd, nil, "+QMTUNS: ", func(fields []string) (bool, error) {
+		if len(fields) < 3 || strings.TrimSpace(fields[1]) != strconv.Itoa(msgID) {
+			return false, nil
+		}
+		return true, mqttResult(fields[2])
+	})
+}
+
+// nextMQTTMsgID returns the next packet identifier (1-65535)
+func (d *bg95) nextMQTTMsgID() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.mqttMsgID = d.mqttMsgID%65535 + 1
+	return d.mqttMsgID
+}
+
+// mqttTransact issues the command, sending the payload when prompted if
+// there is one, and then passes the fields of the URCs with the prefix for
+// our client to fn until fn is done.
+func (d *bg95) mqttTransact(ctx context.Context, cmd string, payload []byte, prefix string, fn func([]string) (bool, error)) error {
+	urcs, unsubscribe := d.cmd.Subscribe(prefix, 16)
+	defer unsubscribe()
+
+	var err error
+	if payload != nil {
+		err = d.send(cmd, payload)
+	} else {
+		err = d.cmd.Transact(cmd, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	return at.WaitURC(ctx, urcs, at.ContextTimeout(ctx, mqttTimeout), func(s string) (bool, error) {
+		fields := strings.Split(strings.TrimPrefix(s, prefix), ",")
+		if len(fields) < 2 || strings.TrimSpace(fields[0]) != strconv.Itoa(mqttClientIdx) {
+			return false, nil
+		}
+		return fn(fields)
+	})
+}
+
+// mqttResult turns the result field of the MQTT URCs into an error
+func mqttResult(result string) error {
+	switch strings.TrimSpace(result) {
+	case "0":
+		return nil
+	case "1":
+		return errors.New("packet retransmission")
+	default:
+		return fmt.Errorf("MQTT operation failed with result %s", strings.TrimSpace(result))
+	}
+}
+
+// handleQMTRECV handles the +QMTRECV: <client_idx>,<msgID>,"<topic>",<payload_len>,"<payload>" URC
+func (d *bg95) handleQMTRECV(s string) {
+	st := strings.TrimPrefix(s, "+QMTRECV: ")
+
+	// The topic may contain commas so find it by its quotes
+	start := strings.Index(st, `"`)
+	end := strings.Index(st, `",`)
+	if start < 0 || end <= start {
+		log.Printf("Could not parse MQTT message: %s", s)
+		return
+	}
+	topic := st[start+1 : end]
+	fields := strings.Split(st[end+2:], ",")
+	if len(fields) != 2 {
+		log.Printf("Could not parse MQTT message: %s", s)
+		return
+	}
+	payload, err := hex.DecodeString(at.TrimQuotes(strings.TrimSpace(fields[1])))
+	if err != nil {
+		log.Printf("Invalid payload in MQTT message: %s", s)
+		return
+	}
+
+	d.mu.Lock()
+	fn := d.mqttOnMessage
+	d.mu.Unlock()
+	if fn != nil {
+		fn(&mqtt.Message{Topic: topic, Payload: payload})
+	}
+}
+
+// handleQMTSTAT handles the +QMTSTAT: <client_idx>,<err_code> URC which
+// reports that the connection has been closed.
+func (d *bg95) handleQMTSTAT(s string) {
+	log.Printf("MQTT connection closed: %s", s)
+
+	d.mu.Lock()
+	fn := d.mqttOnLost
+	d.mu.Unlock()
+	if fn != nil {
+		fn()
+	}
+}
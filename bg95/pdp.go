@@ -0,0 +1,77 @@
+package bg95
+
+import (
+	"fmt"
+
+	"github.com/lab5e/at"
+)
+
+// qiContextTypes are the context types AT+QICSGP uses for the PDP types.
+// Non-IP contexts aren't handled by the TCP/IP stack of the module.
+var qiContextTypes = map[string]int{
+	at.PDPTypeIP:     1,
+	at.PDPTypeIPv6:   2,
+	at.PDPTypeIPv4v6: 3,
+}
+
+// SetAuth sets the authentication with AT+QICSGP for IP contexts so the
+// TCP/IP stack of the module uses it. AT+QICSGP sets the type and APN as
+// well so the context must be defined first. Non-IP contexts use
+// AT+CGAUTH.
+func (d *bg95) SetAuth(cid int, auth at.AuthType, username string, password string) error {
+	ctx, err := d.context(cid)
+	if err != nil {
+		return err
+	}
+	contextType, ok := qiContextTypes[ctx.Type]
+	if !ok {
+		return d.DefaultImplementation.SetAuth(cid, auth, username, password)
+	}
+	if auth != at.AuthNone && auth != at.AuthPAP && auth != at.AuthCHAP {
+		return fmt.Errorf("invalid authentication protocol %d", auth)
+	}
+	if auth == at.AuthNone {
+		username, password = "", ""
+	}
+	return d.cmd.Transact(fmt.Sprintf(`AT+QICSGP=%d,%d,"%s","%s","%s",%d`, cid, contextType, ctx.APN, username, password, auth), nil)
+}
+
+// Activate activates IP contexts with AT+QIACT so the TCP/IP stack of the
+// module can use them. Non-IP contexts are activated with AT+CGACT.
+func (d *bg95) Activate(cid int) error {
+	ctx, err := d.context(cid)
+	if err != nil {
+		return err
+	}
+	if _, ok := qiContextTypes[ctx.Type]; !ok {
+		return d.DefaultImplementation.Activate(cid)
+	}
+	return d.cmd.TransactTimeout(fmt.Sprintf("AT+QIACT=%d", cid), at.ContextActivationTimeout, nil)
+}
+
+// Deactivate deactivates IP contexts with AT+QIDEACT. Sockets using the
+// context are closed by the module.
+func (d *bg95) Deactivate(cid int) error {
+	ctx, err := d.context(cid)
+	if err != nil {
+		return err
+	}
+	if _, ok := qiContextTypes[ctx.Type]; !ok {
+		return d.DefaultImplementation.Deactivate(cid)
+	}
+	return d.cmd.TransactTimeout(fmt.Sprintf("AT+QIDEACT=%d", cid), at.ContextActivationTimeout, nil)
+}
+
+// context returns the PDP context with the CID
+func (d *bg95) context(cid int) (*at.PDPContext, error) {
+	contexts, err := d.ListContexts()
+	if err != nil {
+		return nil, err
+	}
+	for i := range contexts {
+		if contexts[i].CID == cid {
+			return &contexts[i], nil
+		}
+	}
+	return nil, fmt.Errorf("PDP context %d is not defined", cid)
+}
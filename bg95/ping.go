@@ -0,0 +1,90 @@
+package bg95
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lab5e/at"
+)
+
+// maxPingCount is the largest number of echo requests AT+QPING sends
+const maxPingCount = 10
+
+// pingTimeoutError is the error code in +QPING URCs for requests that
+// weren't answered in time
+const pingTimeoutError = "569"
+
+// pingMargin is how much longer than the ping timeouts we wait for the
+// final +QPING URC
+const pingMargin = 10 * time.Second
+
+// Ping pings the host with AT+QPING on context 1. The module doesn't let
+// us set the packet size so size is ignored. Requests are sent in batches
+// of up to 10 since that is the most the command allows.
+func (d *bg95) Ping(ctx context.Context, host string, count int, size int) (*at.PingResult, error) {
+	urcs, unsubscribe := d.cmd.Subscribe("+QPING: ", 2*maxPingCount+1)
+	defer unsubscribe()
+
+	var replies []at.PingReply
+	var addr string
+	sent := 0
+	for sent < count {
+		batch := count - sent
+		if batch > maxPingCount {
+			batch = maxPingCount
+		}
+		timeout := at.DefaultPingTimeout / time.Second
+		if err := d.cmd.Transact(fmt.Sprintf(`AT+QPING=1,"%s",%d,%d`, host, timeout, batch), nil); err != nil {
+			return nil, err
+		}
+
+		// One +QPING: <result>[,<IP_address>,<bytes>,<time>,<ttl>] URC
+		// is sent per request followed by
+		// +QPING: <finresult>[,<sent>,<rcvd>,<lost>,<min>,<max>,<avg>]
+		wait := time.Duration(batch)*at.DefaultPingTimeout + pingMargin
+		err := at.WaitURC(ctx, urcs, at.ContextTimeout(ctx, wait), func(s string) (bool, error) {
+			fields := strings.Split(strings.TrimPrefix(s, "+QPING: "), ",")
+			for i := range fields {
+				fields[i] = strings.TrimSpace(fields[i])
+			}
+			switch len(fields) {
+			case 1:
+				if fields[0] != pingTimeoutError {
+					return false, fmt.Errorf("ping failed with error code %s", fields[0])
+				}
+				return false, nil
+			case 5:
+				if fields[0] != "0" {
+					return false, nil
+				}
+				addr = at.TrimQuotes(fields[1])
+				rtt, err := strconv.Atoi(fields[3])
+				if err != nil {
+					return false, errors.New("invalid RTT")
+				}
+				ttl, err := strconv.Atoi(fields[4])
+				if err != nil {
+					return false, errors.New("invalid TTL")
+				}
+				replies = append(replies, at.PingReply{RTT: time.Duration(rtt) * time.Millisecond, TTL: ttl})
+				return false, nil
+			case 7:
+				return true, nil
+			default:
+				return false, errors.New("could not parse +QPING URC")
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		sent += batch
+	}
+	if addr == "" {
+		addr = host
+	}
+	return at.NewPingResult(addr, sent, replies), nil
+}
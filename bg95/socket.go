@@ -1,12 +1,16 @@
 package bg95
 
 import (
+	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/lab5e/at"
 )
@@ -27,71 +31,111 @@ OK
 OK
 */
 
-var socketno = 0
+// maxConnections is the number of connection IDs (0-11) in the module
+const maxConnections = 12
 
-// Note: There is only a single socket in the LTE modem. The port parameter may be 0, then the
-// socket won't be bound to a port.
-func (d *bg95) CreateUDPSocket(port int) (int, error) {
-	socketno++
-	if socketno > 11 {
-		return 0, errors.New("sockets exhausted")
+// openTimeout is how long to wait for the +QIOPEN URC when the context
+// has no deadline. This is the maximum response time in the manual.
+const openTimeout = 150 * time.Second
+
+// allocateConnID returns a free connection ID
+func (d *bg95) allocateConnID() (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for id := 0; id < maxConnections; id++ {
+		if !d.connIDs[id] {
+			d.connIDs[id] = true
+			return id, nil
+		}
+	}
+	return 0, errors.New("sockets exhausted")
+}
+
+// releaseConnID marks the connection ID as free
+func (d *bg95) releaseConnID(id int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.connIDs, id)
+}
+
+// openConnection issues an AT+QIOPEN command for the connection ID and
+// waits for the +QIOPEN URC with the result.
+func (d *bg95) openConnection(ctx context.Context, connID int, cmd string) error {
+	return d.openWith(ctx, connID, cmd, "+QIOPEN: ")
+}
+
+// openWith issues an open command for the connection ID and waits for the
+// URC with the prefix that reports the result.
+func (d *bg95) openWith(ctx context.Context, connID int, cmd string, prefix string) error {
+	urcs, unsubscribe := d.cmd.Subscribe(prefix, maxConnections)
+	defer unsubscribe()
+
+	if err := d.cmd.Transact(cmd, nil); err != nil {
+		return err
 	}
-	err := d.cmd.Transact(fmt.Sprintf(`AT+QIOPEN=1,%d,"UDP SERVICE","0.0.0.0",0,%d`, socketno, port), func(s string) error {
+
+	return at.WaitURC(ctx, urcs, at.ContextTimeout(ctx, openTimeout), func(s string) (bool, error) {
 		// The module will return <connection id>,<error> and <error> should - obviously be 0
-		if strings.HasPrefix(s, "+QIOPEN") {
-			elems := strings.Split(s, ":")
-			if len(elems) != 2 {
-				log.Printf("Error parsing result from AT+QIOPEN: %s", s)
-				return errors.New("could not parse return value from AT+QIOPEN command")
-			}
-			fields := strings.Split(elems[1], ",")
-			if len(fields) != 2 {
-				log.Printf("Expected 2 fields returned but got %d: %s", len(fields), s)
-				return errors.New("could not parse response fields from AT+QIOPEN")
-			}
-			connID, err := strconv.Atoi(strings.TrimSpace(fields[0]))
-			if err != nil {
-				log.Printf("Invalid connection ID (field #1) from module: %s", s)
-				return errors.New("could not parse connection ID")
-			}
-			if strings.TrimSpace(fields[1]) != "0" {
-				log.Printf("Got error response from AT+QIOPEN: %s", s)
-				return errors.New("error code returned from module")
-			}
-			socketno = connID
-			return nil
+		fields := strings.Split(strings.TrimPrefix(s, prefix), ",")
+		if len(fields) != 2 {
+			log.Printf("Expected 2 fields returned but got %d: %s", len(fields), s)
+			return false, errors.New("could not parse response fields from open command")
 		}
-		return nil
+		id, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+		if err != nil {
+			log.Printf("Invalid connection ID (field #1) from module: %s", s)
+			return false, errors.New("could not parse connection ID")
+		}
+		if id != connID {
+			return false, nil
+		}
+		if strings.TrimSpace(fields[1]) != "0" {
+			log.Printf("Got error response from open command: %s", s)
+			return false, fmt.Errorf("error code %s returned from module", strings.TrimSpace(fields[1]))
+		}
+		return true, nil
 	})
-	return socketno, err
 }
 
-// This might not work with arbitrary binary data since the data is sent as a string
+// CreateUDPSocket opens an UDP service socket. The port parameter may be
+// 0, then the socket won't be bound to a port.
+func (d *bg95) CreateUDPSocket(port int) (int, error) {
+	connID, err := d.allocateConnID()
+	if err != nil {
+		return 0, err
+	}
+	err = d.openConnection(context.Background(), connID, fmt.Sprintf(`AT+QIOPEN=1,%d,"UDP SERVICE","0.0.0.0",0,%d`, connID, port))
+	if err != nil {
+		d.releaseConnID(connID)
+		return 0, err
+	}
+	return connID, nil
+}
+
 func (d *bg95) SendUDP(socket int, address net.IP, remotePort int, data []byte) (int, error) {
-	// Start by sending AT+SEND and when we receive the '>' character send the payload. We should get a "SEND OK" or "SEND ERROR" back
-	err := d.cmd.Transact(fmt.Sprintf(`AT+QISEND=%d,%d,"%s",%d`,
-		socket, len(data), address.String(), remotePort), func(s string) error {
-		d.cmd.SendCRLF(string(data))
-		return nil
-	})
+	// The payload is sent at the '>' prompt and the module answers with "SEND OK" or "SEND FAIL"
+	err := d.send(fmt.Sprintf(`AT+QISEND=%d,%d,"%s",%d`,
+		socket, len(data), address.String(), remotePort), data)
 	if err == nil {
 		return len(data), nil
 	}
 	return 0, err
 }
 
-// Note: Receive has a 10 second timeout
+// Note: Receive has a 10 second timeout. If there is no data waiting the
+// returned data is empty.
 func (d *bg95) ReceiveUDP(socket int, length int) (*at.ReceivedData, error) {
-	ret := &at.ReceivedData{}
+	ret := &at.ReceivedData{Socket: socket}
+	header := false
 	err := d.cmd.Transact(fmt.Sprintf("AT+QIRD=%d", socket), func(s string) error {
 		if strings.HasPrefix(s, "+QIRD:") {
-			log.Printf("Got data: %s", s)
 			// +QIRD: <read_actual_length>,<remoteIP>,<remote_port> <CR><LF><data>
 			// This line will contain the remote IP, port and length
 			fields := strings.Split(s[6:], ",")
 			if len(fields) == 1 {
 				// A single number is "no new data"
-				return errors.New("no more data")
+				return nil
 			}
 			if len(fields) != 3 {
 				log.Printf("Error parsing returned value: %s", s)
@@ -103,22 +147,97 @@ func (d *bg95) ReceiveUDP(socket int, length int) (*at.ReceivedData, error) {
 				log.Printf("Length field error: %s", s)
 				return errors.New("invalid length field")
 			}
-			ret.IP = fields[1]
+			ret.IP = at.TrimQuotes(strings.TrimSpace(fields[1]))
 			ret.Port, err = strconv.Atoi(strings.TrimSpace(fields[2]))
 			if err != nil {
 				log.Printf("Port field error: %s", s)
 				return errors.New("invalid port field")
 			}
+			header = true
 			return nil
 		}
-		ret.Data = append(ret.Data, []byte(s)...)
-		return nil
+		if !header || ret.Data != nil {
+			return nil
+		}
+		// The module is set up to return received data in hex
+		var err error
+		ret.Data, err = hex.DecodeString(s)
+		return err
 	})
 	return ret, err
 }
 
+// send issues a send command and writes the payload when the module
+// prompts for it with >.
+func (d *bg95) send(cmd string, data []byte) error {
+	return d.cmd.TransactPrompt(cmd, ">", data, nil)
+}
+
 func (d *bg95) CloseUDPSocket(socket int) error {
+	defer d.releaseConnID(socket)
 	return d.cmd.Transact(fmt.Sprintf("AT+QICLOSE=%d", socket), func(s string) error {
 		return nil
 	})
 }
+
+// ListSockets returns the sockets opened through the driver. Connection
+// IDs that aren't TCP or TLS connections are UDP sockets.
+func (d *bg95) ListSockets() []at.SocketInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var ret []at.SocketInfo
+	for id := range d.connIDs {
+		protocol := "udp"
+		if d.tcp[id] != nil {
+			protocol = "tcp"
+		}
+		ret = append(ret, at.SocketInfo{Socket: id, Protocol: protocol})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Socket < ret[j].Socket
+	})
+	return ret
+}
+
+// OnReceive registers a handler for the data received on the socket. The
+// data is read when the module issues a +QIURC: "recv" URC.
+func (d *bg95) OnReceive(socket int, handler func(*at.ReceivedData)) error {
+	d.receivers.Set(socket, handler)
+	return nil
+}
+
+// handleQIURC handles the +QIURC: "<type>",<connectID>[,...] URCs
+func (d *bg95) handleQIURC(s string) {
+	fields := strings.Split(strings.TrimPrefix(s, "+QIURC: "), ",")
+	if len(fields) < 2 {
+		return
+	}
+
+	switch at.TrimQuotes(fields[0]) {
+	case "recv":
+		socket, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil {
+			log.Printf("Invalid connection ID in URC: %s", s)
+			return
+		}
+		if t := d.tcpSocket(socket); t != nil {
+			t.DataAvailable()
+			return
+		}
+		// The module won't issue another URC until the buffer has been
+		// read empty
+		for d.receivers.Fetch(socket, d.ReceiveUDP) {
+		}
+
+	case "closed":
+		socket, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil {
+			log.Printf("Invalid connection ID in URC: %s", s)
+			return
+		}
+		if t := d.tcpSocket(socket); t != nil {
+			t.SetState(at.ConnClosed)
+		}
+	}
+}
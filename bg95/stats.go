@@ -0,0 +1,54 @@
+package bg95
+
+import (
+	"strings"
+
+	"github.com/lab5e/at"
+)
+
+// GetStats reads the signal quality with AT+QCSQ and the serving cell with
+// AT+QENG="servingcell". The coverage enhancement level is read with
+// AT+QCFG="celevel" if the firmware supports it.
+func (d *bg95) GetStats() (*at.Stats, error) {
+	stats := at.UnknownStats()
+
+	err := d.cmd.Transact("AT+QCSQ", func(s string) error {
+		// +QCSQ: "eMTC"|"NBIoT",<lte_rssi>,<lte_rsrp>,<lte_sinr>,<lte_rsrq>
+		// or +QCSQ: "NOSERVICE" when there is no service
+		st := strings.TrimPrefix(s, "+QCSQ: ")
+		if st == s {
+			return nil
+		}
+		fields := strings.Split(st, ",")
+		if len(fields) < 5 {
+			return nil
+		}
+		stats.TotalPower = tenths(at.ParseMeasurement(fields[1]))
+		stats.SignalPower = tenths(at.ParseMeasurement(fields[2]))
+		stats.SNR = sinr(at.ParseMeasurement(fields[3]))
+		stats.RSRQ = tenths(at.ParseMeasurement(fields[4]))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	serving, err := d.servingCell()
+	if err != nil {
+		return nil, err
+	}
+	if serving != nil {
+		stats.CellID = serving.CellID
+		stats.EARFCN = serving.EARFCN
+		stats.PCI = serving.PCI
+	}
+
+	// +QCFG: "celevel",<level>
+	d.cmd.Transact(`AT+QCFG="celevel"`, func(s string) error {
+		if st := strings.TrimPrefix(s, `+QCFG: "celevel",`); st != s {
+			stats.ECL = at.ParseMeasurement(st)
+		}
+		return nil
+	})
+	return stats, nil
+}
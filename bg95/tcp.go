@@ -0,0 +1,150 @@
+package bg95
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/lab5e/at"
+)
+
+// maxSendSize is the largest payload we send with one command
+const maxSendSize = 1460
+
+type tcpSocket struct {
+	at.SocketEvents
+
+	d      *bg95
+	connID int
+
+	// ssl is set for connections opened with AT+QSSLOPEN. They use the
+	// AT+QSSL* commands rather than the AT+QI* commands.
+	ssl bool
+}
+
+// DialTCP opens a TCP connection. The module resolves host if it is a
+// name.
+func (d *bg95) DialTCP(ctx context.Context, host string, port int) (at.TCPSocket, error) {
+	connID, err := d.allocateConnID()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tcpSocket{d: d, connID: connID}
+	d.mu.Lock()
+	d.tcp[connID] = t
+	d.mu.Unlock()
+
+	// The last parameter selects buffer access mode where data is read
+	// with AT+QIRD after a +QIURC: "recv" URC
+	err = d.openConnection(ctx, connID, fmt.Sprintf(`AT+QIOPEN=1,%d,"TCP","%s",%d,0,0`, connID, host, port))
+	if err != nil {
+		d.removeTCPSocket(connID)
+		d.releaseConnID(connID)
+		return nil, err
+	}
+	t.SetState(at.ConnConnected)
+
+	return t, nil
+}
+
+// tcpSocket returns the TCP socket or nil if the connection isn't a TCP
+// connection
+func (d *bg95) tcpSocket(connID int) *tcpSocket {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.tcp[connID]
+}
+
+func (d *bg95) removeTCPSocket(connID int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.tcp, connID)
+}
+
+// MaxSendSize returns 1460, the most AT+QISEND takes in one command on a
+// TCP connection
+func (t *tcpSocket) MaxSendSize() int {
+	return maxSendSize
+}
+
+func (t *tcpSocket) Socket() int {
+	return t.connID
+}
+
+func (t *tcpSocket) Send(data []byte) (int, error) {
+	if t.State() == at.ConnClosed {
+		return 0, at.ErrClosed
+	}
+	cmd := "AT+QISEND"
+	if t.ssl {
+		cmd = "AT+QSSLSEND"
+	}
+	if err := t.d.send(fmt.Sprintf("%s=%d,%d", cmd, t.connID, len(data)), data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (t *tcpSocket) Receive(length int) ([]byte, error) {
+	if t.ssl {
+		return t.receiveSSL(length)
+	}
+
+	var data []byte
+	readLength := -1
+	err := t.d.cmd.Transact(fmt.Sprintf("AT+QIRD=%d,%d", t.connID, length), func(s string) error {
+		// +QIRD: <read_actual_length><CR><LF><data>
+		if st := strings.TrimPrefix(s, "+QIRD: "); st != s {
+			n, err := strconv.Atoi(strings.TrimSpace(st))
+			if err != nil {
+				log.Printf("Length field error: %s", s)
+				return errors.New("invalid length field")
+			}
+			readLength = n
+			return nil
+		}
+		if readLength <= 0 || data != nil {
+			return nil
+		}
+		var err error
+		data, err = hex.DecodeString(s)
+		return err
+	})
+	return data, err
+}
+
+// receiveSSL reads from a TLS connection. AT+QSSLRECV has no hex mode so
+// the data is read as is, using the length on the line before it.
+func (t *tcpSocket) receiveSSL(length int) ([]byte, error) {
+	// +QSSLRECV: <have_read_length><CR><LF><data>
+	return t.d.cmd.TransactSizedData(fmt.Sprintf("AT+QSSLRECV=%d,%d", t.connID, length), func(s string) (int, bool) {
+		st := strings.TrimPrefix(s, "+QSSLRECV: ")
+		if st == s {
+			return 0, false
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(st))
+		if err != nil || n < 0 {
+			log.Printf("Length field error: %s", s)
+			return 0, false
+		}
+		return n, true
+	}, at.DefaultLineTimeout, nil)
+}
+
+func (t *tcpSocket) Close() error {
+	t.d.removeTCPSocket(t.connID)
+	defer t.d.releaseConnID(t.connID)
+
+	cmd := "AT+QICLOSE"
+	if t.ssl {
+		cmd = "AT+QSSLCLOSE"
+	}
+	err := t.d.cmd.Transact(fmt.Sprintf("%s=%d", cmd, t.connID), nil)
+	t.SetState(at.ConnClosed)
+	return err
+}
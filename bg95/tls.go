@@ -0,0 +1,207 @@
+package bg95
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/lab5e/at"
+)
+
+// maxSSLContexts is the number of SSL contexts (0-5) in the module
+const maxSSLContexts = 6
+
+// Security levels for AT+QSSLCFG="seclevel"
+const (
+	secLevelNone       = 0
+	secLevelServerAuth = 1
+	secLevelMutualAuth = 2
+)
+
+// credentialNames are the suffixes of the files credentials are stored in
+var credentialNames = map[at.CredentialType]string{
+	at.CredentialCACert:     "ca",
+	at.CredentialClientCert: "cert",
+	at.CredentialClientKey:  "key",
+}
+
+// credentialFile returns the name of the file in the user file system the
+// credential is stored in.
+func credentialFile(tag int, credentialType at.CredentialType) string {
+	return fmt.Sprintf("sec%d_%s.pem", tag, credentialNames[credentialType])
+}
+
+// ListCredentials lists the credentials stored in the user file system
+func (d *bg95) ListCredentials() ([]at.Credential, error) {
+	files, err := d.listFiles("sec*.pem")
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []at.Credential
+	for _, f := range files {
+		var tag int
+		var name string
+		if _, err := fmt.Sscanf(strings.Replace(f.name, "_", " ", 1), "sec%d %s", &tag, &name); err != nil {
+			continue
+		}
+		for t, n := range credentialNames {
+			if n+".pem" == name {
+				ret = append(ret, at.Credential{Tag: tag, Type: t})
+			}
+		}
+	}
+	return ret, nil
+}
+
+// WriteCredential uploads the credential to the user file system with
+// AT+QFUPL. The tag is the SSL context (0-5) the credential is used with.
+func (d *bg95) WriteCredential(tag int, credentialType at.CredentialType, pem []byte) error {
+	if _, ok := credentialNames[credentialType]; !ok {
+		return errors.New("unsupported credential type")
+	}
+	if tag < 0 || tag >= maxSSLContexts {
+		return errors.New("security tag must be an SSL context (0-5)")
+	}
+
+	name := credentialFile(tag, credentialType)
+	// Uploads fail if the file exists so get rid of the old one first
+	files, err := d.listFiles(name)
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 {
+		if err := d.deleteFile(name); err != nil {
+			return err
+		}
+	}
+	return d.uploadFile(name, pem)
+}
+
+// DeleteCredential removes the credential from the user file system
+func (d *bg95) DeleteCredential(tag int, credentialType at.CredentialType) error {
+	if _, ok := credentialNames[credentialType]; !ok {
+		return errors.New("unsupported credential type")
+	}
+	return d.deleteFile(credentialFile(tag, credentialType))
+}
+
+// DialTLS opens a TLS connection using the TLS stack in the module. The
+// security tag in the config is used as the SSL context and the
+// credentials stored with the tag are configured for the context. The
+// module uses the host name for SNI so ServerName must be empty or match
+// the host.
+func (d *bg95) DialTLS(ctx context.Context, host string, port int, config *at.TLSConfig) (at.TCPSocket, error) {
+	if config == nil {
+		return nil, errors.New("missing TLS configuration")
+	}
+	if config.ServerName != "" && config.ServerName != host {
+		return nil, errors.New("server name must match the host")
+	}
+	if err := d.configureSSLContext(config); err != nil {
+		return nil, err
+	}
+
+	connID, err := d.allocateConnID()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tcpSocket{d: d, connID: connID, ssl: true}
+	d.mu.Lock()
+	d.tcp[connID] = t
+	d.mu.Unlock()
+
+	// The last parameter selects buffer access mode where data is read
+	// with AT+QSSLRECV after a +QSSLURC: "recv" URC
+	err = d.openWith(ctx, connID,
+		fmt.Sprintf(`AT+QSSLOPEN=1,%d,%d,"%s",%d,0`, config.SecurityTag, connID, host, port),
+		"+QSSLOPEN: ")
+	if err != nil {
+		d.removeTCPSocket(connID)
+		d.releaseConnID(connID)
+		return nil, err
+	}
+	t.SetState(at.ConnConnected)
+
+	return t, nil
+}
+
+// configureSSLContext sets up the SSL context with the credentials stored
+// for the security tag.
+func (d *bg95) configureSSLContext(config *at.TLSConfig) error {
+	sslCtx := config.SecurityTag
+	if sslCtx < 0 || sslCtx >= maxSSLContexts {
+		return errors.New("security tag must be an SSL context (0-5)")
+	}
+
+	stored := make(map[at.CredentialType]bool)
+	credentials, err := d.ListCredentials()
+	if err != nil {
+		return err
+	}
+	for _, c := range credentials {
+		if c.Tag == sslCtx {
+			stored[c.Type] = true
+		}
+	}
+
+	secLevel := secLevelServerAuth
+	switch {
+	case config.InsecureSkipVerify:
+		secLevel = secLevelNone
+	case !stored[at.CredentialCACert]:
+		return errors.New("no CA certificate stored for the security tag")
+	case stored[at.CredentialClientCert] && stored[at.CredentialClientKey]:
+		secLevel = secLevelMutualAuth
+	}
+
+	cmds := []string{
+		fmt.Sprintf(`AT+QSSLCFG="sslversion",%d,4`, sslCtx),
+		fmt.Sprintf(`AT+QSSLCFG="ciphersuite",%d,0xFFFF`, sslCtx),
+		fmt.Sprintf(`AT+QSSLCFG="seclevel",%d,%d`, sslCtx, secLevel),
+		fmt.Sprintf(`AT+QSSLCFG="sni",%d,1`, sslCtx),
+	}
+	if secLevel >= secLevelServerAuth {
+		cmds = append(cmds, fmt.Sprintf(`AT+QSSLCFG="cacert",%d,"UFS:%s"`, sslCtx, credentialFile(sslCtx, at.CredentialCACert)))
+	}
+	if secLevel == secLevelMutualAuth {
+		cmds = append(cmds,
+			fmt.Sprintf(`AT+QSSLCFG="clientcert",%d,"UFS:%s"`, sslCtx, credentialFile(sslCtx, at.CredentialClientCert)),
+			fmt.Sprintf(`AT+QSSLCFG="clientkey",%d,"UFS:%s"`, sslCtx, credentialFile(sslCtx, at.CredentialClientKey)))
+	}
+
+	for _, cmd := range cmds {
+		if err := d.cmd.Transact(cmd, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleQSSLURC handles the +QSSLURC: "<type>",<connectID> URCs
+func (d *bg95) handleQSSLURC(s string) {
+	fields := strings.Split(strings.TrimPrefix(s, "+QSSLURC: "), ",")
+	if len(fields) < 2 {
+		return
+	}
+	connID, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+	if err != nil {
+		log.Printf("Invalid connection ID in URC: %s", s)
+		return
+	}
+	t := d.tcpSocket(connID)
+	if t == nil {
+		return
+	}
+
+	switch at.TrimQuotes(fields[0]) {
+	case "recv":
+		t.DataAvailable()
+	case "closed":
+		t.SetState(at.ConnClosed)
+	}
+}
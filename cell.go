@@ -0,0 +1,85 @@
+package at
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Unknown marks values the module didn't report. It is used rather than
+// zero since zero is a valid value for most measurements.
+const Unknown = math.MinInt32
+
+// Cell contains the identity and measurements of a cell. Values the module
+// doesn't report are set to Unknown.
+type Cell struct {
+	// EARFCN is the E-UTRA absolute radio frequency channel number of the
+	// cell
+	EARFCN int
+	// PCI is the physical cell ID (0-503)
+	PCI int
+	// CellID is the E-UTRAN cell identity. It is usually only reported
+	// for the serving cell.
+	CellID int
+	// TAC is the tracking area code. It is usually only reported for the
+	// serving cell.
+	TAC int
+	// RSRP is the reference signal received power in tenths of dBm
+	RSRP int
+	// RSRQ is the reference signal received quality in tenths of dB
+	RSRQ int
+	// SINR is the signal to interference plus noise ratio in tenths of dB
+	SINR int
+}
+
+// UnknownCell returns a cell where all the values are Unknown. Drivers
+// fill in the values they get from the module.
+func UnknownCell() Cell {
+	return Cell{
+		EARFCN: Unknown,
+		PCI:    Unknown,
+		CellID: Unknown,
+		TAC:    Unknown,
+		RSRP:   Unknown,
+		RSRQ:   Unknown,
+		SINR:   Unknown,
+	}
+}
+
+// CellInfo contains the serving cell and the neighbour cells the module
+// has measured
+type CellInfo struct {
+	// Serving is the serving cell or nil if the module isn't camped on a
+	// cell
+	Serving *Cell
+	// Neighbours are the neighbour cells
+	Neighbours []Cell
+}
+
+// CellInfoReader is implemented by devices that report measurements of
+// the serving and neighbour cells.
+type CellInfoReader interface {
+	// GetCellInfo measures the serving and neighbour cells
+	GetCellInfo() (*CellInfo, error)
+}
+
+// ParseMeasurement parses a decimal measurement from the module. Empty
+// fields and fields that aren't numbers, like "-", return Unknown.
+func ParseMeasurement(s string) int {
+	n, err := strconv.Atoi(TrimQuotes(strings.TrimSpace(s)))
+	if err != nil {
+		return Unknown
+	}
+	return n
+}
+
+// ParseHexMeasurement parses a hexadecimal value from the module, like
+// cell IDs and tracking area codes. Fields that can't be parsed return
+// Unknown.
+func ParseHexMeasurement(s string) int {
+	n, err := strconv.ParseInt(TrimQuotes(strings.TrimSpace(s)), 16, 64)
+	if err != nil || n > math.MaxInt32 {
+		return Unknown
+	}
+	return int(n)
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/lab5e/at"
+)
+
+// exporter serves the metrics of the monitored devices in the Prometheus
+// text format
+type exporter struct {
+	mu      sync.Mutex
+	devices []*monitoredDevice
+}
+
+// monitoredDevice is a device with the monitor sampling it
+type monitoredDevice struct {
+	driver       string
+	serialDevice string
+	device       at.Device
+	monitor      *at.Monitor
+	stop         chan struct{}
+
+	mu           sync.Mutex
+	samples      int
+	sampleErrors int
+}
+
+// metric is a metric family. Values that are Unknown are left out.
+type metric struct {
+	name  string
+	help  string
+	typ   string
+	value func(d *monitoredDevice, s *scrape) []labelledValue
+}
+
+// scrape is the data read from a device for a scrape
+type scrape struct {
+	sample *at.Sample
+	// commands is nil if the device doesn't expose command metrics
+	commands *at.CommandMetrics
+}
+
+// labelledValue is a value with the labels in addition to the device
+// labels. The suffix is added to the name for histograms.
+type labelledValue struct {
+	suffix string
+	labels string
+	value  float64
+}
+
+func newExporter() *exporter {
+	return &exporter{}
+}
+
+// add starts monitoring the device
+func (e *exporter) add(driver string, serialDevice string, device at.Device, opts at.MonitorOptions) {
+	d := &monitoredDevice{
+		driver:       driver,
+		serialDevice: serialDevice,
+		device:       device,
+		monitor:      at.NewMonitor(device, opts),
+		stop:         make(chan struct{}),
+	}
+	go d.count()
+	d.monitor.Start()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.devices = append(e.devices, d)
+}
+
+// stop stops the monitors
+func (e *exporter) stop() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, d := range e.devices {
+		d.monitor.Stop()
+		close(d.stop)
+	}
+}
+
+// count counts the samples and the samples that failed until the device
+// is stopped. The monitor never closes the deltas channel.
+func (d *monitoredDevice) count() {
+	for {
+		select {
+		case delta := <-d.monitor.Deltas():
+			d.mu.Lock()
+			d.samples++
+			if delta.Current.Err != nil {
+				d.sampleErrors++
+			}
+			d.mu.Unlock()
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// tenths returns the value in tenths as a metric value
+func tenths(field func(*at.Stats) int) func(*monitoredDevice, *scrape) []labelledValue {
+	return stat(field, 10)
+}
+
+// stat returns the statistic divided by scale as a metric value
+func stat(field func(*at.Stats) int, scale float64) func(*monitoredDevice, *scrape) []labelledValue {
+	return func(_ *monitoredDevice, sc *scrape) []labelledValue {
+		s := sc.sample
+		if s == nil || s.Stats == nil || field(s.Stats) == at.Unknown {
+			return nil
+		}
+		return []labelledValue{{value: float64(field(s.Stats)) / scale}}
+	}
+}
+
+// perCommand returns a value per command verb
+func perCommand(value func(c *at.CommandStats) float64) func(*monitoredDevice, *scrape) []labelledValue {
+	return func(_ *monitoredDevice, sc *scrape) []labelledValue {
+		if sc.commands == nil {
+			return nil
+		}
+		var ret []labelledValue
+		for i := range sc.commands.Commands {
+			c := &sc.commands.Commands[i]
+			ret = append(ret, labelledValue{labels: verbLabel(c), value: value(c)})
+		}
+		return ret
+	}
+}
+
+func verbLabel(c *at.CommandStats) string {
+	return fmt.Sprintf(`verb="%s"`, escape(c.Verb))
+}
+
+func single(v float64) []labelledValue {
+	return []labelledValue{{value: v}}
+}
+
+var metrics = []metric{
+	{"at_up", "Whether the last sample of the device succeeded", "gauge", func(_ *monitoredDevice, sc *scrape) []labelledValue {
+		s := sc.sample
+		if s == nil || s.Err != nil {
+			return single(0)
+		}
+		return single(1)
+	}},
+	{"at_last_sample_timestamp_seconds", "Time of the last sample", "gauge", func(_ *monitoredDevice, sc *scrape) []labelledValue {
+		s := sc.sample
+		if s == nil {
+			return nil
+		}
+		return single(float64(s.Time.UnixNano()) / 1e9)
+	}},
+	{"at_samples_total", "Number of samples taken", "counter", func(d *monitoredDevice, _ *scrape) []labelledValue {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return single(float64(d.samples))
+	}},
+	{"at_sample_errors_total", "Number of samples where a command failed", "counter", func(d *monitoredDevice, _ *scrape) []labelledValue {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return single(float64(d.sampleErrors))
+	}},
+	{"at_rsrp_dbm", "Reference signal received power", "gauge", tenths(func(s *at.Stats) int { return s.SignalPower })},
+	{"at_rssi_dbm", "Total power within the receive bandwidth", "gauge", tenths(func(s *at.Stats) int { return s.TotalPower })},
+	{"at_rsrq_db", "Reference signal received quality", "gauge", tenths(func(s *at.Stats) int { return s.RSRQ })},
+	{"at_snr_db", "Signal to noise ratio", "gauge", tenths(func(s *at.Stats) int { return s.SNR })},
+	{"at_tx_power_dbm", "Transmit power", "gauge", tenths(func(s *at.Stats) int { return s.TXPower })},
+	{"at_ecl", "Coverage enhancement level", "gauge", stat(func(s *at.Stats) int { return s.ECL }, 1)},
+	{"at_cell_id", "Identity of the serving cell", "gauge", stat(func(s *at.Stats) int { return s.CellID }, 1)},
+	{"at_earfcn", "Channel number of the serving cell", "gauge", stat(func(s *at.Stats) int { return s.EARFCN }, 1)},
+	{"at_pci", "Physical cell ID of the serving cell", "gauge", stat(func(s *at.Stats) int { return s.PCI }, 1)},
+	{"at_tx_time_seconds", "Time spent transmitting since the module was powered on", "counter", stat(func(s *at.Stats) int { return s.TXTime }, 1000)},
+	{"at_rx_time_seconds", "Time spent receiving since the module was powered on", "counter", stat(func(s *at.Stats) int { return s.RXTime }, 1000)},
+	{"at_registration_state", "Network registration status as reported by AT+CEREG", "gauge", func(_ *monitoredDevice, sc *scrape) []labelledValue {
+		s := sc.sample
+		if s == nil || s.Registration == at.RegistrationUnknown {
+			return nil
+		}
+		return single(float64(s.Registration))
+	}},
+	{"at_registered", "Whether the device is registered in the home network or roaming", "gauge", func(_ *monitoredDevice, sc *scrape) []labelledValue {
+		s := sc.sample
+		if s == nil || s.Registration == at.RegistrationUnknown {
+			return nil
+		}
+		if s.Registration.Registered() {
+			return single(1)
+		}
+		return single(0)
+	}},
+	{"at_neighbour_cells", "Number of neighbour cells measured", "gauge", func(_ *monitoredDevice, sc *scrape) []labelledValue {
+		s := sc.sample
+		if s == nil || s.Cells == nil {
+			return nil
+		}
+		return single(float64(len(s.Cells.Neighbours)))
+	}},
+	{"at_sockets", "Number of open sockets", "gauge", func(d *monitoredDevice, _ *scrape) []labelledValue {
+		sl, ok := d.device.(at.SocketLister)
+		if !ok {
+			return nil
+		}
+		counts := map[string]int{"udp": 0, "tcp": 0}
+		for _, s := range sl.ListSockets() {
+			counts[s.Protocol]++
+		}
+		var ret []labelledValue
+		for _, protocol := range []string{"tcp", "udp"} {
+			ret = append(ret, labelledValue{labels: fmt.Sprintf(`protocol="%s"`, protocol), value: float64(counts[protocol])})
+		}
+		return ret
+	}},
+	{"at_commands_total", "Number of AT commands sent", "counter", perCommand(func(c *at.CommandStats) float64 { return float64(c.Count) })},
+	{"at_command_errors_total", "Number of AT commands that failed with ERROR or +CME ERROR", "counter", perCommand(func(c *at.CommandStats) float64 { return float64(c.Errors) })},
+	{"at_command_timeouts_total", "Number of AT commands that timed out", "counter", perCommand(func(c *at.CommandStats) float64 { return float64(c.Timeouts) })},
+	{"at_command_cme_errors_total", "Number of +CME ERROR responses by code", "counter", func(_ *monitoredDevice, sc *scrape) []labelledValue {
+		if sc.commands == nil {
+			return nil
+		}
+		var ret []labelledValue
+		for i := range sc.commands.Commands {
+			c := &sc.commands.Commands[i]
+			codes := make([]int, 0, len(c.CMEErrors))
+			for code := range c.CMEErrors {
+				codes = append(codes, code)
+			}
+			sort.Ints(codes)
+			for _, code := range codes {
+				ret = append(ret, labelledValue{
+					labels: fmt.Sprintf(`%s,code="%d"`, verbLabel(c), code),
+					value:  float64(c.CMEErrors[code]),
+				})
+			}
+		}
+		return ret
+	}},
+	{"at_command_duration_seconds", "Time from sending an AT command to the final result code", "histogram", func(_ *monitoredDevice, sc *scrape) []labelledValue {
+		if sc.commands == nil {
+			return nil
+		}
+		var ret []labelledValue
+		for i := range sc.commands.Commands {
+			c := &sc.commands.Commands[i]
+			cumulative := 0
+			for b, bound := range at.LatencyBuckets {
+				cumulative += c.Buckets[b]
+				ret = append(ret, labelledValue{
+					suffix: "_bucket",
+					labels: fmt.Sprintf(`%s,le="%g"`, verbLabel(c), bound.Seconds()),
+					value:  float64(cumulative),
+				})
+			}
+			ret = append(ret,
+				labelledValue{suffix: "_bucket", labels: verbLabel(c) + `,le="+Inf"`, value: float64(c.Count)},
+				labelledValue{suffix: "_sum", labels: verbLabel(c), value: c.TotalLatency.Seconds()},
+				labelledValue{suffix: "_count", labels: verbLabel(c), value: float64(c.Count)},
+			)
+		}
+		return ret
+	}},
+	{"at_received_bytes_total", "Bytes read from the device", "counter", func(_ *monitoredDevice, sc *scrape) []labelledValue {
+		if sc.commands == nil {
+			return nil
+		}
+		return single(float64(sc.commands.BytesIn))
+	}},
+	{"at_sent_bytes_total", "Bytes written to the device", "counter", func(_ *monitoredDevice, sc *scrape) []labelledValue {
+		if sc.commands == nil {
+			return nil
+		}
+		return single(float64(sc.commands.BytesOut))
+	}},
+}
+
+func (e *exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	e.write(w)
+}
+
+// write writes the metrics in the Prometheus text format
+func (e *exporter) write(w io.Writer) {
+	e.mu.Lock()
+	devices := append([]*monitoredDevice(nil), e.devices...)
+	e.mu.Unlock()
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].serialDevice < devices[j].serialDevice
+	})
+
+	scrapes := make([]*scrape, len(devices))
+	for i, d := range devices {
+		scrapes[i] = &scrape{sample: d.monitor.Latest()}
+		if inst, ok := d.device.(at.Instrumented); ok {
+			scrapes[i].commands = inst.CommandMetrics()
+		}
+	}
+
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.typ)
+		for i, d := range devices {
+			for _, v := range m.value(d, scrapes[i]) {
+				labels := fmt.Sprintf(`device="%s",driver="%s"`, escape(d.serialDevice), escape(d.driver))
+				if v.labels != "" {
+					labels += "," + v.labels
+				}
+				fmt.Fprintf(w, "%s%s{%s} %g\n", m.name, v.suffix, labels, v.value)
+			}
+		}
+	}
+}
+
+// escape escapes a label value
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
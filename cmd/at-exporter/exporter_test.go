@@ -0,0 +1,145 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lab5e/at"
+	"github.com/lab5e/at/internal/fakemodem"
+)
+
+// scrapeMetrics returns the metrics served by the exporter
+func scrapeMetrics(t *testing.T, url string) string {
+	t.Helper()
+	resp, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatalf("Could not scrape: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Could not read metrics: %v", err)
+	}
+	return string(body)
+}
+
+func TestExporter(t *testing.T) {
+	m := fakemodem.New(t)
+	m.Reply("AT+CESQ", fakemodem.Lines("+CESQ: 99,99,255,255,30,60", "OK"))
+	m.Reply("AT%XSNRSQ?", fakemodem.Lines("%XSNRSQ: 40,0,1", "OK"))
+	m.Reply("AT+CEREG?", fakemodem.Lines("+CEREG: 0,5", "OK"))
+
+	name, serialDevice, device, err := openDevice("nrf91:" + m.Path())
+	if err != nil {
+		t.Fatalf("Could not open device: %v", err)
+	}
+	defer device.Close()
+
+	e := newExporter()
+	e.add(name, serialDevice, device, at.MonitorOptions{Interval: time.Hour, History: 1, Gap: time.Millisecond})
+	defer e.stop()
+
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	labels := fmt.Sprintf(`device="%s",driver="nrf91"`, m.Path())
+	var metrics string
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		metrics = scrapeMetrics(t, server.URL)
+		if strings.Contains(metrics, "at_samples_total{"+labels+"} 1\n") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("No sample taken:\n%s", metrics)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, line := range []string{
+		"# TYPE at_rsrp_dbm gauge",
+		fmt.Sprintf("at_up{%s} 1", labels),
+		fmt.Sprintf("at_sample_errors_total{%s} 0", labels),
+		fmt.Sprintf("at_rsrp_dbm{%s} %g", labels, float64(at.RSRPFromIndex(60))/10),
+		fmt.Sprintf("at_rsrq_db{%s} %g", labels, float64(at.RSRQFromIndex(30))/10),
+		fmt.Sprintf("at_snr_db{%s} 16", labels),
+		fmt.Sprintf("at_ecl{%s} 1", labels),
+		fmt.Sprintf("at_registration_state{%s} 5", labels),
+		fmt.Sprintf("at_registered{%s} 1", labels),
+		fmt.Sprintf(`at_commands_total{%s,verb="AT+CESQ"} 1`, labels),
+		fmt.Sprintf(`at_sockets{%s,protocol="tcp"} 0`, labels),
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("Expected %q in the metrics:\n%s", line, metrics)
+		}
+	}
+
+	// Values the modem doesn't report are left out
+	if strings.Contains(metrics, "at_cell_id{") {
+		t.Errorf("Unexpected cell ID in the metrics:\n%s", metrics)
+	}
+}
+
+func TestOpenDevice(t *testing.T) {
+	for _, spec := range []string{"nrf91", "x100:/dev/ttyUSB0", "nrf91:/dev/ttyUSB0:fast"} {
+		if _, _, _, err := openDevice(spec); err == nil {
+			t.Errorf("Expected an error for %s", spec)
+		}
+	}
+}
+
+func TestRunShutdown(t *testing.T) {
+	m := fakemodem.New(t)
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	listen := l.Addr().String()
+
+	// The address is in use so the server fails
+	opts := at.MonitorOptions{Interval: time.Hour, History: 1}
+	if err := run(listen, []string{"nrf91:" + m.Path()}, opts, false); err == nil {
+		t.Fatal("Expected an error when the address is in use")
+	}
+	l.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- run(listen, []string{"nrf91:" + m.Path()}, opts, false) }()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		resp, err := http.Get("http://" + listen + "/metrics")
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The metrics weren't served: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected a clean shutdown, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("The exporter didn't stop")
+	}
+	if _, err := http.Get("http://" + listen + "/metrics"); err == nil {
+		t.Fatal("The metrics are still served")
+	}
+}
@@ -0,0 +1,143 @@
+// at-exporter exposes the radio statistics of one or more modules as
+// Prometheus metrics on /metrics.
+//
+// Devices are given as <driver>:<serial device>[:<baud rate>], ie
+//
+//	at-exporter -listen :9150 n211:/dev/ttyUSB0 bg95:/dev/ttyUSB2:115200
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lab5e/at"
+	"github.com/lab5e/at/bg95"
+	"github.com/lab5e/at/n211"
+	"github.com/lab5e/at/nrf91"
+)
+
+func main() {
+	listen := flag.String("listen", ":9150", "address to serve metrics on")
+	interval := flag.Duration("interval", 30*time.Second, "sampling interval")
+	cells := flag.Bool("cells", false, "measure the serving and neighbour cells")
+	debug := flag.Bool("debug", false, "log the AT commands")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <driver>:<serial device>[:<baud rate>]...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Drivers: n211, bg95, nrf91\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opts := at.MonitorOptions{
+		Interval: *interval,
+		History:  1,
+		CellInfo: *cells,
+	}
+	if err := run(*listen, flag.Args(), opts, *debug); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// shutdownTimeout is how long the server gets to finish the requests in
+// progress when the exporter is stopped
+const shutdownTimeout = 5 * time.Second
+
+// run monitors the devices and serves the metrics until the server fails
+// or the process is interrupted. The devices are closed when it returns.
+func run(listen string, specs []string, opts at.MonitorOptions, debug bool) error {
+	e := newExporter()
+	for _, spec := range specs {
+		driver, serialDevice, device, err := openDevice(spec)
+		if err != nil {
+			return fmt.Errorf("error opening %s: %v", spec, err)
+		}
+		defer device.Close()
+		device.SetDebug(debug)
+
+		e.add(driver, serialDevice, device, opts)
+		log.Printf("Monitoring %s on %s", driver, serialDevice)
+	}
+	defer e.stop()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", e)
+	server := &http.Server{Addr: listen, Handler: mux}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	errs := make(chan error, 1)
+	go func() {
+		log.Printf("Serving metrics on %s/metrics", listen)
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		log.Printf("Got %v, shutting down", sig)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return server.Shutdown(ctx)
+}
+
+// driver creates devices for a serial device and baud rate
+type driver struct {
+	baudRate int
+	new      func(serialDevice string, baudRate int) at.Device
+}
+
+// drivers are the drivers the devices can use, by name. The serial device
+// can be any terminal so the tests run the drivers against fake modems.
+var drivers = map[string]driver{
+	"n211":  {n211.DefaultBaudRate, n211.New},
+	"bg95":  {bg95.DefaultBaudRate, bg95.New},
+	"nrf91": {nrf91.DefaultBaudRate, nrf91.New},
+}
+
+// openDevice opens and starts the device in the spec
+func openDevice(spec string) (string, string, at.Device, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) < 2 {
+		return "", "", nil, fmt.Errorf("device must be <driver>:<serial device>[:<baud rate>]")
+	}
+	name, serialDevice := strings.ToLower(parts[0]), parts[1]
+
+	baudRate := 0
+	if len(parts) == 3 {
+		n, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return "", "", nil, fmt.Errorf("invalid baud rate: %s", parts[2])
+		}
+		baudRate = n
+	}
+
+	d, ok := drivers[name]
+	if !ok {
+		return "", "", nil, fmt.Errorf("unknown driver: %s", name)
+	}
+	if baudRate == 0 {
+		baudRate = d.baudRate
+	}
+	device := d.new(serialDevice, baudRate)
+	if err := device.Start(); err != nil {
+		return "", "", nil, err
+	}
+	return name, serialDevice, device, nil
+}
@@ -0,0 +1,668 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lab5e/at"
+)
+
+// env is what the commands work with
+type env struct {
+	opts   options
+	device at.Device
+	out    *output
+}
+
+// command is a subcommand
+type command struct {
+	name string
+	fn   func(e *env, args []string) error
+}
+
+var commands = []command{
+	{"info", info},
+	{"apn", apn},
+	{"pdp", pdp},
+	{"radio", radio},
+	{"send", send},
+	{"recv", recv},
+	{"stats", stats},
+	{"ping", ping},
+	{"scan", scan},
+	{"raw", raw},
+	{"script", script},
+}
+
+// newFlagSet returns a flag set for the options of a command
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	return fs
+}
+
+func findCommand(name string) (command, bool) {
+	for _, c := range commands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+// infoResult is the result of info
+type infoResult struct {
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Model        string `json:"model,omitempty"`
+	Firmware     string `json:"firmware,omitempty"`
+	IMEI         string `json:"imei"`
+	IMSI         string `json:"imsi"`
+	CCID         string `json:"ccid,omitempty"`
+}
+
+func (r *infoResult) print(w io.Writer) {
+	if r.Manufacturer != "" {
+		fmt.Fprintf(w, "Manufacturer:\t%s\n", r.Manufacturer)
+		fmt.Fprintf(w, "Model:\t%s\n", r.Model)
+		fmt.Fprintf(w, "Firmware:\t%s\n", r.Firmware)
+	}
+	fmt.Fprintf(w, "IMEI:\t%s\n", r.IMEI)
+	fmt.Fprintf(w, "IMSI:\t%s\n", r.IMSI)
+	if r.CCID != "" {
+		fmt.Fprintf(w, "CCID:\t%s\n", r.CCID)
+	}
+}
+
+func info(e *env, args []string) error {
+	if len(args) != 0 {
+		return usageError{"usage: info"}
+	}
+	r := &infoResult{}
+	if ir, ok := e.device.(at.InfoReader); ok {
+		info, err := ir.GetDeviceInfo()
+		if err != nil {
+			return err
+		}
+		r.Manufacturer, r.Model, r.Firmware = info.Manufacturer, info.Model, info.FirmwareVersion
+	}
+	var err error
+	if r.IMEI, err = e.device.GetIMEI(); err != nil {
+		return err
+	}
+	if r.IMSI, err = e.device.GetIMSI(); err != nil {
+		return err
+	}
+	// The CCID isn't supported by all firmware versions
+	r.CCID, _ = e.device.GetCCID()
+	e.out.print(r)
+	return nil
+}
+
+// apnResult is the result of apn get
+type apnResult struct {
+	CID     int    `json:"cid"`
+	PDPType string `json:"pdp_type"`
+	Name    string `json:"apn"`
+	Address string `json:"address,omitempty"`
+}
+
+func (r *apnResult) print(w io.Writer) {
+	fmt.Fprintf(w, "APN:\t%s\n", r.Name)
+	fmt.Fprintf(w, "Context:\t%d\n", r.CID)
+	fmt.Fprintf(w, "PDP type:\t%s\n", r.PDPType)
+	if r.Address != "" {
+		fmt.Fprintf(w, "Address:\t%s\n", r.Address)
+	}
+}
+
+func apn(e *env, args []string) error {
+	switch {
+	case len(args) == 1 && args[0] == "get":
+		a, err := e.device.GetAPN()
+		if err != nil {
+			return err
+		}
+		e.out.print(&apnResult{CID: a.ContextIdentifier, PDPType: a.PDPType, Name: a.Name, Address: a.Address})
+		return nil
+
+	case len(args) == 2 && args[0] == "set":
+		return e.device.SetAPN(args[1])
+	}
+	return usageError{"usage: apn get | apn set <apn>"}
+}
+
+// contextsResult is the result of pdp list
+type contextsResult struct {
+	Contexts []contextResult `json:"contexts"`
+}
+
+type contextResult struct {
+	CID       int      `json:"cid"`
+	Type      string   `json:"type"`
+	APN       string   `json:"apn"`
+	Active    bool     `json:"active"`
+	Addresses []string `json:"addresses"`
+}
+
+func (r *contextsResult) print(w io.Writer) {
+	fmt.Fprintf(w, "CID\tType\tAPN\tState\tAddresses\n")
+	for _, c := range r.Contexts {
+		state := "inactive"
+		if c.Active {
+			state = "active"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", c.CID, c.Type, c.APN, state, strings.Join(c.Addresses, " "))
+	}
+}
+
+// authTypes are the authentication protocols for pdp auth
+var authTypes = map[string]at.AuthType{
+	"none": at.AuthNone,
+	"pap":  at.AuthPAP,
+	"chap": at.AuthCHAP,
+}
+
+func pdp(e *env, args []string) error {
+	const usage = "usage: pdp list | define <cid> <type> <apn> | auth <cid> none|pap|chap [<user> <password>] | activate <cid> | deactivate <cid>"
+	cm, ok := e.device.(at.ContextManager)
+	if !ok {
+		return errNotSupported
+	}
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	if args[0] == "list" {
+		if len(args) != 1 {
+			return usageError{usage}
+		}
+		contexts, err := cm.ListContexts()
+		if err != nil {
+			return err
+		}
+		r := &contextsResult{Contexts: []contextResult{}}
+		for _, c := range contexts {
+			addrs := c.Addresses
+			if addrs == nil {
+				addrs = []string{}
+			}
+			r.Contexts = append(r.Contexts, contextResult{CID: c.CID, Type: c.Type, APN: c.APN, Active: c.Active, Addresses: addrs})
+		}
+		e.out.print(r)
+		return nil
+	}
+
+	if len(args) < 2 {
+		return usageError{usage}
+	}
+	cid, err := strconv.Atoi(args[1])
+	if err != nil {
+		return usageError{fmt.Sprintf("invalid CID: %s", args[1])}
+	}
+	switch {
+	case args[0] == "define" && len(args) == 4:
+		pdpType, err := at.NormalizePDPType(args[2])
+		if err != nil {
+			return usageError{err.Error()}
+		}
+		return cm.DefineContext(cid, pdpType, args[3])
+
+	case args[0] == "auth" && (len(args) == 3 || len(args) == 5):
+		auth, ok := authTypes[strings.ToLower(args[2])]
+		if !ok {
+			return usageError{fmt.Sprintf("invalid authentication protocol: %s", args[2])}
+		}
+		if auth != at.AuthNone && len(args) != 5 {
+			return usageError{usage}
+		}
+		var username, password string
+		if len(args) == 5 {
+			username, password = args[3], args[4]
+		}
+		return cm.SetAuth(cid, auth, username, password)
+
+	case args[0] == "activate" && len(args) == 2:
+		return cm.Activate(cid)
+
+	case args[0] == "deactivate" && len(args) == 2:
+		return cm.Deactivate(cid)
+	}
+	return usageError{usage}
+}
+
+func radio(e *env, args []string) error {
+	if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		return usageError{"usage: radio on|off"}
+	}
+	return e.device.SetRadio(args[0] == "on")
+}
+
+// sendResult is the result of send
+type sendResult struct {
+	Host  string `json:"host"`
+	Port  int    `json:"port"`
+	Bytes int    `json:"bytes"`
+}
+
+func (r *sendResult) print(w io.Writer) {
+	fmt.Fprintf(w, "Sent %d bytes to %s\n", r.Bytes, net.JoinHostPort(r.Host, strconv.Itoa(r.Port)))
+}
+
+func send(e *env, args []string) error {
+	if len(args) < 2 || len(args) > 3 {
+		return usageError{"usage: send <host> <port> [text]"}
+	}
+	port, err := strconv.Atoi(args[1])
+	if err != nil {
+		return usageError{fmt.Sprintf("invalid port: %s", args[1])}
+	}
+
+	var data []byte
+	if len(args) == 3 {
+		data = []byte(args[2])
+	} else if data, err = ioutil.ReadAll(os.Stdin); err != nil {
+		return err
+	}
+
+	socket, err := e.device.CreateUDPSocket(0)
+	if err != nil {
+		return err
+	}
+	defer e.device.CloseUDPSocket(socket)
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.opts.timeout)
+	defer cancel()
+
+	n, err := at.SendUDPTo(ctx, e.device, socket, args[0], port, data)
+	if err != nil {
+		return err
+	}
+	e.out.print(&sendResult{Host: args[0], Port: port, Bytes: n})
+	return nil
+}
+
+// message is a message received by recv
+type message struct {
+	IP   string `json:"ip"`
+	Port int    `json:"port"`
+	Data []byte `json:"data"`
+}
+
+func (m *message) print(w io.Writer) {
+	fmt.Fprintf(w, "%s: %q\n", net.JoinHostPort(m.IP, strconv.Itoa(m.Port)), m.Data)
+}
+
+// recvPollInterval is the interval for polling for messages on devices
+// that don't signal when data arrives
+const recvPollInterval = time.Second
+
+func recv(e *env, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return usageError{"usage: recv <port> [count]"}
+	}
+	port, err := strconv.Atoi(args[0])
+	if err != nil || port <= 0 {
+		return usageError{fmt.Sprintf("invalid port: %s", args[0])}
+	}
+	count := 1
+	if len(args) == 2 {
+		if count, err = strconv.Atoi(args[1]); err != nil || count < 1 {
+			return usageError{fmt.Sprintf("invalid count: %s", args[1])}
+		}
+	}
+
+	socket, err := e.device.CreateUDPSocket(port)
+	if err != nil {
+		return err
+	}
+	defer e.device.CloseUDPSocket(socket)
+
+	messages := make(chan *at.ReceivedData, count)
+	if notifier, ok := e.device.(at.ReceiveNotifier); ok {
+		err := notifier.OnReceive(socket, func(data *at.ReceivedData) {
+			select {
+			case messages <- data:
+			default:
+			}
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		go func() {
+			for {
+				data, err := e.device.ReceiveUDP(socket, 1500)
+				if err == nil && data.Length > 0 {
+					messages <- data
+					continue
+				}
+				time.Sleep(recvPollInterval)
+			}
+		}()
+	}
+
+	timeout := time.After(e.opts.timeout)
+	for i := 0; i < count; i++ {
+		select {
+		case data := <-messages:
+			e.out.print(&message{IP: data.IP, Port: data.Port, Data: data.Data})
+		case <-timeout:
+			return fmt.Errorf("received %d of %d messages: %w", i, count, at.ErrReadTimeout)
+		}
+	}
+	return nil
+}
+
+// statsResult is the result of stats. Values the module doesn't report
+// are null.
+type statsResult struct {
+	RSRP    *float64 `json:"rsrp_dbm"`
+	RSSI    *float64 `json:"rssi_dbm"`
+	RSRQ    *float64 `json:"rsrq_db"`
+	SNR     *float64 `json:"snr_db"`
+	TXPower *float64 `json:"tx_power_dbm"`
+	ECL     *int     `json:"ecl"`
+	CellID  *int     `json:"cell_id"`
+	EARFCN  *int     `json:"earfcn"`
+	PCI     *int     `json:"pci"`
+}
+
+func (r *statsResult) print(w io.Writer) {
+	fmt.Fprintf(w, "RSRP:\t%s\n", formatTenths(r.RSRP, "dBm"))
+	fmt.Fprintf(w, "RSSI:\t%s\n", formatTenths(r.RSSI, "dBm"))
+	fmt.Fprintf(w, "RSRQ:\t%s\n", formatTenths(r.RSRQ, "dB"))
+	fmt.Fprintf(w, "SNR:\t%s\n", formatTenths(r.SNR, "dB"))
+	fmt.Fprintf(w, "TX power:\t%s\n", formatTenths(r.TXPower, "dBm"))
+	fmt.Fprintf(w, "ECL:\t%s\n", formatInt(r.ECL))
+	fmt.Fprintf(w, "Cell ID:\t%s\n", formatInt(r.CellID))
+	fmt.Fprintf(w, "EARFCN:\t%s\n", formatInt(r.EARFCN))
+	fmt.Fprintf(w, "PCI:\t%s\n", formatInt(r.PCI))
+}
+
+func stats(e *env, args []string) error {
+	if len(args) != 0 {
+		return usageError{"usage: stats"}
+	}
+	sr, ok := e.device.(at.StatsReader)
+	if !ok {
+		return errNotSupported
+	}
+	s, err := sr.GetStats()
+	if err != nil {
+		return err
+	}
+	e.out.print(&statsResult{
+		RSRP:    tenths(s.SignalPower),
+		RSSI:    tenths(s.TotalPower),
+		RSRQ:    tenths(s.RSRQ),
+		SNR:     tenths(s.SNR),
+		TXPower: tenths(s.TXPower),
+		ECL:     value(s.ECL),
+		CellID:  value(s.CellID),
+		EARFCN:  value(s.EARFCN),
+		PCI:     value(s.PCI),
+	})
+	return nil
+}
+
+// pingResult is the result of ping. Times are in milliseconds.
+type pingResult struct {
+	Host     string    `json:"host"`
+	Addr     string    `json:"addr"`
+	Sent     int       `json:"sent"`
+	Received int       `json:"received"`
+	Loss     float64   `json:"loss"`
+	RTTs     []float64 `json:"rtt_ms"`
+	MinRTT   float64   `json:"min_rtt_ms"`
+	AvgRTT   float64   `json:"avg_rtt_ms"`
+	MaxRTT   float64   `json:"max_rtt_ms"`
+}
+
+func (r *pingResult) print(w io.Writer) {
+	for _, rtt := range r.RTTs {
+		fmt.Fprintf(w, "Reply from %s: time=%.0f ms\n", r.Addr, rtt)
+	}
+	fmt.Fprintf(w, "%d sent, %d received, %.0f%% loss\n", r.Sent, r.Received, r.Loss*100)
+	if r.Received > 0 {
+		fmt.Fprintf(w, "rtt min/avg/max = %.0f/%.0f/%.0f ms\n", r.MinRTT, r.AvgRTT, r.MaxRTT)
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func ping(e *env, args []string) error {
+	fs := newFlagSet("ping <host>")
+	count := fs.Int("c", at.DefaultPingCount, "number of echo requests")
+	size := fs.Int("s", at.DefaultPingSize, "payload size")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return usageError{"usage: ping [-c count] [-s size] <host>"}
+	}
+	host := fs.Arg(0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.opts.timeout)
+	defer cancel()
+
+	res, err := at.Ping(ctx, e.device, host, *count, *size)
+	if err != nil {
+		return err
+	}
+	r := &pingResult{
+		Host:     host,
+		Addr:     res.Addr,
+		Sent:     res.Sent,
+		Received: res.Received(),
+		Loss:     res.Loss(),
+		RTTs:     []float64{},
+		MinRTT:   milliseconds(res.MinRTT),
+		AvgRTT:   milliseconds(res.AvgRTT),
+		MaxRTT:   milliseconds(res.MaxRTT),
+	}
+	for _, reply := range res.Replies {
+		r.RTTs = append(r.RTTs, milliseconds(reply.RTT))
+	}
+	e.out.print(r)
+	if r.Received == 0 {
+		return fmt.Errorf("no replies from %s", host)
+	}
+	return nil
+}
+
+// cellResult is a cell measured by scan
+type cellResult struct {
+	Serving bool     `json:"serving"`
+	EARFCN  *int     `json:"earfcn"`
+	PCI     *int     `json:"pci"`
+	CellID  *int     `json:"cell_id"`
+	TAC     *int     `json:"tac"`
+	RSRP    *float64 `json:"rsrp_dbm"`
+	RSRQ    *float64 `json:"rsrq_db"`
+	SINR    *float64 `json:"sinr_db"`
+}
+
+// scanResult is the result of scan
+type scanResult struct {
+	Cells []cellResult `json:"cells"`
+}
+
+func (r *scanResult) print(w io.Writer) {
+	fmt.Fprintf(w, "\tEARFCN\tPCI\tCell ID\tTAC\tRSRP\tRSRQ\tSINR\n")
+	for _, c := range r.Cells {
+		label := "neighbour"
+		if c.Serving {
+			label = "serving"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", label,
+			formatInt(c.EARFCN), formatInt(c.PCI), formatInt(c.CellID), formatInt(c.TAC),
+			formatTenths(c.RSRP, "dBm"), formatTenths(c.RSRQ, "dB"), formatTenths(c.SINR, "dB"))
+	}
+}
+
+func newCellResult(c *at.Cell, serving bool) cellResult {
+	return cellResult{
+		Serving: serving,
+		EARFCN:  value(c.EARFCN),
+		PCI:     value(c.PCI),
+		CellID:  value(c.CellID),
+		TAC:     value(c.TAC),
+		RSRP:    tenths(c.RSRP),
+		RSRQ:    tenths(c.RSRQ),
+		SINR:    tenths(c.SINR),
+	}
+}
+
+func scan(e *env, args []string) error {
+	if len(args) != 0 {
+		return usageError{"usage: scan"}
+	}
+	cr, ok := e.device.(at.CellInfoReader)
+	if !ok {
+		return errNotSupported
+	}
+	info, err := cr.GetCellInfo()
+	if err != nil {
+		return err
+	}
+	r := &scanResult{Cells: []cellResult{}}
+	if info.Serving != nil {
+		r.Cells = append(r.Cells, newCellResult(info.Serving, true))
+	}
+	for i := range info.Neighbours {
+		r.Cells = append(r.Cells, newCellResult(&info.Neighbours[i], false))
+	}
+	e.out.print(r)
+	return nil
+}
+
+// rawResult is the result of raw
+type rawResult struct {
+	Command  string   `json:"command"`
+	Response []string `json:"response"`
+	Error    string   `json:"error,omitempty"`
+}
+
+func (r *rawResult) print(w io.Writer) {
+	for _, s := range r.Response {
+		fmt.Fprintln(w, s)
+	}
+}
+
+func raw(e *env, args []string) error {
+	if len(args) == 0 {
+		return usageError{"usage: raw <command>"}
+	}
+	c, ok := e.device.(at.Commander)
+	if !ok {
+		return errNotSupported
+	}
+	r := &rawResult{Command: strings.Join(args, " "), Response: []string{}}
+	err := c.CommandInterface().TransactTimeout(r.Command, e.opts.timeout, func(s string) error {
+		if s != "" {
+			r.Response = append(r.Response, s)
+		}
+		return nil
+	})
+	if err != nil {
+		r.Error = err.Error()
+	}
+	e.out.print(r)
+	return err
+}
+
+// scriptStep is a statement that ran in script
+type scriptStep struct {
+	Line      int      `json:"line"`
+	Statement string   `json:"statement"`
+	Command   string   `json:"command,omitempty"`
+	Lines     []string `json:"lines,omitempty"`
+	Attempts  int      `json:"attempts,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	Duration  float64  `json:"duration"`
+}
+
+// scriptResult is the result of script
+type scriptResult struct {
+	Steps    []scriptStep      `json:"steps"`
+	Vars     map[string]string `json:"vars"`
+	Error    string            `json:"error,omitempty"`
+	Duration float64           `json:"duration"`
+	report   *at.ScriptReport
+}
+
+func (r *scriptResult) print(w io.Writer) {
+	fmt.Fprint(w, r.report.String())
+}
+
+// scriptVars collects the -var flags of script
+type scriptVars map[string]string
+
+func (v scriptVars) String() string {
+	return ""
+}
+
+func (v scriptVars) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i < 1 {
+		return fmt.Errorf("%s is not name=value", s)
+	}
+	v[s[:i]] = s[i+1:]
+	return nil
+}
+
+func script(e *env, args []string) error {
+	vars := scriptVars{}
+	fs := newFlagSet("script")
+	fs.Var(vars, "var", "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return usageError{"usage: script [-var name=value ...] <file|->"}
+	}
+	c, ok := e.device.(at.Commander)
+	if !ok {
+		return errNotSupported
+	}
+
+	var src []byte
+	var err error
+	if fs.Arg(0) == "-" {
+		src, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		src, err = ioutil.ReadFile(fs.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	s, err := at.ParseScript(string(src))
+	if err != nil {
+		return usageError{err.Error()}
+	}
+
+	report, err := s.Run(context.Background(), c.CommandInterface(), vars)
+	r := &scriptResult{Steps: []scriptStep{}, Vars: report.Vars, Duration: report.Duration.Seconds(), report: report}
+	for _, step := range report.Steps {
+		ss := scriptStep{
+			Line:      step.Line,
+			Statement: step.Statement,
+			Command:   step.Command,
+			Lines:     step.Lines,
+			Attempts:  step.Attempts,
+			Duration:  step.Duration.Seconds(),
+		}
+		if step.Err != nil {
+			ss.Error = step.Err.Error()
+		}
+		r.Steps = append(r.Steps, ss)
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	e.out.print(r)
+	return err
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lab5e/at"
+	"github.com/lab5e/at/bg95"
+	"github.com/lab5e/at/n211"
+	"github.com/lab5e/at/nrf91"
+)
+
+// probeTimeout is the time to wait for the module to respond when
+// detecting the driver
+const probeTimeout = time.Second
+
+// errNotDetected is returned when the module doesn't match a driver
+var errNotDetected = errors.New("could not detect the module, use -driver")
+
+// openDevice opens and starts the device with the driver. The driver is
+// detected if it is auto.
+func openDevice(driver string, serialDevice string, baudRate int) (at.Device, error) {
+	driver = strings.ToLower(driver)
+	if driver == "auto" {
+		var err error
+		driver, baudRate, err = detect(serialDevice, baudRate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var device at.Device
+	switch driver {
+	case "n211":
+		if baudRate == 0 {
+			baudRate = n211.DefaultBaudRate
+		}
+		device = n211.New(serialDevice, baudRate)
+	case "bg95":
+		if baudRate == 0 {
+			baudRate = bg95.DefaultBaudRate
+		}
+		device = bg95.New(serialDevice, baudRate)
+	case "nrf91":
+		if baudRate == 0 {
+			baudRate = nrf91.DefaultBaudRate
+		}
+		device = nrf91.New(serialDevice, baudRate)
+	default:
+		return nil, usageError{fmt.Sprintf("unknown driver: %s", driver)}
+	}
+
+	if err := device.Start(); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// detect finds the driver and the baud rate for the module. The baud
+// rates of the drivers are tried unless the baud rate is given.
+func detect(serialDevice string, baudRate int) (string, int, error) {
+	rates := []int{bg95.DefaultBaudRate, n211.DefaultBaudRate}
+	if baudRate != 0 {
+		rates = []int{baudRate}
+	}
+
+	for _, rate := range rates {
+		info, err := identify(serialDevice, rate)
+		if err == at.ErrReadTimeout {
+			continue
+		}
+		if err != nil {
+			return "", 0, err
+		}
+		driver := driverFor(info)
+		if driver == "" {
+			return "", 0, fmt.Errorf("%w: %s %s", errNotDetected, info.Manufacturer, info.Model)
+		}
+		return driver, rate, nil
+	}
+	return "", 0, fmt.Errorf("no response from the module: %w", at.ErrReadTimeout)
+}
+
+// identify reads the identity of the module at the baud rate
+func identify(serialDevice string, baudRate int) (*at.DeviceInfo, error) {
+	cmd := at.NewCommandInterface(serialDevice, baudRate)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	defer cmd.Close()
+
+	// The first command may fail if there is noise on the line
+	err := cmd.TransactTimeout("AT", probeTimeout, nil)
+	if err != nil {
+		err = cmd.TransactTimeout("AT", probeTimeout, nil)
+	}
+	if err != nil {
+		return nil, at.ErrReadTimeout
+	}
+	// Modules like the BG95 echo the commands by default and the echo
+	// would be taken for the information text. Modules without ATE0 keep
+	// the echo off anyway.
+	cmd.TransactTimeout("ATE0", probeTimeout, nil)
+
+	d := &at.DefaultImplementation{Cmd: cmd}
+	return d.GetDeviceInfo()
+}
+
+// driverFor returns the driver for the module or an empty string if there
+// is no driver for it
+func driverFor(info *at.DeviceInfo) string {
+	s := strings.ToLower(info.Manufacturer + " " + info.Model)
+	switch {
+	case strings.Contains(s, "quectel"), strings.Contains(s, "bg95"), strings.Contains(s, "bg96"), strings.Contains(s, "bg77"):
+		return "bg95"
+	case strings.Contains(s, "nordic"), strings.Contains(s, "nrf91"):
+		return "nrf91"
+	case strings.Contains(s, "u-blox"), strings.Contains(s, "neul"), strings.Contains(s, "sara-n2"), strings.Contains(s, "n211"):
+		return "n211"
+	}
+	return ""
+}
@@ -0,0 +1,47 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"testing"
+
+	"github.com/lab5e/at"
+	"github.com/lab5e/at/bg95"
+	"github.com/lab5e/at/internal/fakemodem"
+)
+
+func TestDetectWithEcho(t *testing.T) {
+	// A BG95 fresh out of the box has the echo on
+	m := fakemodem.New(t)
+	m.SetEcho(true)
+	m.Reply("AT+CGMI", fakemodem.Lines("Quectel", "OK"))
+	m.Reply("AT+CGMM", fakemodem.Lines("BG95-M3", "OK"))
+	m.Reply("AT+CGMR", fakemodem.Lines("BG95M3LAR02A03", "OK"))
+
+	driver, rate, err := detect(m.Path(), bg95.DefaultBaudRate)
+	if err != nil {
+		t.Fatalf("Could not detect the module: %v", err)
+	}
+	if driver != "bg95" || rate != bg95.DefaultBaudRate {
+		t.Fatalf("Expected bg95 at %d, got %s at %d", bg95.DefaultBaudRate, driver, rate)
+	}
+}
+
+func TestDriverFor(t *testing.T) {
+	for _, tc := range []struct {
+		manufacturer string
+		model        string
+		driver       string
+	}{
+		{"Quectel", "BG95-M3", "bg95"},
+		{"Nordic Semiconductor ASA", "nRF9160-SICA", "nrf91"},
+		{"u-blox", "SARA-N211", "n211"},
+		{"AT+CGMI", "AT+CGMM", ""},
+	} {
+		info := &at.DeviceInfo{Manufacturer: tc.manufacturer, Model: tc.model}
+		if driver := driverFor(info); driver != tc.driver {
+			t.Errorf("Expected %q for %s %s, got %q", tc.driver, tc.manufacturer, tc.model, driver)
+		}
+	}
+}
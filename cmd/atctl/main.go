@@ -0,0 +1,129 @@
+// atctl is a command line tool for modules with AT command interfaces.
+//
+//	atctl [options] <command> [arguments]
+//
+// The commands are
+//
+//	info                          show the module, firmware and SIM identities
+//	apn get                       show the APN
+//	apn set <apn>                 set the APN (the module reboots)
+//	pdp [list]                    list the PDP contexts with their addresses
+//	pdp define <cid> <type> <apn> define a PDP context (IP, IPV6, IPV4V6 or Non-IP)
+//	pdp auth <cid> <auth> [u p]   set the authentication (none, pap or chap)
+//	pdp activate|deactivate <cid> activate or deactivate a PDP context
+//	radio on|off                  turn the radio on or off
+//	send <host> <port> [text]     send an UDP message, read from stdin if no text is given
+//	recv <port> [count]           wait for count (default 1) UDP messages on the port
+//	stats                         show the radio statistics
+//	ping [-c n] [-s size] <host>  ping the host
+//	scan                          measure the serving and neighbour cells
+//	raw <command>                 send an AT command and show the response
+//	script [-var n=v] <file|->    run a chat script, see at.Script
+//
+// The driver is detected from the identity the module reports unless it
+// is given with -driver. With -json the output is JSON, one object per
+// line for recv.
+//
+// The exit codes are
+//
+//	0  success
+//	1  the command failed, ie the module returned ERROR
+//	2  invalid usage
+//	3  the device couldn't be opened or didn't respond
+//	4  the command isn't supported by the driver
+//	5  the command timed out
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// Exit codes
+const (
+	exitOK           = 0
+	exitFailure      = 1
+	exitUsage        = 2
+	exitDevice       = 3
+	exitNotSupported = 4
+	exitTimeout      = 5
+)
+
+// options are the global options
+type options struct {
+	serialDevice string
+	driver       string
+	baudRate     int
+	json         bool
+	debug        bool
+	timeout      time.Duration
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run runs the command and returns the exit code
+func run(args []string) int {
+	var opts options
+	fs := flag.NewFlagSet("atctl", flag.ContinueOnError)
+	fs.StringVar(&opts.serialDevice, "device", os.Getenv("AT_DEVICE"), "serial device, defaults to $AT_DEVICE")
+	fs.StringVar(&opts.driver, "driver", "auto", "driver to use: auto, n211, bg95 or nrf91")
+	fs.IntVar(&opts.baudRate, "baud", 0, "baud rate (default is the default of the driver)")
+	fs.BoolVar(&opts.json, "json", false, "print the output as JSON")
+	fs.BoolVar(&opts.debug, "debug", false, "log the AT commands")
+	fs.DurationVar(&opts.timeout, "timeout", 30*time.Second, "time limit for ping, send and recv")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: atctl [options] <command> [arguments]\n\n")
+		fmt.Fprintf(os.Stderr, "Commands: info, apn get|set, pdp, radio on|off, send, recv, stats, ping, scan, raw, script\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	c, ok := findCommand(fs.Arg(0))
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", fs.Arg(0))
+		fs.Usage()
+		return exitUsage
+	}
+	if opts.serialDevice == "" {
+		fmt.Fprintf(os.Stderr, "No device given, use -device or set AT_DEVICE\n")
+		return exitUsage
+	}
+
+	// The library logs failing commands. Only show the log when asked to
+	// since the errors are reported anyway.
+	log.SetOutput(os.Stderr)
+	if !opts.debug {
+		log.SetOutput(ioutil.Discard)
+	}
+	log.SetFlags(log.Ltime | log.Lmicroseconds)
+
+	d, err := openDevice(opts.driver, opts.serialDevice, opts.baudRate)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening %s: %v\n", opts.serialDevice, err)
+		if _, ok := err.(usageError); ok {
+			return exitUsage
+		}
+		return exitDevice
+	}
+	defer d.Close()
+	d.SetDebug(opts.debug)
+
+	out := newOutput(os.Stdout, opts.json)
+	if err := c.fn(&env{opts: opts, device: d, out: out}, fs.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitCode(err)
+	}
+	return exitOK
+}
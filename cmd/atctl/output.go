@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/lab5e/at"
+)
+
+// output prints the results either for humans or as JSON
+type output struct {
+	w    io.Writer
+	json bool
+}
+
+// result is the result of a command. It is marshalled as is for JSON.
+type result interface {
+	// print prints the result for humans
+	print(w io.Writer)
+}
+
+func newOutput(w io.Writer, json bool) *output {
+	return &output{w: w, json: json}
+}
+
+// print prints the result. JSON is written as one object per line.
+func (o *output) print(r result) {
+	if !o.json {
+		tw := tabwriter.NewWriter(o.w, 0, 4, 2, ' ', 0)
+		r.print(tw)
+		tw.Flush()
+		return
+	}
+	buf, err := json.Marshal(r)
+	if err != nil {
+		fmt.Fprintf(o.w, "{\"error\":%q}\n", err.Error())
+		return
+	}
+	fmt.Fprintf(o.w, "%s\n", buf)
+}
+
+// usageError is returned for invalid arguments
+type usageError struct {
+	msg string
+}
+
+func (e usageError) Error() string {
+	return e.msg
+}
+
+// errNotSupported is returned for commands the driver doesn't support
+var errNotSupported = errors.New("not supported by the driver")
+
+// exitCode returns the exit code for the error
+func exitCode(err error) int {
+	var ue usageError
+	switch {
+	case errors.As(err, &ue):
+		return exitUsage
+	case errors.Is(err, errNotDetected):
+		return exitDevice
+	case errors.Is(err, errNotSupported), errors.Is(err, at.ErrPingNotSupported):
+		return exitNotSupported
+	case errors.Is(err, at.ErrReadTimeout), errors.Is(err, context.DeadlineExceeded):
+		return exitTimeout
+	}
+	return exitFailure
+}
+
+// value returns the value or nil if it is unknown so that unknown values
+// are null in JSON
+func value(v int) *int {
+	if v == at.Unknown {
+		return nil
+	}
+	return &v
+}
+
+// tenths returns the value in tenths or nil if it is unknown
+func tenths(v int) *float64 {
+	if v == at.Unknown {
+		return nil
+	}
+	f := float64(v) / 10
+	return &f
+}
+
+// formatInt formats a value for humans
+func formatInt(v *int) string {
+	if v == nil {
+		return "-"
+	}
+	return fmt.Sprint(*v)
+}
+
+// formatTenths formats a value in tenths with the unit for humans
+func formatTenths(v *float64, unit string) string {
+	if v == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f %s", *v, unit)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// maxHistory is the number of lines kept in the history
+const maxHistory = 500
+
+// editor reads lines from the terminal with basic emacs style editing and
+// history. Output written with Print while a line is being edited is
+// written above the line.
+type editor struct {
+	in  *bufio.Reader
+	out io.Writer
+	// raw is true if the terminal is in raw mode. Lines are read as is
+	// without editing otherwise.
+	raw bool
+
+	mu      sync.Mutex
+	prompt  string
+	editing bool
+	line    []rune
+	pos     int
+	history []string
+}
+
+func newEditor(in io.Reader, out io.Writer, raw bool) *editor {
+	return &editor{in: bufio.NewReader(in), out: out, raw: raw}
+}
+
+// Print writes the line above the line being edited
+func (e *editor) Print(s string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.editing {
+		fmt.Fprint(e.out, s+"\r\n")
+		return
+	}
+	fmt.Fprint(e.out, "\r\x1b[K"+s+"\r\n")
+	e.redraw()
+}
+
+// Write makes the editor an io.Writer so that it can be used for logging
+func (e *editor) Write(p []byte) (int, error) {
+	e.Print(strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+// redraw draws the prompt and the line. The caller must hold e.mu.
+func (e *editor) redraw() {
+	s := "\r\x1b[K" + e.prompt + string(e.line)
+	if n := len(e.line) - e.pos; n > 0 {
+		s += fmt.Sprintf("\x1b[%dD", n)
+	}
+	fmt.Fprint(e.out, s)
+}
+
+// ReadLine reads a line. It returns io.EOF when the input ends or on
+// ctrl-D on an empty line.
+func (e *editor) ReadLine(prompt string) (string, error) {
+	if !e.raw {
+		fmt.Fprint(e.out, prompt)
+		s, err := e.in.ReadString('\n')
+		if err != nil && s == "" {
+			return "", err
+		}
+		return strings.TrimRight(s, "\r\n"), nil
+	}
+
+	e.mu.Lock()
+	e.prompt = prompt
+	e.editing = true
+	e.line = nil
+	e.pos = 0
+	e.redraw()
+	e.mu.Unlock()
+
+	defer func() {
+		e.mu.Lock()
+		e.editing = false
+		e.mu.Unlock()
+	}()
+
+	// histPos is the history entry shown. The line being edited is kept
+	// in scratch while browsing the history.
+	histPos := len(e.history)
+	var scratch []rune
+
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		e.mu.Lock()
+		switch r {
+		case '\r', '\n':
+			s := string(e.line)
+			fmt.Fprint(e.out, "\r\n")
+			e.editing = false
+			e.mu.Unlock()
+			e.addHistory(s)
+			return s, nil
+
+		case 3: // ctrl-C clears the line
+			fmt.Fprint(e.out, "^C\r\n")
+			e.line, e.pos = nil, 0
+			histPos = len(e.history)
+
+		case 4: // ctrl-D
+			if len(e.line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				e.editing = false
+				e.mu.Unlock()
+				return "", io.EOF
+			}
+			e.delete()
+
+		case 127, 8: // backspace
+			if e.pos > 0 {
+				e.pos--
+				e.delete()
+			}
+
+		case 1: // ctrl-A
+			e.pos = 0
+
+		case 5: // ctrl-E
+			e.pos = len(e.line)
+
+		case 2: // ctrl-B
+			e.left()
+
+		case 6: // ctrl-F
+			e.right()
+
+		case 11: // ctrl-K kills to the end of the line
+			e.line = e.line[:e.pos]
+
+		case 21: // ctrl-U kills to the start of the line
+			e.line = append([]rune(nil), e.line[e.pos:]...)
+			e.pos = 0
+
+		case 12: // ctrl-L
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+
+		case 16: // ctrl-P
+			histPos, scratch = e.browse(histPos, -1, scratch)
+
+		case 14: // ctrl-N
+			histPos, scratch = e.browse(histPos, 1, scratch)
+
+		case 27:
+			e.mu.Unlock()
+			key := e.readEscape()
+			e.mu.Lock()
+			switch key {
+			case 'A':
+				histPos, scratch = e.browse(histPos, -1, scratch)
+			case 'B':
+				histPos, scratch = e.browse(histPos, 1, scratch)
+			case 'C':
+				e.right()
+			case 'D':
+				e.left()
+			case 'H':
+				e.pos = 0
+			case 'F':
+				e.pos = len(e.line)
+			case '~':
+				e.delete()
+			}
+
+		default:
+			if unicode.IsPrint(r) {
+				e.line = append(e.line, 0)
+				copy(e.line[e.pos+1:], e.line[e.pos:])
+				e.line[e.pos] = r
+				e.pos++
+			}
+		}
+		e.redraw()
+		e.mu.Unlock()
+	}
+}
+
+// readEscape reads the rest of an escape sequence and returns the final
+// character. The delete key (ESC [ 3 ~) is returned as '~'.
+func (e *editor) readEscape() rune {
+	r, _, err := e.in.ReadRune()
+	if err != nil || (r != '[' && r != 'O') {
+		return 0
+	}
+	for {
+		r, _, err = e.in.ReadRune()
+		if err != nil {
+			return 0
+		}
+		if r < '0' || r > '9' {
+			if r == '~' {
+				return '~'
+			}
+			return r
+		}
+	}
+}
+
+// delete deletes the character under the cursor. The caller must hold
+// e.mu.
+func (e *editor) delete() {
+	if e.pos < len(e.line) {
+		e.line = append(e.line[:e.pos], e.line[e.pos+1:]...)
+	}
+}
+
+func (e *editor) left() {
+	if e.pos > 0 {
+		e.pos--
+	}
+}
+
+func (e *editor) right() {
+	if e.pos < len(e.line) {
+		e.pos++
+	}
+}
+
+// browse moves through the history. The caller must hold e.mu.
+func (e *editor) browse(histPos int, delta int, scratch []rune) (int, []rune) {
+	n := histPos + delta
+	if n < 0 || n > len(e.history) {
+		return histPos, scratch
+	}
+	if histPos == len(e.history) {
+		scratch = e.line
+	}
+	if n == len(e.history) {
+		e.line = scratch
+	} else {
+		e.line = []rune(e.history[n])
+	}
+	e.pos = len(e.line)
+	return n, scratch
+}
+
+// addHistory adds the line to the history unless it is empty or the same
+// as the previous line
+func (e *editor) addHistory(s string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if strings.TrimSpace(s) == "" {
+		return
+	}
+	if len(e.history) > 0 && e.history[len(e.history)-1] == s {
+		return
+	}
+	e.history = append(e.history, s)
+	if len(e.history) > maxHistory {
+		e.history = e.history[len(e.history)-maxHistory:]
+	}
+}
+
+// loadHistory reads the history from the file. A missing file is not an
+// error.
+func (e *editor) loadHistory(filename string) error {
+	buf, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, s := range strings.Split(string(buf), "\n") {
+		e.addHistory(s)
+	}
+	return nil
+}
+
+// saveHistory writes the history to the file
+func (e *editor) saveHistory(filename string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	s := strings.Join(e.history, "\n")
+	if s != "" {
+		s += "\n"
+	}
+	return ioutil.WriteFile(filename, []byte(s), 0600)
+}
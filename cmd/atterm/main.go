@@ -0,0 +1,141 @@
+// atterm is an interactive terminal for modules with AT command
+// interfaces. Unlike a plain serial terminal it uses the driver in this
+// library so it can share the port with the library's view of the module,
+// decode +CME ERROR codes and offer shortcuts for the operations the
+// driver supports.
+//
+//	atterm -driver bg95 /dev/ttyUSB2
+//
+// Lines are sent to the module as commands. Lines starting with a colon
+// are shortcuts, type :help for a list. Responses are shown in the default
+// colour, OK in green, errors in red and URCs in yellow.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lab5e/at"
+	"github.com/lab5e/at/bg95"
+	"github.com/lab5e/at/n211"
+	"github.com/lab5e/at/nrf91"
+)
+
+// device is what the terminal needs from the device. The generic driver
+// is an at.DefaultImplementation and the others are at.Device.
+type device interface {
+	Start() error
+	Close()
+	SetDebug(bool)
+	at.Commander
+}
+
+func main() {
+	driver := flag.String("driver", "generic", "driver to use: n211, bg95, nrf91 or generic")
+	baudRate := flag.Int("baud", 0, "baud rate (default is the default of the driver)")
+	timeout := flag.Duration("timeout", 10*time.Second, "time to wait for the response to a command")
+	history := flag.String("history", defaultHistoryFile(), "file to keep the command history in")
+	noColour := flag.Bool("no-color", false, "don't use colours")
+	debug := flag.Bool("debug", false, "show the log of the library")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <serial device>\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	d, err := openDevice(*driver, flag.Arg(0), *baudRate)
+	if err != nil {
+		log.Fatalf("Error opening device: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		log.Fatalf("Error opening device: %v", err)
+	}
+	defer d.Close()
+
+	fd := int(os.Stdin.Fd())
+	raw := false
+	if isTerminal(fd) {
+		restore, err := makeRaw(fd)
+		if err == nil {
+			raw = true
+			defer restore()
+		}
+	}
+
+	e := newEditor(os.Stdin, os.Stdout, raw)
+	if *history != "" {
+		if err := e.loadHistory(*history); err != nil {
+			log.Printf("Error reading history: %v", err)
+		}
+		defer func() {
+			if err := e.saveHistory(*history); err != nil {
+				log.Printf("Error writing history: %v", err)
+			}
+		}()
+	}
+
+	// The library logs failing transactions. Only show the log when
+	// asked to since the terminal shows the errors anyway.
+	log.SetOutput(ioutil.Discard)
+	if *debug {
+		log.SetOutput(e)
+		d.SetDebug(true)
+	}
+
+	t := newTerminal(d, e, *timeout, !*noColour && isTerminal(int(os.Stdout.Fd())))
+	t.run()
+}
+
+// openDevice creates the device for the driver
+func openDevice(driver string, serialDevice string, baudRate int) (device, error) {
+	var d at.Device
+	switch strings.ToLower(driver) {
+	case "n211":
+		if baudRate == 0 {
+			baudRate = n211.DefaultBaudRate
+		}
+		d = n211.New(serialDevice, baudRate)
+	case "bg95":
+		if baudRate == 0 {
+			baudRate = bg95.DefaultBaudRate
+		}
+		d = bg95.New(serialDevice, baudRate)
+	case "nrf91":
+		if baudRate == 0 {
+			baudRate = nrf91.DefaultBaudRate
+		}
+		d = nrf91.New(serialDevice, baudRate)
+	case "generic":
+		if baudRate == 0 {
+			baudRate = 115200
+		}
+		return &at.DefaultImplementation{Cmd: at.NewCommandInterface(serialDevice, baudRate)}, nil
+	default:
+		return nil, fmt.Errorf("unknown driver: %s", driver)
+	}
+
+	ret, ok := d.(device)
+	if !ok {
+		return nil, fmt.Errorf("the %s driver doesn't give access to the command interface", driver)
+	}
+	return ret, nil
+}
+
+// defaultHistoryFile returns ~/.atterm_history
+func defaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".atterm_history")
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lab5e/at"
+)
+
+// ANSI colours
+const (
+	colourRed    = "\x1b[31m"
+	colourGreen  = "\x1b[32m"
+	colourYellow = "\x1b[33m"
+	colourCyan   = "\x1b[36m"
+	colourReset  = "\x1b[0m"
+)
+
+// terminal sends the lines read by the editor to the device and shows the
+// responses
+type terminal struct {
+	device  device
+	cmd     *at.CommandInterface
+	editor  *editor
+	timeout time.Duration
+	colours bool
+
+	// The command interface passes every line from the device to the URC
+	// handlers, including the responses. The responses are recorded in
+	// solicited by an interceptor so that the URC handler can skip them.
+	// The handler may see a line before the transaction does so lines are
+	// skipped while busy and the transaction shows them.
+	mu        sync.Mutex
+	solicited []string
+	busy      int
+}
+
+// maxSolicited is the number of responses kept for the URC handler to
+// skip
+const maxSolicited = 100
+
+// shortcut is a command that starts with a colon
+type shortcut struct {
+	name string
+	help string
+	fn   func(t *terminal, args []string) error
+}
+
+var shortcuts []shortcut
+
+func init() {
+	shortcuts = []shortcut{
+		{"help", "show this help", (*terminal).help},
+		{"info", "show the module, firmware and SIM identities", (*terminal).info},
+		{"stats", "show the radio statistics", (*terminal).stats},
+		{"reg", "show the network registration status", (*terminal).registration},
+		{"cells", "show the serving and neighbour cells", (*terminal).cells},
+		{"sockets", "list the open sockets", (*terminal).sockets},
+		{"quit", "exit the terminal", nil},
+	}
+}
+
+func newTerminal(d device, e *editor, timeout time.Duration, colours bool) *terminal {
+	return &terminal{
+		device:  d,
+		cmd:     d.CommandInterface(),
+		editor:  e,
+		timeout: timeout,
+		colours: colours,
+	}
+}
+
+// run reads and executes lines until the input ends or the user quits
+func (t *terminal) run() {
+	t.cmd.AddInterceptor(t.intercept)
+	t.cmd.AddURCHandler("", t.urc)
+	t.println(colourCyan, "Type AT commands or :help for shortcuts. Exit with :quit or ctrl-D.")
+
+	for {
+		line, err := t.editor.ReadLine("> ")
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.println(colourRed, "Error reading input: "+err.Error())
+			return
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, ":") {
+			fields := strings.Fields(line[1:])
+			if len(fields) > 0 && (fields[0] == "quit" || fields[0] == "exit") {
+				return
+			}
+			err = t.shortcut(fields)
+		} else {
+			err = t.send(line)
+		}
+
+		if err != nil {
+			t.println(colourRed, t.describe(err))
+		}
+	}
+}
+
+// intercept records the response lines of all transactions, including
+// the ones the driver runs for shortcuts
+func (t *terminal) intercept(cmd string, fn func(string) error, invoke at.Invoker) error {
+	t.mu.Lock()
+	t.busy++
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.busy--
+		t.mu.Unlock()
+	}()
+
+	return invoke(cmd, func(s string) error {
+		if s != "" {
+			t.mu.Lock()
+			t.solicited = append(t.solicited, s)
+			if len(t.solicited) > maxSolicited {
+				t.solicited = t.solicited[1:]
+			}
+			t.mu.Unlock()
+		}
+		return fn(s)
+	})
+}
+
+// urc shows the lines from the device that weren't part of a response.
+// The URC handlers see the lines in the order they arrived so the
+// responses are skipped by looking them up in the recorded responses.
+func (t *terminal) urc(s string) {
+	if s == "" {
+		return
+	}
+	t.mu.Lock()
+	for i, r := range t.solicited {
+		if r == s {
+			t.solicited = t.solicited[i+1:]
+			t.mu.Unlock()
+			return
+		}
+	}
+	busy := t.busy > 0
+	t.mu.Unlock()
+	if busy {
+		return
+	}
+	t.println(colourYellow, s)
+}
+
+// send sends the command and shows the response
+func (t *terminal) send(cmd string) error {
+	prefix := strings.TrimPrefix(at.CommandVerb(cmd), "AT")
+	err := t.cmd.TransactTimeout(cmd, t.timeout, func(s string) error {
+		switch {
+		case s == "":
+		case isURC(s, prefix):
+			t.println(colourYellow, s)
+		default:
+			t.println("", s)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	t.println(colourGreen, "OK")
+	return nil
+}
+
+// isURC returns true if the line looks like a result code for another
+// command than the one with the prefix, ie +CEREG: 5 in the response to
+// AT+CGPADDR
+func isURC(s string, prefix string) bool {
+	if s[0] != '+' && s[0] != '%' && s[0] != '#' && s[0] != '^' {
+		return false
+	}
+	i := strings.IndexAny(s, ": ")
+	if i < 0 {
+		return s != prefix
+	}
+	return s[:i] != prefix
+}
+
+// describe describes the error. CME errors are shown as the module
+// reports them with the description of the code.
+func (t *terminal) describe(err error) string {
+	var cme *at.CMEError
+	switch {
+	case errors.As(err, &cme):
+		if cme.Code < 0 {
+			return "+CME ERROR: " + cme.Text
+		}
+		if cme.Text == "" {
+			return fmt.Sprintf("+CME ERROR: %d (unknown or module specific error)", cme.Code)
+		}
+		return fmt.Sprintf("+CME ERROR: %d (%s)", cme.Code, cme.Text)
+	case err == at.ErrATError:
+		return "ERROR"
+	case err == at.ErrReadTimeout:
+		return fmt.Sprintf("No response within %v", t.timeout)
+	}
+	return err.Error()
+}
+
+// println prints the line in the colour
+func (t *terminal) println(colour string, s string) {
+	if t.colours && colour != "" {
+		s = colour + s + colourReset
+	}
+	t.editor.Print(s)
+}
+
+// field prints a label and a value
+func (t *terminal) field(label string, value string) {
+	t.println("", fmt.Sprintf("%-16s %s", label+":", value))
+}
+
+// shortcut runs the shortcut
+func (t *terminal) shortcut(fields []string) error {
+	if len(fields) == 0 {
+		return t.help(nil)
+	}
+	for _, s := range shortcuts {
+		if s.name == fields[0] && s.fn != nil {
+			return s.fn(t, fields[1:])
+		}
+	}
+	return fmt.Errorf("unknown shortcut :%s, type :help for a list", fields[0])
+}
+
+// errNotSupported is returned by shortcuts the driver doesn't support
+var errNotSupported = errors.New("the driver doesn't support this, use -driver to select the driver for the module")
+
+func (t *terminal) help(_ []string) error {
+	for _, s := range shortcuts {
+		t.println("", fmt.Sprintf(":%-10s %s", s.name, s.help))
+	}
+	return nil
+}
+
+// identity is an identity shown by :info
+type identity struct {
+	label string
+	fn    func() (string, error)
+}
+
+func (t *terminal) info(_ []string) error {
+	supported := false
+	if ir, ok := t.device.(at.InfoReader); ok {
+		supported = true
+		info, err := ir.GetDeviceInfo()
+		if err != nil {
+			return err
+		}
+		t.field("Manufacturer", info.Manufacturer)
+		t.field("Model", info.Model)
+		t.field("Firmware", info.FirmwareVersion)
+	}
+
+	// The generic driver reads the IMEI and IMSI but not the CCID
+	var ids []identity
+	if d, ok := t.device.(interface{ GetIMEI() (string, error) }); ok {
+		ids = append(ids, identity{"IMEI", d.GetIMEI})
+	}
+	if d, ok := t.device.(interface{ GetIMSI() (string, error) }); ok {
+		ids = append(ids, identity{"IMSI", d.GetIMSI})
+	}
+	if d, ok := t.device.(interface{ GetCCID() (string, error) }); ok {
+		ids = append(ids, identity{"CCID", d.GetCCID})
+	}
+	for _, id := range ids {
+		supported = true
+		s, err := id.fn()
+		if err != nil {
+			s = t.describe(err)
+		}
+		t.field(id.label, s)
+	}
+	if !supported {
+		return errNotSupported
+	}
+	return nil
+}
+
+// tenths formats a value in tenths with the unit
+func tenths(v int, unit string) string {
+	if v == at.Unknown {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f %s", float64(v)/10, unit)
+}
+
+// integer formats an integer
+func integer(v int) string {
+	if v == at.Unknown {
+		return "-"
+	}
+	return fmt.Sprint(v)
+}
+
+func (t *terminal) stats(_ []string) error {
+	sr, ok := t.device.(at.StatsReader)
+	if !ok {
+		return errNotSupported
+	}
+	s, err := sr.GetStats()
+	if err != nil {
+		return err
+	}
+	t.field("RSRP", tenths(s.SignalPower, "dBm"))
+	t.field("RSSI", tenths(s.TotalPower, "dBm"))
+	t.field("RSRQ", tenths(s.RSRQ, "dB"))
+	t.field("SNR", tenths(s.SNR, "dB"))
+	t.field("TX power", tenths(s.TXPower, "dBm"))
+	t.field("ECL", integer(s.ECL))
+	t.field("Cell ID", integer(s.CellID))
+	t.field("EARFCN", integer(s.EARFCN))
+	t.field("PCI", integer(s.PCI))
+	return nil
+}
+
+func (t *terminal) registration(_ []string) error {
+	rr, ok := t.device.(at.RegistrationReader)
+	if !ok {
+		return errNotSupported
+	}
+	status, err := rr.GetRegistration()
+	if err != nil {
+		return err
+	}
+	t.field("Registration", status.String())
+	return nil
+}
+
+func (t *terminal) cells(_ []string) error {
+	cr, ok := t.device.(at.CellInfoReader)
+	if !ok {
+		return errNotSupported
+	}
+	info, err := cr.GetCellInfo()
+	if err != nil {
+		return err
+	}
+	t.println("", fmt.Sprintf("%-8s %6s %4s %10s %6s %12s %10s %9s", "", "EARFCN", "PCI", "Cell ID", "TAC", "RSRP", "RSRQ", "SINR"))
+	row := func(label string, c *at.Cell) {
+		t.println("", fmt.Sprintf("%-8s %6s %4s %10s %6s %12s %10s %9s", label,
+			integer(c.EARFCN), integer(c.PCI), integer(c.CellID), integer(c.TAC),
+			tenths(c.RSRP, "dBm"), tenths(c.RSRQ, "dB"), tenths(c.SINR, "dB")))
+	}
+	if info.Serving != nil {
+		row("serving", info.Serving)
+	}
+	for i := range info.Neighbours {
+		row("neighbour", &info.Neighbours[i])
+	}
+	return nil
+}
+
+func (t *terminal) sockets(_ []string) error {
+	sl, ok := t.device.(at.SocketLister)
+	if !ok {
+		return errNotSupported
+	}
+	sockets := sl.ListSockets()
+	if len(sockets) == 0 {
+		t.println("", "No open sockets")
+		return nil
+	}
+	for _, s := range sockets {
+		t.field(fmt.Sprintf("Socket %d", s.Socket), s.Protocol)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package at
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CMEError is returned when the device responds with +CME ERROR. The code
+// is -1 if the module reports the error as text (AT+CMEE=2).
+type CMEError struct {
+	Code int
+	Text string
+}
+
+func (e *CMEError) Error() string {
+	if e.Code < 0 {
+		return "device returned +CME ERROR: " + e.Text
+	}
+	if e.Text != "" {
+		return fmt.Sprintf("device returned +CME ERROR: %d (%s)", e.Code, e.Text)
+	}
+	return fmt.Sprintf("device returned +CME ERROR: %d", e.Code)
+}
+
+// Is makes errors.Is(err, ErrATError) true for CME errors
+func (e *CMEError) Is(target error) bool {
+	return target == ErrATError
+}
+
+// cmePrefix is the prefix of the final result code for errors
+const cmePrefix = "+CME ERROR:"
+
+// ParseCMEError parses a +CME ERROR line. Numeric codes are described
+// with the text from 3GPP TS 27.007 if the code is known.
+func ParseCMEError(s string) *CMEError {
+	st := strings.TrimSpace(strings.TrimPrefix(s, cmePrefix))
+	code, err := strconv.Atoi(st)
+	if err != nil {
+		return &CMEError{Code: -1, Text: st}
+	}
+	return &CMEError{Code: code, Text: CMEErrorText(code)}
+}
+
+// CMEErrorText returns the description of the CME error code from 3GPP
+// TS 27.007 or an empty string if the code isn't known. Modules use codes
+// above 256 for their own errors.
+func CMEErrorText(code int) string {
+	return cmeErrors[code]
+}
+
+var cmeErrors = map[int]string{
+	0:   "phone failure",
+	1:   "no connection to phone",
+	2:   "phone-adaptor link reserved",
+	3:   "operation not allowed",
+	4:   "operation not supported",
+	5:   "PH-SIM PIN required",
+	6:   "PH-FSIM PIN required",
+	7:   "PH-FSIM PUK required",
+	10:  "SIM not inserted",
+	11:  "SIM PIN required",
+	12:  "SIM PUK required",
+	13:  "SIM failure",
+	14:  "SIM busy",
+	15:  "SIM wrong",
+	16:  "incorrect password",
+	17:  "SIM PIN2 required",
+	18:  "SIM PUK2 required",
+	20:  "memory full",
+	21:  "invalid index",
+	22:  "not found",
+	23:  "memory failure",
+	24:  "text string too long",
+	25:  "invalid characters in text string",
+	26:  "dial string too long",
+	27:  "invalid characters in dial string",
+	30:  "no network service",
+	31:  "network timeout",
+	32:  "network not allowed - emergency calls only",
+	40:  "network personalization PIN required",
+	41:  "network personalization PUK required",
+	42:  "network subset personalization PIN required",
+	43:  "network subset personalization PUK required",
+	44:  "service provider personalization PIN required",
+	45:  "service provider personalization PUK required",
+	46:  "corporate personalization PIN required",
+	47:  "corporate personalization PUK required",
+	48:  "hidden key required",
+	49:  "EAP method not supported",
+	50:  "incorrect parameters",
+	51:  "command implemented but currently disabled",
+	52:  "command aborted by user",
+	53:  "not attached to network due to MT functionality restrictions",
+	54:  "modem not allowed - MT restricted to emergency calls only",
+	55:  "operation not allowed because of MT functionality restrictions",
+	56:  "fixed dial number only allowed",
+	57:  "temporarily out of service due to other MT usage",
+	58:  "language/alphabet not supported",
+	59:  "unexpected data value",
+	60:  "system failure",
+	61:  "data missing",
+	62:  "call barred",
+	63:  "message waiting indication subscription failure",
+	100: "unknown",
+	103: "illegal MS",
+	106: "illegal ME",
+	107: "GPRS services not allowed",
+	108: "GPRS services and non-GPRS services not allowed",
+	111: "PLMN not allowed",
+	112: "location area not allowed",
+	113: "roaming not allowed in this location area",
+	114: "GPRS services not allowed in this PLMN",
+	115: "no suitable cells in tracking area",
+	122: "congestion",
+	125: "insufficient resources",
+	126: "missing or unknown APN",
+	127: "unknown PDP address or PDP type",
+	128: "user authentication or authorization failed",
+	129: "activation rejected by GGSN, Serving GW or PDN GW",
+	130: "activation rejected, unspecified",
+	131: "service option not supported",
+	132: "requested service option not subscribed",
+	133: "service option temporarily out of order",
+	134: "NS-api already used",
+	148: "unspecified GPRS error",
+	149: "PDP authentication failure",
+	150: "invalid mobile class",
+	171: "last PDN disconnection not allowed",
+	172: "semantically incorrect message",
+	173: "invalid mandatory information",
+	174: "message type non-existent or not implemented",
+	175: "conditional IE error",
+	176: "protocol error, unspecified",
+	177: "operator determined barring",
+	178: "maximum number of PDP contexts reached",
+	179: "requested APN not supported in current RAT and PLMN combination",
+	180: "request rejected, bearer control mode violation",
+	181: "unsupported QCI value",
+}
@@ -0,0 +1,70 @@
+package coap
+
+import "errors"
+
+// DefaultBlockSize is the block size used for block-wise transfers. The
+// NB-IoT modules limit a datagram to 512 bytes so 256 byte blocks leave
+// room for the header and options.
+const DefaultBlockSize = 256
+
+// Block is the value of the Block1 and Block2 options (RFC 7959)
+type Block struct {
+	Num  uint32 // Num is the block number
+	More bool   // More is set when there are more blocks
+	Size int    // Size is the block size, a power of two from 16 to 1024
+}
+
+// Offset returns the offset of the block in the body
+func (b Block) Offset() int {
+	return int(b.Num) * b.Size
+}
+
+// szx returns the size exponent of the block size
+func (b Block) szx() (uint32, error) {
+	for szx := uint32(0); szx <= 6; szx++ {
+		if 16<<szx == b.Size {
+			return szx, nil
+		}
+	}
+	return 0, errors.New("block size must be a power of two between 16 and 1024")
+}
+
+func (b Block) encode() ([]byte, error) {
+	szx, err := b.szx()
+	if err != nil {
+		return nil, err
+	}
+	v := b.Num<<4 | szx
+	if b.More {
+		v |= 0x08
+	}
+	return encodeUint(v), nil
+}
+
+// SetBlock replaces the Block1 or Block2 option
+func (m *Message) SetBlock(number OptionNumber, block Block) error {
+	value, err := block.encode()
+	if err != nil {
+		return err
+	}
+	m.RemoveOption(number)
+	m.AddOption(number, value)
+	return nil
+}
+
+// Block returns the Block1 or Block2 option and whether it was present
+func (m *Message) Block(number OptionNumber) (Block, bool, error) {
+	v, ok := m.Uint(number)
+	if !ok {
+		return Block{}, false, nil
+	}
+	szx := v & 0x07
+	if szx == 7 {
+		return Block{}, true, errors.New("reserved block size exponent")
+	}
+	return Block{
+		Num:  v >> 4,
+		More: v&0x08 != 0,
+		Size: 16 << szx,
+	}, true, nil
+}
@@ -0,0 +1,785 @@
+// Package coap implements a CoAP client (RFC 7252) on top of the UDP
+// sockets of a device. It supports confirmable and non-confirmable
+// requests with retransmission, block-wise transfers (RFC 7959) and
+// observing resources (RFC 7641). The defaults are sized for the payload
+// limits of NB-IoT modules. Requests from the server, as used by LwM2M,
+// are served by the handler set with HandleRequests.
+//
+// Example:
+//
+//	client, err := coap.Dial(ctx, device, "coap.example.com:5683", nil)
+//	if err != nil {
+//	    log.Fatalf("Could not create client: %v", err)
+//	}
+//	defer client.Close()
+//	resp, err := client.Post(ctx, "/data", coap.AppJSON, []byte(`{"temp":21}`))
+//	...
+//	obs, err := client.Observe(ctx, "/config", func(msg *coap.Message) {
+//	    log.Printf("Config is now %s", msg.Payload)
+//	})
+package coap
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lab5e/at"
+)
+
+// Transmission parameters from section 4.8 of RFC 7252
+const (
+	// DefaultPort is the default CoAP port
+	DefaultPort = 5683
+
+	// AckTimeout is the initial time to wait for an acknowledgement
+	AckTimeout = 2 * time.Second
+
+	// AckRandomFactor is the random factor applied to AckTimeout
+	AckRandomFactor = 1.5
+
+	// MaxRetransmit is the number of retransmissions of a confirmable
+	// message before giving up
+	MaxRetransmit = 4
+
+	// MaxTransmitWait is the time from the first transmission of a
+	// confirmable message until the sender gives up
+	MaxTransmitWait = 93 * time.Second
+)
+
+// DefaultLocalPort is the local port Dial binds to. The N211 only
+// receives on sockets bound to a port and reserves 5683 for itself.
+const DefaultLocalPort = 56830
+
+// maxMessageSize is the largest message the client reads
+const maxMessageSize = 1152
+
+// tokenLength is the length of the generated tokens. Short tokens save
+// bytes on the radio.
+const tokenLength = 4
+
+// recentSize is the number of received confirmable messages the client
+// remembers so it can acknowledge retransmissions.
+const recentSize = 32
+
+// recentMessage is a received confirmable message and the reply to it
+type recentMessage struct {
+	id    uint16
+	reply []byte
+}
+
+var (
+	// ErrTimeout is returned when the server doesn't respond
+	ErrTimeout = errors.New("no response from server")
+
+	// ErrReset is returned when the server rejects the message with a
+	// reset
+	ErrReset = errors.New("message was reset by the server")
+
+	// ErrNotObservable is returned by Observe when the server doesn't
+	// support observing the resource
+	ErrNotObservable = errors.New("resource is not observable")
+)
+
+// Options are the client options. Zero values use the defaults.
+type Options struct {
+	// LocalPort is the local port Dial binds to
+	LocalPort int
+
+	// NonConfirmable sends requests as non-confirmable messages which
+	// aren't retransmitted
+	NonConfirmable bool
+
+	// BlockSize is the block size for block-wise transfers. It must be
+	// a power of two from 16 to 1024.
+	BlockSize int
+
+	// AckTimeout is the initial time to wait for an acknowledgement
+	AckTimeout time.Duration
+
+	// MaxRetransmit is the number of retransmissions
+	MaxRetransmit int
+
+	// ResponseTimeout is how long to wait for a separate response or
+	// the response to a non-confirmable request when the context has no
+	// deadline.
+	ResponseTimeout time.Duration
+}
+
+// Handler serves requests from the server. The returned response gets
+// the type, message ID and token set by the client. Returning nil
+// responds with 4.04 Not Found.
+type Handler func(req *Message) *Message
+
+// Client is a CoAP client talking to a single server
+type Client struct {
+	conn            net.PacketConn
+	remote          net.Addr
+	nonConfirmable  bool
+	blockSize       int
+	ackTimeout      time.Duration
+	maxRetransmit   int
+	responseTimeout time.Duration
+
+	mu        sync.Mutex
+	messageID uint16
+	acks      map[uint16]chan *Message
+	responses map[string]chan *Message
+	observers map[string]*Observation
+	recent    []recentMessage
+	handler   Handler
+
+	closed chan struct{}
+	once   sync.Once
+}
+
+// Dial creates a client for the server at address. The address is
+// host:port or just the host for the default port. Host names are
+// resolved by the device.
+func Dial(ctx context.Context, device at.Device, address string, opts *Options) (*Client, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		host, portStr = address, strconv.Itoa(DefaultPort)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in address %s", address)
+	}
+
+	ips, err := at.ResolveHost(ctx, device, host)
+	if err != nil {
+		return nil, err
+	}
+
+	localPort := DefaultLocalPort
+	if opts != nil && opts.LocalPort != 0 {
+		localPort = opts.LocalPort
+	}
+	conn, err := at.ListenPacket(device, localPort)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn, &net.UDPAddr{IP: ips[0], Port: port}, opts), nil
+}
+
+// NewClient creates a client for the server at remote using the packet
+// connection. The client owns the connection and closes it when it is
+// closed.
+func NewClient(conn net.PacketConn, remote net.Addr, opts *Options) *Client {
+	if opts == nil {
+		opts = &Options{}
+	}
+	c := &Client{
+		conn:            conn,
+		remote:          remote,
+		nonConfirmable:  opts.NonConfirmable,
+		blockSize:       opts.BlockSize,
+		ackTimeout:      opts.AckTimeout,
+		maxRetransmit:   opts.MaxRetransmit,
+		responseTimeout: opts.ResponseTimeout,
+		acks:            make(map[uint16]chan *Message),
+		responses:       make(map[string]chan *Message),
+		observers:       make(map[string]*Observation),
+		closed:          make(chan struct{}),
+	}
+	if c.blockSize == 0 {
+		c.blockSize = DefaultBlockSize
+	}
+	if c.ackTimeout == 0 {
+		c.ackTimeout = AckTimeout
+	}
+	if c.maxRetransmit == 0 {
+		c.maxRetransmit = MaxRetransmit
+	}
+	if c.responseTimeout == 0 {
+		c.responseTimeout = MaxTransmitWait
+	}
+
+	var id [2]byte
+	rand.Read(id[:])
+	c.messageID = binary.BigEndian.Uint16(id[:])
+
+	go c.readLoop()
+	return c
+}
+
+// Close closes the client and the connection. Observations end without
+// deregistering.
+func (c *Client) Close() error {
+	var err error
+	c.once.Do(func() {
+		close(c.closed)
+		err = c.conn.Close()
+
+		c.mu.Lock()
+		observers := make([]*Observation, 0, len(c.observers))
+		for _, o := range c.observers {
+			observers = append(observers, o)
+		}
+		c.mu.Unlock()
+		for _, o := range observers {
+			o.end()
+		}
+	})
+	return err
+}
+
+// HandleRequests sets the handler for requests from the server. Requests
+// are rejected with a reset when there is no handler. The handler runs in
+// its own goroutine so it may use the client.
+func (c *Client) HandleRequests(handler Handler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handler = handler
+}
+
+// Notify sends a notification for an observation the server has
+// registered through the request handler. The message must have the
+// token of the observe request. Confirmable notifications are
+// retransmitted until they are acknowledged. It returns ErrReset if the
+// server no longer wants notifications.
+func (c *Client) Notify(ctx context.Context, msg *Message) error {
+	msg = msg.clone()
+	if msg.Type != Confirmable && msg.Type != NonConfirmable {
+		return errors.New("notifications must be confirmable or non-confirmable")
+	}
+	_, err := c.transmit(ctx, msg, nil)
+	return err
+}
+
+// NewRequest creates a request for the path. The path may include a
+// query string, ie "/sensors/temp?unit=C".
+func NewRequest(code Code, path string) *Message {
+	req := &Message{Type: Confirmable, Code: code}
+	query := ""
+	if i := strings.Index(path, "?"); i >= 0 {
+		path, query = path[:i], path[i+1:]
+	}
+	req.SetPath(path)
+	if query != "" {
+		for _, q := range strings.Split(query, "&") {
+			req.AddQuery(q)
+		}
+	}
+	return req
+}
+
+// Get retrieves the resource
+func (c *Client) Get(ctx context.Context, path string) (*Message, error) {
+	return c.Do(ctx, NewRequest(GET, path))
+}
+
+// Post posts the payload to the resource
+func (c *Client) Post(ctx context.Context, path string, mediaType MediaType, payload []byte) (*Message, error) {
+	req := NewRequest(POST, path)
+	req.SetContentFormat(mediaType)
+	req.Payload = payload
+	return c.Do(ctx, req)
+}
+
+// Put updates the resource with the payload
+func (c *Client) Put(ctx context.Context, path string, mediaType MediaType, payload []byte) (*Message, error) {
+	req := NewRequest(PUT, path)
+	req.SetContentFormat(mediaType)
+	req.Payload = payload
+	return c.Do(ctx, req)
+}
+
+// Delete deletes the resource
+func (c *Client) Delete(ctx context.Context, path string) (*Message, error) {
+	return c.Do(ctx, NewRequest(DELETE, path))
+}
+
+// Do sends the request and returns the response. Payloads larger than the
+// block size are sent with Block1 and responses split with Block2 are
+// reassembled. The message ID and token are set by the client. Responses
+// with error codes are returned without an error; check the Code field.
+func (c *Client) Do(ctx context.Context, req *Message) (*Message, error) {
+	req = req.clone()
+	if c.nonConfirmable {
+		req.Type = NonConfirmable
+	}
+	if req.Type != Confirmable && req.Type != NonConfirmable {
+		return nil, errors.New("requests must be confirmable or non-confirmable")
+	}
+
+	if len(req.Payload) > c.blockSize {
+		return c.doBlock1(ctx, req)
+	}
+
+	// Ask the server to use our block size rather than sending responses
+	// that won't fit the modem buffers. Servers without block-wise
+	// support reject the critical Block2 option so retry without it.
+	if req.Code == GET && !req.HasOption(Block2) {
+		first := req.clone()
+		if err := first.SetBlock(Block2, Block{Size: c.blockSize}); err != nil {
+			return nil, err
+		}
+		resp, err := c.roundTrip(ctx, first)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Code != BadOption {
+			return c.completeBlock2(ctx, req, resp)
+		}
+	}
+
+	resp, err := c.roundTrip(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return c.completeBlock2(ctx, req, resp)
+}
+
+// doBlock1 sends the request payload in blocks
+func (c *Client) doBlock1(ctx context.Context, req *Message) (*Message, error) {
+	size := c.blockSize
+	offset := 0
+	for {
+		end := offset + size
+		more := true
+		if end >= len(req.Payload) {
+			end = len(req.Payload)
+			more = false
+		}
+
+		part := req.clone()
+		part.Payload = req.Payload[offset:end]
+		if err := part.SetBlock(Block1, Block{Num: uint32(offset / size), More: more, Size: size}); err != nil {
+			return nil, err
+		}
+		if offset == 0 {
+			part.SetUint(Size1, uint32(len(req.Payload)))
+		}
+
+		resp, err := c.roundTrip(ctx, part)
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			return c.completeBlock2(ctx, req, resp)
+		}
+		if resp.Code != Continue {
+			return resp, nil
+		}
+
+		// The server may ask for smaller blocks. The offset is a
+		// multiple of the new size since sizes are powers of two.
+		if block, ok, err := resp.Block(Block1); err == nil && ok && block.Size < size {
+			size = block.Size
+		}
+		offset = end
+	}
+}
+
+// completeBlock2 fetches the remaining blocks of a response and returns
+// the response with the complete payload.
+func (c *Client) completeBlock2(ctx context.Context, req *Message, resp *Message) (*Message, error) {
+	block, ok, err := resp.Block(Block2)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || !block.More || !resp.Code.IsSuccess() {
+		return resp, nil
+	}
+	if block.Offset() != 0 {
+		return nil, fmt.Errorf("response starts at block %d", block.Num)
+	}
+
+	etag := resp.Option(ETag)
+	body := append([]byte(nil), resp.Payload...)
+	for block.More {
+		next := req.clone()
+		next.Payload = nil
+		next.RemoveOption(Block1)
+		next.RemoveOption(Size1)
+		next.RemoveOption(Observe)
+		if err := next.SetBlock(Block2, Block{Num: uint32(len(body) / block.Size), Size: block.Size}); err != nil {
+			return nil, err
+		}
+
+		part, err := c.roundTrip(ctx, next)
+		if err != nil {
+			return nil, err
+		}
+		if !part.Code.IsSuccess() {
+			return part, nil
+		}
+		if string(part.Option(ETag)) != string(etag) {
+			return nil, errors.New("resource changed during block-wise transfer")
+		}
+		block, ok, err = part.Block(Block2)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || block.Offset() != len(body) {
+			return nil, errors.New("unexpected block in response")
+		}
+		body = append(body, part.Payload...)
+	}
+
+	resp.Payload = body
+	resp.RemoveOption(Block2)
+	return resp, nil
+}
+
+// roundTrip sends a single request with a new token and waits for the
+// response.
+func (c *Client) roundTrip(ctx context.Context, req *Message) (*Message, error) {
+	req.Token = newToken()
+	return c.exchange(ctx, req)
+}
+
+// exchange sends a single request and waits for the response
+func (c *Client) exchange(ctx context.Context, req *Message) (*Message, error) {
+	responses := make(chan *Message, 1)
+	key := string(req.Token)
+
+	c.mu.Lock()
+	c.responses[key] = responses
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.responses, key)
+		c.mu.Unlock()
+	}()
+
+	return c.transmit(ctx, req, responses)
+}
+
+// transmit sends the message and waits for the response. Confirmable
+// messages are retransmitted with exponential backoff until they are
+// acknowledged. The response is either piggybacked on the acknowledgement
+// or arrives separately on the responses channel. Pass a nil channel to
+// return as soon as the message is acknowledged.
+func (c *Client) transmit(ctx context.Context, msg *Message, responses <-chan *Message) (*Message, error) {
+	c.mu.Lock()
+	c.messageID++
+	msg.MessageID = c.messageID
+	c.mu.Unlock()
+
+	data, err := msg.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	acks := make(chan *Message, 1)
+	if msg.Type == Confirmable {
+		c.mu.Lock()
+		c.acks[msg.MessageID] = acks
+		c.mu.Unlock()
+		defer func() {
+			c.mu.Lock()
+			delete(c.acks, msg.MessageID)
+			c.mu.Unlock()
+		}()
+	}
+
+	if _, err := c.conn.WriteTo(data, c.remote); err != nil {
+		return nil, err
+	}
+
+	if msg.Type == Confirmable {
+		timeout := c.ackTimeout + time.Duration(mathrand.Float64()*(AckRandomFactor-1)*float64(c.ackTimeout))
+		acknowledged := false
+		for attempt := 0; !acknowledged; attempt++ {
+			timer := time.NewTimer(timeout)
+			select {
+			case ack := <-acks:
+				timer.Stop()
+				if ack.Type == Reset {
+					return nil, ErrReset
+				}
+				if ack.Code != Empty {
+					return ack, nil
+				}
+				// Empty acknowledgement, the response comes later
+				acknowledged = true
+
+			case resp := <-responses:
+				// The acknowledgement was lost but the response made it
+				timer.Stop()
+				return resp, nil
+
+			case <-timer.C:
+				if attempt == c.maxRetransmit {
+					return nil, ErrTimeout
+				}
+				timeout *= 2
+				if _, err := c.conn.WriteTo(data, c.remote); err != nil {
+					return nil, err
+				}
+
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+
+			case <-c.closed:
+				timer.Stop()
+				return nil, at.ErrClosed
+			}
+		}
+	}
+
+	if responses == nil {
+		return nil, nil
+	}
+
+	timer := time.NewTimer(at.ContextTimeout(ctx, c.responseTimeout))
+	defer timer.Stop()
+	select {
+	case resp := <-responses:
+		return resp, nil
+	case <-timer.C:
+		return nil, ErrTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.closed:
+		return nil, at.ErrClosed
+	}
+}
+
+// readLoop reads and dispatches messages until the connection is closed
+func (c *Client) readLoop() {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-c.closed:
+			default:
+				log.Printf("Error reading from CoAP connection: %v", err)
+				c.Close()
+			}
+			return
+		}
+		if !c.fromServer(addr) {
+			continue
+		}
+		msg, err := Unmarshal(buf[:n])
+		if err != nil {
+			log.Printf("Ignoring invalid CoAP message: %v", err)
+			continue
+		}
+		c.handle(msg)
+	}
+}
+
+// fromServer returns true if the address is the server address
+func (c *Client) fromServer(addr net.Addr) bool {
+	remote, ok := c.remote.(*net.UDPAddr)
+	from, ok2 := addr.(*net.UDPAddr)
+	if !ok || !ok2 {
+		return true
+	}
+	return remote.Port == from.Port && (from.IP == nil || remote.IP.Equal(from.IP))
+}
+
+// handle dispatches a message from the server
+func (c *Client) handle(msg *Message) {
+	if msg.Type == Acknowledgement || msg.Type == Reset {
+		c.mu.Lock()
+		acks := c.acks[msg.MessageID]
+		c.mu.Unlock()
+		if acks != nil {
+			select {
+			case acks <- msg:
+			default:
+			}
+		}
+		return
+	}
+
+	// Pings are rejected
+	if msg.Code == Empty {
+		if msg.Type == Confirmable {
+			c.reply(Reset, msg.MessageID)
+		}
+		return
+	}
+
+	if msg.Code.Class() == 0 {
+		c.mu.Lock()
+		handler := c.handler
+		reply, duplicate := c.remember(msg)
+		c.mu.Unlock()
+
+		switch {
+		case duplicate:
+			// The reply is nil while the request is being served
+			if reply != nil {
+				c.conn.WriteTo(reply, c.remote)
+			}
+		case handler == nil:
+			if msg.Type == Confirmable {
+				c.reply(Reset, msg.MessageID)
+			}
+		default:
+			go c.serve(handler, msg)
+		}
+		return
+	}
+
+	key := string(msg.Token)
+	c.mu.Lock()
+	responses := c.responses[key]
+	observer := c.observers[key]
+	_, duplicate := c.remember(msg)
+	c.mu.Unlock()
+
+	switch {
+	case responses != nil:
+		select {
+		case responses <- msg:
+		default:
+		}
+	case observer != nil:
+		if !duplicate {
+			observer.receive(msg)
+		}
+	case duplicate:
+		// A retransmission of a response we have acknowledged already
+	default:
+		// Unknown tokens are rejected which also makes the server
+		// forget observations we no longer want
+		if msg.Type == Confirmable {
+			c.reply(Reset, msg.MessageID)
+		}
+		return
+	}
+
+	if msg.Type == Confirmable {
+		c.reply(Acknowledgement, msg.MessageID)
+	}
+}
+
+// remember records the message ID of a confirmable message and returns
+// true if it has been seen before along with the reply to it, if any. The
+// lock must be held.
+func (c *Client) remember(msg *Message) ([]byte, bool) {
+	if msg.Type != Confirmable {
+		return nil, false
+	}
+	for _, r := range c.recent {
+		if r.id == msg.MessageID {
+			return r.reply, true
+		}
+	}
+	c.recent = append(c.recent, recentMessage{id: msg.MessageID})
+	if len(c.recent) > recentSize {
+		c.recent = c.recent[1:]
+	}
+	return nil, false
+}
+
+// serve passes the request to the handler and sends the response
+func (c *Client) serve(handler Handler, req *Message) {
+	resp := handler(req)
+	if resp == nil {
+		resp = &Message{Code: NotFound}
+	}
+	resp = resp.clone()
+	if err := c.splitBlock2(req, resp); err != nil {
+		resp = &Message{Code: BadOption}
+	}
+	resp.Token = req.Token
+	if req.Type == Confirmable {
+		resp.Type = Acknowledgement
+		resp.MessageID = req.MessageID
+	} else {
+		resp.Type = NonConfirmable
+		c.mu.Lock()
+		c.messageID++
+		resp.MessageID = c.messageID
+		c.mu.Unlock()
+	}
+
+	data, err := resp.Marshal()
+	if err != nil {
+		log.Printf("Error encoding CoAP response: %v", err)
+		return
+	}
+	if req.Type == Confirmable {
+		c.mu.Lock()
+		for i := range c.recent {
+			if c.recent[i].id == req.MessageID {
+				c.recent[i].reply = data
+			}
+		}
+		c.mu.Unlock()
+	}
+	if _, err := c.conn.WriteTo(data, c.remote); err != nil {
+		log.Printf("Error sending CoAP response: %v", err)
+	}
+}
+
+// splitBlock2 replaces the payload of a response that doesn't fit the
+// block size with the block the server asked for. The server asks for the
+// following blocks with the Block2 option.
+func (c *Client) splitBlock2(req *Message, resp *Message) error {
+	size := c.blockSize
+	offset := 0
+	block, ok, err := req.Block(Block2)
+	if err != nil {
+		return err
+	}
+	if ok {
+		offset = block.Offset()
+		if block.Size < size {
+			size = block.Size
+		}
+	}
+	if offset == 0 && len(resp.Payload) <= size {
+		return nil
+	}
+	if offset >= len(resp.Payload) {
+		return errors.New("block is beyond the end of the response")
+	}
+
+	total := len(resp.Payload)
+	end := offset + size
+	if end > total {
+		end = total
+	}
+	resp.Payload = resp.Payload[offset:end]
+	if offset == 0 {
+		resp.SetUint(Size2, uint32(total))
+	}
+	return resp.SetBlock(Block2, Block{Num: uint32(offset / size), More: end < total, Size: size})
+}
+
+// reply sends an empty acknowledgement or reset for the message ID
+func (c *Client) reply(t Type, messageID uint16) {
+	msg := &Message{Type: t, Code: Empty, MessageID: messageID}
+	data, err := msg.Marshal()
+	if err != nil {
+		return
+	}
+	if _, err := c.conn.WriteTo(data, c.remote); err != nil {
+		log.Printf("Error sending CoAP %s: %v", t, err)
+	}
+}
+
+// newToken returns a random token
+func newToken() []byte {
+	token := make([]byte, tokenLength)
+	rand.Read(token)
+	return token
+}
+
+// clone returns a copy of the message. The option values and payload are
+// shared.
+func (m *Message) clone() *Message {
+	ret := *m
+	ret.Options = append([]Option(nil), m.Options...)
+	return &ret
+}
@@ -0,0 +1,329 @@
+package coap_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lab5e/at"
+	"github.com/lab5e/at/coap"
+)
+
+// datagram is a packet in flight between the ends of a pipe
+type datagram struct {
+	data []byte
+	from net.Addr
+}
+
+// pipeConn is one end of an in-memory packet connection pair
+type pipeConn struct {
+	addr net.Addr
+	peer *pipeConn
+	in   chan datagram
+
+	mu sync.Mutex
+	// drop returns true for the packets from this end that are lost
+	drop   func(data []byte) bool
+	writes []time.Time
+
+	closed chan struct{}
+	once   sync.Once
+}
+
+// newPipe returns a connected client and server pair
+func newPipe() (*pipeConn, *pipeConn) {
+	client := &pipeConn{
+		addr:   &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: coap.DefaultLocalPort},
+		in:     make(chan datagram, 64),
+		closed: make(chan struct{}),
+	}
+	server := &pipeConn{
+		addr:   &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: coap.DefaultPort},
+		in:     make(chan datagram, 64),
+		closed: make(chan struct{}),
+	}
+	client.peer, server.peer = server, client
+	return client, server
+}
+
+func (p *pipeConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case d := <-p.in:
+		return copy(b, d.data), d.from, nil
+	case <-p.closed:
+		return 0, nil, at.ErrClosed
+	}
+}
+
+func (p *pipeConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	p.mu.Lock()
+	p.writes = append(p.writes, time.Now())
+	lost := p.drop != nil && p.drop(b)
+	p.mu.Unlock()
+	if lost {
+		return len(b), nil
+	}
+	select {
+	case p.peer.in <- datagram{data: append([]byte(nil), b...), from: p.addr}:
+	case <-p.closed:
+		return 0, at.ErrClosed
+	}
+	return len(b), nil
+}
+
+func (p *pipeConn) Close() error {
+	p.once.Do(func() { close(p.closed) })
+	return nil
+}
+
+func (p *pipeConn) LocalAddr() net.Addr                { return p.addr }
+func (p *pipeConn) SetDeadline(t time.Time) error      { return nil }
+func (p *pipeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (p *pipeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// writeTimes returns the time of each write
+func (p *pipeConn) writeTimes() []time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]time.Time(nil), p.writes...)
+}
+
+// server is the server end of a pipe
+type server struct {
+	t    *testing.T
+	conn *pipeConn
+}
+
+// newClient creates a client talking to a server stand-in through a pipe
+func newClient(t *testing.T, opts *coap.Options) (*coap.Client, *pipeConn, *server) {
+	clientConn, serverConn := newPipe()
+	client := coap.NewClient(clientConn, serverConn.addr, opts)
+	t.Cleanup(func() {
+		client.Close()
+		serverConn.Close()
+	})
+	return client, clientConn, &server{t: t, conn: serverConn}
+}
+
+// receive waits for a message from the client
+func (s *server) receive() *coap.Message {
+	s.t.Helper()
+	select {
+	case d := <-s.conn.in:
+		msg, err := coap.Unmarshal(d.data)
+		if err != nil {
+			s.t.Fatalf("Invalid message from the client: %v", err)
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		s.t.Fatal("No message from the client")
+		return nil
+	}
+}
+
+// expectNone checks that the client doesn't send anything
+func (s *server) expectNone() {
+	s.t.Helper()
+	select {
+	case d := <-s.conn.in:
+		msg, _ := coap.Unmarshal(d.data)
+		s.t.Fatalf("Unexpected message from the client: %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// send sends the message to the client
+func (s *server) send(msg *coap.Message) {
+	s.t.Helper()
+	data, err := msg.Marshal()
+	if err != nil {
+		s.t.Fatalf("Could not encode message: %v", err)
+	}
+	if _, err := s.conn.WriteTo(data, s.conn.peer.addr); err != nil {
+		s.t.Fatalf("Could not send message: %v", err)
+	}
+}
+
+// get runs a GET request in the background
+func get(client *coap.Client, path string) (<-chan *coap.Message, <-chan error) {
+	responses := make(chan *coap.Message, 1)
+	errs := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		resp, err := client.Get(ctx, path)
+		responses <- resp
+		errs <- err
+	}()
+	return responses, errs
+}
+
+// response waits for the result of get
+func response(t *testing.T, responses <-chan *coap.Message, errs <-chan error) *coap.Message {
+	t.Helper()
+	select {
+	case resp := <-responses:
+		if err := <-errs; err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		return resp
+	case <-time.After(10 * time.Second):
+		t.Fatal("No response")
+		return nil
+	}
+}
+
+func TestRetransmission(t *testing.T) {
+	const ackTimeout = 50 * time.Millisecond
+	client, clientConn, s := newClient(t, &coap.Options{AckTimeout: ackTimeout})
+
+	// The first transmission is lost and the server ignores the second
+	lost := 0
+	clientConn.drop = func([]byte) bool {
+		lost++
+		return lost == 1
+	}
+	responses, errs := get(client, "/temp")
+	first := s.receive()
+	second := s.receive()
+	if first.MessageID != second.MessageID || !bytes.Equal(first.Token, second.Token) {
+		t.Fatalf("Retransmissions have another message ID or token: %+v %+v", first, second)
+	}
+	s.send(&coap.Message{Type: coap.Acknowledgement, Code: coap.Content, MessageID: second.MessageID, Token: second.Token, Payload: []byte("21.5")})
+	if resp := response(t, responses, errs); string(resp.Payload) != "21.5" {
+		t.Fatalf("Unexpected response: %q", resp.Payload)
+	}
+
+	// The first timeout is between the ACK timeout and 1.5 times that
+	// and it doubles for each retransmission
+	writes := clientConn.writeTimes()
+	if len(writes) != 3 {
+		t.Fatalf("Expected 3 transmissions, got %d", len(writes))
+	}
+	gap1, gap2 := writes[1].Sub(writes[0]), writes[2].Sub(writes[1])
+	if gap1 < ackTimeout || gap1 > ackTimeout*3/2+50*time.Millisecond {
+		t.Fatalf("Expected the first retransmission after 50-75ms, got %v", gap1)
+	}
+	if gap2 < 2*gap1-10*time.Millisecond || gap2 > 2*gap1+50*time.Millisecond {
+		t.Fatalf("Expected the timeout to double from %v, got %v", gap1, gap2)
+	}
+}
+
+func TestRetransmissionTimeout(t *testing.T) {
+	client, clientConn, s := newClient(t, &coap.Options{AckTimeout: 10 * time.Millisecond, MaxRetransmit: 2})
+	clientConn.drop = func([]byte) bool { return true }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.Get(ctx, "/temp"); err != coap.ErrTimeout {
+		t.Fatalf("Expected a timeout, got %v", err)
+	}
+	if writes := clientConn.writeTimes(); len(writes) != 3 {
+		t.Fatalf("Expected the request and 2 retransmissions, got %d", len(writes))
+	}
+	s.expectNone()
+}
+
+func TestDuplicateAck(t *testing.T) {
+	client, _, s := newClient(t, &coap.Options{AckTimeout: time.Second})
+
+	// Separate response: an empty ACK, sent twice, and then the response
+	// which is retransmitted as well
+	responses, errs := get(client, "/temp")
+	req := s.receive()
+	ack := &coap.Message{Type: coap.Acknowledgement, Code: coap.Empty, MessageID: req.MessageID}
+	s.send(ack)
+	s.send(ack)
+	separate := &coap.Message{Type: coap.Confirmable, Code: coap.Content, MessageID: 1000, Token: req.Token, Payload: []byte("21.5")}
+	s.send(separate)
+	if resp := response(t, responses, errs); string(resp.Payload) != "21.5" {
+		t.Fatalf("Unexpected response: %q", resp.Payload)
+	}
+	if reply := s.receive(); reply.Type != coap.Acknowledgement || reply.MessageID != 1000 {
+		t.Fatalf("Expected the response to be acknowledged, got %+v", reply)
+	}
+	// The retransmitted response is acknowledged again and nothing else
+	s.send(separate)
+	if reply := s.receive(); reply.Type != coap.Acknowledgement || reply.MessageID != 1000 {
+		t.Fatalf("Expected the retransmission to be acknowledged, got %+v", reply)
+	}
+
+	// A late copy of the old ACK doesn't answer the next request
+	responses, errs = get(client, "/humidity")
+	next := s.receive()
+	s.send(&coap.Message{Type: coap.Acknowledgement, Code: coap.Content, MessageID: req.MessageID, Token: req.Token, Payload: []byte("old")})
+	s.send(&coap.Message{Type: coap.Acknowledgement, Code: coap.Content, MessageID: next.MessageID, Token: next.Token, Payload: []byte("45")})
+	if resp := response(t, responses, errs); string(resp.Payload) != "45" {
+		t.Fatalf("Unexpected response: %q", resp.Payload)
+	}
+	s.expectNone()
+}
+
+func TestBlock2(t *testing.T) {
+	const blockSize = 16
+	client, _, s := newClient(t, &coap.Options{BlockSize: blockSize})
+	body := []byte("The resource is larger than three blocks of 16 bytes")
+	etag := []byte{1, 2, 3, 4}
+
+	responses, errs := get(client, "/large")
+	var token []byte
+	for num := 0; num*blockSize < len(body); num++ {
+		req := s.receive()
+		block, ok, err := req.Block(coap.Block2)
+		if err != nil || !ok || int(block.Num) != num || block.Size != blockSize {
+			t.Fatalf("Expected a request for block %d of %d bytes, got %+v %v %v", num, blockSize, block, ok, err)
+		}
+		if req.Path() != "large" {
+			t.Fatalf("Unexpected path in block request: %s", req.Path())
+		}
+		if bytes.Equal(req.Token, token) {
+			t.Fatal("The token is reused for the next block")
+		}
+		token = req.Token
+
+		end := (num + 1) * blockSize
+		if end > len(body) {
+			end = len(body)
+		}
+		resp := &coap.Message{Type: coap.Acknowledgement, Code: coap.Content, MessageID: req.MessageID, Token: req.Token, Payload: body[num*blockSize : end]}
+		resp.AddOption(coap.ETag, etag)
+		if err := resp.SetBlock(coap.Block2, coap.Block{Num: uint32(num), More: end < len(body), Size: blockSize}); err != nil {
+			t.Fatalf("Could not set block: %v", err)
+		}
+		s.send(resp)
+	}
+
+	resp := response(t, responses, errs)
+	if !bytes.Equal(resp.Payload, body) {
+		t.Fatalf("Unexpected payload: %q", resp.Payload)
+	}
+	if resp.HasOption(coap.Block2) {
+		t.Fatal("The reassembled response has a Block2 option")
+	}
+}
+
+func TestMatching(t *testing.T) {
+	client, _, s := newClient(t, &coap.Options{AckTimeout: time.Second})
+
+	responses, errs := get(client, "/temp")
+	req := s.receive()
+
+	// An ACK for another message ID is ignored
+	s.send(&coap.Message{Type: coap.Acknowledgement, Code: coap.Content, MessageID: req.MessageID + 1, Token: req.Token, Payload: []byte("wrong ID")})
+	// A response with an unknown token is rejected
+	s.send(&coap.Message{Type: coap.Confirmable, Code: coap.Content, MessageID: 2000, Token: []byte("nope"), Payload: []byte("wrong token")})
+	if reply := s.receive(); reply.Type != coap.Reset || reply.MessageID != 2000 {
+		t.Fatalf("Expected the unknown token to be reset, got %+v", reply)
+	}
+
+	// The separate response is matched on the token
+	s.send(&coap.Message{Type: coap.Acknowledgement, Code: coap.Empty, MessageID: req.MessageID})
+	s.send(&coap.Message{Type: coap.NonConfirmable, Code: coap.Content, MessageID: 2001, Token: req.Token, Payload: []byte("21.5")})
+	if resp := response(t, responses, errs); string(resp.Payload) != "21.5" {
+		t.Fatalf("Unexpected response: %q", resp.Payload)
+	}
+	s.expectNone()
+}
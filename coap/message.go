@@ -0,0 +1,416 @@
+package coap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Type is the message type
+type Type uint8
+
+// Message types
+const (
+	Confirmable     Type = 0
+	NonConfirmable  Type = 1
+	Acknowledgement Type = 2
+	Reset           Type = 3
+)
+
+func (t Type) String() string {
+	switch t {
+	case Confirmable:
+		return "CON"
+	case NonConfirmable:
+		return "NON"
+	case Acknowledgement:
+		return "ACK"
+	case Reset:
+		return "RST"
+	default:
+		return "unknown"
+	}
+}
+
+// Code is the request method or response code. The upper three bits are
+// the class and the lower five bits the detail, ie 2.05 is 69.
+type Code uint8
+
+// Request methods
+const (
+	Empty  Code = 0
+	GET    Code = 1
+	POST   Code = 2
+	PUT    Code = 3
+	DELETE Code = 4
+)
+
+// Response codes
+const (
+	Created                 Code = 65  // 2.01
+	Deleted                 Code = 66  // 2.02
+	Valid                   Code = 67  // 2.03
+	Changed                 Code = 68  // 2.04
+	Content                 Code = 69  // 2.05
+	Continue                Code = 95  // 2.31
+	BadRequest              Code = 128 // 4.00
+	Unauthorized            Code = 129 // 4.01
+	BadOption               Code = 130 // 4.02
+	Forbidden               Code = 131 // 4.03
+	NotFound                Code = 132 // 4.04
+	MethodNotAllowed        Code = 133 // 4.05
+	NotAcceptable           Code = 134 // 4.06
+	RequestEntityIncomplete Code = 136 // 4.08
+	RequestEntityTooLarge   Code = 141 // 4.13
+	UnsupportedFormat       Code = 143 // 4.15
+	InternalServerError     Code = 160 // 5.00
+	NotImplemented          Code = 161 // 5.01
+	ServiceUnavailable      Code = 163 // 5.03
+)
+
+// Class returns the class of the code, ie 2 for 2.05
+func (c Code) Class() int {
+	return int(c >> 5)
+}
+
+// IsSuccess returns true for 2.xx codes
+func (c Code) IsSuccess() bool {
+	return c.Class() == 2
+}
+
+func (c Code) String() string {
+	return fmt.Sprintf("%d.%02d", c>>5, c&0x1f)
+}
+
+// OptionNumber identifies an option
+type OptionNumber uint16
+
+// Options defined in RFC 7252, RFC 7641 and RFC 7959
+const (
+	IfMatch       OptionNumber = 1
+	URIHost       OptionNumber = 3
+	ETag          OptionNumber = 4
+	IfNoneMatch   OptionNumber = 5
+	Observe       OptionNumber = 6
+	URIPort       OptionNumber = 7
+	LocationPath  OptionNumber = 8
+	URIPath       OptionNumber = 11
+	ContentFormat OptionNumber = 12
+	MaxAge        OptionNumber = 14
+	URIQuery      OptionNumber = 15
+	Accept        OptionNumber = 17
+	LocationQuery OptionNumber = 20
+	Block2        OptionNumber = 23
+	Block1        OptionNumber = 27
+	Size2         OptionNumber = 28
+	ProxyURI      OptionNumber = 35
+	ProxyScheme   OptionNumber = 39
+	Size1         OptionNumber = 60
+)
+
+// MediaType is the value of the Content-Format and Accept options
+type MediaType uint16
+
+// Common media types
+const (
+	TextPlain     MediaType = 0
+	AppLinkFormat MediaType = 40
+	AppXML        MediaType = 41
+	AppOctets     MediaType = 42
+	AppJSON       MediaType = 50
+	AppCBOR       MediaType = 60
+	AppSenMLJSON  MediaType = 110
+	AppSenMLCBOR  MediaType = 112
+	AppLwM2MTLV   MediaType = 11542
+	AppLwM2MJSON  MediaType = 11543
+)
+
+// Option is a message option
+type Option struct {
+	Number OptionNumber
+	Value  []byte
+}
+
+// Message is a CoAP message
+type Message struct {
+	Type      Type
+	Code      Code
+	MessageID uint16
+	Token     []byte
+	Options   []Option
+	Payload   []byte
+}
+
+var errShortMessage = errors.New("message is too short")
+
+// payloadMarker separates the options from the payload
+const payloadMarker = 0xff
+
+// Marshal encodes the message
+func (m *Message) Marshal() ([]byte, error) {
+	if len(m.Token) > 8 {
+		return nil, errors.New("token is longer than 8 bytes")
+	}
+
+	buf := make([]byte, 4, 4+len(m.Token)+len(m.Payload)+32)
+	buf[0] = 1<<6 | byte(m.Type)<<4 | byte(len(m.Token))
+	buf[1] = byte(m.Code)
+	binary.BigEndian.PutUint16(buf[2:], m.MessageID)
+	buf = append(buf, m.Token...)
+
+	// Options are encoded in order as deltas from the previous option
+	options := make([]Option, len(m.Options))
+	copy(options, m.Options)
+	sort.SliceStable(options, func(i, j int) bool {
+		return options[i].Number < options[j].Number
+	})
+
+	prev := OptionNumber(0)
+	for _, o := range options {
+		delta := int(o.Number - prev)
+		prev = o.Number
+
+		deltaNibble, deltaExt := optionNibble(delta)
+		lengthNibble, lengthExt := optionNibble(len(o.Value))
+		buf = append(buf, byte(deltaNibble<<4|lengthNibble))
+		buf = append(buf, deltaExt...)
+		buf = append(buf, lengthExt...)
+		buf = append(buf, o.Value...)
+	}
+
+	if len(m.Payload) > 0 {
+		buf = append(buf, payloadMarker)
+		buf = append(buf, m.Payload...)
+	}
+	return buf, nil
+}
+
+// optionNibble returns the 4-bit value and extended bytes for an option
+// delta or length.
+func optionNibble(n int) (int, []byte) {
+	switch {
+	case n < 13:
+		return n, nil
+	case n < 269:
+		return 13, []byte{byte(n - 13)}
+	default:
+		ext := make([]byte, 2)
+		binary.BigEndian.PutUint16(ext, uint16(n-269))
+		return 14, ext
+	}
+}
+
+// Unmarshal decodes a message
+func Unmarshal(data []byte) (*Message, error) {
+	if len(data) < 4 {
+		return nil, errShortMessage
+	}
+	if data[0]>>6 != 1 {
+		return nil, errors.New("unsupported CoAP version")
+	}
+
+	m := &Message{
+		Type:      Type(data[0] >> 4 & 0x03),
+		Code:      Code(data[1]),
+		MessageID: binary.BigEndian.Uint16(data[2:]),
+	}
+
+	tokenLength := int(data[0] & 0x0f)
+	if tokenLength > 8 {
+		return nil, errors.New("invalid token length")
+	}
+	data = data[4:]
+	if len(data) < tokenLength {
+		return nil, errShortMessage
+	}
+	m.Token = append([]byte(nil), data[:tokenLength]...)
+	data = data[tokenLength:]
+
+	prev := 0
+	for len(data) > 0 {
+		if data[0] == payloadMarker {
+			if len(data) == 1 {
+				return nil, errors.New("payload marker without payload")
+			}
+			m.Payload = append([]byte(nil), data[1:]...)
+			break
+		}
+
+		deltaNibble := int(data[0] >> 4)
+		lengthNibble := int(data[0] & 0x0f)
+		data = data[1:]
+
+		var delta, length int
+		var err error
+		if delta, data, err = optionValue(deltaNibble, data); err != nil {
+			return nil, err
+		}
+		if length, data, err = optionValue(lengthNibble, data); err != nil {
+			return nil, err
+		}
+		if len(data) < length {
+			return nil, errShortMessage
+		}
+
+		prev += delta
+		m.Options = append(m.Options, Option{
+			Number: OptionNumber(prev),
+			Value:  append([]byte(nil), data[:length]...),
+		})
+		data = data[length:]
+	}
+
+	return m, nil
+}
+
+// optionValue decodes an option delta or length from the nibble and the
+// extended bytes.
+func optionValue(nibble int, data []byte) (int, []byte, error) {
+	switch nibble {
+	case 13:
+		if len(data) < 1 {
+			return 0, nil, errShortMessage
+		}
+		return int(data[0]) + 13, data[1:], nil
+	case 14:
+		if len(data) < 2 {
+			return 0, nil, errShortMessage
+		}
+		return int(binary.BigEndian.Uint16(data)) + 269, data[2:], nil
+	case 15:
+		return 0, nil, errors.New("invalid option nibble")
+	default:
+		return nibble, data, nil
+	}
+}
+
+// Option returns the value of the first option with the number or nil if
+// there is none.
+func (m *Message) Option(number OptionNumber) []byte {
+	for _, o := range m.Options {
+		if o.Number == number {
+			return o.Value
+		}
+	}
+	return nil
+}
+
+// HasOption returns true if the message has the option
+func (m *Message) HasOption(number OptionNumber) bool {
+	for _, o := range m.Options {
+		if o.Number == number {
+			return true
+		}
+	}
+	return false
+}
+
+// AddOption adds an option
+func (m *Message) AddOption(number OptionNumber, value []byte) {
+	m.Options = append(m.Options, Option{Number: number, Value: value})
+}
+
+// RemoveOption removes all options with the number
+func (m *Message) RemoveOption(number OptionNumber) {
+	options := m.Options[:0]
+	for _, o := range m.Options {
+		if o.Number != number {
+			options = append(options, o)
+		}
+	}
+	m.Options = options
+}
+
+// SetUint replaces the option with an unsigned integer value
+func (m *Message) SetUint(number OptionNumber, value uint32) {
+	m.RemoveOption(number)
+	m.AddOption(number, encodeUint(value))
+}
+
+// Uint returns the value of an unsigned integer option and whether the
+// option was present.
+func (m *Message) Uint(number OptionNumber) (uint32, bool) {
+	for _, o := range m.Options {
+		if o.Number == number {
+			return decodeUint(o.Value), true
+		}
+	}
+	return 0, false
+}
+
+// SetPath replaces the Uri-Path options with the segments of the path
+func (m *Message) SetPath(path string) {
+	m.RemoveOption(URIPath)
+	for _, segment := range strings.Split(strings.Trim(path, "/"), "/") {
+		if segment != "" {
+			m.AddOption(URIPath, []byte(segment))
+		}
+	}
+}
+
+// Path returns the Uri-Path options joined by slashes
+func (m *Message) Path() string {
+	return joinOptions(m, URIPath, "/")
+}
+
+// AddQuery adds an Uri-Query option
+func (m *Message) AddQuery(query string) {
+	m.AddOption(URIQuery, []byte(query))
+}
+
+// Queries returns the Uri-Query options
+func (m *Message) Queries() []string {
+	var ret []string
+	for _, o := range m.Options {
+		if o.Number == URIQuery {
+			ret = append(ret, string(o.Value))
+		}
+	}
+	return ret
+}
+
+// LocationPath returns the Location-Path options joined by slashes
+func (m *Message) LocationPath() string {
+	return joinOptions(m, LocationPath, "/")
+}
+
+// SetContentFormat sets the Content-Format option
+func (m *Message) SetContentFormat(mediaType MediaType) {
+	m.SetUint(ContentFormat, uint32(mediaType))
+}
+
+func joinOptions(m *Message, number OptionNumber, sep string) string {
+	var parts []string
+	for _, o := range m.Options {
+		if o.Number == number {
+			parts = append(parts, string(o.Value))
+		}
+	}
+	return strings.Join(parts, sep)
+}
+
+// encodeUint encodes the value with as few bytes as possible
+func encodeUint(v uint32) []byte {
+	switch {
+	case v == 0:
+		return []byte{}
+	case v < 1<<8:
+		return []byte{byte(v)}
+	case v < 1<<16:
+		return []byte{byte(v >> 8), byte(v)}
+	case v < 1<<24:
+		return []byte{byte(v >> 16), byte(v >> 8), byte(v)}
+	default:
+		return []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+	}
+}
+
+func decodeUint(b []byte) uint32 {
+	var v uint32
+	for _, c := range b {
+		v = v<<8 | uint32(c)
+	}
+	return v
+}
@@ -0,0 +1,190 @@
+package coap
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// notificationQueueSize is the number of notifications an observation
+// buffers before it starts dropping them
+const notificationQueueSize = 8
+
+// observeFreshness is how long until a notification is considered fresh
+// regardless of the sequence number (section 3.4 of RFC 7641)
+const observeFreshness = 128 * time.Second
+
+// Observation is an observed resource. Notifications are passed to the
+// handler in order.
+type Observation struct {
+	c     *Client
+	req   *Message
+	fn    func(*Message)
+	first chan *Message
+	queue chan *Message
+	done  chan struct{}
+	once  sync.Once
+
+	mu          sync.Mutex
+	established bool
+	seq         uint32
+	received    time.Time
+}
+
+// Observe registers an observation of the resource. The handler is called
+// with the current state and with every notification from the server. The
+// handler is called a final time if the server ends the observation with
+// an error code. It returns ErrNotObservable if the server doesn't support
+// observing the resource.
+func (c *Client) Observe(ctx context.Context, path string, fn func(*Message)) (*Observation, error) {
+	req := NewRequest(GET, path)
+	if c.nonConfirmable {
+		req.Type = NonConfirmable
+	}
+	req.Token = newToken()
+	req.SetUint(Observe, 0)
+
+	o := &Observation{
+		c:     c,
+		req:   req,
+		fn:    fn,
+		first: make(chan *Message, 1),
+		queue: make(chan *Message, notificationQueueSize),
+		done:  make(chan struct{}),
+	}
+
+	c.mu.Lock()
+	c.observers[string(req.Token)] = o
+	c.mu.Unlock()
+
+	resp, err := c.transmit(ctx, req.clone(), o.first)
+	if err != nil {
+		o.end()
+		return nil, err
+	}
+	if !resp.Code.IsSuccess() {
+		o.end()
+		return nil, fmt.Errorf("observe failed with code %s", resp.Code)
+	}
+	if !resp.HasOption(Observe) {
+		o.end()
+		return nil, ErrNotObservable
+	}
+
+	go o.run()
+	o.mu.Lock()
+	o.established = true
+	o.mu.Unlock()
+	o.notify(resp)
+	return o, nil
+}
+
+// Done returns a channel that is closed when the observation ends
+func (o *Observation) Done() <-chan struct{} {
+	return o.done
+}
+
+// Cancel ends the observation and tells the server to stop sending
+// notifications.
+func (o *Observation) Cancel(ctx context.Context) error {
+	o.end()
+
+	req := o.req.clone()
+	req.SetUint(Observe, 1)
+	_, err := o.c.exchange(ctx, req)
+	return err
+}
+
+// end stops the observation without telling the server. Later
+// notifications are rejected with a reset.
+func (o *Observation) end() {
+	o.once.Do(func() {
+		o.c.mu.Lock()
+		delete(o.c.observers, string(o.req.Token))
+		o.c.mu.Unlock()
+		close(o.done)
+	})
+}
+
+// receive is called by the client with messages that match the token
+func (o *Observation) receive(msg *Message) {
+	o.mu.Lock()
+	established := o.established
+	o.mu.Unlock()
+
+	if !established {
+		select {
+		case o.first <- msg:
+		default:
+		}
+		return
+	}
+	o.notify(msg)
+}
+
+// notify queues the notification if it is newer than the last one
+func (o *Observation) notify(msg *Message) {
+	final := !msg.Code.IsSuccess() || !msg.HasOption(Observe)
+	if !final {
+		seq, _ := msg.Uint(Observe)
+		now := time.Now()
+
+		o.mu.Lock()
+		fresh := o.received.IsZero() ||
+			(o.seq < seq && seq-o.seq < 1<<23) ||
+			(o.seq > seq && o.seq-seq > 1<<23) ||
+			now.After(o.received.Add(observeFreshness))
+		if fresh {
+			o.seq = seq
+			o.received = now
+		}
+		o.mu.Unlock()
+
+		if !fresh {
+			return
+		}
+	}
+
+	select {
+	case o.queue <- msg:
+	default:
+		log.Printf("Dropping CoAP notification for %s", o.req.Path())
+	}
+	if final {
+		o.end()
+	}
+}
+
+// run passes the notifications to the handler. Notifications that are
+// split into blocks are completed first.
+func (o *Observation) run() {
+	for {
+		select {
+		case msg := <-o.queue:
+			o.deliver(msg)
+		case <-o.done:
+			// Deliver the final notification if there is one
+			for {
+				select {
+				case msg := <-o.queue:
+					o.deliver(msg)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (o *Observation) deliver(msg *Message) {
+	req := o.req.clone()
+	req.RemoveOption(Observe)
+	msg, err := o.c.completeBlock2(context.Background(), req, msg)
+	if err != nil {
+		log.Printf("Error fetching CoAP notification for %s: %v", o.req.Path(), err)
+		return
+	}
+	o.fn(msg)
+}
@@ -0,0 +1,281 @@
+package at
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ConnPollInterval is how often a connection checks for data while a
+// reader is waiting, in case the device notification went missing.
+const ConnPollInterval = 5 * time.Second
+
+// DefaultMaxSendSize is the chunk size used for writes when the socket
+// doesn't report its maximum send size.
+const DefaultMaxSendSize = 512
+
+// MaxSendSizer is implemented by sockets that limit the amount of data
+// that can be sent with one command.
+type MaxSendSizer interface {
+	// MaxSendSize returns the maximum number of bytes per Send
+	MaxSendSize() int
+}
+
+// conn is a net.Conn on top of a TCP socket on the device
+type conn struct {
+	socket TCPSocket
+	local  net.Addr
+	remote net.Addr
+
+	readMu  sync.Mutex
+	pending []byte
+	writeMu sync.Mutex
+
+	// signal is poked when there is data or the state changes
+	signal chan struct{}
+	closed chan struct{}
+	once   sync.Once
+
+	mu              sync.Mutex
+	readDeadline    time.Time
+	writeDeadline   time.Time
+	deadlineChanged chan struct{}
+}
+
+// hostAddr is a net.Addr for addresses that are names rather than IP
+// addresses.
+type hostAddr string
+
+func (a hostAddr) Network() string { return "tcp" }
+func (a hostAddr) String() string  { return string(a) }
+
+// Dial connects to the address through the device and returns the
+// connection as a net.Conn. The network must be "tcp", "tcp4" or "tcp6"
+// and the device must implement TCPDialer. The signature matches
+// net.Dialer.DialContext so it can be plugged into ie http.Transport.
+func Dial(ctx context.Context, device Device, network, address string) (net.Conn, error) {
+	dialer, ok := device.(TCPDialer)
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("device does not support TCP")}
+	}
+	return dial(ctx, device, network, address, dialer.DialTCP)
+}
+
+// dial parses the address, opens the socket with fn and wraps it in a
+// net.Conn
+func dial(ctx context.Context, device Device, network, address string, fn func(ctx context.Context, host string, port int) (TCPSocket, error)) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	var remote net.Addr = hostAddr(address)
+	if ip := net.ParseIP(host); ip != nil {
+		remote = &net.TCPAddr{IP: ip, Port: port}
+	}
+
+	socket, err := fn(ctx, host, port)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: remote, Err: err}
+	}
+
+	local := &net.TCPAddr{}
+	if _, addr, err := device.GetAddr(); err == nil {
+		local.IP = net.ParseIP(addr)
+	}
+
+	return newConn(socket, local, remote), nil
+}
+
+func newConn(socket TCPSocket, local, remote net.Addr) *conn {
+	c := &conn{
+		socket:          socket,
+		local:           local,
+		remote:          remote,
+		signal:          make(chan struct{}, 1),
+		closed:          make(chan struct{}),
+		deadlineChanged: make(chan struct{}),
+	}
+	socket.OnData(c.poke)
+	socket.OnStateChange(func(ConnState) { c.poke() })
+	return c
+}
+
+// poke wakes up a waiting reader
+func (c *conn) poke() {
+	select {
+	case c.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Read reads the data that is available, waiting for data if there is
+// none. Read returns io.EOF when the remote end has closed the connection
+// and all data has been read.
+func (c *conn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	for {
+		if len(c.pending) > 0 {
+			n := copy(p, c.pending)
+			c.pending = c.pending[n:]
+			return n, nil
+		}
+
+		select {
+		case <-c.closed:
+			return 0, c.opError("read", ErrClosed)
+		default:
+		}
+
+		c.mu.Lock()
+		deadline := c.readDeadline
+		changed := c.deadlineChanged
+		c.mu.Unlock()
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, c.opError("read", os.ErrDeadlineExceeded)
+		}
+
+		// Check the state before reading so we don't miss data that
+		// arrived right before the connection was closed
+		state := c.socket.State()
+
+		length := len(p)
+		if length > ReceiveChunkSize {
+			length = ReceiveChunkSize
+		}
+		data, err := c.socket.Receive(length)
+		if err != nil {
+			return 0, c.opError("read", err)
+		}
+		if len(data) > 0 {
+			c.pending = data
+			continue
+		}
+		if state == ConnClosed {
+			return 0, io.EOF
+		}
+
+		timeout, stop := deadlineTimer(deadline)
+		select {
+		case <-c.signal:
+		case <-changed:
+		case <-c.closed:
+		case <-timeout:
+		case <-time.After(ConnPollInterval):
+		}
+		stop()
+	}
+}
+
+// Write writes the data in chunks no larger than the maximum send size of
+// the socket.
+func (c *conn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	chunkSize := DefaultMaxSendSize
+	if m, ok := c.socket.(MaxSendSizer); ok {
+		chunkSize = m.MaxSendSize()
+	}
+
+	written := 0
+	for written < len(p) {
+		select {
+		case <-c.closed:
+			return written, c.opError("write", ErrClosed)
+		default:
+		}
+
+		c.mu.Lock()
+		deadline := c.writeDeadline
+		c.mu.Unlock()
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return written, c.opError("write", os.ErrDeadlineExceeded)
+		}
+
+		chunk := p[written:]
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		n, err := c.socket.Send(chunk)
+		written += n
+		if err != nil {
+			return written, c.opError("write", err)
+		}
+		if n == 0 {
+			return written, c.opError("write", io.ErrShortWrite)
+		}
+	}
+	return written, nil
+}
+
+// Close closes the connection on the device
+func (c *conn) Close() error {
+	err := ErrClosed
+	c.once.Do(func() {
+		close(c.closed)
+		err = c.socket.Close()
+	})
+	return err
+}
+
+// LocalAddr returns the address the device has been allocated. The
+// local port isn't known.
+func (c *conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return c.SetReadDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	// Wake up any readers so they pick up the new deadline
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeDeadline = t
+	return nil
+}
+
+func (c *conn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "tcp", Source: c.local, Addr: c.remote, Err: err}
+}
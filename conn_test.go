@@ -0,0 +1,121 @@
+//go:build linux
+// +build linux
+
+package at_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lab5e/at"
+	"github.com/lab5e/at/internal/fakemodem"
+	"github.com/lab5e/at/nrf91"
+)
+
+// startNRF91 starts an nRF91 driver talking to a fake modem. The device is
+// closed when the test ends.
+func startNRF91(t *testing.T) (at.Device, *fakemodem.SLM) {
+	modem := fakemodem.NewSLM(t)
+	device := nrf91.New(modem.Path(), nrf91.DefaultBaudRate)
+	if err := device.Start(); err != nil {
+		t.Fatalf("Could not start device: %v", err)
+	}
+	t.Cleanup(device.Close)
+	return device, modem
+}
+
+// serveOnce accepts one connection and passes it to fn
+func serveOnce(t *testing.T, fn func(c *net.TCPConn)) string {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		fn(c.(*net.TCPConn))
+	}()
+	return l.Addr().String()
+}
+
+// dial connects through the device. Reads give up after the deadline so
+// a read that never ends fails the test.
+func dial(t *testing.T, device at.Device, address string) net.Conn {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := at.Dial(ctx, device, "tcp", address)
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	return c
+}
+
+func TestConnReadUntilClosed(t *testing.T) {
+	address := serveOnce(t, func(c *net.TCPConn) {
+		c.Write([]byte("hello"))
+		c.Close()
+	})
+
+	device, _ := startNRF91(t)
+	data, err := ioutil.ReadAll(dial(t, device, address))
+	if err != nil {
+		t.Fatalf("Expected EOF after the data, got %v", err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("Unexpected data: %q", data)
+	}
+}
+
+func TestConnBinaryData(t *testing.T) {
+	// Final result codes, URCs and bare line breaks in the data are
+	// data like everything else
+	payload := []byte("OK\r\n\r\nERROR\r\n#XAPOLL: 0,1\r\nbare\rcr and\nlf\r\n")
+	for i := 0; i < 256; i++ {
+		payload = append(payload, byte(i))
+	}
+	address := serveOnce(t, func(c *net.TCPConn) {
+		c.Write(payload)
+		c.Close()
+	})
+
+	device, _ := startNRF91(t)
+	data, err := ioutil.ReadAll(dial(t, device, address))
+	if err != nil {
+		t.Fatalf("Could not read: %v", err)
+	}
+	if !bytes.Equal(data, payload) {
+		t.Fatalf("Data doesn't match the payload:\n%q\n%q", data, payload)
+	}
+}
+
+func TestConnReset(t *testing.T) {
+	// The connection is reset once it is up since a reset while
+	// connecting fails the dial
+	dialed := make(chan struct{})
+	address := serveOnce(t, func(c *net.TCPConn) {
+		<-dialed
+		// Closing without linger resets the connection
+		c.SetLinger(0)
+		c.Close()
+	})
+
+	device, _ := startNRF91(t)
+	c := dial(t, device, address)
+	close(dialed)
+	_, err := ioutil.ReadAll(c)
+	if err == nil {
+		t.Fatal("Expected an error for a reset connection")
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("The read didn't end when the connection was reset: %v", err)
+	}
+}
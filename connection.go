@@ -0,0 +1,522 @@
+package at
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConnectionState is the state of the connection managed by a
+// ConnectionManager
+type ConnectionState int
+
+// Connection states. A connection moves through the states in order and
+// drops back when the module loses the network.
+const (
+	ConnectionOff ConnectionState = iota
+	ConnectionSearchingNetwork
+	ConnectionRegistered
+	ConnectionPDPActive
+	ConnectionReady
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case ConnectionOff:
+		return "off"
+	case ConnectionSearchingNetwork:
+		return "searching network"
+	case ConnectionRegistered:
+		return "registered"
+	case ConnectionPDPActive:
+		return "PDP context active"
+	case ConnectionReady:
+		return "ready"
+	default:
+		return "unknown"
+	}
+}
+
+// Connection manager defaults
+const (
+	DefaultConnectionPollInterval  = 10 * time.Second
+	DefaultConnectionAttachTimeout = 3 * time.Minute
+	DefaultConnectionMinBackoff    = 5 * time.Second
+	DefaultConnectionMaxBackoff    = 10 * time.Minute
+	DefaultConnectionRebootAfter   = 3
+)
+
+// ConnectionOptions are the options for NewConnectionManager
+type ConnectionOptions struct {
+	// APN is set on the module if the module uses another APN. The APN
+	// is left alone if it is empty.
+	APN string
+
+	// Socket turns on creation of an UDP socket on Port when the PDP
+	// context is active. The connection is ready when the socket is
+	// created.
+	Socket bool
+	Port   int
+
+	// PollInterval is the time between polls of the registration status
+	// and the address. The default is DefaultConnectionPollInterval.
+	PollInterval time.Duration
+
+	// AttachTimeout is the time the module gets to register and get an
+	// address before the manager starts over. The default is
+	// DefaultConnectionAttachTimeout.
+	AttachTimeout time.Duration
+
+	// MinBackoff and MaxBackoff bound the wait before the next attempt
+	// after a failure. The wait doubles with each failure in a row. The
+	// defaults are DefaultConnectionMinBackoff and
+	// DefaultConnectionMaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// RebootAfter is the number of failures in a row before the module is
+	// rebooted instead of turning the radio off and on. The radio is
+	// cycled if the device isn't a Rebooter. The default is
+	// DefaultConnectionRebootAfter.
+	RebootAfter int
+}
+
+// ConnectionEvent is a change of the connection state
+type ConnectionEvent struct {
+	Time     time.Time
+	Previous ConnectionState
+	State    ConnectionState
+	// Failures is the number of failed attempts in a row
+	Failures int
+	// Err is the reason the connection was lost or the attempt failed
+	Err error
+}
+
+// ErrAttachTimeout is published when the module doesn't register or get
+// an address within the attach timeout
+var ErrAttachTimeout = errors.New("timed out attaching to the network")
+
+// ErrRegistrationLost is published when the module loses the network
+var ErrRegistrationLost = errors.New("network registration lost")
+
+// ConnectionManager brings the device online and keeps it online. It
+// turns on the radio, waits for the module to register, sets the APN,
+// waits for an address and creates a socket. When the module loses the
+// network it waits for the module to register again and starts over with
+// a radio off and on cycle if it doesn't. Failed attempts are retried
+// with exponential backoff and the module is rebooted after repeated
+// failures.
+//
+// The registration status is polled and +CEREG URCs are turned on
+// (AT+CEREG=1) on every attempt for devices that implement Commander so
+// the manager reacts right away when the network is lost.
+type ConnectionManager struct {
+	device Device
+	opts   ConnectionOptions
+
+	mu          sync.Mutex
+	state       ConnectionState
+	failures    int
+	address     string
+	socket      int
+	subscribers map[int]chan ConnectionEvent
+	nextID      int
+	stop        chan struct{}
+	stopped     chan struct{}
+}
+
+// NewConnectionManager creates a connection manager for the device. Call
+// Start to connect.
+func NewConnectionManager(device Device, opts ConnectionOptions) *ConnectionManager {
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = DefaultConnectionPollInterval
+	}
+	if opts.AttachTimeout <= 0 {
+		opts.AttachTimeout = DefaultConnectionAttachTimeout
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = DefaultConnectionMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = DefaultConnectionMaxBackoff
+		if opts.MaxBackoff < opts.MinBackoff {
+			opts.MaxBackoff = opts.MinBackoff
+		}
+	}
+	if opts.RebootAfter <= 0 {
+		opts.RebootAfter = DefaultConnectionRebootAfter
+	}
+	return &ConnectionManager{
+		device:      device,
+		opts:        opts,
+		socket:      -1,
+		subscribers: make(map[int]chan ConnectionEvent),
+	}
+}
+
+// Start starts connecting in the background
+func (m *ConnectionManager) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stop != nil {
+		return
+	}
+	m.stop = make(chan struct{})
+	m.stopped = make(chan struct{})
+	go m.run(m.stop, m.stopped)
+}
+
+// Stop stops managing the connection, closes the socket and turns the
+// radio off
+func (m *ConnectionManager) Stop() {
+	m.mu.Lock()
+	stop, stopped := m.stop, m.stopped
+	m.stop, m.stopped = nil, nil
+	m.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-stopped
+
+	m.closeSocket()
+	if err := m.device.SetRadio(false); err != nil {
+		log.Printf("Error turning the radio off: %v", err)
+	}
+	m.setState(ConnectionOff, nil)
+}
+
+// State returns the current state
+func (m *ConnectionManager) State() ConnectionState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// Address returns the address of the device. It is empty unless the PDP
+// context is active.
+func (m *ConnectionManager) Address() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.address
+}
+
+// Socket returns the socket and true when the connection is ready and
+// the manager creates a socket
+func (m *ConnectionManager) Socket() (int, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.socket, m.state == ConnectionReady && m.socket >= 0
+}
+
+// Subscribe returns a channel that receives the state changes until the
+// returned function is called. Events are dropped if the channel buffer
+// is full.
+func (m *ConnectionManager) Subscribe(size int) (<-chan ConnectionEvent, func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := m.nextID
+	m.nextID++
+	ch := make(chan ConnectionEvent, size)
+	m.subscribers[id] = ch
+	return ch, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.subscribers, id)
+	}
+}
+
+// WaitReady waits until the connection is ready or the context is done
+func (m *ConnectionManager) WaitReady(ctx context.Context) error {
+	events, remove := m.Subscribe(8)
+	defer remove()
+
+	if m.State() == ConnectionReady {
+		return nil
+	}
+	for {
+		select {
+		case e := <-events:
+			if e.State == ConnectionReady {
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// setState changes the state and publishes the change if the state
+// changed or there is an error
+func (m *ConnectionManager) setState(state ConnectionState, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if state == m.state && err == nil {
+		return
+	}
+	if state < ConnectionPDPActive {
+		m.address = ""
+	}
+	e := ConnectionEvent{
+		Time:     time.Now(),
+		Previous: m.state,
+		State:    state,
+		Failures: m.failures,
+		Err:      err,
+	}
+	m.state = state
+	for _, ch := range m.subscribers {
+		select {
+		case ch <- e:
+		default:
+			log.Printf("Dropping connection event: subscriber is not keeping up")
+		}
+	}
+}
+
+// errStopped is returned by the steps when the manager is stopped
+var errStopped = errors.New("connection manager stopped")
+
+func (m *ConnectionManager) run(stop <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+
+	var urcs <-chan string
+	if c, ok := m.device.(Commander); ok {
+		var remove func()
+		urcs, remove = c.CommandInterface().Subscribe("+CEREG:", 16)
+		defer remove()
+	}
+
+	for {
+		err := m.connect(stop, urcs)
+		if err == errStopped {
+			return
+		}
+
+		m.mu.Lock()
+		m.failures++
+		failures := m.failures
+		m.mu.Unlock()
+
+		m.closeSocket()
+		m.recover(failures)
+		m.setState(ConnectionOff, err)
+
+		select {
+		case <-time.After(m.backoff(failures)):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// connect brings the connection up and keeps it up. It returns when an
+// attempt fails.
+func (m *ConnectionManager) connect(stop <-chan struct{}, urcs <-chan string) error {
+	if err := m.device.SetRadio(true); err != nil {
+		return err
+	}
+	// The URC setting is lost when the module reboots so it is set for
+	// every attempt
+	m.enableRegistrationURCs()
+	m.setState(ConnectionSearchingNetwork, nil)
+
+	for {
+		err := m.waitFor(stop, urcs, m.opts.AttachTimeout, m.registered, RegistrationStatus.Registered)
+		if err != nil {
+			return err
+		}
+		m.setState(ConnectionRegistered, nil)
+
+		if err := m.configureAPN(); err != nil {
+			return err
+		}
+		var addr string
+		err = m.waitFor(stop, nil, m.opts.AttachTimeout, func() (bool, error) {
+			var err error
+			_, addr, err = m.device.GetAddr()
+			return addr != "", err
+		}, nil)
+		if err != nil {
+			return err
+		}
+		m.mu.Lock()
+		m.address = addr
+		m.mu.Unlock()
+		m.setState(ConnectionPDPActive, nil)
+
+		if m.opts.Socket {
+			socket, err := m.device.CreateUDPSocket(m.opts.Port)
+			if err != nil {
+				return err
+			}
+			m.mu.Lock()
+			m.socket = socket
+			m.mu.Unlock()
+		}
+		m.mu.Lock()
+		m.failures = 0
+		m.mu.Unlock()
+		m.setState(ConnectionReady, nil)
+
+		// Wait until the network is lost and give the module the attach
+		// timeout to register again
+		err = m.waitFor(stop, urcs, 0, func() (bool, error) {
+			registered, err := m.registered()
+			return !registered && err == nil, err
+		}, func(status RegistrationStatus) bool {
+			return !status.Registered()
+		})
+		if err != nil {
+			return err
+		}
+		m.closeSocket()
+		m.setState(ConnectionSearchingNetwork, ErrRegistrationLost)
+	}
+}
+
+// waitFor polls check until it returns true or a +CEREG URC arrives with
+// a status urc returns true for. check is called right away and every
+// poll interval. URCs don't trigger polls since the module may send a URC
+// in the response to the poll. Errors from check are logged and the check
+// is retried. The timeout is ignored if it is zero.
+func (m *ConnectionManager) waitFor(stop <-chan struct{}, urcs <-chan string, timeout time.Duration, check func() (bool, error), urc func(RegistrationStatus) bool) error {
+	ticker := time.NewTicker(m.opts.PollInterval)
+	defer ticker.Stop()
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		ok, err := check()
+		if err != nil {
+			log.Printf("Error polling the connection state: %v", err)
+		}
+		if ok {
+			return nil
+		}
+
+	wait:
+		for {
+			select {
+			case s := <-urcs:
+				// Responses to AT+CEREG? are seen here too
+				if status, ok := parseRegistrationURC(s); ok && urc != nil && urc(status) {
+					return nil
+				}
+			case <-ticker.C:
+				break wait
+			case <-deadline:
+				return ErrAttachTimeout
+			case <-stop:
+				return errStopped
+			}
+		}
+	}
+}
+
+// parseRegistrationURC returns the status in a +CEREG URC. It returns
+// false for other lines.
+func parseRegistrationURC(s string) (RegistrationStatus, bool) {
+	if !IsRegistrationURC(s) {
+		return RegistrationUnknown, false
+	}
+	fields := strings.Split(strings.TrimPrefix(s, "+CEREG:"), ",")
+	stat, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+	if err != nil {
+		return RegistrationUnknown, false
+	}
+	return RegistrationStatus(stat), true
+}
+
+// registered reports whether the module is registered. Devices that don't
+// report the registration status are registered when they have an
+// address.
+func (m *ConnectionManager) registered() (bool, error) {
+	if rr, ok := m.device.(RegistrationReader); ok {
+		status, err := rr.GetRegistration()
+		return status.Registered(), err
+	}
+	_, addr, err := m.device.GetAddr()
+	return addr != "", err
+}
+
+// enableRegistrationURCs turns on the +CEREG URCs for devices that
+// implement Commander
+func (m *ConnectionManager) enableRegistrationURCs() {
+	if c, ok := m.device.(Commander); ok {
+		if err := c.CommandInterface().Transact("AT+CEREG=1", nil); err != nil {
+			log.Printf("Could not turn on registration URCs: %v", err)
+		}
+	}
+}
+
+// configureAPN sets the APN if the module uses another APN. Some modules
+// reboot to change the APN so the registration URCs are turned on again
+// afterwards.
+func (m *ConnectionManager) configureAPN() error {
+	if m.opts.APN == "" {
+		return nil
+	}
+	apn, err := m.device.GetAPN()
+	if err == nil && strings.EqualFold(apn.Name, m.opts.APN) {
+		return nil
+	}
+	if err := m.device.SetAPN(m.opts.APN); err != nil {
+		return err
+	}
+	m.enableRegistrationURCs()
+	return nil
+}
+
+// recover turns the radio off or reboots the module after a failure
+func (m *ConnectionManager) recover(failures int) {
+	if r, ok := m.device.(Rebooter); ok && failures >= m.opts.RebootAfter {
+		log.Printf("Rebooting the module after %d failed connection attempts", failures)
+		if err := r.Reboot(); err != nil {
+			log.Printf("Error rebooting the module: %v", err)
+		}
+		return
+	}
+	if err := m.device.SetRadio(false); err != nil {
+		log.Printf("Error turning the radio off: %v", err)
+	}
+}
+
+// backoff returns the wait before the next attempt
+func (m *ConnectionManager) backoff(failures int) time.Duration {
+	d := m.opts.MinBackoff
+	for i := 1; i < failures && d < m.opts.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > m.opts.MaxBackoff {
+		d = m.opts.MaxBackoff
+	}
+	return d
+}
+
+// closeSocket closes the socket if there is one
+func (m *ConnectionManager) closeSocket() {
+	m.mu.Lock()
+	socket := m.socket
+	m.socket = -1
+	m.mu.Unlock()
+
+	if socket < 0 {
+		return
+	}
+	if err := m.device.CloseUDPSocket(socket); err != nil {
+		log.Printf("Error closing socket %d: %v", socket, err)
+	}
+}
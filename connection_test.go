@@ -0,0 +1,177 @@
+//go:build linux
+// +build linux
+
+package at_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lab5e/at"
+	"github.com/lab5e/at/internal/fakemodem"
+	"github.com/lab5e/at/n211"
+)
+
+// manage starts a connection manager for the device. The manager is
+// stopped when the test ends.
+func manage(t *testing.T, device at.Device, opts at.ConnectionOptions) (*at.ConnectionManager, <-chan at.ConnectionEvent) {
+	m := at.NewConnectionManager(device, opts)
+	events, remove := m.Subscribe(64)
+	m.Start()
+	t.Cleanup(func() {
+		m.Stop()
+		remove()
+	})
+	return m, events
+}
+
+// waitState waits for an event with the state
+func waitState(t *testing.T, events <-chan at.ConnectionEvent, state at.ConnectionState) at.ConnectionEvent {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.State == state {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("The connection didn't become %s", state)
+		}
+	}
+}
+
+// filterCommands returns the commands that are in cmds
+func filterCommands(commands []string, cmds ...string) []string {
+	var ret []string
+	for _, c := range commands {
+		for _, cmd := range cmds {
+			if c == cmd {
+				ret = append(ret, c)
+			}
+		}
+	}
+	return ret
+}
+
+func TestConnectionReconnect(t *testing.T) {
+	device, modem := startNRF91(t)
+	modem.Reply("AT+CEREG?", fakemodem.Lines("+CEREG: 1,1", "OK"))
+
+	// The manager only polls when it starts waiting so the URCs drive
+	// the changes
+	m, events := manage(t, device, at.ConnectionOptions{PollInterval: time.Hour, AttachTimeout: time.Hour})
+	waitState(t, events, at.ConnectionReady)
+	if m.Address() != "127.0.0.1" {
+		t.Fatalf("Unexpected address: %q", m.Address())
+	}
+
+	modem.Reply("AT+CEREG?", fakemodem.Lines("+CEREG: 1,2", "OK"))
+	modem.Write(fakemodem.Lines("+CEREG: 2"))
+	e := waitState(t, events, at.ConnectionSearchingNetwork)
+	if e.Err != at.ErrRegistrationLost {
+		t.Fatalf("Expected the registration to be lost, got %v", e.Err)
+	}
+	if m.Address() != "" {
+		t.Fatalf("The address is kept after the registration was lost: %q", m.Address())
+	}
+
+	modem.Reply("AT+CEREG?", fakemodem.Lines("+CEREG: 1,5", "OK"))
+	modem.Write(fakemodem.Lines("+CEREG: 5"))
+	waitState(t, events, at.ConnectionReady)
+	if m.Address() != "127.0.0.1" {
+		t.Fatalf("Unexpected address after reconnecting: %q", m.Address())
+	}
+}
+
+func TestConnectionBackoff(t *testing.T) {
+	device, modem := startNRF91(t)
+	modem.Reply("AT+CEREG?", fakemodem.Lines("+CEREG: 1,2", "OK"))
+
+	const (
+		minBackoff = 50 * time.Millisecond
+		maxBackoff = 150 * time.Millisecond
+	)
+	_, events := manage(t, device, at.ConnectionOptions{
+		PollInterval:  10 * time.Millisecond,
+		AttachTimeout: 50 * time.Millisecond,
+		MinBackoff:    minBackoff,
+		MaxBackoff:    maxBackoff,
+		RebootAfter:   100,
+	})
+
+	// The wait doubles with each failure until it reaches the maximum
+	for i, expected := range []time.Duration{minBackoff, 2 * minBackoff, maxBackoff, maxBackoff, maxBackoff} {
+		failed := waitState(t, events, at.ConnectionOff)
+		if failed.Failures != i+1 || failed.Err != at.ErrAttachTimeout {
+			t.Fatalf("Expected failure %d to be an attach timeout, got %d %v", i+1, failed.Failures, failed.Err)
+		}
+		wait := waitState(t, events, at.ConnectionSearchingNetwork).Time.Sub(failed.Time)
+		if wait < expected || wait > expected+100*time.Millisecond {
+			t.Fatalf("Expected to wait %v after failure %d, waited %v", expected, i+1, wait)
+		}
+	}
+}
+
+func TestConnectionReboot(t *testing.T) {
+	device, modem := startNRF91(t)
+	modem.Reply("AT+CEREG?", fakemodem.Lines("+CEREG: 1,2", "OK"))
+	modem.Reply("AT#XRESET", fakemodem.OK+fakemodem.Lines("Ready"))
+
+	_, events := manage(t, device, at.ConnectionOptions{
+		PollInterval:  10 * time.Millisecond,
+		AttachTimeout: 50 * time.Millisecond,
+		MinBackoff:    10 * time.Millisecond,
+		MaxBackoff:    10 * time.Millisecond,
+		RebootAfter:   2,
+	})
+	for failures := 0; failures < 2; {
+		failures = waitState(t, events, at.ConnectionOff).Failures
+	}
+	waitState(t, events, at.ConnectionSearchingNetwork)
+
+	// The radio is turned off after the first failure and the module is
+	// rebooted after the second. The registration URCs are turned on
+	// again after the reboot.
+	commands := filterCommands(modem.Commands(), "AT+CEREG=1", "AT+CFUN=0", "AT#XRESET")
+	expected := []string{"AT+CEREG=1", "AT+CFUN=0", "AT+CEREG=1", "AT#XRESET", "AT+CEREG=1"}
+	if len(commands) < len(expected) || strings.Join(commands[:len(expected)], " ") != strings.Join(expected, " ") {
+		t.Fatalf("Expected %v, got %v", expected, commands)
+	}
+}
+
+func TestConnectionAPN(t *testing.T) {
+	modem := fakemodem.New(t)
+	modem.Reply("AT+CEREG?", fakemodem.Lines("+CEREG: 1,1", "OK"))
+	modem.Reply("AT+CGDCONT?", fakemodem.Lines(`+CGDCONT: 0,"IP","old.example.com","",0,0`, "OK"))
+	modem.Reply("AT+CGPADDR", fakemodem.Lines(`+CGPADDR: 0,"10.0.0.1"`, "OK"))
+	device := n211.New(modem.Path(), n211.DefaultBaudRate)
+	if err := device.Start(); err != nil {
+		t.Fatalf("Could not start device: %v", err)
+	}
+	t.Cleanup(device.Close)
+
+	_, events := manage(t, device, at.ConnectionOptions{APN: "new.example.com", PollInterval: 10 * time.Millisecond})
+	waitState(t, events, at.ConnectionReady)
+
+	// The module reboots to change the APN, which turns the registration
+	// URCs off
+	commands := filterCommands(modem.Commands(), "AT+CEREG=1", "AT+NRB")
+	if len(commands) < 2 || commands[len(commands)-2] != "AT+NRB" || commands[len(commands)-1] != "AT+CEREG=1" {
+		t.Fatalf("Expected the registration URCs to be turned on after the reboot, got %v", commands)
+	}
+	if !contains(modem.Commands(), `AT+CGDCONT=0,"IP","new.example.com"`) {
+		t.Fatalf("The APN wasn't set: %v", modem.Commands())
+	}
+}
+
+// contains reports whether cmd is in commands
+func contains(commands []string, cmd string) bool {
+	for _, c := range commands {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
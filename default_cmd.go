@@ -20,6 +20,11 @@ func (d *DefaultImplementation) Close() {
 	d.Cmd.Close()
 }
 
+// CommandInterface returns the command interface
+func (d *DefaultImplementation) CommandInterface() *CommandInterface {
+	return d.Cmd
+}
+
 func (d *DefaultImplementation) AT() error {
 	return d.Cmd.Transact("AT", func(s string) error {
 		return nil
@@ -130,3 +135,89 @@ func (d *DefaultImplementation) GetAPN() (*APN, error) {
 
 	return apn, err
 }
+
+func (d *DefaultImplementation) GetRegistration() (RegistrationStatus, error) {
+	status := RegistrationUnknown
+	err := d.Cmd.Transact("AT+CEREG?", func(s string) error {
+		// URCs are passed to the URC handlers and skipped here
+		if !strings.HasPrefix(s, "+CEREG: ") || IsRegistrationURC(s) {
+			return nil
+		}
+		var err error
+		status, err = ParseRegistration(s)
+		return err
+	})
+	return status, err
+}
+
+// GetStats reads the signal quality with AT+CESQ and AT+CSQ. Modules
+// usually support at least one of them so the command only fails if both
+// do. The other values are Unknown.
+func (d *DefaultImplementation) GetStats() (*Stats, error) {
+	stats := UnknownStats()
+
+	cesqErr := d.Cmd.Transact("AT+CESQ", func(s string) error {
+		// +CESQ: <rxlev>,<ber>,<rscp>,<ecno>,<rsrq>,<rsrp>
+		st := strings.TrimPrefix(s, "+CESQ: ")
+		if st == s {
+			return nil
+		}
+		fields := strings.Split(st, ",")
+		if len(fields) != 6 {
+			return errors.New("could not parse AT+CESQ response")
+		}
+		stats.RSRQ = RSRQFromIndex(ParseMeasurement(fields[4]))
+		stats.SignalPower = RSRPFromIndex(ParseMeasurement(fields[5]))
+		return nil
+	})
+
+	csqErr := d.Cmd.Transact("AT+CSQ", func(s string) error {
+		// +CSQ: <rssi>,<ber>
+		st := strings.TrimPrefix(s, "+CSQ: ")
+		if st == s {
+			return nil
+		}
+		fields := strings.Split(st, ",")
+		if len(fields) != 2 {
+			return errors.New("could not parse AT+CSQ response")
+		}
+		stats.TotalPower = RSSIFromCSQ(ParseMeasurement(fields[0]))
+		return nil
+	})
+
+	if cesqErr != nil && csqErr != nil {
+		return nil, cesqErr
+	}
+	return stats, nil
+}
+
+func (d *DefaultImplementation) GetDeviceInfo() (*DeviceInfo, error) {
+	var err error
+	info := &DeviceInfo{}
+	if info.Manufacturer, err = d.infoText("AT+CGMI", "+CGMI: "); err != nil {
+		return nil, err
+	}
+	if info.Model, err = d.infoText("AT+CGMM", "+CGMM: "); err != nil {
+		return nil, err
+	}
+	if info.FirmwareVersion, err = d.infoText("AT+CGMR", "+CGMR: "); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// infoText returns the first line of the information text returned by
+// the command. Some modules prefix the text with the command name. Other
+// lines starting with +, # or % are URCs.
+func (d *DefaultImplementation) infoText(cmd string, prefix string) (string, error) {
+	var text string
+	err := d.Cmd.Transact(cmd, func(s string) error {
+		s = strings.TrimSpace(strings.TrimPrefix(s, prefix))
+		if s == "" || text != "" || strings.ContainsAny(s[:1], "+#%") {
+			return nil
+		}
+		text = TrimQuotes(s)
+		return nil
+	})
+	return text, err
+}
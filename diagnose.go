@@ -0,0 +1,177 @@
+package at
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Layer is a layer checked by Diagnose
+type Layer int
+
+// Layers in the order they are checked
+const (
+	LayerSIM Layer = iota
+	LayerRegistration
+	LayerPDP
+	LayerDNS
+	LayerPing
+)
+
+func (l Layer) String() string {
+	switch l {
+	case LayerSIM:
+		return "SIM"
+	case LayerRegistration:
+		return "registration"
+	case LayerPDP:
+		return "PDP context"
+	case LayerDNS:
+		return "DNS"
+	case LayerPing:
+		return "ping"
+	default:
+		return "unknown"
+	}
+}
+
+// DiagnosticStep is the result of checking a layer
+type DiagnosticStep struct {
+	Layer Layer
+	// Detail describes what was found, ie the IMSI or the address
+	Detail string
+	// Err is set if the check failed
+	Err error
+	// Duration is how long the check took
+	Duration time.Duration
+}
+
+// Diagnosis is the result of Diagnose
+type Diagnosis struct {
+	// Steps are the layers checked. Diagnose stops at the first layer
+	// that fails so only the last step can have an error.
+	Steps []DiagnosticStep
+	// Ping is the result of the ping if the host was pinged
+	Ping *PingResult
+}
+
+// Failed returns the step for the first layer that failed or nil if all
+// layers are working.
+func (d *Diagnosis) Failed() *DiagnosticStep {
+	for i := range d.Steps {
+		if d.Steps[i].Err != nil {
+			return &d.Steps[i]
+		}
+	}
+	return nil
+}
+
+func (d *Diagnosis) String() string {
+	var lines []string
+	for _, s := range d.Steps {
+		status := "ok"
+		if s.Err != nil {
+			status = "FAILED: " + s.Err.Error()
+		}
+		line := fmt.Sprintf("%-12s %s", s.Layer.String(), status)
+		if s.Detail != "" {
+			line += " (" + s.Detail + ")"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Diagnose checks the connectivity of the device layer by layer to find
+// where it fails: the SIM, the network registration, the PDP context
+// address, DNS resolution of the host and finally a ping of the host.
+// Layers the device can't check, like registration on devices that don't
+// implement RegistrationReader, are skipped. The error is only set if
+// the context is cancelled. Failing layers are reported in the diagnosis.
+func Diagnose(ctx context.Context, device Device, host string) (*Diagnosis, error) {
+	d := &Diagnosis{}
+	check := func(layer Layer, fn func() (string, error)) bool {
+		start := time.Now()
+		detail, err := fn()
+		d.Steps = append(d.Steps, DiagnosticStep{
+			Layer:    layer,
+			Detail:   detail,
+			Err:      err,
+			Duration: time.Since(start),
+		})
+		return err == nil && ctx.Err() == nil
+	}
+
+	ok := check(LayerSIM, func() (string, error) {
+		imsi, err := device.GetIMSI()
+		if err != nil {
+			return "", fmt.Errorf("could not read IMSI: %v", err)
+		}
+		if imsi == "" {
+			return "", errors.New("no IMSI, is the SIM inserted?")
+		}
+		return "IMSI " + imsi, nil
+	})
+
+	if rr, isReader := device.(RegistrationReader); ok && isReader {
+		ok = check(LayerRegistration, func() (string, error) {
+			status, err := rr.GetRegistration()
+			if err != nil {
+				return "", fmt.Errorf("could not read registration status: %v", err)
+			}
+			if !status.Registered() {
+				return "", fmt.Errorf("device is not registered: %s", status)
+			}
+			return status.String(), nil
+		})
+	}
+
+	ok = ok && check(LayerPDP, func() (string, error) {
+		cid, addr, err := device.GetAddr()
+		if err != nil {
+			return "", fmt.Errorf("could not read PDP address: %v", err)
+		}
+		if addr == "" {
+			return "", errors.New("no address allocated")
+		}
+		return fmt.Sprintf("CID %d address %s", cid, addr), nil
+	})
+
+	var addr string
+	ok = ok && check(LayerDNS, func() (string, error) {
+		ips, err := ResolveHost(ctx, device, host)
+		if err != nil {
+			return "", fmt.Errorf("could not resolve %s: %v", host, err)
+		}
+		addr = ips[0].String()
+		return fmt.Sprintf("%s is %s", host, joinIPs(ips)), nil
+	})
+
+	if _, isPinger := device.(Pinger); ok && isPinger {
+		check(LayerPing, func() (string, error) {
+			result, err := Ping(ctx, device, addr, 0, 0)
+			if err != nil {
+				return "", err
+			}
+			d.Ping = result
+			detail := fmt.Sprintf("%d/%d replies", result.Received(), result.Sent)
+			if result.Received() == 0 {
+				return detail, fmt.Errorf("no replies from %s", addr)
+			}
+			return fmt.Sprintf("%s, avg %v", detail, result.AvgRTT), nil
+		})
+	}
+
+	return d, ctx.Err()
+}
+
+func joinIPs(ips []net.IP) string {
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,101 @@
+package at
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultDNSTTL is how long results are cached when the device doesn't
+// report the TTL of the answer.
+const DefaultDNSTTL = 5 * time.Minute
+
+// ErrNoResolver is returned when a name must be resolved by a device that
+// can't resolve names.
+var ErrNoResolver = errors.New("device can not resolve host names")
+
+// Resolver is implemented by devices that can resolve host names through
+// the DNS servers of the network.
+type Resolver interface {
+	// Resolve returns the IPv4 and IPv6 addresses of the host. Results
+	// are cached according to their TTL.
+	Resolve(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// DNSCache caches the addresses for host names. Drivers use it to
+// implement the Resolver interface.
+type DNSCache struct {
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// Lookup returns the cached addresses for the host or nil if there are
+// none or they have expired.
+func (c *DNSCache) Lookup(host string) []net.IP {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	host = strings.ToLower(host)
+	e, ok := c.entries[host]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, host)
+		return nil
+	}
+	return e.ips
+}
+
+// Store caches the addresses for the host for the duration of the TTL.
+// If ttl is 0 DefaultDNSTTL is used.
+func (c *DNSCache) Store(host string, ips []net.IP, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ttl <= 0 {
+		ttl = DefaultDNSTTL
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]dnsEntry)
+	}
+	c.entries[strings.ToLower(host)] = dnsEntry{ips: ips, expires: time.Now().Add(ttl)}
+}
+
+// ResolveHost returns the addresses of host. If host is an IP address it
+// is returned as is, otherwise the name is resolved by the device.
+func ResolveHost(ctx context.Context, device Device, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	resolver, ok := device.(Resolver)
+	if !ok {
+		return nil, ErrNoResolver
+	}
+	ips, err := resolver.Resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no addresses found", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+// SendUDPTo sends an UDP packet to host, which may be a name or an IP
+// address. Names are resolved by the device and the first address is used.
+func SendUDPTo(ctx context.Context, device Device, socket int, host string, remotePort int, data []byte) (int, error) {
+	ips, err := ResolveHost(ctx, device, host)
+	if err != nil {
+		return 0, err
+	}
+	return device.SendUDP(socket, ips[0], remotePort, data)
+}
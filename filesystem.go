@@ -0,0 +1,87 @@
+package at
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"time"
+)
+
+// FileSystem is implemented by devices with a file system in the module,
+// ie for certificates or firmware packages. It is modelled on io/fs with
+// explicit operations for writing and removing files. The module file
+// systems are flat so the only directory is the root, named ".". Errors
+// are *os.PathError values and missing files are reported with
+// os.ErrNotExist.
+type FileSystem interface {
+	// Open reads the named file from the module and returns it for
+	// reading.
+	Open(name string) (File, error)
+
+	// Stat returns information about the named file
+	Stat(name string) (os.FileInfo, error)
+
+	// ReadDir lists the files in the named directory sorted by name
+	ReadDir(name string) ([]os.FileInfo, error)
+
+	// ReadFile reads the named file from the module
+	ReadFile(name string) ([]byte, error)
+
+	// WriteFile writes the data to the named file, replacing the file if
+	// it exists.
+	WriteFile(name string, data []byte) error
+
+	// Remove removes the named file
+	Remove(name string) error
+}
+
+// File is a file opened for reading from a FileSystem
+type File interface {
+	Stat() (os.FileInfo, error)
+	Read(p []byte) (int, error)
+	Close() error
+}
+
+// ValidFileName reports whether the name is a valid name for a file in the
+// root directory of a FileSystem.
+func ValidFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\"\r\n")
+}
+
+// NewFileInfo returns the information for a regular file in a FileSystem
+func NewFileInfo(name string, size int64) os.FileInfo {
+	return &fileInfo{name: name, size: size}
+}
+
+// NewFile returns a File that reads the data read from the module
+func NewFile(info os.FileInfo, data []byte) File {
+	return &file{info: info, Reader: bytes.NewReader(data)}
+}
+
+// fileInfo describes a file in a FileSystem. The module file systems don't
+// keep permissions or modification times.
+type fileInfo struct {
+	name string
+	size int64
+}
+
+func (f *fileInfo) Name() string       { return f.name }
+func (f *fileInfo) Size() int64        { return f.size }
+func (f *fileInfo) Mode() os.FileMode  { return 0644 }
+func (f *fileInfo) ModTime() time.Time { return time.Time{} }
+func (f *fileInfo) IsDir() bool        { return false }
+func (f *fileInfo) Sys() interface{}   { return nil }
+
+// file is a File with the contents in memory
+type file struct {
+	*bytes.Reader
+	info os.FileInfo
+}
+
+func (f *file) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *file) Close() error {
+	return nil
+}
@@ -0,0 +1,155 @@
+package at
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// FOTAState is the state of a firmware update
+type FOTAState int
+
+// Firmware update states
+const (
+	FOTADownloading FOTAState = iota
+	FOTADownloaded
+	FOTAUpdating
+	FOTARebooting
+	FOTAVerifying
+	FOTAComplete
+	FOTAFailed
+)
+
+func (s FOTAState) String() string {
+	switch s {
+	case FOTADownloading:
+		return "downloading"
+	case FOTADownloaded:
+		return "downloaded"
+	case FOTAUpdating:
+		return "updating"
+	case FOTARebooting:
+		return "rebooting"
+	case FOTAVerifying:
+		return "verifying"
+	case FOTAComplete:
+		return "complete"
+	case FOTAFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// FOTAEvent reports the progress of a firmware update
+type FOTAEvent struct {
+	State FOTAState
+	// Progress is the percentage of the current state that is done or -1
+	// if the module doesn't report it
+	Progress int
+	// Version is the firmware version. It is set for the complete event.
+	Version string
+	// Err is set for the failed event
+	Err error
+}
+
+// FOTARebootTimeout is how long UpdateFirmware waits for the module to
+// respond after it has rebooted with the new firmware when the context
+// has no deadline.
+const FOTARebootTimeout = 10 * time.Minute
+
+// FOTAPollInterval is how often UpdateFirmware checks if the module is
+// back after the reboot.
+const FOTAPollInterval = 5 * time.Second
+
+var (
+	// ErrFOTANotSupported is returned when the device can't update its
+	// firmware over the air
+	ErrFOTANotSupported = errors.New("device does not support firmware updates")
+
+	// ErrFirmwareUnchanged is returned when the module reports the same
+	// firmware version after the update
+	ErrFirmwareUnchanged = errors.New("firmware version is unchanged after the update")
+)
+
+// FirmwareUpdater is implemented by devices that can update the module
+// firmware over the air.
+type FirmwareUpdater interface {
+	// UpdateFirmware downloads the firmware delta from the URL and
+	// applies it. Progress is reported through the progress function.
+	// It returns when the module has rebooted with the new firmware.
+	UpdateFirmware(ctx context.Context, url string, progress func(FOTAEvent)) error
+}
+
+// UpdateFirmware updates the module firmware from the URL and returns the
+// new firmware version. The device must implement FirmwareUpdater and
+// InfoReader. Progress events are sent on the events channel if it isn't
+// nil. The update fails with ErrFirmwareUnchanged if the module reports
+// the same version as before.
+func UpdateFirmware(ctx context.Context, device Device, url string, events chan<- FOTAEvent) (string, error) {
+	updater, ok := device.(FirmwareUpdater)
+	if !ok {
+		return "", ErrFOTANotSupported
+	}
+	infoReader, ok := device.(InfoReader)
+	if !ok {
+		return "", ErrFOTANotSupported
+	}
+
+	send := func(e FOTAEvent) {
+		if events == nil {
+			return
+		}
+		select {
+		case events <- e:
+		case <-ctx.Done():
+		}
+	}
+	fail := func(err error) (string, error) {
+		send(FOTAEvent{State: FOTAFailed, Progress: -1, Err: err})
+		return "", err
+	}
+
+	before, err := infoReader.GetDeviceInfo()
+	if err != nil {
+		return fail(fmt.Errorf("could not read firmware version: %v", err))
+	}
+
+	if err := updater.UpdateFirmware(ctx, url, send); err != nil {
+		return fail(err)
+	}
+
+	send(FOTAEvent{State: FOTAVerifying, Progress: -1})
+	if err := waitForDevice(ctx, device); err != nil {
+		return fail(err)
+	}
+	after, err := infoReader.GetDeviceInfo()
+	if err != nil {
+		return fail(fmt.Errorf("could not read firmware version: %v", err))
+	}
+	if after.FirmwareVersion == before.FirmwareVersion {
+		return fail(ErrFirmwareUnchanged)
+	}
+
+	send(FOTAEvent{State: FOTAComplete, Progress: 100, Version: after.FirmwareVersion})
+	return after.FirmwareVersion, nil
+}
+
+// waitForDevice polls the device with AT until it responds
+func waitForDevice(ctx context.Context, device Device) error {
+	timeout := time.NewTimer(ContextTimeout(ctx, FOTARebootTimeout))
+	defer timeout.Stop()
+	for {
+		if err := device.AT(); err == nil {
+			return nil
+		}
+		select {
+		case <-time.After(FOTAPollInterval):
+		case <-timeout.C:
+			return errors.New("module did not respond after the reboot")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -4,9 +4,13 @@ import (
 	"bufio"
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tarm/serial"
@@ -40,7 +44,7 @@ type CommandInterface struct {
 	baudRate    int
 	port        *serial.Port
 	inputChan   chan string
-	outputChan  chan string
+	outputChan  chan outputLine
 	lineTimeout time.Duration
 	debug       bool
 	ctx         context.Context
@@ -48,6 +52,47 @@ type CommandInterface struct {
 	errors      []string
 	successes   []string
 	splits      []string
+
+	// mu serializes transactions. active is the ID of the transaction
+	// that is waiting for its response or 0.
+	mu     sync.Mutex
+	active uint32
+	lastID uint32
+
+	urcMu       sync.Mutex
+	urcHandlers []urcHandler
+	urcNextID   int
+	urcQueue    []string
+	urcSignal   chan struct{}
+	urcPartial  []string
+	urcNext     []func(string) bool
+	// handlingURC is set while the dispatcher runs URC handlers
+	handlingURC int32
+
+	// dataMu protects the state used to read binary data following a
+	// trigger line. The split function switches to reading dataRemaining
+	// raw bytes when it sees dataTrigger, or a line dataLength returns a
+	// size for. It also looks for dataPrompt at the start of a line and
+	// sets promptToken when it finds it.
+	dataMu        sync.Mutex
+	dataTrigger   string
+	dataSize      int
+	dataLength    func(string) (int, bool)
+	dataRemaining int
+	dataToken     bool
+	data          []byte
+	dataPrompt    string
+	promptToken   bool
+
+	metrics      commandMetrics
+	interceptors []Interceptor
+}
+
+type urcHandler struct {
+	id         int
+	prefix     string
+	fn         func(string)
+	extraLines func(string) []func(string) bool
 }
 
 func NewCommandInterface(device string, baudRate int) *CommandInterface {
@@ -56,7 +101,7 @@ func NewCommandInterface(device string, baudRate int) *CommandInterface {
 		device:      device,
 		baudRate:    baudRate,
 		inputChan:   make(chan string, 10),
-		outputChan:  make(chan string, 10),
+		outputChan:  make(chan outputLine, 10),
 		lineTimeout: DefaultLineTimeout,
 		debug:       false,
 		ctx:         ctx,
@@ -64,6 +109,7 @@ func NewCommandInterface(device string, baudRate int) *CommandInterface {
 		errors:      []string{"ERROR"},
 		successes:   []string{"OK"},
 		splits:      []string{"\r\n"},
+		urcSignal:   make(chan struct{}, 1),
 	}
 }
 
@@ -90,8 +136,9 @@ func (c *CommandInterface) SetDebug(debug bool) {
 
 func (c *CommandInterface) Start() error {
 	p, err := serial.OpenPort(&serial.Config{
-		Name: c.device,
-		Baud: c.baudRate,
+		Name:        c.device,
+		Baud:        c.baudRate,
+		ReadTimeout: pollInterval,
 	})
 	if err != nil {
 		return err
@@ -101,15 +148,42 @@ func (c *CommandInterface) Start() error {
 
 	go c.outputReader(c.ctx)
 	go c.inputReader(c.ctx)
+	go c.urcDispatcher(c.ctx)
 
 	return nil
 }
 
+// Close stops the goroutines and closes the serial port
 func (c *CommandInterface) Close() {
+	c.cancel()
 	if c.port != nil {
 		c.port.Close()
 	}
-	c.cancel()
+}
+
+// pollInterval is the read timeout of the serial port. Reads return
+// when it expires so that the port can be closed without waiting for the
+// device to send something.
+const pollInterval = 100 * time.Millisecond
+
+// portReader reads from the serial port until the context is done. Reads
+// that time out without data are retried. The port returns io.EOF on
+// timeouts on Unix and no data and no error on Windows.
+type portReader struct {
+	ctx  context.Context
+	port *serial.Port
+}
+
+func (r *portReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.port.Read(p)
+		if r.ctx.Err() != nil {
+			return 0, io.EOF
+		}
+		if n > 0 || (err != nil && err != io.EOF) {
+			return n, err
+		}
+	}
 }
 
 // inputReader reads from the input channel and sends the strings as
@@ -122,6 +196,7 @@ func (c *CommandInterface) inputReader(ctx context.Context) {
 			if err != nil {
 				log.Fatalf("Error writing to %s: %v", c.device, err)
 			}
+			c.metrics.addBytesOut(len(line))
 		case <-ctx.Done():
 			log.Printf("Terminating inputReader")
 			return
@@ -130,12 +205,52 @@ func (c *CommandInterface) inputReader(ctx context.Context) {
 }
 
 func (c *CommandInterface) splitFunc(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	c.dataMu.Lock()
+	defer c.dataMu.Unlock()
+
+	if c.dataRemaining > 0 {
+		c.dataToken = true
+		n := len(data)
+		if n > c.dataRemaining {
+			n = c.dataRemaining
+		}
+		c.dataRemaining -= n
+		c.metrics.addBytesIn(n)
+		return n, data[:n], nil
+	}
+	c.dataToken = false
+	c.promptToken = false
+
+	// The prompt isn't followed by a line break, the module waits for
+	// the payload after it
+	if c.dataPrompt != "" && strings.HasPrefix(string(data), c.dataPrompt) {
+		advance = len(c.dataPrompt)
+		if len(data) > advance && data[advance] == ' ' {
+			advance++
+		}
+		c.dataPrompt = ""
+		c.promptToken = true
+		c.metrics.addBytesIn(advance)
+		return advance, data[:advance], nil
+	}
+
 	for _, v := range c.splits {
 		pos := strings.Index(string(data), v)
 		if pos >= 0 {
 			advance = pos + len(v)
 			token = data[:pos]
 			err = nil
+			if c.dataTrigger != "" && string(token) == c.dataTrigger {
+				c.dataTrigger = ""
+				c.dataRemaining = c.dataSize
+			}
+			if c.dataLength != nil {
+				if n, ok := c.dataLength(string(token)); ok {
+					c.dataLength = nil
+					c.dataRemaining = n
+				}
+			}
+			c.metrics.addBytesIn(advance)
 			return
 		}
 	}
@@ -144,33 +259,94 @@ func (c *CommandInterface) splitFunc(data []byte, atEOF bool) (advance int, toke
 
 // outputReader reads output from the device and prints it out
 func (c *CommandInterface) outputReader(ctx context.Context) {
-	scanner := bufio.NewScanner(c.port)
+	scanner := bufio.NewScanner(&portReader{ctx: ctx, port: c.port})
 	scanner.Split(c.splitFunc)
 	for scanner.Scan() {
+		// Binary data is collected for the transaction that expects it
+		c.dataMu.Lock()
+		if c.dataToken {
+			c.data = append(c.data, scanner.Bytes()...)
+			c.dataMu.Unlock()
+			continue
+		}
+		prompt := c.promptToken
+		c.dataMu.Unlock()
+
+		// The prompt goes to the transaction that asked for it
+		if prompt {
+			select {
+			case c.outputChan <- outputLine{id: atomic.LoadUint32(&c.active), prompt: true}:
+			case <-ctx.Done():
+				log.Printf("Terminating outputReader")
+				return
+			}
+			continue
+		}
+
+		// Every line goes through the URC handlers here, in the order
+		// the lines arrived, and is passed on to the transaction that is
+		// waiting for a response. The final result code of a response is
+		// not a URC.
+		line := scanner.Text()
+		id := atomic.LoadUint32(&c.active)
+		if id == 0 || !c.isFinalResult(line) {
+			c.consumeOutput(line)
+		}
+		if id == 0 {
+			continue
+		}
 		select {
-		case c.outputChan <- scanner.Text():
+		case c.outputChan <- outputLine{id: id, line: line}:
 		case <-ctx.Done():
 			log.Printf("Terminating outputReader")
+			return
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
 		log.Fatal(err)
 	}
 }
 
-// drainOutput drains the output channel
-func (c *CommandInterface) drainOutput() {
-	for len(c.outputChan) > 0 {
+// outputLine is a line for the transaction with the ID. prompt is set
+// when the module prompts for the payload.
+type outputLine struct {
+	id     uint32
+	line   string
+	prompt bool
+}
+
+// discardOutput discards the lines left in the output channel. These are
+// lines that arrived as a transaction ended and they have already been
+// through the URC handlers. The caller must hold c.mu.
+func (c *CommandInterface) discardOutput() {
+	for {
 		select {
-		case s := <-c.outputChan:
-			c.consumeOutput(s)
+		case <-c.outputChan:
 		default:
 			return
 		}
 	}
 }
 
+// isFinalResult reports whether the line is a final result code
+func (c *CommandInterface) isFinalResult(line string) bool {
+	if strings.HasPrefix(line, cmePrefix) {
+		return true
+	}
+	for _, v := range c.successes {
+		if line == v {
+			return true
+		}
+	}
+	for _, v := range c.errors {
+		if line == v {
+			return true
+		}
+	}
+	return false
+}
+
 // consumeOutput is used to consume response codes, both solicited and
 // unsolicited, so that we can use this in a state machine later.
 // This function is meant to be used wherever you process data from
@@ -181,6 +357,180 @@ func (c *CommandInterface) consumeOutput(s string) {
 	if c.debug {
 		log.Printf("CONSUME '%s'", s)
 	}
+
+	c.urcMu.Lock()
+	defer c.urcMu.Unlock()
+
+	// Collect the lines that belong to a multi-line URC. Blank lines
+	// are separators and not part of the URC. A line that doesn't look
+	// like the next line of the URC is something else, ie a response,
+	// and the incomplete URC is dropped.
+	if c.urcPartial != nil {
+		if s == "" {
+			return
+		}
+		if c.urcNext[0](s) {
+			c.urcPartial = append(c.urcPartial, s)
+			c.urcNext = c.urcNext[1:]
+			if len(c.urcNext) == 0 {
+				c.enqueueURC(strings.Join(c.urcPartial, "\r\n"))
+				c.urcPartial = nil
+			}
+			return
+		}
+		log.Printf("Incomplete URC: %s", strings.Join(c.urcPartial, " "))
+		c.urcPartial = nil
+		c.urcNext = nil
+	}
+
+	for _, h := range c.urcHandlers {
+		if strings.HasPrefix(s, h.prefix) {
+			if h.extraLines != nil {
+				if next := h.extraLines(s); len(next) > 0 {
+					c.urcPartial = []string{s}
+					c.urcNext = next
+					return
+				}
+			}
+			c.enqueueURC(s)
+			return
+		}
+	}
+}
+
+// enqueueURC queues the URC for the dispatcher. The caller must hold
+// c.urcMu.
+func (c *CommandInterface) enqueueURC(s string) {
+	c.urcQueue = append(c.urcQueue, s)
+	select {
+	case c.urcSignal <- struct{}{}:
+	default:
+	}
+}
+
+// AddURCHandler registers fn to be called with every line from the device
+// that starts with prefix, regardless of whether it arrives during a
+// transaction or not. Handlers run on a separate goroutine, one line at a
+// time in the order the lines arrived, so it is safe to call Transact from
+// a handler. The returned function removes the handler.
+func (c *CommandInterface) AddURCHandler(prefix string, fn func(string)) func() {
+	return c.addURCHandler(urcHandler{prefix: prefix, fn: fn})
+}
+
+// AddMultilineURCHandler works like AddURCHandler for URCs that span more
+// than one line. The extraLines function is called with the first line of
+// the URC and returns a function for each of the lines that follow it
+// that reports whether the line looks like that line. The URC ends at the
+// first line that doesn't, which is handled as a line of its own. The
+// handler is called with all the lines of the URC joined by CRLF.
+func (c *CommandInterface) AddMultilineURCHandler(prefix string, extraLines func(string) []func(string) bool, fn func(string)) func() {
+	return c.addURCHandler(urcHandler{prefix: prefix, fn: fn, extraLines: extraLines})
+}
+
+func (c *CommandInterface) addURCHandler(h urcHandler) func() {
+	c.urcMu.Lock()
+	defer c.urcMu.Unlock()
+
+	id := c.urcNextID
+	c.urcNextID++
+	h.id = id
+	c.urcHandlers = append(c.urcHandlers, h)
+
+	return func() {
+		c.urcMu.Lock()
+		defer c.urcMu.Unlock()
+		for i, h := range c.urcHandlers {
+			if h.id == id {
+				c.urcHandlers = append(c.urcHandlers[:i], c.urcHandlers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Subscribe returns a channel that receives the lines starting with prefix
+// until the returned function is called. Lines are dropped if the channel
+// buffer is full. This is handy for commands that report their result in
+// an URC after the final OK.
+func (c *CommandInterface) Subscribe(prefix string, size int) (<-chan string, func()) {
+	ch := make(chan string, size)
+	remove := c.AddURCHandler(prefix, func(s string) {
+		select {
+		case ch <- s:
+		default:
+			log.Printf("Dropping '%s': subscriber is not keeping up", s)
+		}
+	})
+	return ch, remove
+}
+
+// WaitURC reads URCs from a channel returned by Subscribe and passes them
+// to fn until fn returns true or an error. It gives up when the timeout
+// expires or the context is done.
+func WaitURC(ctx context.Context, urcs <-chan string, timeout time.Duration, fn func(string) (bool, error)) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case s := <-urcs:
+			done, err := fn(s)
+			if err != nil {
+				return err
+			}
+			if done {
+				return nil
+			}
+
+		case <-timer.C:
+			return ErrReadTimeout
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// HandlingURC reports whether URC handlers are running. Commands sent
+// meanwhile are most likely sent by a handler rather than on behalf of a
+// caller of the command interface.
+func (c *CommandInterface) HandlingURC() bool {
+	return atomic.LoadInt32(&c.handlingURC) != 0
+}
+
+// urcDispatcher calls the URC handlers for the lines queued by
+// consumeOutput.
+func (c *CommandInterface) urcDispatcher(ctx context.Context) {
+	for {
+		select {
+		case <-c.urcSignal:
+		case <-ctx.Done():
+			return
+		}
+
+		for {
+			c.urcMu.Lock()
+			if len(c.urcQueue) == 0 {
+				c.urcMu.Unlock()
+				break
+			}
+			line := c.urcQueue[0]
+			c.urcQueue = c.urcQueue[1:]
+			var handlers []func(string)
+			for _, h := range c.urcHandlers {
+				if strings.HasPrefix(line, h.prefix) {
+					handlers = append(handlers, h.fn)
+				}
+			}
+			c.urcMu.Unlock()
+
+			atomic.StoreInt32(&c.handlingURC, 1)
+			for _, fn := range handlers {
+				fn(line)
+			}
+			atomic.StoreInt32(&c.handlingURC, 0)
+		}
+	}
 }
 
 // transact drains the output from the device, then sends the
@@ -188,13 +538,33 @@ func (c *CommandInterface) consumeOutput(s string) {
 // calls fn with each line in the response as long as fn returns
 // ErrContinueReading.
 func (c *CommandInterface) Transact(s string, fn func(string) error) error {
-	var debugLog []string
+	return c.TransactTimeout(s, c.lineTimeout, fn)
+}
 
-	c.drainOutput()
-	c.SendCRLF(s)
+// TransactTimeout works like Transact but waits up to timeout for each
+// line in the response rather than the default line timeout. Use this for
+// commands that block in the module, like socket reads with a receive
+// timeout.
+func (c *CommandInterface) TransactTimeout(s string, timeout time.Duration, fn func(string) error) error {
+	return c.transact(s, timeout, fn, nil)
+}
 
-	// Append the outgoing command to log
-	debugLog = append(debugLog, " > "+s)
+// dataPhase is binary data the module sends after the trigger line or
+// the payload sent to the module when it prompts for it. The trigger line
+// is either the trigger or a line length returns the size for.
+type dataPhase struct {
+	trigger string
+	size    int
+	length  func(string) (int, bool)
+	data    []byte
+	prompt  string
+	payload []byte
+}
+
+// transact runs the transaction through the interceptors
+func (c *CommandInterface) transact(s string, timeout time.Duration, fn func(string) error, dp *dataPhase) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
 	// If we didn't get a callback function we define a default
 	// function.  This makes the logic a bit more regular.
@@ -202,12 +572,83 @@ func (c *CommandInterface) Transact(s string, fn func(string) error) error {
 		fn = func(s string) error { return nil }
 	}
 
+	invoke := func(s string, fn func(string) error) error {
+		return c.exchange(s, timeout, fn, dp)
+	}
+	for i := len(c.interceptors) - 1; i >= 0; i-- {
+		interceptor, next := c.interceptors[i], invoke
+		invoke = func(s string, fn func(string) error) error {
+			return interceptor(s, fn, next)
+		}
+	}
+	return invoke(s, fn)
+}
+
+// exchange sends the command and reads the response. The caller must hold
+// c.mu.
+func (c *CommandInterface) exchange(s string, timeout time.Duration, fn func(string) error, dp *dataPhase) (err error) {
+	var debugLog []string
+
+	start := time.Now()
+	defer func() {
+		c.metrics.record(s, time.Since(start), err)
+	}()
+
+	// Lines are tagged with the transaction that was waiting when they
+	// arrived so lines queued as the previous transaction ended are
+	// skipped
+	c.discardOutput()
+	c.lastID++
+	if c.lastID == 0 {
+		c.lastID = 1
+	}
+	id := c.lastID
+	atomic.StoreUint32(&c.active, id)
+	defer func() {
+		atomic.StoreUint32(&c.active, 0)
+		c.discardOutput()
+	}()
+
+	if dp != nil {
+		c.dataMu.Lock()
+		c.dataTrigger = dp.trigger
+		c.dataSize = dp.size
+		c.dataLength = dp.length
+		c.data = nil
+		c.dataPrompt = dp.prompt
+		c.dataMu.Unlock()
+
+		defer func() {
+			c.dataMu.Lock()
+			defer c.dataMu.Unlock()
+			dp.data = c.data
+			c.dataTrigger = ""
+			c.dataLength = nil
+			c.dataRemaining = 0
+			c.data = nil
+			c.dataPrompt = ""
+		}()
+	}
+	c.SendCRLF(s)
+
+	// Append the outgoing command to log
+	debugLog = append(debugLog, " > "+s)
+
 	// Loop over the response until we have ERROR or OK
 	var line string
 	for {
 		select {
-		case line = <-c.outputChan:
-		case <-time.After(c.lineTimeout):
+		case out := <-c.outputChan:
+			if out.id != id {
+				continue
+			}
+			if out.prompt {
+				debugLog = append(debugLog, fmt.Sprintf(" > [%d bytes]", len(dp.payload)))
+				c.SendBytes(dp.payload)
+				continue
+			}
+			line = out.line
+		case <-time.After(timeout):
 			return ErrReadTimeout
 		}
 
@@ -227,6 +668,12 @@ func (c *CommandInterface) Transact(s string, fn func(string) error) error {
 		}
 
 		// Handle error response
+		if strings.HasPrefix(line, cmePrefix) {
+			for n, lin := range debugLog {
+				log.Printf("[%2d] %s", n, lin)
+			}
+			return ParseCMEError(line)
+		}
 		for _, v := range c.errors {
 			if line == v {
 				// When we have an error we're going to log it regardless
@@ -240,19 +687,69 @@ func (c *CommandInterface) Transact(s string, fn func(string) error) error {
 			}
 		}
 
-		c.consumeOutput(line)
-
-		err := fn(line)
-		if err != nil {
+		if err := fn(line); err != nil {
 			return err
 		}
 	}
 }
 
+// TransactData works like TransactTimeout for commands where the module
+// sends size bytes of binary data after the trigger line, ie CONNECT. The
+// data is read as is rather than split into lines and returned when the
+// command completes.
+func (c *CommandInterface) TransactData(s string, trigger string, size int, timeout time.Duration, fn func(string) error) ([]byte, error) {
+	dp := &dataPhase{trigger: trigger, size: size}
+	if err := c.transact(s, timeout, fn, dp); err != nil {
+		return nil, err
+	}
+	if len(dp.data) != size {
+		return nil, fmt.Errorf("expected %d bytes of data but got %d", size, len(dp.data))
+	}
+	return dp.data, nil
+}
+
+// TransactSizedData works like TransactData for commands where the size
+// of the data is on the line before it, ie #XRECV: <size>. length returns
+// the size for that line and false for the lines before it. There is no
+// data if the module didn't send the line.
+func (c *CommandInterface) TransactSizedData(s string, length func(string) (int, bool), timeout time.Duration, fn func(string) error) ([]byte, error) {
+	size := -1
+	dp := &dataPhase{length: func(line string) (int, bool) {
+		n, ok := length(line)
+		if ok {
+			size = n
+		}
+		return n, ok
+	}}
+	if err := c.transact(s, timeout, fn, dp); err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		return nil, nil
+	}
+	if len(dp.data) != size {
+		return nil, fmt.Errorf("expected %d bytes of data but got %d", size, len(dp.data))
+	}
+	return dp.data, nil
+}
+
+// TransactPrompt works like Transact for commands where the module
+// prompts for a payload, ie > after AT+QISEND. The payload is sent as is
+// when the prompt turns up at the start of a line.
+func (c *CommandInterface) TransactPrompt(s string, prompt string, payload []byte, fn func(string) error) error {
+	return c.transact(s, c.lineTimeout, fn, &dataPhase{prompt: prompt, payload: payload})
+}
+
 func (c *CommandInterface) SendCRLF(s string) {
 	c.inputChan <- (s + "\r\n")
 }
 
+// SendBytes sends data to the device as is. This is used for payloads
+// sent after a prompt from the device.
+func (c *CommandInterface) SendBytes(data []byte) {
+	c.inputChan <- string(data)
+}
+
 func TrimQuotes(s string) string {
 	if len(s) >= 2 {
 		if s[0] == '"' && s[len(s)-1] == '"' {
@@ -0,0 +1,39 @@
+package at
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HTTP transport settings. The defaults in net/http assume a fast network
+// and plenty of sockets, neither of which is true for a mobile IoT module.
+const (
+	httpTLSHandshakeTimeout = 60 * time.Second
+	httpIdleConnTimeout     = 30 * time.Second
+	httpMaxConnsPerHost     = 2
+)
+
+// NewHTTPTransport returns an http.Transport that makes its connections
+// through the device. Host names are passed on to the device which
+// resolves them. TLS is handled by crypto/tls on top of the connection.
+func NewHTTPTransport(device Device) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return Dial(ctx, device, network, address)
+		},
+		TLSHandshakeTimeout: httpTLSHandshakeTimeout,
+		IdleConnTimeout:     httpIdleConnTimeout,
+		MaxIdleConns:        httpMaxConnsPerHost,
+		MaxConnsPerHost:     httpMaxConnsPerHost,
+	}
+}
+
+// NewHTTPClient returns an http.Client that makes its requests through the
+// device. The device must implement TCPDialer.
+func NewHTTPClient(device Device) *http.Client {
+	return &http.Client{
+		Transport: NewHTTPTransport(device),
+	}
+}
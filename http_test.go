@@ -0,0 +1,170 @@
+//go:build linux
+// +build linux
+
+package at_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lab5e/at"
+	"github.com/lab5e/at/internal/fakemodem"
+)
+
+// newHTTPClient returns an HTTP client that makes its requests through an
+// nRF91 driver talking to a fake modem
+func newHTTPClient(t *testing.T) (*http.Client, *fakemodem.SLM) {
+	device, modem := startNRF91(t)
+	client := at.NewHTTPClient(device)
+	t.Cleanup(client.CloseIdleConnections)
+	return client, modem
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Could not read body: %v", err)
+	}
+	return string(body)
+}
+
+func TestHTTPGet(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "hello from "+r.URL.Path+"\r\nsecond line\n")
+	}))
+	defer server.Close()
+
+	client, _ := newHTTPClient(t)
+	resp, err := client.Get(server.URL + "/greeting")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	if body := readBody(t, resp); body != "hello from /greeting\r\nsecond line\n" {
+		t.Fatalf("Unexpected body: %q", body)
+	}
+}
+
+func TestHTTPChunkedPost(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TransferEncoding) == 0 || r.TransferEncoding[0] != "chunked" {
+			http.Error(w, "expected a chunked body", http.StatusBadRequest)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Echo the body back in chunks
+		flusher := w.(http.Flusher)
+		for len(body) > 0 {
+			n := 100
+			if n > len(body) {
+				n = len(body)
+			}
+			w.Write(body[:n])
+			flusher.Flush()
+			body = body[n:]
+		}
+	}))
+	defer server.Close()
+
+	// The body is larger than the maximum send and receive sizes so it
+	// takes several commands both ways
+	payload := strings.Repeat("0123456789abcdef", 150)
+
+	client, _ := newHTTPClient(t)
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < len(payload); i += 300 {
+			end := i + 300
+			if end > len(payload) {
+				end = len(payload)
+			}
+			pw.Write([]byte(payload[i:end]))
+		}
+		pw.Close()
+	}()
+
+	resp, err := client.Post(server.URL+"/echo", "text/plain", pr)
+	if err != nil {
+		t.Fatalf("POST failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, readBody(t, resp))
+	}
+	if len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+		t.Fatalf("Expected a chunked response, got %v", resp.TransferEncoding)
+	}
+	if body := readBody(t, resp); body != payload {
+		t.Fatalf("Body doesn't match the payload, got %d of %d bytes", len(body), len(payload))
+	}
+}
+
+func TestHTTPConnectionReuse(t *testing.T) {
+	var mu sync.Mutex
+	remotes := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		remotes[r.RemoteAddr] = true
+		mu.Unlock()
+		if r.URL.Path == "/close" {
+			w.Header().Set("Connection", "close")
+		}
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer server.Close()
+
+	client, modem := newHTTPClient(t)
+	get := func(path string) {
+		t.Helper()
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		if body := readBody(t, resp); body != path {
+			t.Fatalf("Unexpected body for %s: %q", path, body)
+		}
+	}
+
+	// The connection is kept open between requests
+	get("/first")
+	get("/second")
+	if n := modem.Connections(); n != 1 {
+		t.Fatalf("Expected one connection, got %d", n)
+	}
+
+	// The server closes the connection after this one so the next
+	// request opens a new connection
+	get("/close")
+	get("/third")
+	if n := modem.Connections(); n != 2 {
+		t.Fatalf("Expected two connections, got %d", n)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(remotes) != 2 {
+		t.Fatalf("Expected requests from two connections, got %d", len(remotes))
+	}
+
+	// The closed connection is closed on the device as well
+	closed := false
+	for _, cmd := range modem.Commands() {
+		if cmd == "AT#XSOCKET=0" {
+			closed = true
+		}
+	}
+	if !closed {
+		t.Fatal("Expected the socket to be closed on the device")
+	}
+}
@@ -0,0 +1,45 @@
+package at
+
+// Invoker runs a transaction. It returns when the device has responded
+// with a final result code or the transaction timed out.
+type Invoker func(cmd string, fn func(string) error) error
+
+// Interceptor wraps a transaction. It is called with the command and the
+// function that handles the response lines and must call invoke to run the
+// transaction, ie
+//
+//	func(cmd string, fn func(string) error, invoke at.Invoker) error {
+//		start := time.Now()
+//		err := invoke(cmd, func(s string) error {
+//			log.Printf("%s: %s", cmd, s)
+//			return fn(s)
+//		})
+//		log.Printf("%s took %v: %v", cmd, time.Since(start), err)
+//		return err
+//	}
+//
+// Interceptors run while the command interface is locked so they must not
+// send commands themselves.
+type Interceptor func(cmd string, fn func(string) error, invoke Invoker) error
+
+// Interceptable is implemented by devices that let interceptors wrap the
+// transactions with the module.
+type Interceptable interface {
+	// AddInterceptor adds an interceptor to the chain. Interceptors added
+	// first are called first.
+	AddInterceptor(i Interceptor)
+}
+
+// AddInterceptor adds an interceptor to the chain that wraps each
+// transaction. Interceptors added first are called first. The interceptor
+// is used from the next transaction.
+func (c *CommandInterface) AddInterceptor(i Interceptor) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.interceptors = append(c.interceptors, i)
+}
+
+// AddInterceptor adds an interceptor to the command interface
+func (d *DefaultImplementation) AddInterceptor(i Interceptor) {
+	d.Cmd.AddInterceptor(i)
+}
@@ -0,0 +1,215 @@
+//go:build linux
+// +build linux
+
+// Package fakemodem is a fake modem on a pseudo terminal for testing the
+// drivers. The drivers open the terminal like a serial port and the fake
+// modem answers the commands with the responses set up by the test.
+package fakemodem
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// OK is the response to a successful command
+const OK = "\r\nOK\r\n"
+
+// Handler returns the response to the command. The response is written
+// as is so lines must be framed with CRLF, see Lines. Handlers run on the
+// goroutine that reads the commands and may call Read to read a payload
+// that follows the command.
+type Handler func(cmd string) string
+
+// Modem is a fake modem. Commands that don't match a handler get OK.
+type Modem struct {
+	t      testing.TB
+	master *os.File
+	path   string
+	reader *bufio.Reader
+
+	// writeMu keeps the responses and the URCs written by other
+	// goroutines from being mixed up
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	handlers map[string]Handler
+	commands []string
+	closed   bool
+	echo     bool
+}
+
+// New creates a fake modem. The modem is closed when the test ends.
+func New(t testing.TB) *Modem {
+	fd, err := unix.Open("/dev/ptmx", unix.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Fatalf("Could not open pseudo terminal: %v", err)
+	}
+	var unlock int32
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+		unix.Close(fd)
+		t.Fatalf("Could not unlock pseudo terminal: %v", errno)
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		unix.Close(fd)
+		t.Fatalf("Could not get pseudo terminal number: %v", err)
+	}
+
+	master := os.NewFile(uintptr(fd), "ptmx")
+	m := &Modem{
+		t:        t,
+		master:   master,
+		path:     "/dev/pts/" + strconv.Itoa(n),
+		reader:   bufio.NewReader(master),
+		handlers: make(map[string]Handler),
+	}
+	t.Cleanup(m.close)
+	go m.loop()
+	return m
+}
+
+// Lines frames the lines the way the modem does, ie with CRLF before and
+// after each line.
+func Lines(lines ...string) string {
+	var sb strings.Builder
+	for _, l := range lines {
+		sb.WriteString("\r\n" + l + "\r\n")
+	}
+	return sb.String()
+}
+
+// Args splits the arguments of the command on commas and removes the
+// quotes, ie AT+CMD=1,"a" gives 1 and a. Quoted arguments can't contain
+// commas.
+func Args(cmd string) []string {
+	i := strings.Index(cmd, "=")
+	if i < 0 {
+		return nil
+	}
+	fields := strings.Split(cmd[i+1:], ",")
+	for i := range fields {
+		fields[i] = strings.Trim(strings.TrimSpace(fields[i]), `"`)
+	}
+	return fields
+}
+
+// Path returns the path of the terminal the driver should open
+func (m *Modem) Path() string {
+	return m.path
+}
+
+// Handle sets the handler for the commands that start with prefix. The
+// handler with the longest matching prefix is used.
+func (m *Modem) Handle(prefix string, fn Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[prefix] = fn
+}
+
+// Reply sets a fixed response for the commands that start with prefix
+func (m *Modem) Reply(prefix string, response string) {
+	m.Handle(prefix, func(string) string { return response })
+}
+
+// Write writes s to the driver, ie an URC. It is safe to call from any
+// goroutine.
+func (m *Modem) Write(s string) {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	if _, err := m.master.Write([]byte(s)); err != nil {
+		m.t.Errorf("Could not write to the driver: %v", err)
+	}
+}
+
+// Read reads n bytes sent by the driver. Call it from a handler to read
+// the payload that follows a prompt.
+func (m *Modem) Read(n int) []byte {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(m.reader, buf); err != nil {
+		m.t.Errorf("Could not read payload: %v", err)
+	}
+	return buf
+}
+
+// SetEcho turns the echo of the commands on or off. The modem turns the
+// echo on and off itself for ATE1 and ATE0 like real modems do.
+func (m *Modem) SetEcho(on bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.echo = on
+}
+
+// Commands returns the commands received so far
+func (m *Modem) Commands() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.commands...)
+}
+
+// close closes the terminal, which stops the loop
+func (m *Modem) close() {
+	m.mu.Lock()
+	m.closed = true
+	m.mu.Unlock()
+	m.master.Close()
+}
+
+// loop reads the commands and writes the responses until the modem is
+// closed. Reads fail while the driver doesn't have the terminal open.
+func (m *Modem) loop() {
+	for {
+		line, err := m.reader.ReadString('\n')
+		if err != nil {
+			m.mu.Lock()
+			closed := m.closed
+			m.mu.Unlock()
+			if closed {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		cmd := strings.TrimSpace(line)
+		if cmd == "" {
+			continue
+		}
+
+		m.mu.Lock()
+		m.commands = append(m.commands, cmd)
+		echo := m.echo
+		switch cmd {
+		case "ATE0":
+			m.echo = false
+		case "ATE1":
+			m.echo = true
+		}
+		var fn Handler
+		best := -1
+		for prefix, h := range m.handlers {
+			if strings.HasPrefix(cmd, prefix) && len(prefix) > best {
+				fn, best = h, len(prefix)
+			}
+		}
+		m.mu.Unlock()
+
+		if echo {
+			m.Write(cmd + "\r")
+		}
+		response := OK
+		if fn != nil {
+			response = fn(cmd)
+		}
+		if response != "" {
+			m.Write(response)
+		}
+	}
+}
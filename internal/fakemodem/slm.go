@@ -0,0 +1,425 @@
+//go:build linux
+// +build linux
+
+package fakemodem
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Socket types used with AT#XSOCKET
+const (
+	slmStream = 1
+	slmDgram  = 2
+)
+
+// Poll events reported by #XAPOLL
+const (
+	slmPollIn  = 0x01
+	slmPollErr = 0x08
+	slmPollHup = 0x10
+)
+
+// SLM is a fake modem that runs the socket commands of the nRF91 Serial
+// LTE Modem. The sockets are bridged to sockets on the host so the
+// drivers can talk to servers started by the test, ie with httptest.
+// UDP sockets are bound to a free port on the loopback interface
+// regardless of the port given to AT#XBIND.
+type SLM struct {
+	*Modem
+
+	mu       sync.Mutex
+	sockets  map[int]*slmSocket
+	next     int
+	selected int
+	polled   map[int]bool
+	// changed is closed and replaced when data arrives
+	changed chan struct{}
+}
+
+// slmSocket is a socket on the host
+type slmSocket struct {
+	handle     int
+	socketType int
+	timeout    time.Duration
+	tcp        net.Conn
+	udp        *net.UDPConn
+	data       []byte
+	packets    []packet
+	eof        bool
+	// reset is set when the connection ended with an error rather than
+	// being closed by the remote end
+	reset bool
+}
+
+// packet is a datagram received on a UDP socket
+type packet struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+// NewSLM creates a fake nRF91 Serial LTE Modem. The sockets are closed
+// when the test ends.
+func NewSLM(t testing.TB) *SLM {
+	m := &SLM{
+		Modem:    New(t),
+		sockets:  make(map[int]*slmSocket),
+		selected: -1,
+		polled:   make(map[int]bool),
+		changed:  make(chan struct{}),
+	}
+	m.Handle("AT#XSOCKET=", m.socket)
+	m.Handle("AT#XSOCKETSELECT=", m.selectSocket)
+	m.Handle("AT#XSOCKETOPT=", m.socketOpt)
+	m.Handle("AT#XBIND=", m.bind)
+	m.Handle("AT#XCONNECT=", m.connect)
+	m.Handle("AT#XSEND=", m.send)
+	m.Handle("AT#XRECV=", m.recv)
+	m.Handle("AT#XSENDTO=", m.sendTo)
+	m.Handle("AT#XRECVFROM", m.recvFrom)
+	m.Handle("AT#XPOLL=", m.pollNow)
+	m.Handle("AT#XAPOLL=", m.poll)
+	m.Handle("AT+CGPADDR", func(string) string {
+		return Lines(`+CGPADDR: 1,"127.0.0.1"`, "OK")
+	})
+	t.Cleanup(m.close)
+	return m
+}
+
+// Connections returns the number of TCP connections made with
+// AT#XCONNECT
+func (m *SLM) Connections() int {
+	n := 0
+	for _, cmd := range m.Commands() {
+		if strings.HasPrefix(cmd, "AT#XCONNECT=") {
+			n++
+		}
+	}
+	return n
+}
+
+// close closes the sockets on the host
+func (m *SLM) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.sockets {
+		s.close()
+	}
+}
+
+func (s *slmSocket) close() {
+	if s.tcp != nil {
+		s.tcp.Close()
+	}
+	if s.udp != nil {
+		s.udp.Close()
+	}
+}
+
+// current returns the selected socket. The caller must hold m.mu.
+func (m *SLM) current() *slmSocket {
+	return m.sockets[m.selected]
+}
+
+func (m *SLM) socket(cmd string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a := Args(cmd)
+	if a[0] == "0" {
+		s := m.current()
+		if s == nil {
+			return Lines("ERROR")
+		}
+		s.close()
+		delete(m.sockets, s.handle)
+		delete(m.polled, s.handle)
+		m.selected = -1
+		return Lines(fmt.Sprintf(`#XSOCKET: %d,"closed"`, s.handle), "OK")
+	}
+
+	socketType, _ := strconv.Atoi(a[1])
+	s := &slmSocket{handle: m.next, socketType: socketType}
+	m.next++
+	m.sockets[s.handle] = s
+	m.selected = s.handle
+	proto := 6
+	if socketType == slmDgram {
+		proto = 17
+	}
+	return Lines(fmt.Sprintf("#XSOCKET: %d,%d,%d", s.handle, socketType, proto), "OK")
+}
+
+func (m *SLM) selectSocket(cmd string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	handle, _ := strconv.Atoi(Args(cmd)[0])
+	if m.sockets[handle] == nil {
+		return Lines("ERROR")
+	}
+	m.selected = handle
+	return Lines(fmt.Sprintf("#XSOCKETSELECT: %d", handle), "OK")
+}
+
+func (m *SLM) socketOpt(cmd string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a := Args(cmd)
+	s := m.current()
+	if s == nil || len(a) < 3 {
+		return Lines("ERROR")
+	}
+	// SO_RCVTIMEO is the only option the driver sets
+	if a[1] == "20" {
+		seconds, _ := strconv.Atoi(a[2])
+		s.timeout = time.Duration(seconds) * time.Second
+	}
+	return OK
+}
+
+func (m *SLM) bind(cmd string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.current()
+	if s == nil || s.socketType != slmDgram {
+		return Lines("ERROR")
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return Lines("ERROR")
+	}
+	s.udp = conn
+	go m.readUDP(s)
+	return OK
+}
+
+func (m *SLM) connect(cmd string) string {
+	m.mu.Lock()
+	s := m.current()
+	m.mu.Unlock()
+
+	a := Args(cmd)
+	if s == nil || s.socketType != slmStream || len(a) < 2 {
+		return Lines("ERROR")
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(a[0], a[1]), 5*time.Second)
+	if err != nil {
+		return Lines("#XCONNECT: 0", "OK")
+	}
+
+	m.mu.Lock()
+	s.tcp = conn
+	m.mu.Unlock()
+	go m.readTCP(s)
+	return Lines("#XCONNECT: 1", "OK")
+}
+
+func (m *SLM) send(cmd string) string {
+	m.mu.Lock()
+	s := m.current()
+	m.mu.Unlock()
+
+	a := Args(cmd)
+	if s == nil || s.tcp == nil || len(a) < 2 {
+		return Lines("ERROR")
+	}
+	data, err := hex.DecodeString(a[1])
+	if err != nil {
+		return Lines("ERROR")
+	}
+	n, err := s.tcp.Write(data)
+	if err != nil {
+		return Lines("ERROR")
+	}
+	return Lines(fmt.Sprintf("#XSEND: %d", n), "OK")
+}
+
+func (m *SLM) recv(cmd string) string {
+	size, _ := strconv.Atoi(Args(cmd)[0])
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.current()
+	if s == nil || s.tcp == nil {
+		return Lines("ERROR")
+	}
+	if !m.wait(s.timeout, func() bool { return len(s.data) > 0 || s.eof }) || (len(s.data) == 0 && s.reset) {
+		return Lines("ERROR")
+	}
+	if size > len(s.data) {
+		size = len(s.data)
+	}
+	data := s.data[:size]
+	s.data = s.data[size:]
+	return Lines(fmt.Sprintf("#XRECV: %d", size)) + string(data) + Lines("OK")
+}
+
+func (m *SLM) sendTo(cmd string) string {
+	m.mu.Lock()
+	s := m.current()
+	m.mu.Unlock()
+
+	a := Args(cmd)
+	if s == nil || s.udp == nil || len(a) < 4 {
+		return Lines("ERROR")
+	}
+	port, _ := strconv.Atoi(a[1])
+	data, err := hex.DecodeString(a[3])
+	if err != nil {
+		return Lines("ERROR")
+	}
+	n, err := s.udp.WriteToUDP(data, &net.UDPAddr{IP: net.ParseIP(a[0]), Port: port})
+	if err != nil {
+		return Lines("ERROR")
+	}
+	return Lines(fmt.Sprintf("#XSENDTO: %d", n), "OK")
+}
+
+func (m *SLM) recvFrom(cmd string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.current()
+	if s == nil || s.udp == nil {
+		return Lines("ERROR")
+	}
+	if !m.wait(s.timeout, func() bool { return len(s.packets) > 0 }) {
+		return Lines("ERROR")
+	}
+	p := s.packets[0]
+	s.packets = s.packets[1:]
+	return Lines(fmt.Sprintf(`#XRECVFROM: %d,"%s",%d`, len(p.data), p.addr.IP, p.addr.Port)) + string(p.data) + Lines("OK")
+}
+
+// pollNow reports the events of the sockets right away. The timeout is
+// ignored.
+func (m *SLM) pollNow(cmd string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var lines []string
+	for _, h := range Args(cmd)[1:] {
+		handle, _ := strconv.Atoi(h)
+		s := m.sockets[handle]
+		if s == nil {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("#XPOLL: %d,%d", handle, s.events()))
+	}
+	return Lines(append(lines, "OK")...)
+}
+
+// events returns the poll events of the socket. The caller must hold m.mu.
+func (s *slmSocket) events() int {
+	events := 0
+	if len(s.data) > 0 || len(s.packets) > 0 || s.eof {
+		events |= slmPollIn
+	}
+	if s.eof {
+		events |= slmPollHup
+	}
+	if s.reset {
+		events |= slmPollErr
+	}
+	return events
+}
+
+func (m *SLM) poll(cmd string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a := Args(cmd)
+	m.polled = make(map[int]bool)
+	// Events that are pending when polling starts are reported right
+	// away
+	var events []string
+	if a[0] == "1" {
+		for _, h := range a[2:] {
+			handle, _ := strconv.Atoi(h)
+			m.polled[handle] = true
+			if s := m.sockets[handle]; s != nil && s.events() != 0 {
+				events = append(events, fmt.Sprintf("#XAPOLL: %d,%d", handle, s.events()))
+			}
+		}
+	}
+	return OK + Lines(events...)
+}
+
+// wait waits for ready to return true or the timeout to expire. A
+// timeout of 0 waits forever. The caller must hold m.mu.
+func (m *SLM) wait(timeout time.Duration, ready func() bool) bool {
+	if timeout == 0 {
+		timeout = time.Hour
+	}
+	expired := time.After(timeout)
+	for !ready() {
+		changed := m.changed
+		m.mu.Unlock()
+		select {
+		case <-changed:
+		case <-expired:
+			m.mu.Lock()
+			return ready()
+		}
+		m.mu.Lock()
+	}
+	return true
+}
+
+// notify wakes up waiting reads and reports the events for the socket if
+// it is polled. The caller must hold m.mu.
+func (m *SLM) notify(s *slmSocket, events int) {
+	close(m.changed)
+	m.changed = make(chan struct{})
+	if m.polled[s.handle] {
+		m.Write(Lines(fmt.Sprintf("#XAPOLL: %d,%d", s.handle, events)))
+	}
+}
+
+// readTCP reads from the TCP connection until it is closed
+func (m *SLM) readTCP(s *slmSocket) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := s.tcp.Read(buf)
+		m.mu.Lock()
+		if n > 0 {
+			s.data = append(s.data, buf[:n]...)
+			m.notify(s, slmPollIn)
+		}
+		if err != nil {
+			s.eof = true
+			s.reset = err != io.EOF
+			m.notify(s, s.events())
+			m.mu.Unlock()
+			return
+		}
+		m.mu.Unlock()
+	}
+}
+
+// readUDP reads datagrams until the socket is closed
+func (m *SLM) readUDP(s *slmSocket) {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.udp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		m.mu.Lock()
+		s.packets = append(s.packets, packet{data: append([]byte(nil), buf[:n]...), addr: addr})
+		m.notify(s, slmPollIn)
+		m.mu.Unlock()
+	}
+}
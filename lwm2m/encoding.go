@@ -0,0 +1,578 @@
+package lwm2m
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lab5e/at/coap"
+)
+
+// errUnsupportedFormat is returned when a payload can't be encoded or
+// decoded with the requested content format
+var errUnsupportedFormat = errors.New("unsupported content format")
+
+// resourceValue is the value of a resource that has been read. Single
+// resources have one value.
+type resourceValue struct {
+	id       uint16
+	typ      ResourceType
+	multiple bool
+	values   []interface{}
+}
+
+// instanceValue holds the resources read from an instance
+type instanceValue struct {
+	id        uint16
+	resources []resourceValue
+}
+
+// TLV identifier types
+const (
+	tlvInstance         = 0
+	tlvResourceInstance = 1
+	tlvMultipleResource = 2
+	tlvResource         = 3
+)
+
+// tlv is a decoded TLV entry
+type tlv struct {
+	kind     int
+	id       uint16
+	value    []byte
+	children []tlv
+}
+
+// encodePayload encodes the values read from the path. Single resources
+// are encoded in plain text unless another format is requested.
+func encodePayload(format coap.MediaType, path Path, instances []instanceValue) ([]byte, error) {
+	switch format {
+	case coap.AppLwM2MTLV:
+		return encodeTLV(path, instances)
+	case coap.AppSenMLJSON:
+		return encodeSenML(path, instances)
+	case coap.TextPlain, coap.AppOctets:
+		if len(instances) != 1 || len(instances[0].resources) != 1 || path.Resource < 0 {
+			return nil, errUnsupportedFormat
+		}
+		r := instances[0].resources[0]
+		if (r.multiple && path.ResourceInstance < 0) || len(r.values) != 1 {
+			return nil, errUnsupportedFormat
+		}
+		if format == coap.AppOctets {
+			b, ok := r.values[0].([]byte)
+			if !ok {
+				return nil, errUnsupportedFormat
+			}
+			return b, nil
+		}
+		return []byte(formatText(r.values[0])), nil
+	default:
+		return nil, errUnsupportedFormat
+	}
+}
+
+func encodeTLV(path Path, instances []instanceValue) ([]byte, error) {
+	var buf []byte
+	for _, inst := range instances {
+		var resources []byte
+		for _, r := range inst.resources {
+			resources = append(resources, encodeResourceTLV(path, r)...)
+		}
+		if path.Instance >= 0 {
+			buf = append(buf, resources...)
+			continue
+		}
+		buf = append(buf, tlvHeader(tlvInstance, inst.id, len(resources))...)
+		buf = append(buf, resources...)
+	}
+	return buf, nil
+}
+
+func encodeResourceTLV(path Path, r resourceValue) []byte {
+	if !r.multiple {
+		v := encodeBinary(r.values[0])
+		return append(tlvHeader(tlvResource, r.id, len(v)), v...)
+	}
+
+	var children []byte
+	for i, value := range r.values {
+		if value == nil {
+			continue
+		}
+		id := i
+		if path.ResourceInstance >= 0 {
+			id = path.ResourceInstance
+		}
+		v := encodeBinary(value)
+		children = append(children, tlvHeader(tlvResourceInstance, uint16(id), len(v))...)
+		children = append(children, v...)
+	}
+	if path.ResourceInstance >= 0 {
+		return children
+	}
+	return append(tlvHeader(tlvMultipleResource, r.id, len(children)), children...)
+}
+
+// tlvHeader returns the type byte, identifier and length of a TLV entry
+func tlvHeader(kind int, id uint16, length int) []byte {
+	t := byte(kind << 6)
+	buf := []byte{0}
+	if id > 0xff {
+		t |= 0x20
+		buf = append(buf, byte(id>>8), byte(id))
+	} else {
+		buf = append(buf, byte(id))
+	}
+	switch {
+	case length < 8:
+		t |= byte(length)
+	case length <= 0xff:
+		t |= 0x08
+		buf = append(buf, byte(length))
+	case length <= 0xffff:
+		t |= 0x10
+		buf = append(buf, byte(length>>8), byte(length))
+	default:
+		t |= 0x18
+		buf = append(buf, byte(length>>16), byte(length>>8), byte(length))
+	}
+	buf[0] = t
+	return buf
+}
+
+func decodeTLV(data []byte) ([]tlv, error) {
+	var ret []tlv
+	for len(data) > 0 {
+		t := data[0]
+		data = data[1:]
+
+		entry := tlv{kind: int(t >> 6)}
+		idLength := 1
+		if t&0x20 != 0 {
+			idLength = 2
+		}
+		lengthLength := int(t>>3) & 0x03
+		if len(data) < idLength+lengthLength {
+			return nil, errors.New("truncated TLV header")
+		}
+		for i := 0; i < idLength; i++ {
+			entry.id = entry.id<<8 | uint16(data[i])
+		}
+		data = data[idLength:]
+
+		length := int(t & 0x07)
+		if lengthLength > 0 {
+			length = 0
+			for i := 0; i < lengthLength; i++ {
+				length = length<<8 | int(data[i])
+			}
+			data = data[lengthLength:]
+		}
+		if len(data) < length {
+			return nil, errors.New("truncated TLV value")
+		}
+		entry.value = data[:length]
+		data = data[length:]
+
+		if entry.kind == tlvInstance || entry.kind == tlvMultipleResource {
+			children, err := decodeTLV(entry.value)
+			if err != nil {
+				return nil, err
+			}
+			entry.children = children
+		}
+		ret = append(ret, entry)
+	}
+	return ret, nil
+}
+
+// encodeBinary encodes a value for TLV
+func encodeBinary(v interface{}) []byte {
+	switch val := v.(type) {
+	case string:
+		return []byte(val)
+	case int64:
+		switch {
+		case val >= math.MinInt8 && val <= math.MaxInt8:
+			return []byte{byte(val)}
+		case val >= math.MinInt16 && val <= math.MaxInt16:
+			return []byte{byte(val >> 8), byte(val)}
+		case val >= math.MinInt32 && val <= math.MaxInt32:
+			b := make([]byte, 4)
+			binary.BigEndian.PutUint32(b, uint32(val))
+			return b
+		default:
+			b := make([]byte, 8)
+			binary.BigEndian.PutUint64(b, uint64(val))
+			return b
+		}
+	case uint64:
+		switch {
+		case val <= math.MaxUint8:
+			return []byte{byte(val)}
+		case val <= math.MaxUint16:
+			return []byte{byte(val >> 8), byte(val)}
+		case val <= math.MaxUint32:
+			b := make([]byte, 4)
+			binary.BigEndian.PutUint32(b, uint32(val))
+			return b
+		default:
+			b := make([]byte, 8)
+			binary.BigEndian.PutUint64(b, val)
+			return b
+		}
+	case float64:
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, math.Float64bits(val))
+		return b
+	case bool:
+		if val {
+			return []byte{1}
+		}
+		return []byte{0}
+	case []byte:
+		return val
+	case time.Time:
+		return encodeBinary(val.Unix())
+	case ObjectLink:
+		return []byte{byte(val.Object >> 8), byte(val.Object), byte(val.Instance >> 8), byte(val.Instance)}
+	}
+	return nil
+}
+
+// decodeBinary decodes a TLV value
+func decodeBinary(t ResourceType, b []byte) (interface{}, error) {
+	switch t {
+	case String:
+		return string(b), nil
+	case Integer, Time:
+		var n int64
+		switch len(b) {
+		case 1:
+			n = int64(int8(b[0]))
+		case 2:
+			n = int64(int16(binary.BigEndian.Uint16(b)))
+		case 4:
+			n = int64(int32(binary.BigEndian.Uint32(b)))
+		case 8:
+			n = int64(binary.BigEndian.Uint64(b))
+		default:
+			return nil, errors.New("invalid integer length")
+		}
+		if t == Time {
+			return time.Unix(n, 0), nil
+		}
+		return n, nil
+	case UnsignedInteger:
+		if len(b) != 1 && len(b) != 2 && len(b) != 4 && len(b) != 8 {
+			return nil, errors.New("invalid unsigned integer length")
+		}
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, nil
+	case Float:
+		switch len(b) {
+		case 4:
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+		case 8:
+			return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+		}
+		return nil, errors.New("invalid float length")
+	case Boolean:
+		if len(b) != 1 || b[0] > 1 {
+			return nil, errors.New("invalid boolean")
+		}
+		return b[0] == 1, nil
+	case Opaque:
+		return append([]byte(nil), b...), nil
+	case ObjLink:
+		if len(b) != 4 {
+			return nil, errors.New("invalid object link length")
+		}
+		return ObjectLink{Object: binary.BigEndian.Uint16(b), Instance: binary.BigEndian.Uint16(b[2:])}, nil
+	}
+	return nil, errUnsupportedFormat
+}
+
+// formatText formats a value as plain text
+func formatText(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case int64:
+		return strconv.FormatInt(val, 10)
+	case uint64:
+		return strconv.FormatUint(val, 10)
+	case float64:
+		return strconv.FormatFloat(val, 'g', -1, 64)
+	case bool:
+		if val {
+			return "1"
+		}
+		return "0"
+	case []byte:
+		return base64.StdEncoding.EncodeToString(val)
+	case time.Time:
+		return strconv.FormatInt(val.Unix(), 10)
+	case ObjectLink:
+		return fmt.Sprintf("%d:%d", val.Object, val.Instance)
+	}
+	return ""
+}
+
+// parseText parses a plain text value
+func parseText(t ResourceType, s string) (interface{}, error) {
+	switch t {
+	case String:
+		return s, nil
+	case Integer:
+		return strconv.ParseInt(s, 10, 64)
+	case UnsignedInteger:
+		return strconv.ParseUint(s, 10, 64)
+	case Float:
+		return strconv.ParseFloat(s, 64)
+	case Boolean:
+		switch s {
+		case "1":
+			return true, nil
+		case "0":
+			return false, nil
+		}
+		return nil, errors.New("invalid boolean")
+	case Opaque:
+		return base64.StdEncoding.DecodeString(s)
+	case Time:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return time.Unix(n, 0), nil
+	case ObjLink:
+		parts := strings.Split(s, ":")
+		if len(parts) != 2 {
+			return nil, errors.New("invalid object link")
+		}
+		o, err := strconv.ParseUint(parts[0], 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		i, err := strconv.ParseUint(parts[1], 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		return ObjectLink{Object: uint16(o), Instance: uint16(i)}, nil
+	}
+	return nil, errUnsupportedFormat
+}
+
+// senmlRecord is a SenML JSON record (RFC 8428) as used by LwM2M 1.1
+type senmlRecord struct {
+	BaseName    string       `json:"bn,omitempty"`
+	Name        string       `json:"n,omitempty"`
+	Value       *json.Number `json:"v,omitempty"`
+	StringValue *string      `json:"vs,omitempty"`
+	BoolValue   *bool        `json:"vb,omitempty"`
+	DataValue   *string      `json:"vd,omitempty"`
+	ObjectLink  *string      `json:"vlo,omitempty"`
+}
+
+func encodeSenML(path Path, instances []instanceValue) ([]byte, error) {
+	var records []senmlRecord
+	for _, inst := range instances {
+		for _, r := range inst.resources {
+			for i, v := range r.values {
+				if v == nil {
+					continue
+				}
+				name := fmt.Sprintf("/%d/%d/%d", path.Object, inst.id, r.id)
+				if r.multiple {
+					id := i
+					if path.ResourceInstance >= 0 {
+						id = path.ResourceInstance
+					}
+					name += "/" + strconv.Itoa(id)
+				}
+				records = append(records, senmlValue(name, v))
+			}
+		}
+	}
+	return json.Marshal(records)
+}
+
+func senmlValue(name string, v interface{}) senmlRecord {
+	rec := senmlRecord{Name: name}
+	switch val := v.(type) {
+	case string:
+		rec.StringValue = &val
+	case bool:
+		rec.BoolValue = &val
+	case []byte:
+		s := base64.RawURLEncoding.EncodeToString(val)
+		rec.DataValue = &s
+	case ObjectLink:
+		s := formatText(val)
+		rec.ObjectLink = &s
+	default:
+		n := json.Number(formatText(val))
+		rec.Value = &n
+	}
+	return rec
+}
+
+// decodeSenML decodes the records and returns the values by path
+func decodeSenML(data []byte) (map[Path]senmlRecord, error) {
+	var records []senmlRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	ret := make(map[Path]senmlRecord)
+	baseName := ""
+	for _, rec := range records {
+		if rec.BaseName != "" {
+			baseName = rec.BaseName
+		}
+		p, err := ParsePath(baseName + rec.Name)
+		if err != nil {
+			return nil, err
+		}
+		ret[p] = rec
+	}
+	return ret, nil
+}
+
+// senmlToValue converts a record to a value of the resource type
+func senmlToValue(t ResourceType, rec senmlRecord) (interface{}, error) {
+	switch {
+	case rec.StringValue != nil && t == String:
+		return *rec.StringValue, nil
+	case rec.BoolValue != nil && t == Boolean:
+		return *rec.BoolValue, nil
+	case rec.DataValue != nil && t == Opaque:
+		s := strings.TrimRight(*rec.DataValue, "=")
+		if b, err := base64.RawURLEncoding.DecodeString(s); err == nil {
+			return b, nil
+		}
+		return base64.RawStdEncoding.DecodeString(s)
+	case rec.ObjectLink != nil && t == ObjLink:
+		return parseText(t, *rec.ObjectLink)
+	case rec.Value != nil:
+		switch t {
+		case Integer, UnsignedInteger, Float, Time:
+			return parseText(t, rec.Value.String())
+		}
+	}
+	return nil, errors.New("SenML record doesn't match the resource type")
+}
+
+// decodeWrite decodes the payload of a write to the instance or a
+// resource in it and returns the new values by resource ID.
+func decodeWrite(format coap.MediaType, path Path, inst *Instance, payload []byte) (map[uint16]interface{}, error) {
+	ret := make(map[uint16]interface{})
+	switch format {
+	case coap.AppLwM2MTLV:
+		entries, err := decodeTLV(payload)
+		if err != nil {
+			return nil, err
+		}
+		// Writes to an instance may wrap the resources in the instance
+		if len(entries) == 1 && entries[0].kind == tlvInstance {
+			entries = entries[0].children
+		}
+		for _, e := range entries {
+			id := e.id
+			if path.Resource >= 0 {
+				id = uint16(path.Resource)
+			}
+			r := inst.Resource(id)
+			if r == nil {
+				return nil, ErrNotFound
+			}
+			switch e.kind {
+			case tlvResource:
+				v, err := decodeBinary(r.Type, e.value)
+				if err != nil {
+					return nil, err
+				}
+				ret[id] = v
+			case tlvMultipleResource:
+				var values []interface{}
+				for _, c := range e.children {
+					v, err := decodeBinary(r.Type, c.value)
+					if err != nil {
+						return nil, err
+					}
+					values = setIndex(values, int(c.id), v)
+				}
+				ret[id] = values
+			default:
+				return nil, errors.New("unexpected TLV entry")
+			}
+		}
+
+	case coap.AppSenMLJSON:
+		records, err := decodeSenML(payload)
+		if err != nil {
+			return nil, err
+		}
+		for p, rec := range records {
+			if p.Object != path.Object || p.Instance != int(inst.ID) || p.Resource < 0 {
+				return nil, errors.New("SenML record outside the target")
+			}
+			r := inst.Resource(uint16(p.Resource))
+			if r == nil {
+				return nil, ErrNotFound
+			}
+			v, err := senmlToValue(r.Type, rec)
+			if err != nil {
+				return nil, err
+			}
+			if p.ResourceInstance >= 0 {
+				values, _ := ret[r.ID].([]interface{})
+				ret[r.ID] = setIndex(values, p.ResourceInstance, v)
+				continue
+			}
+			ret[r.ID] = v
+		}
+
+	case coap.TextPlain, coap.AppOctets:
+		if path.Resource < 0 {
+			return nil, errUnsupportedFormat
+		}
+		r := inst.Resource(uint16(path.Resource))
+		if r == nil {
+			return nil, ErrNotFound
+		}
+		var v interface{} = append([]byte(nil), payload...)
+		var err error
+		if format == coap.TextPlain {
+			if v, err = parseText(r.Type, string(payload)); err != nil {
+				return nil, err
+			}
+		} else if r.Type != Opaque {
+			return nil, errUnsupportedFormat
+		}
+		ret[r.ID] = v
+
+	default:
+		return nil, errUnsupportedFormat
+	}
+	return ret, nil
+}
+
+// setIndex sets the value at the index, growing the slice as needed
+func setIndex(values []interface{}, i int, v interface{}) []interface{} {
+	for len(values) <= i {
+		values = append(values, nil)
+	}
+	values[i] = v
+	return values
+}
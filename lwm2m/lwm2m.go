@@ -0,0 +1,374 @@
+// Package lwm2m implements an LwM2M 1.1 client on top of the UDP sockets
+// of a device. The client registers with an LwM2M server over CoAP
+// without security and serves the Security (0), Server (1), Device (3) and
+// Connectivity Monitoring (4) objects, populated from the device.
+// Applications can add their own objects.
+//
+// The server can read, write, execute, discover, observe and set
+// notification attributes. Bootstrapping and creating or deleting
+// instances from the server aren't supported.
+//
+// Example:
+//
+//	client, err := lwm2m.New(device, nil)
+//	if err != nil {
+//	    log.Fatalf("Could not create client: %v", err)
+//	}
+//	temp := lwm2m.NewObject(3303)
+//	temp.AddInstance(0, &lwm2m.Resource{ID: 5700, Type: lwm2m.Float, Read: readTemperature})
+//	client.AddObject(temp)
+//	if err := client.Register(ctx, "leshan.example.com:5683"); err != nil {
+//	    log.Fatalf("Could not register: %v", err)
+//	}
+//	...
+//	client.Changed("/3303/0/5700")
+package lwm2m
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lab5e/at"
+	"github.com/lab5e/at/coap"
+)
+
+// DefaultLifetime is the default registration lifetime
+const DefaultLifetime = time.Hour
+
+// DefaultShortServerID is the default short server ID
+const DefaultShortServerID = 1
+
+// minUpdateMargin is the least time before the registration expires that
+// the client sends the registration update
+const minUpdateMargin = 30 * time.Second
+
+// Options are the client options. Zero values use the defaults.
+type Options struct {
+	// Endpoint is the endpoint client name. The default is
+	// urn:imei:<IMEI>.
+	Endpoint string
+
+	// Lifetime is the registration lifetime
+	Lifetime time.Duration
+
+	// ShortServerID is the short server ID in the Security and Server
+	// objects
+	ShortServerID uint16
+
+	// NetworkBearer is the network bearer reported in the Connectivity
+	// Monitoring object. The default is BearerNBIoT.
+	NetworkBearer int
+
+	// CoAP are the options for the CoAP transport
+	CoAP *coap.Options
+}
+
+// Client is an LwM2M client
+type Client struct {
+	device        at.Device
+	endpoint      string
+	shortServerID uint16
+	coapOptions   *coap.Options
+
+	mu           sync.Mutex
+	objects      map[uint16]*Object
+	lifetime     time.Duration
+	server       string
+	coap         *coap.Client
+	location     string
+	sendLifetime bool
+	sendObjects  bool
+	trigger      chan struct{}
+	stop         chan struct{}
+	observations map[string]*observation
+	attributes   map[Path]attributes
+}
+
+// New creates a client for the device with the standard objects
+func New(device at.Device, opts *Options) (*Client, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	c := &Client{
+		device:        device,
+		endpoint:      opts.Endpoint,
+		shortServerID: opts.ShortServerID,
+		lifetime:      opts.Lifetime,
+		objects:       make(map[uint16]*Object),
+		trigger:       make(chan struct{}, 1),
+		observations:  make(map[string]*observation),
+		attributes:    make(map[Path]attributes),
+		coapOptions:   opts.CoAP,
+	}
+	if c.shortServerID == 0 {
+		c.shortServerID = DefaultShortServerID
+	}
+	if c.lifetime == 0 {
+		c.lifetime = DefaultLifetime
+	}
+	if c.endpoint == "" {
+		imei, err := device.GetIMEI()
+		if err != nil {
+			return nil, err
+		}
+		if imei == "" {
+			return nil, errors.New("could not read IMEI for the endpoint name")
+		}
+		c.endpoint = "urn:imei:" + imei
+	}
+	bearer := opts.NetworkBearer
+	if bearer == 0 {
+		bearer = BearerNBIoT
+	}
+
+	c.addStandardObjects(bearer)
+	return c, nil
+}
+
+// Endpoint returns the endpoint client name
+func (c *Client) Endpoint() string {
+	return c.endpoint
+}
+
+// AddObject adds an object. If the client is registered the server is
+// told about the object with a registration update.
+func (c *Client) AddObject(obj *Object) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.objects[obj.ID]; exists {
+		return fmt.Errorf("object %d already exists", obj.ID)
+	}
+	c.objects[obj.ID] = obj
+	c.sendObjects = true
+	c.triggerUpdate()
+	return nil
+}
+
+// Object returns the object with the ID or nil if there is none
+func (c *Client) Object(id uint16) *Object {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.objects[id]
+}
+
+// Register registers with the server. The address is host:port or a
+// coap:// URI. The client keeps the registration alive with updates
+// until Deregister is called.
+func (c *Client) Register(ctx context.Context, server string) error {
+	c.mu.Lock()
+	if c.coap != nil {
+		c.mu.Unlock()
+		return errors.New("already registered")
+	}
+	c.mu.Unlock()
+
+	address := strings.TrimSuffix(strings.TrimPrefix(server, "coap://"), "/")
+	client, err := coap.Dial(ctx, c.device, address, c.coapOptions)
+	if err != nil {
+		return err
+	}
+	client.HandleRequests(c.serve)
+
+	c.mu.Lock()
+	c.coap = client
+	c.server = "coap://" + address
+	c.mu.Unlock()
+
+	if err := c.register(ctx); err != nil {
+		c.mu.Lock()
+		c.coap = nil
+		c.mu.Unlock()
+		client.Close()
+		return err
+	}
+
+	c.mu.Lock()
+	c.stop = make(chan struct{})
+	go c.updateLoop(client, c.stop)
+	c.mu.Unlock()
+	return nil
+}
+
+// register sends the registration request
+func (c *Client) register(ctx context.Context) error {
+	c.mu.Lock()
+	client := c.coap
+	req := coap.NewRequest(coap.POST, "/rd")
+	req.AddQuery("ep=" + c.endpoint)
+	req.AddQuery("lt=" + strconv.Itoa(int(c.lifetime/time.Second)))
+	req.AddQuery("lwm2m=1.1")
+	req.AddQuery("b=U")
+	req.SetContentFormat(coap.AppLinkFormat)
+	req.Payload = []byte(c.links())
+	c.mu.Unlock()
+
+	resp, err := client.Do(ctx, req)
+	if err != nil {
+		return err
+	}
+	if resp.Code != coap.Created {
+		return fmt.Errorf("registration failed with code %s", resp.Code)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.location = resp.LocationPath()
+	c.sendLifetime = false
+	c.sendObjects = false
+	return nil
+}
+
+// Update sends a registration update. If the server has forgotten the
+// registration the client registers again.
+func (c *Client) Update(ctx context.Context) error {
+	c.mu.Lock()
+	client := c.coap
+	if client == nil {
+		c.mu.Unlock()
+		return errors.New("not registered")
+	}
+	req := coap.NewRequest(coap.POST, "/"+c.location)
+	if c.sendLifetime {
+		req.AddQuery("lt=" + strconv.Itoa(int(c.lifetime/time.Second)))
+	}
+	if c.sendObjects {
+		req.SetContentFormat(coap.AppLinkFormat)
+		req.Payload = []byte(c.links())
+	}
+	c.mu.Unlock()
+
+	resp, err := client.Do(ctx, req)
+	if err != nil {
+		return err
+	}
+	switch resp.Code {
+	case coap.Changed:
+		c.mu.Lock()
+		c.sendLifetime = false
+		c.sendObjects = false
+		c.mu.Unlock()
+		return nil
+	case coap.NotFound:
+		return c.register(ctx)
+	default:
+		return fmt.Errorf("registration update failed with code %s", resp.Code)
+	}
+}
+
+// Deregister removes the registration from the server and closes the
+// connection.
+func (c *Client) Deregister(ctx context.Context) error {
+	c.mu.Lock()
+	client := c.coap
+	if client == nil {
+		c.mu.Unlock()
+		return errors.New("not registered")
+	}
+	close(c.stop)
+	location := c.location
+	c.mu.Unlock()
+
+	c.cancelObservations()
+	resp, err := client.Delete(ctx, "/"+location)
+
+	c.mu.Lock()
+	c.coap = nil
+	c.location = ""
+	c.mu.Unlock()
+	client.Close()
+
+	if err != nil {
+		return err
+	}
+	if resp.Code != coap.Deleted {
+		return fmt.Errorf("deregistration failed with code %s", resp.Code)
+	}
+	return nil
+}
+
+// triggerUpdate makes the update loop send an update right away. The
+// lock must be held.
+func (c *Client) triggerUpdate() {
+	if c.coap == nil {
+		return
+	}
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// updateLoop sends registration updates before the registration expires
+// and when triggered.
+func (c *Client) updateLoop(client *coap.Client, stop chan struct{}) {
+	for {
+		c.mu.Lock()
+		interval := c.lifetime - c.lifetime/10
+		if c.lifetime-interval < minUpdateMargin {
+			interval = c.lifetime - minUpdateMargin
+		}
+		c.mu.Unlock()
+		if interval < time.Second {
+			interval = time.Second
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-c.trigger:
+			timer.Stop()
+		case <-stop:
+			timer.Stop()
+			return
+		}
+
+		if err := c.Update(context.Background()); err != nil {
+			log.Printf("LwM2M registration update failed: %v", err)
+		}
+	}
+}
+
+// links returns the registered objects and instances in CoRE link
+// format. The Security object isn't included. The lock must be held.
+func (c *Client) links() string {
+	ids := make([]int, 0, len(c.objects))
+	for id := range c.objects {
+		if id != SecurityObjectID {
+			ids = append(ids, int(id))
+		}
+	}
+	sort.Ints(ids)
+
+	links := []string{fmt.Sprintf(`</>;rt="oma.lwm2m";ct="%d %d"`, coap.AppSenMLJSON, coap.AppLwM2MTLV)}
+	for _, id := range ids {
+		obj := c.objects[uint16(id)]
+		instances := obj.Instances()
+		if obj.Version != "" {
+			links = append(links, fmt.Sprintf("</%d>;ver=%s", id, obj.Version))
+		} else if len(instances) == 0 {
+			links = append(links, fmt.Sprintf("</%d>", id))
+		}
+		for _, inst := range instances {
+			links = append(links, fmt.Sprintf("</%d/%d>", id, inst.ID))
+		}
+	}
+	return strings.Join(links, ",")
+}
+
+// setLifetime changes the registration lifetime and sends an update
+func (c *Client) setLifetime(lifetime time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lifetime = lifetime
+	c.sendLifetime = true
+	c.triggerUpdate()
+}
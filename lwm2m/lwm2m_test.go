@@ -0,0 +1,317 @@
+//go:build linux
+// +build linux
+
+package lwm2m_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lab5e/at/coap"
+	"github.com/lab5e/at/internal/fakemodem"
+	"github.com/lab5e/at/lwm2m"
+	"github.com/lab5e/at/nrf91"
+)
+
+const (
+	testIMEI = "352656100000001"
+	testIMSI = "242016000000001"
+)
+
+// server is a LwM2M server stand-in. It accepts the registration and
+// records the requests from the client. The client is reached through
+// the CoAP client in the other direction.
+type server struct {
+	conn     net.PacketConn
+	register chan *coap.Message
+	requests chan *coap.Message
+
+	mu   sync.Mutex
+	coap *coap.Client
+}
+
+// startServer starts a server stand-in on the loopback interface
+func startServer(t *testing.T) *server {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	s := &server{
+		conn:     conn,
+		register: make(chan *coap.Message, 1),
+		requests: make(chan *coap.Message, 16),
+	}
+	t.Cleanup(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.coap != nil {
+			s.coap.Close()
+		} else {
+			conn.Close()
+		}
+	})
+	go s.accept(t)
+	return s
+}
+
+// accept answers the registration and serves the following requests
+// from the client
+func (s *server) accept(t *testing.T) {
+	buf := make([]byte, 2048)
+	n, addr, err := s.conn.ReadFrom(buf)
+	if err != nil {
+		return
+	}
+	req, err := coap.Unmarshal(buf[:n])
+	if err != nil {
+		t.Errorf("Invalid registration: %v", err)
+		return
+	}
+
+	client := coap.NewClient(s.conn, addr, nil)
+	client.HandleRequests(func(req *coap.Message) *coap.Message {
+		s.requests <- req
+		if req.Code == coap.DELETE {
+			return &coap.Message{Code: coap.Deleted}
+		}
+		return &coap.Message{Code: coap.Changed}
+	})
+	s.mu.Lock()
+	s.coap = client
+	s.mu.Unlock()
+
+	resp := &coap.Message{Type: coap.Acknowledgement, Code: coap.Created, MessageID: req.MessageID, Token: req.Token}
+	resp.AddOption(coap.LocationPath, []byte("rd"))
+	resp.AddOption(coap.LocationPath, []byte("1"))
+	data, err := resp.Marshal()
+	if err != nil {
+		t.Errorf("Could not encode response: %v", err)
+		return
+	}
+	s.register <- req
+	s.conn.WriteTo(data, addr)
+}
+
+// client returns the CoAP client talking to the LwM2M client
+func (s *server) client() *coap.Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.coap
+}
+
+// request waits for a request from the client
+func (s *server) request(t *testing.T) *coap.Message {
+	t.Helper()
+	select {
+	case req := <-s.requests:
+		return req
+	case <-time.After(10 * time.Second):
+		t.Fatal("No request from the client")
+		return nil
+	}
+}
+
+// newClient creates a client for an nRF91 talking to a fake modem
+func newClient(t *testing.T) (*lwm2m.Client, *fakemodem.SLM) {
+	m := fakemodem.NewSLM(t)
+	m.Reply("AT+CGSN", fakemodem.Lines(testIMEI, "OK"))
+	m.Reply("AT+CIMI", fakemodem.Lines(testIMSI, "OK"))
+	m.Reply("AT+CEREG?", fakemodem.Lines("+CEREG: 0,1", "OK"))
+	m.Reply("AT+CGMI", fakemodem.Lines("Nordic Semiconductor ASA", "OK"))
+	m.Reply("AT+CGMM", fakemodem.Lines("nRF9160-SICA", "OK"))
+	m.Reply("AT+CGMR", fakemodem.Lines("mfw_nrf9160_1.3.0", "OK"))
+
+	device := nrf91.New(m.Path(), nrf91.DefaultBaudRate)
+	if err := device.Start(); err != nil {
+		t.Fatalf("Could not start device: %v", err)
+	}
+	t.Cleanup(device.Close)
+
+	client, err := lwm2m.New(device, nil)
+	if err != nil {
+		t.Fatalf("Could not create client: %v", err)
+	}
+	return client, m
+}
+
+// register registers the client with a new server stand-in
+func register(t *testing.T, client *lwm2m.Client) (*server, *coap.Message) {
+	s := startServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := client.Register(ctx, s.conn.LocalAddr().String()); err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	return s, <-s.register
+}
+
+func TestRegister(t *testing.T) {
+	client, _ := newClient(t)
+	s, req := register(t, client)
+
+	if req.Code != coap.POST || req.Path() != "rd" {
+		t.Fatalf("Expected POST rd, got %s %s", req.Code, req.Path())
+	}
+	queries := strings.Join(req.Queries(), "&")
+	if !strings.Contains(queries, "ep=urn:imei:"+testIMEI) || !strings.Contains(queries, "lt=") {
+		t.Fatalf("Unexpected queries: %s", queries)
+	}
+	links := string(req.Payload)
+	for _, link := range []string{"</1/0>", "</3/0>", "</4/0>"} {
+		if !strings.Contains(links, link) {
+			t.Fatalf("Expected %s in the links: %s", link, links)
+		}
+	}
+	if strings.Contains(links, "</0/0>") {
+		t.Fatalf("The Security object is registered: %s", links)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := client.Deregister(ctx); err != nil {
+		t.Fatalf("Could not deregister: %v", err)
+	}
+	if req := s.request(t); req.Code != coap.DELETE || req.Path() != "rd/1" {
+		t.Fatalf("Expected DELETE rd/1, got %s %s", req.Code, req.Path())
+	}
+}
+
+func TestRead(t *testing.T) {
+	client, m := newClient(t)
+	s, _ := register(t, client)
+
+	read := func(path string) (coap.Code, string) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		resp, err := s.client().Get(ctx, path)
+		if err != nil {
+			t.Fatalf("Could not read %s: %v", path, err)
+		}
+		return resp.Code, string(resp.Payload)
+	}
+
+	for path, expected := range map[string]string{
+		"/3/0/0":  "Nordic Semiconductor ASA",
+		"/3/0/2":  testIMEI,
+		"/4/0/9":  "1",
+		"/4/0/10": "242",
+	} {
+		if code, value := read(path); code != coap.Content || value != expected {
+			t.Fatalf("Expected %s for %s, got %s %q", expected, path, code, value)
+		}
+	}
+
+	if code, _ := read("/0/0/0"); code != coap.Unauthorized {
+		t.Fatalf("Expected the Security object to be hidden, got %s", code)
+	}
+
+	// The serving network isn't known when roaming
+	m.Reply("AT+CEREG?", fakemodem.Lines("+CEREG: 0,5", "OK"))
+	if code, _ := read("/4/0/10"); code != coap.NotFound {
+		t.Fatalf("Expected no MCC when roaming, got %s", code)
+	}
+}
+
+func TestWriteExecute(t *testing.T) {
+	client, _ := newClient(t)
+	s, _ := register(t, client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Writing the lifetime sends an update with the new lifetime
+	resp, err := s.client().Put(ctx, "/1/0/1", coap.TextPlain, []byte("600"))
+	if err != nil || resp.Code != coap.Changed {
+		t.Fatalf("Could not write the lifetime: %v %v", resp, err)
+	}
+	req := s.request(t)
+	if req.Code != coap.POST || req.Path() != "rd/1" {
+		t.Fatalf("Expected an update, got %s %s", req.Code, req.Path())
+	}
+	if queries := req.Queries(); len(queries) != 1 || queries[0] != "lt=600" {
+		t.Fatalf("Expected the new lifetime in the update, got %v", queries)
+	}
+
+	if resp, err := s.client().Put(ctx, "/1/0/1", coap.TextPlain, []byte("0")); err != nil || resp.Code == coap.Changed {
+		t.Fatalf("Expected an invalid lifetime to be rejected: %v %v", resp, err)
+	}
+
+	// Registration Update Trigger sends an update without the lifetime
+	resp, err = s.client().Post(ctx, "/1/0/8", coap.TextPlain, nil)
+	if err != nil || resp.Code != coap.Changed {
+		t.Fatalf("Could not execute the update trigger: %v %v", resp, err)
+	}
+	req = s.request(t)
+	if req.Code != coap.POST || req.Path() != "rd/1" || len(req.Queries()) != 0 {
+		t.Fatalf("Expected an update, got %s %s %v", req.Code, req.Path(), req.Queries())
+	}
+
+	// Resources that can't be executed
+	if resp, err := s.client().Post(ctx, "/3/0/0", coap.TextPlain, nil); err != nil || resp.Code != coap.MethodNotAllowed {
+		t.Fatalf("Expected 4.05, got %v %v", resp, err)
+	}
+}
+
+func TestObserve(t *testing.T) {
+	client, _ := newClient(t)
+
+	var mu sync.Mutex
+	value := int64(20)
+	temperature := lwm2m.NewObject(3303)
+	temperature.AddInstance(0, &lwm2m.Resource{ID: 5700, Type: lwm2m.Integer, Read: func() (interface{}, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return value, nil
+	}})
+	if err := client.AddObject(temperature); err != nil {
+		t.Fatalf("Could not add object: %v", err)
+	}
+
+	s, req := register(t, client)
+	if !strings.Contains(string(req.Payload), "</3303/0>") {
+		t.Fatalf("Expected the object in the links: %s", req.Payload)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	notifications := make(chan string, 4)
+	obs, err := s.client().Observe(ctx, "/3303/0/5700", func(msg *coap.Message) {
+		notifications <- string(msg.Payload)
+	})
+	if err != nil {
+		t.Fatalf("Could not observe: %v", err)
+	}
+
+	notification := func() string {
+		t.Helper()
+		select {
+		case n := <-notifications:
+			return n
+		case <-time.After(10 * time.Second):
+			t.Fatal("No notification")
+			return ""
+		}
+	}
+	if n := notification(); n != "20" {
+		t.Fatalf("Expected the current value, got %q", n)
+	}
+
+	mu.Lock()
+	value = 21
+	mu.Unlock()
+	if err := client.Changed("/3303/0/5700"); err != nil {
+		t.Fatalf("Changed failed: %v", err)
+	}
+	if n := notification(); n != "21" {
+		t.Fatalf("Expected the new value, got %q", n)
+	}
+
+	if err := obs.Cancel(ctx); err != nil {
+		t.Fatalf("Could not cancel the observation: %v", err)
+	}
+}
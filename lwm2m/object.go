@@ -0,0 +1,299 @@
+package lwm2m
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResourceType is the data type of a resource. The Go types of the values
+// are string, int64, uint64, float64, bool, []byte, time.Time and
+// ObjectLink.
+type ResourceType int
+
+// Resource data types
+const (
+	String ResourceType = iota
+	Integer
+	UnsignedInteger
+	Float
+	Boolean
+	Opaque
+	Time
+	ObjLink
+)
+
+// ObjectLink refers to an object instance
+type ObjectLink struct {
+	Object   uint16
+	Instance uint16
+}
+
+var (
+	// ErrNotFound is returned when the object, instance or resource
+	// doesn't exist
+	ErrNotFound = errors.New("not found")
+
+	// ErrNotAllowed is returned when the operation isn't supported by
+	// the resource
+	ErrNotAllowed = errors.New("operation not allowed")
+)
+
+// Resource is a resource in an object instance. The operations the
+// resource supports depend on which of the functions are set. Multiple
+// instance resources read and write []interface{} where the index is the
+// resource instance ID.
+type Resource struct {
+	ID       uint16
+	Type     ResourceType
+	Multiple bool
+	Read     func() (interface{}, error)
+	Write    func(value interface{}) error
+	Execute  func(args string) error
+}
+
+// Constant returns a read function for a resource with a fixed value
+func Constant(value interface{}) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		return value, nil
+	}
+}
+
+// Instance is an object instance
+type Instance struct {
+	ID        uint16
+	Resources []*Resource
+}
+
+// Resource returns the resource with the ID or nil if there is none
+func (i *Instance) Resource(id uint16) *Resource {
+	for _, r := range i.Resources {
+		if r.ID == id {
+			return r
+		}
+	}
+	return nil
+}
+
+// Object is an LwM2M object and its instances
+type Object struct {
+	ID uint16
+
+	// Version is the object version reported when registering. Leave
+	// it empty for version 1.0.
+	Version string
+
+	mu        sync.Mutex
+	instances []*Instance
+}
+
+// NewObject creates an object with no instances
+func NewObject(id uint16) *Object {
+	return &Object{ID: id}
+}
+
+// AddInstance adds an instance with the resources, replacing any
+// existing instance with the same ID.
+func (o *Object) AddInstance(id uint16, resources ...*Resource) *Instance {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	inst := &Instance{ID: id, Resources: resources}
+	for i, existing := range o.instances {
+		if existing.ID == id {
+			o.instances[i] = inst
+			return inst
+		}
+	}
+	o.instances = append(o.instances, inst)
+	sort.Slice(o.instances, func(i, j int) bool {
+		return o.instances[i].ID < o.instances[j].ID
+	})
+	return inst
+}
+
+// RemoveInstance removes the instance
+func (o *Object) RemoveInstance(id uint16) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	instances := o.instances[:0]
+	for _, inst := range o.instances {
+		if inst.ID != id {
+			instances = append(instances, inst)
+		}
+	}
+	o.instances = instances
+}
+
+// Instance returns the instance with the ID or nil if there is none
+func (o *Object) Instance(id uint16) *Instance {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, inst := range o.instances {
+		if inst.ID == id {
+			return inst
+		}
+	}
+	return nil
+}
+
+// Instances returns the instances of the object
+func (o *Object) Instances() []*Instance {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]*Instance(nil), o.instances...)
+}
+
+// Path is an LwM2M path, ie /3/0/1. Unused levels are -1.
+type Path struct {
+	Object           int
+	Instance         int
+	Resource         int
+	ResourceInstance int
+}
+
+// ParsePath parses a path with up to four levels
+func ParsePath(s string) (Path, error) {
+	p := Path{Object: -1, Instance: -1, Resource: -1, ResourceInstance: -1}
+	s = strings.Trim(s, "/")
+	if s == "" {
+		return p, nil
+	}
+
+	parts := strings.Split(s, "/")
+	if len(parts) > 4 {
+		return p, fmt.Errorf("path %s has too many levels", s)
+	}
+	levels := []*int{&p.Object, &p.Instance, &p.Resource, &p.ResourceInstance}
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 16)
+		if err != nil {
+			return p, fmt.Errorf("invalid path %s", s)
+		}
+		*levels[i] = int(n)
+	}
+	return p, nil
+}
+
+func (p Path) String() string {
+	s := ""
+	for _, n := range []int{p.Object, p.Instance, p.Resource, p.ResourceInstance} {
+		if n < 0 {
+			break
+		}
+		s += "/" + strconv.Itoa(n)
+	}
+	if s == "" {
+		return "/"
+	}
+	return s
+}
+
+// Contains returns true if other is the path or below it
+func (p Path) Contains(other Path) bool {
+	a := []int{p.Object, p.Instance, p.Resource, p.ResourceInstance}
+	b := []int{other.Object, other.Instance, other.Resource, other.ResourceInstance}
+	for i := range a {
+		if a[i] < 0 {
+			return true
+		}
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// normalize converts the value returned by a read function to the Go type
+// for the resource type.
+func normalize(t ResourceType, v interface{}) (interface{}, error) {
+	switch t {
+	case String:
+		switch s := v.(type) {
+		case string:
+			return s, nil
+		case fmt.Stringer:
+			return s.String(), nil
+		}
+	case Integer, Time:
+		if tm, ok := v.(time.Time); ok {
+			if t == Time {
+				return tm, nil
+			}
+			return tm.Unix(), nil
+		}
+		if n, ok := toInt64(v); ok {
+			if t == Time {
+				return time.Unix(n, 0), nil
+			}
+			return n, nil
+		}
+	case UnsignedInteger:
+		if n, ok := toInt64(v); ok && n >= 0 {
+			return uint64(n), nil
+		}
+		if n, ok := v.(uint64); ok {
+			return n, nil
+		}
+	case Float:
+		switch f := v.(type) {
+		case float64:
+			return f, nil
+		case float32:
+			return float64(f), nil
+		}
+		if n, ok := toInt64(v); ok {
+			return float64(n), nil
+		}
+	case Boolean:
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	case Opaque:
+		switch b := v.(type) {
+		case []byte:
+			return b, nil
+		case string:
+			return []byte(b), nil
+		}
+	case ObjLink:
+		if l, ok := v.(ObjectLink); ok {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("can't use %T as resource value", v)
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint:
+		return int64(n), true
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint64:
+		if n < 1<<63 {
+			return int64(n), true
+		}
+	}
+	return 0, false
+}
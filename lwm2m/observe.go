@@ -0,0 +1,279 @@
+package lwm2m
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lab5e/at/coap"
+)
+
+// notifyTimeout is how long the client tries to deliver a notification
+const notifyTimeout = time.Minute
+
+// attributes are the notification attributes the server sets with
+// Write-Attributes
+type attributes struct {
+	pmin time.Duration
+	pmax time.Duration
+}
+
+// observation is an observation the server has registered
+type observation struct {
+	token  []byte
+	path   Path
+	format coap.MediaType
+	seq    uint32
+	last   time.Time
+	// pending is set while a notification waits for the minimum period
+	pending bool
+	// maxTimer sends a notification when the maximum period expires
+	maxTimer *time.Timer
+	done     bool
+}
+
+// Changed tells the client that the value at the path has changed, ie
+// "/3303/0/5700". Observations of the path, its parents and its children
+// are notified subject to the minimum period set by the server.
+func (c *Client) Changed(path string) error {
+	p, err := ParsePath(path)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, o := range c.observations {
+		if o.path.Contains(p) || p.Contains(o.path) {
+			c.schedule(o)
+		}
+	}
+	return nil
+}
+
+// observe registers an observation and returns the current value
+func (c *Client) observe(req *coap.Message, path Path) *coap.Message {
+	format, resp := c.responseFormat(req, path)
+	if resp != nil {
+		return resp
+	}
+	resp = c.read(path, format)
+	if resp.Code != coap.Content {
+		return resp
+	}
+
+	o := &observation{
+		token:  append([]byte(nil), req.Token...),
+		path:   path,
+		format: format,
+		seq:    2,
+		last:   time.Now(),
+	}
+	resp.SetUint(coap.Observe, o.seq)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.observations[string(o.token)]; ok {
+		c.stopObservation(old)
+	}
+	c.observations[string(o.token)] = o
+	c.startMaxTimer(o)
+	return resp
+}
+
+// cancelObservation removes the observation with the token
+func (c *Client) cancelObservation(token []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if o, ok := c.observations[string(token)]; ok {
+		c.stopObservation(o)
+	}
+}
+
+// cancelObservations removes all observations
+func (c *Client) cancelObservations() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, o := range c.observations {
+		c.stopObservation(o)
+	}
+}
+
+// stopObservation removes the observation. The lock must be held.
+func (c *Client) stopObservation(o *observation) {
+	o.done = true
+	if o.maxTimer != nil {
+		o.maxTimer.Stop()
+	}
+	delete(c.observations, string(o.token))
+}
+
+// schedule sends a notification now or when the minimum period has
+// passed. The lock must be held.
+func (c *Client) schedule(o *observation) {
+	if o.pending || o.done {
+		return
+	}
+	attr := c.attributesFor(o.path)
+	wait := time.Until(o.last.Add(attr.pmin))
+	o.pending = true
+	if wait <= 0 {
+		go c.notify(o)
+		return
+	}
+	time.AfterFunc(wait, func() { c.notify(o) })
+}
+
+// startMaxTimer starts the timer for the maximum period. The lock must
+// be held.
+func (c *Client) startMaxTimer(o *observation) {
+	if o.maxTimer != nil {
+		o.maxTimer.Stop()
+		o.maxTimer = nil
+	}
+	attr := c.attributesFor(o.path)
+	if attr.pmax <= 0 {
+		return
+	}
+	o.maxTimer = time.AfterFunc(attr.pmax, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.schedule(o)
+	})
+}
+
+// notify sends a notification with the current value
+func (c *Client) notify(o *observation) {
+	c.mu.Lock()
+	if o.done {
+		c.mu.Unlock()
+		return
+	}
+	o.pending = false
+	o.seq = (o.seq + 1) & 0xffffff
+	o.last = time.Now()
+	seq := o.seq
+	client := c.coap
+	c.startMaxTimer(o)
+	c.mu.Unlock()
+
+	if client == nil {
+		return
+	}
+	msg := &coap.Message{Type: coap.Confirmable, Token: o.token}
+	payload, err := c.encode(o.path, o.format)
+	if err != nil {
+		// The error ends the observation
+		msg.Code = errorResponse(err).Code
+		c.cancelObservation(o.token)
+	} else {
+		msg.Code = coap.Content
+		msg.Payload = payload
+		msg.SetUint(coap.Observe, seq)
+		msg.SetContentFormat(o.format)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	if err := client.Notify(ctx, msg); err != nil {
+		if err == coap.ErrReset {
+			c.cancelObservation(o.token)
+			return
+		}
+		log.Printf("Error sending LwM2M notification for %s: %v", o.path, err)
+	}
+}
+
+// attributesFor returns the attributes for the path. Attributes that
+// aren't set on the path are inherited from the parents. The lock must be
+// held.
+func (c *Client) attributesFor(path Path) attributes {
+	var ret attributes
+	var pminSet, pmaxSet bool
+	for p := path; ; {
+		if attr, ok := c.attributes[p]; ok {
+			if !pminSet && attr.pmin >= 0 {
+				ret.pmin, pminSet = attr.pmin, true
+			}
+			if !pmaxSet && attr.pmax >= 0 {
+				ret.pmax, pmaxSet = attr.pmax, true
+			}
+		}
+		switch {
+		case p.ResourceInstance >= 0:
+			p.ResourceInstance = -1
+		case p.Resource >= 0:
+			p.Resource = -1
+		case p.Instance >= 0:
+			p.Instance = -1
+		default:
+			return ret
+		}
+	}
+}
+
+// writeAttributes sets the notification attributes of the path. Only the
+// pmin and pmax attributes are used, the others are accepted and ignored.
+func (c *Client) writeAttributes(path Path, queries []string) *coap.Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	attr, ok := c.attributes[path]
+	if !ok {
+		attr = attributes{pmin: -1, pmax: -1}
+	}
+	for _, q := range queries {
+		parts := strings.SplitN(q, "=", 2)
+		switch parts[0] {
+		case "pmin", "pmax":
+			// An attribute without a value is removed
+			var d time.Duration = -1
+			if len(parts) == 2 {
+				n, err := strconv.ParseUint(parts[1], 10, 32)
+				if err != nil {
+					return &coap.Message{Code: coap.BadRequest}
+				}
+				d = time.Duration(n) * time.Second
+			}
+			if parts[0] == "pmin" {
+				attr.pmin = d
+			} else {
+				attr.pmax = d
+			}
+		case "gt", "lt", "st", "epmin", "epmax":
+		default:
+			return &coap.Message{Code: coap.BadRequest}
+		}
+	}
+	c.attributes[path] = attr
+
+	for _, o := range c.observations {
+		if path.Contains(o.path) {
+			c.startMaxTimer(o)
+		}
+	}
+	return &coap.Message{Code: coap.Changed}
+}
+
+// attributeLinks returns the attributes of the path in CoRE link format
+// for discover. The lock must not be held.
+func (c *Client) attributeLinks(path Path) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	attr, ok := c.attributes[path]
+	if !ok {
+		return ""
+	}
+	s := ""
+	if attr.pmin >= 0 {
+		s += fmt.Sprintf(";pmin=%d", attr.pmin/time.Second)
+	}
+	if attr.pmax >= 0 {
+		s += fmt.Sprintf(";pmax=%d", attr.pmax/time.Second)
+	}
+	return s
+}
@@ -0,0 +1,322 @@
+package lwm2m
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/lab5e/at/coap"
+)
+
+// serve handles the requests from the server
+func (c *Client) serve(req *coap.Message) *coap.Message {
+	path, err := ParsePath(req.Path())
+	if err != nil || path.Object < 0 {
+		return &coap.Message{Code: coap.BadRequest}
+	}
+	if path.Object == SecurityObjectID {
+		return &coap.Message{Code: coap.Unauthorized}
+	}
+
+	switch req.Code {
+	case coap.GET:
+		if accept, ok := req.Uint(coap.Accept); ok && coap.MediaType(accept) == coap.AppLinkFormat {
+			return c.discover(path)
+		}
+		if observe, ok := req.Uint(coap.Observe); ok {
+			if observe == 0 {
+				return c.observe(req, path)
+			}
+			c.cancelObservation(req.Token)
+		}
+		format, resp := c.responseFormat(req, path)
+		if resp != nil {
+			return resp
+		}
+		return c.read(path, format)
+
+	case coap.PUT:
+		if len(req.Queries()) > 0 && !req.HasOption(coap.ContentFormat) {
+			return c.writeAttributes(path, req.Queries())
+		}
+		return c.write(req, path)
+
+	case coap.POST:
+		if path.Resource >= 0 {
+			return c.execute(path, string(req.Payload))
+		}
+		if path.Instance >= 0 {
+			return c.write(req, path)
+		}
+		return &coap.Message{Code: coap.MethodNotAllowed}
+
+	default:
+		return &coap.Message{Code: coap.MethodNotAllowed}
+	}
+}
+
+// responseFormat returns the content format for a read. Single resources
+// are returned as plain text or opaque unless the server asks for another
+// format.
+func (c *Client) responseFormat(req *coap.Message, path Path) (coap.MediaType, *coap.Message) {
+	if accept, ok := req.Uint(coap.Accept); ok {
+		switch format := coap.MediaType(accept); format {
+		case coap.TextPlain, coap.AppOctets, coap.AppLwM2MTLV, coap.AppSenMLJSON:
+			return format, nil
+		default:
+			return 0, &coap.Message{Code: coap.NotAcceptable}
+		}
+	}
+
+	if path.Resource >= 0 {
+		if r, _ := c.lookup(path); r != nil && (!r.Multiple || path.ResourceInstance >= 0) {
+			if r.Type == Opaque {
+				return coap.AppOctets, nil
+			}
+			return coap.TextPlain, nil
+		}
+	}
+	return coap.AppLwM2MTLV, nil
+}
+
+// lookup returns the resource or instance at the path
+func (c *Client) lookup(path Path) (*Resource, *Instance) {
+	c.mu.Lock()
+	obj := c.objects[uint16(path.Object)]
+	c.mu.Unlock()
+	if obj == nil || path.Instance < 0 {
+		return nil, nil
+	}
+	inst := obj.Instance(uint16(path.Instance))
+	if inst == nil || path.Resource < 0 {
+		return nil, inst
+	}
+	return inst.Resource(uint16(path.Resource)), inst
+}
+
+// readValues reads the values at the path
+func (c *Client) readValues(path Path) ([]instanceValue, error) {
+	c.mu.Lock()
+	obj := c.objects[uint16(path.Object)]
+	c.mu.Unlock()
+	if obj == nil {
+		return nil, ErrNotFound
+	}
+
+	var instances []*Instance
+	if path.Instance >= 0 {
+		inst := obj.Instance(uint16(path.Instance))
+		if inst == nil {
+			return nil, ErrNotFound
+		}
+		instances = []*Instance{inst}
+	} else {
+		instances = obj.Instances()
+	}
+
+	var ret []instanceValue
+	for _, inst := range instances {
+		iv := instanceValue{id: inst.ID}
+		for _, r := range inst.Resources {
+			if path.Resource >= 0 && int(r.ID) != path.Resource {
+				continue
+			}
+			if r.Read == nil {
+				if path.Resource >= 0 {
+					return nil, ErrNotAllowed
+				}
+				continue
+			}
+			rv, err := readResource(r, path.ResourceInstance)
+			if err != nil {
+				// Resources that fail are left out of instance reads
+				if path.Resource >= 0 {
+					return nil, err
+				}
+				log.Printf("Error reading LwM2M resource /%d/%d/%d: %v", path.Object, inst.ID, r.ID, err)
+				continue
+			}
+			iv.resources = append(iv.resources, rv)
+		}
+		if path.Resource >= 0 && len(iv.resources) == 0 {
+			return nil, ErrNotFound
+		}
+		ret = append(ret, iv)
+	}
+	return ret, nil
+}
+
+// readResource reads the resource and converts the values to the Go type
+// of the resource type.
+func readResource(r *Resource, resourceInstance int) (resourceValue, error) {
+	rv := resourceValue{id: r.ID, typ: r.Type, multiple: r.Multiple}
+	v, err := r.Read()
+	if err != nil {
+		return rv, err
+	}
+
+	if !r.Multiple {
+		if resourceInstance >= 0 {
+			return rv, ErrNotFound
+		}
+		n, err := normalize(r.Type, v)
+		if err != nil {
+			return rv, err
+		}
+		rv.values = []interface{}{n}
+		return rv, nil
+	}
+
+	values, ok := v.([]interface{})
+	if !ok {
+		return rv, fmt.Errorf("multiple resource %d must be read as []interface{}", r.ID)
+	}
+	for i, value := range values {
+		if resourceInstance >= 0 && i != resourceInstance {
+			continue
+		}
+		if value == nil {
+			rv.values = append(rv.values, nil)
+			continue
+		}
+		n, err := normalize(r.Type, value)
+		if err != nil {
+			return rv, err
+		}
+		rv.values = append(rv.values, n)
+	}
+	if resourceInstance >= 0 && (len(rv.values) == 0 || rv.values[0] == nil) {
+		return rv, ErrNotFound
+	}
+	return rv, nil
+}
+
+func (c *Client) read(path Path, format coap.MediaType) *coap.Message {
+	payload, err := c.encode(path, format)
+	if err != nil {
+		return errorResponse(err)
+	}
+	resp := &coap.Message{Code: coap.Content, Payload: payload}
+	resp.SetContentFormat(format)
+	return resp
+}
+
+// encode reads and encodes the values at the path
+func (c *Client) encode(path Path, format coap.MediaType) ([]byte, error) {
+	values, err := c.readValues(path)
+	if err != nil {
+		return nil, err
+	}
+	return encodePayload(format, path, values)
+}
+
+func (c *Client) write(req *coap.Message, path Path) *coap.Message {
+	if path.Instance < 0 || path.ResourceInstance >= 0 {
+		return &coap.Message{Code: coap.MethodNotAllowed}
+	}
+	_, inst := c.lookup(Path{Object: path.Object, Instance: path.Instance, Resource: -1, ResourceInstance: -1})
+	if inst == nil {
+		return &coap.Message{Code: coap.NotFound}
+	}
+
+	format, _ := req.Uint(coap.ContentFormat)
+	values, err := decodeWrite(coap.MediaType(format), path, inst, req.Payload)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	// Check that all resources are writable before writing any of them
+	for id := range values {
+		if r := inst.Resource(id); r.Write == nil {
+			return &coap.Message{Code: coap.MethodNotAllowed}
+		}
+	}
+	for id, v := range values {
+		if err := inst.Resource(id).Write(v); err != nil {
+			return errorResponse(err)
+		}
+	}
+	return &coap.Message{Code: coap.Changed}
+}
+
+func (c *Client) execute(path Path, args string) *coap.Message {
+	r, _ := c.lookup(path)
+	if r == nil || path.ResourceInstance >= 0 {
+		return &coap.Message{Code: coap.NotFound}
+	}
+	if r.Execute == nil {
+		return &coap.Message{Code: coap.MethodNotAllowed}
+	}
+	if err := r.Execute(args); err != nil {
+		return errorResponse(err)
+	}
+	return &coap.Message{Code: coap.Changed}
+}
+
+// discover returns the resources below the path in CoRE link format
+func (c *Client) discover(path Path) *coap.Message {
+	c.mu.Lock()
+	obj := c.objects[uint16(path.Object)]
+	c.mu.Unlock()
+	if obj == nil || path.ResourceInstance >= 0 {
+		return &coap.Message{Code: coap.NotFound}
+	}
+
+	var links []string
+	if path.Instance < 0 {
+		link := fmt.Sprintf("</%d>", obj.ID)
+		if obj.Version != "" {
+			link += ";ver=" + obj.Version
+		}
+		links = append(links, link+c.attributeLinks(path))
+	}
+	found := false
+	for _, inst := range obj.Instances() {
+		if path.Instance >= 0 && int(inst.ID) != path.Instance {
+			continue
+		}
+		instPath := Path{Object: path.Object, Instance: int(inst.ID), Resource: -1, ResourceInstance: -1}
+		if path.Resource < 0 {
+			links = append(links, fmt.Sprintf("</%d/%d>", obj.ID, inst.ID)+c.attributeLinks(instPath))
+		}
+		for _, r := range inst.Resources {
+			if path.Resource >= 0 && int(r.ID) != path.Resource {
+				continue
+			}
+			found = true
+			resPath := instPath
+			resPath.Resource = int(r.ID)
+			link := fmt.Sprintf("</%d/%d/%d>", obj.ID, inst.ID, r.ID)
+			if r.Multiple && r.Read != nil {
+				if v, err := r.Read(); err == nil {
+					if values, ok := v.([]interface{}); ok {
+						link += fmt.Sprintf(";dim=%d", len(values))
+					}
+				}
+			}
+			links = append(links, link+c.attributeLinks(resPath))
+		}
+		found = found || path.Resource < 0
+	}
+	if path.Instance >= 0 && !found {
+		return &coap.Message{Code: coap.NotFound}
+	}
+
+	resp := &coap.Message{Code: coap.Content, Payload: []byte(strings.Join(links, ","))}
+	resp.SetContentFormat(coap.AppLinkFormat)
+	return resp
+}
+
+// errorResponse maps an error to a response code
+func errorResponse(err error) *coap.Message {
+	switch err {
+	case ErrNotFound:
+		return &coap.Message{Code: coap.NotFound}
+	case ErrNotAllowed:
+		return &coap.Message{Code: coap.MethodNotAllowed}
+	case errUnsupportedFormat:
+		return &coap.Message{Code: coap.UnsupportedFormat}
+	}
+	log.Printf("LwM2M request failed: %v", err)
+	return &coap.Message{Code: coap.BadRequest}
+}
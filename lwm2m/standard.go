@@ -0,0 +1,250 @@
+package lwm2m
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lab5e/at"
+)
+
+// Standard object IDs
+const (
+	SecurityObjectID     = 0
+	ServerObjectID       = 1
+	DeviceObjectID       = 3
+	ConnectivityObjectID = 4
+)
+
+// Network bearers for the Connectivity Monitoring object
+const (
+	BearerLTETDD = 5
+	BearerLTEFDD = 6
+	BearerNBIoT  = 7
+)
+
+// noSecurity is the NoSec security mode in the Security object
+const noSecurity = 3
+
+// addStandardObjects adds the Security, Server, Device and Connectivity
+// Monitoring objects
+func (c *Client) addStandardObjects(bearer int) {
+	ssid := int64(c.shortServerID)
+
+	security := NewObject(SecurityObjectID)
+	security.AddInstance(0,
+		&Resource{ID: 0, Type: String, Read: func() (interface{}, error) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return c.server, nil
+		}},
+		&Resource{ID: 1, Type: Boolean, Read: Constant(false)},
+		&Resource{ID: 2, Type: Integer, Read: Constant(noSecurity)},
+		&Resource{ID: 3, Type: Opaque, Read: Constant([]byte{})},
+		&Resource{ID: 4, Type: Opaque, Read: Constant([]byte{})},
+		&Resource{ID: 5, Type: Opaque, Read: Constant([]byte{})},
+		&Resource{ID: 10, Type: Integer, Read: Constant(ssid)},
+	)
+
+	server := NewObject(ServerObjectID)
+	server.AddInstance(0,
+		&Resource{ID: 0, Type: Integer, Read: Constant(ssid)},
+		&Resource{ID: 1, Type: Integer,
+			Read: func() (interface{}, error) {
+				c.mu.Lock()
+				defer c.mu.Unlock()
+				return int64(c.lifetime / time.Second), nil
+			},
+			Write: func(v interface{}) error {
+				seconds := v.(int64)
+				if seconds <= 0 {
+					return errors.New("lifetime must be positive")
+				}
+				c.setLifetime(time.Duration(seconds) * time.Second)
+				return nil
+			}},
+		&Resource{ID: 6, Type: Boolean, Read: Constant(false)},
+		&Resource{ID: 7, Type: String, Read: Constant("U")},
+		&Resource{ID: 8, Type: Opaque, Execute: func(string) error {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.triggerUpdate()
+			return nil
+		}},
+	)
+
+	info := &deviceInfo{device: c.device}
+	device := NewObject(DeviceObjectID)
+	device.AddInstance(0,
+		&Resource{ID: 0, Type: String, Read: info.read(func(i *at.DeviceInfo) string { return i.Manufacturer })},
+		&Resource{ID: 1, Type: String, Read: info.read(func(i *at.DeviceInfo) string { return i.Model })},
+		&Resource{ID: 2, Type: String, Read: func() (interface{}, error) { return c.device.GetIMEI() }},
+		&Resource{ID: 3, Type: String, Read: info.read(func(i *at.DeviceInfo) string { return i.FirmwareVersion })},
+		&Resource{ID: 4, Type: Opaque, Execute: func(string) error {
+			r, ok := c.device.(at.Rebooter)
+			if !ok {
+				return ErrNotAllowed
+			}
+			// Reply before the module goes away
+			go func() {
+				time.Sleep(time.Second)
+				r.Reboot()
+			}()
+			return nil
+		}},
+		&Resource{ID: 11, Type: Integer, Multiple: true, Read: Constant([]interface{}{0})},
+		&Resource{ID: 13, Type: Time, Read: func() (interface{}, error) { return time.Now(), nil }},
+		&Resource{ID: 16, Type: String, Read: Constant("U")},
+	)
+
+	connectivity := NewObject(ConnectivityObjectID)
+	resources := []*Resource{
+		{ID: 0, Type: Integer, Read: Constant(bearer)},
+		{ID: 1, Type: Integer, Multiple: true, Read: Constant([]interface{}{bearer})},
+		{ID: 4, Type: String, Multiple: true, Read: func() (interface{}, error) {
+			_, addr, err := c.device.GetAddr()
+			if err != nil {
+				return nil, err
+			}
+			if addr == "" {
+				return []interface{}{}, nil
+			}
+			return []interface{}{addr}, nil
+		}},
+		{ID: 7, Type: String, Multiple: true, Read: func() (interface{}, error) {
+			apn, err := c.device.GetAPN()
+			if err != nil {
+				return nil, err
+			}
+			return []interface{}{apn.Name}, nil
+		}},
+	}
+	// The serving network is the home network from the IMSI unless the
+	// device is roaming
+	home := &homeNetwork{device: c.device}
+	resources = append(resources,
+		&Resource{ID: 9, Type: Integer, Read: home.read(func(mcc, mnc int) int { return mnc })},
+		&Resource{ID: 10, Type: Integer, Read: home.read(func(mcc, mnc int) int { return mcc })},
+	)
+	if sr, ok := c.device.(at.StatsReader); ok {
+		// Signal power and RSRQ are in tenths of dBm and dB
+		resources = append(resources,
+			&Resource{ID: 2, Type: Integer, Read: readStats(sr, 10, func(s *at.Stats) int { return s.SignalPower })},
+			&Resource{ID: 3, Type: Integer, Read: readStats(sr, 10, func(s *at.Stats) int { return s.RSRQ })},
+			&Resource{ID: 8, Type: Integer, Read: readStats(sr, 1, func(s *at.Stats) int { return s.CellID })},
+		)
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		return resources[i].ID < resources[j].ID
+	})
+	connectivity.AddInstance(0, resources...)
+
+	for _, obj := range []*Object{security, server, device, connectivity} {
+		c.objects[obj.ID] = obj
+	}
+}
+
+// deviceInfo reads the device information once
+type deviceInfo struct {
+	device at.Device
+	mu     sync.Mutex
+	info   *at.DeviceInfo
+}
+
+func (d *deviceInfo) read(field func(*at.DeviceInfo) string) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.info == nil {
+			ir, ok := d.device.(at.InfoReader)
+			if !ok {
+				return nil, ErrNotFound
+			}
+			info, err := ir.GetDeviceInfo()
+			if err != nil {
+				return nil, err
+			}
+			d.info = info
+		}
+		return field(d.info), nil
+	}
+}
+
+// homeNetwork reads the home network from the IMSI
+type homeNetwork struct {
+	device at.Device
+	mu     sync.Mutex
+	imsi   string
+}
+
+// read returns a read function for the MCC or MNC of the home network. It
+// returns ErrNotFound if the device is roaming and the serving network is
+// another network.
+func (h *homeNetwork) read(field func(mcc, mnc int) int) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		if rr, ok := h.device.(at.RegistrationReader); ok {
+			status, err := rr.GetRegistration()
+			if err != nil {
+				return nil, err
+			}
+			if status != at.RegisteredHome {
+				return nil, ErrNotFound
+			}
+		}
+
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.imsi == "" {
+			imsi, err := h.device.GetIMSI()
+			if err != nil {
+				return nil, err
+			}
+			h.imsi = imsi
+		}
+		mcc, mnc, err := parseIMSI(h.imsi)
+		if err != nil {
+			return nil, err
+		}
+		return field(mcc, mnc), nil
+	}
+}
+
+// parseIMSI returns the MCC and MNC of the IMSI. The MNC is three digits
+// in North America (MCC 300-316) and two digits elsewhere.
+func parseIMSI(imsi string) (int, int, error) {
+	if len(imsi) < 6 {
+		return 0, 0, fmt.Errorf("invalid IMSI %q", imsi)
+	}
+	mcc, err := strconv.Atoi(imsi[:3])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid IMSI %q", imsi)
+	}
+	digits := 2
+	if mcc >= 300 && mcc <= 316 {
+		digits = 3
+	}
+	mnc, err := strconv.Atoi(imsi[3 : 3+digits])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid IMSI %q", imsi)
+	}
+	return mcc, mnc, nil
+}
+
+// readStats reads the field and divides it by scale. Values the device
+// doesn't report are left out.
+func readStats(sr at.StatsReader, scale int, field func(*at.Stats) int) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		stats, err := sr.GetStats()
+		if err != nil {
+			return nil, err
+		}
+		v := field(stats)
+		if v == at.Unknown {
+			return nil, ErrNotFound
+		}
+		return v / scale, nil
+	}
+}
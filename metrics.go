@@ -0,0 +1,203 @@
+package at
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds of the latency histogram buckets
+var LatencyBuckets = []time.Duration{
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+}
+
+// CommandStats are the statistics for a command verb
+type CommandStats struct {
+	// Verb is the command without parameters, ie AT+NSOST
+	Verb string
+	// Count is the number of transactions
+	Count int
+	// Errors is the number of ERROR and +CME ERROR responses
+	Errors int
+	// Timeouts is the number of transactions that timed out
+	Timeouts int
+	// CMEErrors counts the +CME ERROR responses by code. Errors reported
+	// as text are counted as -1.
+	CMEErrors map[int]int
+	// TotalLatency is the sum of the latencies and MaxLatency the longest
+	TotalLatency time.Duration
+	MaxLatency   time.Duration
+	// Buckets counts the latencies up to each of LatencyBuckets. The last
+	// bucket counts the latencies above the largest bound.
+	Buckets []int
+}
+
+// CommandMetrics is a snapshot of the metrics of a CommandInterface
+type CommandMetrics struct {
+	// Commands are the statistics per verb sorted by verb
+	Commands []CommandStats
+	// BytesIn and BytesOut are the number of bytes read from and written
+	// to the device, including URCs and payloads
+	BytesIn  int64
+	BytesOut int64
+}
+
+// CommandEvent describes a completed transaction. It is passed to the
+// hook set with SetCommandHook.
+type CommandEvent struct {
+	Verb     string
+	Command  string
+	Duration time.Duration
+	// Err is the error of the transaction. It is ErrReadTimeout for
+	// timeouts, ErrATError for ERROR and a *CMEError for +CME ERROR.
+	Err error
+}
+
+// Instrumented is implemented by devices that expose the metrics of their
+// command interface.
+type Instrumented interface {
+	// CommandMetrics returns a snapshot of the metrics
+	CommandMetrics() *CommandMetrics
+
+	// SetCommandHook sets a function that is called after each
+	// transaction, ie to feed an external metrics system. The function is
+	// called before the next transaction can start so it must not block
+	// or send commands. Passing nil removes the hook.
+	SetCommandHook(fn func(CommandEvent))
+}
+
+// commandMetrics collects the metrics of a CommandInterface
+type commandMetrics struct {
+	mu       sync.Mutex
+	commands map[string]*CommandStats
+	bytesIn  int64
+	bytesOut int64
+	hook     func(CommandEvent)
+}
+
+// CommandVerb returns the command without parameters or the read and test
+// suffixes, ie AT+NSOST for AT+NSOST=0,"1.2.3.4",1234,2,"abcd"
+func CommandVerb(cmd string) string {
+	if i := strings.IndexAny(cmd, "=?"); i >= 0 {
+		cmd = cmd[:i]
+	}
+	return strings.ToUpper(strings.TrimSpace(cmd))
+}
+
+// record adds a completed transaction to the metrics
+func (m *commandMetrics) record(cmd string, d time.Duration, err error) {
+	verb := CommandVerb(cmd)
+
+	m.mu.Lock()
+	if m.commands == nil {
+		m.commands = make(map[string]*CommandStats)
+	}
+	s, ok := m.commands[verb]
+	if !ok {
+		s = &CommandStats{
+			Verb:      verb,
+			CMEErrors: make(map[int]int),
+			Buckets:   make([]int, len(LatencyBuckets)+1),
+		}
+		m.commands[verb] = s
+	}
+
+	s.Count++
+	s.TotalLatency += d
+	if d > s.MaxLatency {
+		s.MaxLatency = d
+	}
+	bucket := sort.Search(len(LatencyBuckets), func(i int) bool {
+		return d <= LatencyBuckets[i]
+	})
+	s.Buckets[bucket]++
+
+	var cme *CMEError
+	switch {
+	case err == ErrReadTimeout:
+		s.Timeouts++
+	case errors.As(err, &cme):
+		s.Errors++
+		s.CMEErrors[cme.Code]++
+	case err == ErrATError:
+		s.Errors++
+	}
+	hook := m.hook
+	m.mu.Unlock()
+
+	if hook != nil {
+		hook(CommandEvent{Verb: verb, Command: cmd, Duration: d, Err: err})
+	}
+}
+
+func (m *commandMetrics) addBytesIn(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytesIn += int64(n)
+}
+
+func (m *commandMetrics) addBytesOut(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytesOut += int64(n)
+}
+
+func (m *commandMetrics) setHook(fn func(CommandEvent)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hook = fn
+}
+
+// snapshot returns a copy of the metrics
+func (m *commandMetrics) snapshot() *CommandMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ret := &CommandMetrics{BytesIn: m.bytesIn, BytesOut: m.bytesOut}
+	for _, s := range m.commands {
+		c := *s
+		c.CMEErrors = make(map[int]int, len(s.CMEErrors))
+		for code, n := range s.CMEErrors {
+			c.CMEErrors[code] = n
+		}
+		c.Buckets = append([]int(nil), s.Buckets...)
+		ret.Commands = append(ret.Commands, c)
+	}
+	sort.Slice(ret.Commands, func(i, j int) bool {
+		return ret.Commands[i].Verb < ret.Commands[j].Verb
+	})
+	return ret
+}
+
+// Metrics returns a snapshot of the command metrics
+func (c *CommandInterface) Metrics() *CommandMetrics {
+	return c.metrics.snapshot()
+}
+
+// SetCommandHook sets a function that is called after each transaction.
+// See Instrumented.
+func (c *CommandInterface) SetCommandHook(fn func(CommandEvent)) {
+	c.metrics.setHook(fn)
+}
+
+// CommandMetrics returns a snapshot of the command metrics
+func (d *DefaultImplementation) CommandMetrics() *CommandMetrics {
+	return d.Cmd.Metrics()
+}
+
+// SetCommandHook sets a function that is called after each transaction
+func (d *DefaultImplementation) SetCommandHook(fn func(CommandEvent)) {
+	d.Cmd.SetCommandHook(fn)
+}
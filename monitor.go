@@ -0,0 +1,303 @@
+package at
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Monitor defaults
+const (
+	DefaultMonitorInterval = time.Minute
+	DefaultMonitorHistory  = 60
+	DefaultMonitorGap      = 200 * time.Millisecond
+)
+
+// MonitorOptions are the options for NewMonitor
+type MonitorOptions struct {
+	// Interval is the time between samples. The default is
+	// DefaultMonitorInterval.
+	Interval time.Duration
+
+	// History is the number of samples kept. The default is
+	// DefaultMonitorHistory.
+	History int
+
+	// CellInfo turns on measurement of the serving and neighbour cells.
+	// Some modules take several seconds to measure the cells so it is off
+	// by default.
+	CellInfo bool
+
+	// Gap is the pause between the commands in a sample which lets the
+	// application get its commands in between. The default is
+	// DefaultMonitorGap.
+	Gap time.Duration
+}
+
+// Sample is a sample of the radio conditions. Fields the device can't
+// report are nil or RegistrationUnknown.
+type Sample struct {
+	Time         time.Time
+	Stats        *Stats
+	Registration RegistrationStatus
+	Cells        *CellInfo
+	// Err is the first error reading the sample
+	Err error
+}
+
+// Delta is the change from the previous sample. The differences are
+// Unknown if either sample is missing the value.
+type Delta struct {
+	Previous *Sample
+	Current  *Sample
+
+	// RegistrationChanged is set when the registration status changed
+	RegistrationChanged bool
+	// CellChanged is set when the module changed serving cell
+	CellChanged bool
+
+	// SignalPower is the change in tenths of dBm
+	SignalPower int
+	// RSRQ is the change in tenths of dB
+	RSRQ int
+	// SNR is the change in tenths of dB
+	SNR int
+}
+
+// Monitor samples the statistics, registration status and cells of a
+// device periodically and keeps a bounded history of the samples. Each
+// new sample is published as a Delta on the channel returned by Deltas.
+// The commands in a sample are spaced out so the monitor doesn't hold up
+// application traffic and sampling can be paused during transfers where
+// every command counts.
+type Monitor struct {
+	device Device
+	opts   MonitorOptions
+	deltas chan Delta
+
+	mu      sync.Mutex
+	history []Sample
+	next    int
+	count   int
+	paused  bool
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// NewMonitor creates a monitor for the device. Call Start to start
+// sampling.
+func NewMonitor(device Device, opts MonitorOptions) *Monitor {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultMonitorInterval
+	}
+	if opts.History <= 0 {
+		opts.History = DefaultMonitorHistory
+	}
+	if opts.Gap <= 0 {
+		opts.Gap = DefaultMonitorGap
+	}
+	return &Monitor{
+		device:  device,
+		opts:    opts,
+		deltas:  make(chan Delta, 16),
+		history: make([]Sample, opts.History),
+	}
+}
+
+// Start starts sampling. The first sample is taken right away.
+func (m *Monitor) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stop != nil {
+		return
+	}
+	m.stop = make(chan struct{})
+	m.stopped = make(chan struct{})
+	go m.run(m.stop, m.stopped)
+}
+
+// Stop stops sampling and waits for the current sample to complete. The
+// history is kept.
+func (m *Monitor) Stop() {
+	m.mu.Lock()
+	stop, stopped := m.stop, m.stopped
+	m.stop, m.stopped = nil, nil
+	m.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-stopped
+}
+
+// Pause skips samples until Resume is called
+func (m *Monitor) Pause() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.paused = true
+}
+
+// Resume resumes sampling after Pause
+func (m *Monitor) Resume() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.paused = false
+}
+
+// Deltas returns the channel the changes are published on. Deltas are
+// dropped if the channel isn't read.
+func (m *Monitor) Deltas() <-chan Delta {
+	return m.deltas
+}
+
+// History returns the samples, oldest first
+func (m *Monitor) History() []Sample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ret := make([]Sample, 0, m.count)
+	start := m.next - m.count
+	if start < 0 {
+		start += len(m.history)
+	}
+	for i := 0; i < m.count; i++ {
+		ret = append(ret, m.history[(start+i)%len(m.history)])
+	}
+	return ret
+}
+
+// Latest returns the latest sample or nil if there are none
+func (m *Monitor) Latest() *Sample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.latest()
+}
+
+// latest returns the latest sample. The lock must be held.
+func (m *Monitor) latest() *Sample {
+	if m.count == 0 {
+		return nil
+	}
+	i := m.next - 1
+	if i < 0 {
+		i += len(m.history)
+	}
+	s := m.history[i]
+	return &s
+}
+
+func (m *Monitor) run(stop <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+
+	ticker := time.NewTicker(m.opts.Interval)
+	defer ticker.Stop()
+	for {
+		m.mu.Lock()
+		paused := m.paused
+		m.mu.Unlock()
+
+		if !paused {
+			if sample, ok := m.sample(stop); ok {
+				m.add(sample)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// sample reads a sample from the device. It returns false if the monitor
+// was stopped while sampling.
+func (m *Monitor) sample(stop <-chan struct{}) (*Sample, bool) {
+	s := &Sample{Time: time.Now(), Registration: RegistrationUnknown}
+	var steps []func() error
+
+	if sr, ok := m.device.(StatsReader); ok {
+		steps = append(steps, func() (err error) {
+			s.Stats, err = sr.GetStats()
+			return err
+		})
+	}
+	if rr, ok := m.device.(RegistrationReader); ok {
+		steps = append(steps, func() (err error) {
+			s.Registration, err = rr.GetRegistration()
+			return err
+		})
+	}
+	if cr, ok := m.device.(CellInfoReader); ok && m.opts.CellInfo {
+		steps = append(steps, func() (err error) {
+			s.Cells, err = cr.GetCellInfo()
+			return err
+		})
+	}
+
+	for i, step := range steps {
+		if i > 0 {
+			select {
+			case <-time.After(m.opts.Gap):
+			case <-stop:
+				return nil, false
+			}
+		}
+		if err := step(); err != nil && s.Err == nil {
+			s.Err = err
+		}
+	}
+	return s, true
+}
+
+// add stores the sample and publishes the delta
+func (m *Monitor) add(s *Sample) {
+	m.mu.Lock()
+	delta := newDelta(m.latest(), s)
+	m.history[m.next] = *s
+	m.next = (m.next + 1) % len(m.history)
+	if m.count < len(m.history) {
+		m.count++
+	}
+	m.mu.Unlock()
+
+	select {
+	case m.deltas <- delta:
+	default:
+		log.Printf("Dropping monitor sample: deltas are not being read")
+	}
+}
+
+func newDelta(prev *Sample, cur *Sample) Delta {
+	d := Delta{
+		Previous:    prev,
+		Current:     cur,
+		SignalPower: Unknown,
+		RSRQ:        Unknown,
+		SNR:         Unknown,
+	}
+	if prev == nil {
+		return d
+	}
+	d.RegistrationChanged = prev.Registration != cur.Registration
+	if prev.Stats != nil && cur.Stats != nil {
+		d.SignalPower = difference(prev.Stats.SignalPower, cur.Stats.SignalPower)
+		d.RSRQ = difference(prev.Stats.RSRQ, cur.Stats.RSRQ)
+		d.SNR = difference(prev.Stats.SNR, cur.Stats.SNR)
+		d.CellChanged = prev.Stats.CellID != cur.Stats.CellID
+	}
+	if prev.Cells != nil && cur.Cells != nil {
+		p, c := prev.Cells.Serving, cur.Cells.Serving
+		d.CellChanged = d.CellChanged || (p == nil) != (c == nil) ||
+			(p != nil && c != nil && (p.CellID != c.CellID || p.PCI != c.PCI || p.EARFCN != c.EARFCN))
+	}
+	return d
+}
+
+func difference(prev int, cur int) int {
+	if prev == Unknown || cur == Unknown {
+		return Unknown
+	}
+	return cur - prev
+}
@@ -0,0 +1,252 @@
+// Package mqtt implements an MQTT client on top of the MQTT stack in the
+// module. The BG95 (AT+QMT*) and the nRF91 Serial LTE Modem (#XMQTT*)
+// drivers support it.
+//
+// Example:
+//
+//	client, err := mqtt.New(device)
+//	if err != nil {
+//	    log.Fatalf("No MQTT support: %v", err)
+//	}
+//	err = client.Connect(ctx, &mqtt.Options{Host: "mqtt.example.com", Port: 1883, ClientID: imei})
+//	...
+//	err = client.Subscribe(ctx, "config/#", mqtt.AtLeastOnce, func(msg *mqtt.Message) {
+//	    log.Printf("%s: %s", msg.Topic, msg.Payload)
+//	})
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lab5e/at"
+)
+
+// QoS is the MQTT quality of service level
+type QoS int
+
+// Quality of service levels
+const (
+	AtMostOnce QoS = iota
+	AtLeastOnce
+	ExactlyOnce
+)
+
+var (
+	// ErrNotSupported is returned by New if the device has no MQTT
+	// client
+	ErrNotSupported = errors.New("device does not support MQTT")
+
+	// ErrNotConnected is returned when the client isn't connected
+	ErrNotConnected = errors.New("not connected")
+)
+
+// Message is an MQTT message
+type Message struct {
+	Topic   string
+	Payload []byte
+	QoS     QoS
+	Retain  bool
+}
+
+// Options are the connection options
+type Options struct {
+	Host         string
+	Port         int
+	ClientID     string
+	Username     string
+	Password     string
+	KeepAlive    time.Duration
+	CleanSession bool
+
+	// TLS makes the module connect using TLS with the credentials
+	// stored with the security tag. Leave it nil for plain MQTT.
+	TLS *at.TLSConfig
+}
+
+// Backend is implemented by devices that have an MQTT client in the
+// module. Use Client rather than the backend directly.
+type Backend interface {
+	// MQTTConnect connects to the broker. Incoming messages are passed
+	// to onMessage and onLost is called if the module loses the
+	// connection.
+	MQTTConnect(ctx context.Context, opts *Options, onMessage func(*Message), onLost func()) error
+
+	// MQTTDisconnect disconnects from the broker
+	MQTTDisconnect(ctx context.Context) error
+
+	// MQTTPublish publishes the message
+	MQTTPublish(ctx context.Context, msg *Message) error
+
+	// MQTTSubscribe subscribes to the topic filter
+	MQTTSubscribe(ctx context.Context, topic string, qos QoS) error
+
+	// MQTTUnsubscribe unsubscribes from the topic filter
+	MQTTUnsubscribe(ctx context.Context, topic string) error
+}
+
+// Handler is called with the messages received on a subscription
+type Handler func(*Message)
+
+// Client is an MQTT client using the MQTT stack in the module
+type Client struct {
+	backend Backend
+
+	mu            sync.Mutex
+	connected     bool
+	subscriptions map[string]Handler
+	onLost        func()
+}
+
+// New creates a client for the device. It returns ErrNotSupported if the
+// device has no MQTT client.
+func New(device at.Device) (*Client, error) {
+	backend, ok := device.(Backend)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return &Client{
+		backend:       backend,
+		subscriptions: make(map[string]Handler),
+	}, nil
+}
+
+// OnConnectionLost sets a function that is called when the connection to
+// the broker is lost.
+func (c *Client) OnConnectionLost(fn func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onLost = fn
+}
+
+// Connect connects to the broker
+func (c *Client) Connect(ctx context.Context, opts *Options) error {
+	if err := c.backend.MQTTConnect(ctx, opts, c.dispatch, c.lost); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.connected = true
+	c.mu.Unlock()
+	return nil
+}
+
+// Disconnect disconnects from the broker. The subscriptions are
+// forgotten.
+func (c *Client) Disconnect(ctx context.Context) error {
+	c.mu.Lock()
+	c.connected = false
+	c.subscriptions = make(map[string]Handler)
+	c.mu.Unlock()
+	return c.backend.MQTTDisconnect(ctx)
+}
+
+// IsConnected returns true if the client is connected to the broker
+func (c *Client) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+// Publish publishes the payload on the topic
+func (c *Client) Publish(ctx context.Context, topic string, payload []byte, qos QoS, retain bool) error {
+	if !c.IsConnected() {
+		return ErrNotConnected
+	}
+	return c.backend.MQTTPublish(ctx, &Message{
+		Topic:   topic,
+		Payload: payload,
+		QoS:     qos,
+		Retain:  retain,
+	})
+}
+
+// Subscribe subscribes to the topic filter. Messages matching the filter
+// are passed to the handler.
+func (c *Client) Subscribe(ctx context.Context, topic string, qos QoS, handler Handler) error {
+	if !c.IsConnected() {
+		return ErrNotConnected
+	}
+
+	// Register the handler first so we don't miss retained messages
+	c.mu.Lock()
+	c.subscriptions[topic] = handler
+	c.mu.Unlock()
+
+	if err := c.backend.MQTTSubscribe(ctx, topic, qos); err != nil {
+		c.mu.Lock()
+		delete(c.subscriptions, topic)
+		c.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Unsubscribe removes the subscription for the topic filter
+func (c *Client) Unsubscribe(ctx context.Context, topic string) error {
+	if !c.IsConnected() {
+		return ErrNotConnected
+	}
+
+	c.mu.Lock()
+	delete(c.subscriptions, topic)
+	c.mu.Unlock()
+
+	return c.backend.MQTTUnsubscribe(ctx, topic)
+}
+
+// dispatch passes an incoming message to the handlers with matching
+// filters.
+func (c *Client) dispatch(msg *Message) {
+	c.mu.Lock()
+	var handlers []Handler
+	for filter, handler := range c.subscriptions {
+		if Match(filter, msg.Topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(msg)
+	}
+}
+
+// lost is called by the backend when the connection is lost
+func (c *Client) lost() {
+	c.mu.Lock()
+	c.connected = false
+	fn := c.onLost
+	c.mu.Unlock()
+
+	if fn != nil {
+		fn()
+	}
+}
+
+// Match returns true if the topic matches the topic filter. The filter can
+// contain the + and # wildcards.
+func Match(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	// Topics starting with $ don't match filters starting with wildcards
+	if strings.HasPrefix(topic, "$") && (filterLevels[0] == "+" || filterLevels[0] == "#") {
+		return false
+	}
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
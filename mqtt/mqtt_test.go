@@ -0,0 +1,361 @@
+//go:build linux
+// +build linux
+
+package mqtt_test
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lab5e/at"
+	"github.com/lab5e/at/bg95"
+	"github.com/lab5e/at/internal/fakemodem"
+	"github.com/lab5e/at/mqtt"
+	"github.com/lab5e/at/nrf91"
+)
+
+// broker is a broker stand-in. It keeps the subscriptions of the client
+// and sends the messages published on them back to the client.
+type broker struct {
+	mu            sync.Mutex
+	subscriptions map[string]bool
+	published     []mqtt.Message
+}
+
+func newBroker() *broker {
+	return &broker{subscriptions: make(map[string]bool)}
+}
+
+func (b *broker) subscribe(topic string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscriptions[topic] = true
+}
+
+func (b *broker) unsubscribe(topic string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscriptions, topic)
+}
+
+// publish records the message and returns true if the client subscribes
+// to it
+func (b *broker) publish(msg mqtt.Message) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published = append(b.published, msg)
+	for filter := range b.subscriptions {
+		if mqtt.Match(filter, msg.Topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// modem runs the broker behind a fake modem for one of the drivers
+type modem struct {
+	name string
+	// start starts the fake modem and returns the device
+	start func(t *testing.T, b *broker) (at.Device, *fakemodem.Modem)
+	// lost is the URC that reports a lost connection
+	lost string
+}
+
+var modems = []modem{
+	{name: "nrf91", start: startNRF91, lost: "#XMQTTEVT: 1,-128"},
+	{name: "bg95", start: startBG95, lost: "+QMTSTAT: 0,1"},
+}
+
+func startDevice(t *testing.T, device at.Device) {
+	if err := device.Start(); err != nil {
+		t.Fatalf("Could not start device: %v", err)
+	}
+	t.Cleanup(device.Close)
+}
+
+// startNRF91 emulates the MQTT client in the nRF91 Serial LTE Modem. The
+// events and messages are sent after the OK.
+func startNRF91(t *testing.T, b *broker) (at.Device, *fakemodem.Modem) {
+	m := fakemodem.New(t)
+	event := func(evt int) string {
+		return fakemodem.OK + fakemodem.Lines(fmt.Sprintf("#XMQTTEVT: %d,0", evt))
+	}
+	m.Handle("AT#XMQTTCON=1", func(string) string { return event(0) })
+	m.Handle("AT#XMQTTCON=0", func(string) string { return event(1) })
+	m.Handle("AT#XMQTTSUB=", func(cmd string) string {
+		b.subscribe(fakemodem.Args(cmd)[0])
+		return event(7)
+	})
+	m.Handle("AT#XMQTTUNSUB=", func(cmd string) string {
+		b.unsubscribe(fakemodem.Args(cmd)[0])
+		return event(8)
+	})
+	m.Handle("AT#XMQTTPUB=", func(cmd string) string {
+		args := fakemodem.Args(cmd)
+		payload, err := hex.DecodeString(args[2])
+		if err != nil {
+			t.Errorf("Payload isn't hex: %s", cmd)
+			return fakemodem.Lines("ERROR")
+		}
+		qos, _ := strconv.Atoi(args[3])
+		msg := mqtt.Message{Topic: args[0], Payload: payload, QoS: mqtt.QoS(qos)}
+
+		response := fakemodem.OK
+		switch msg.QoS {
+		case mqtt.AtLeastOnce:
+			response = event(3)
+		case mqtt.ExactlyOnce:
+			response = event(6)
+		}
+		if b.publish(msg) {
+			response += fakemodem.Lines(fmt.Sprintf("#XMQTTMSG: 1,%d,%d", len(msg.Topic), len(msg.Payload)), msg.Topic, string(msg.Payload))
+		}
+		return response
+	})
+
+	d := nrf91.New(m.Path(), nrf91.DefaultBaudRate)
+	startDevice(t, d)
+	return d, m
+}
+
+// startBG95 emulates the MQTT client in the BG95. The payload of
+// AT+QMTPUBEX is sent after the > prompt.
+func startBG95(t *testing.T, b *broker) (at.Device, *fakemodem.Modem) {
+	m := fakemodem.New(t)
+	m.Reply("AT+QMTOPEN=", fakemodem.OK+fakemodem.Lines("+QMTOPEN: 0,0"))
+	m.Reply("AT+QMTCONN=", fakemodem.OK+fakemodem.Lines("+QMTCONN: 0,0,0"))
+	m.Reply("AT+QMTDISC=", fakemodem.OK+fakemodem.Lines("+QMTDISC: 0,0"))
+	m.Handle("AT+QMTSUB=", func(cmd string) string {
+		args := fakemodem.Args(cmd)
+		b.subscribe(args[2])
+		return fakemodem.OK + fakemodem.Lines(fmt.Sprintf("+QMTSUB: 0,%s,0,%s", args[1], args[3]))
+	})
+	m.Handle("AT+QMTUNS=", func(cmd string) string {
+		args := fakemodem.Args(cmd)
+		b.unsubscribe(args[2])
+		return fakemodem.OK + fakemodem.Lines(fmt.Sprintf("+QMTUNS: 0,%s,0", args[1]))
+	})
+	m.Handle("AT+QMTPUBEX=", func(cmd string) string {
+		args := fakemodem.Args(cmd)
+		qos, _ := strconv.Atoi(args[2])
+		length, _ := strconv.Atoi(args[5])
+		m.Write("\r\n> ")
+		msg := mqtt.Message{Topic: args[4], Payload: m.Read(length), QoS: mqtt.QoS(qos)}
+
+		response := fakemodem.OK + fakemodem.Lines(fmt.Sprintf("+QMTPUBEX: 0,%s,0", args[1]))
+		if b.publish(msg) {
+			response += fakemodem.Lines(fmt.Sprintf(`+QMTRECV: 0,1,"%s",%d,"%s"`, msg.Topic, len(msg.Payload), hex.EncodeToString(msg.Payload)))
+		}
+		return response
+	})
+
+	d := bg95.New(m.Path(), bg95.DefaultBaudRate)
+	startDevice(t, d)
+	return d, m
+}
+
+// connect connects a client to the broker through the device
+func connect(t *testing.T, device at.Device) *mqtt.Client {
+	client, err := mqtt.New(device)
+	if err != nil {
+		t.Fatalf("Could not create client: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Connect(ctx, &mqtt.Options{Host: "broker.example.com", Port: 1883, ClientID: "test"}); err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	return client
+}
+
+// receive waits for a message on the channel
+func receive(t *testing.T, messages <-chan *mqtt.Message) *mqtt.Message {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("No message received")
+		return nil
+	}
+}
+
+// expectNone checks that no message arrives on the channel
+func expectNone(t *testing.T, messages <-chan *mqtt.Message) {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		t.Fatalf("Unexpected message on %s", msg.Topic)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	for _, m := range modems {
+		t.Run(m.name, func(t *testing.T) {
+			b := newBroker()
+			device, _ := m.start(t, b)
+			client := connect(t, device)
+			ctx := context.Background()
+
+			messages := make(chan *mqtt.Message, 10)
+			err := client.Subscribe(ctx, "sensors/+", mqtt.AtLeastOnce, func(msg *mqtt.Message) {
+				messages <- msg
+			})
+			if err != nil {
+				t.Fatalf("Could not subscribe: %v", err)
+			}
+
+			for _, qos := range []mqtt.QoS{mqtt.AtMostOnce, mqtt.AtLeastOnce, mqtt.ExactlyOnce} {
+				payload := "reading " + strconv.Itoa(int(qos))
+				if err := client.Publish(ctx, "sensors/temp", []byte(payload), qos, false); err != nil {
+					t.Fatalf("Could not publish with QoS %d: %v", qos, err)
+				}
+				msg := receive(t, messages)
+				if msg.Topic != "sensors/temp" || string(msg.Payload) != payload {
+					t.Fatalf("Unexpected message %s: %q", msg.Topic, msg.Payload)
+				}
+			}
+
+			// Messages on other topics aren't delivered
+			if err := client.Publish(ctx, "actuators/fan", []byte("on"), mqtt.AtLeastOnce, false); err != nil {
+				t.Fatalf("Could not publish: %v", err)
+			}
+			expectNone(t, messages)
+
+			if err := client.Unsubscribe(ctx, "sensors/+"); err != nil {
+				t.Fatalf("Could not unsubscribe: %v", err)
+			}
+			if err := client.Publish(ctx, "sensors/temp", []byte("late"), mqtt.AtLeastOnce, false); err != nil {
+				t.Fatalf("Could not publish: %v", err)
+			}
+			expectNone(t, messages)
+
+			b.mu.Lock()
+			published := len(b.published)
+			b.mu.Unlock()
+			if published != 5 {
+				t.Fatalf("Expected 5 messages at the broker, got %d", published)
+			}
+
+			if err := client.Disconnect(ctx); err != nil {
+				t.Fatalf("Could not disconnect: %v", err)
+			}
+			if client.IsConnected() {
+				t.Fatal("Client is still connected")
+			}
+		})
+	}
+}
+
+// TestBinaryPayload checks that payloads with line breaks and prompt
+// characters reach the broker as they are
+func TestBinaryPayload(t *testing.T) {
+	payload := []byte("line 1\r\n> line 2\x00\xff")
+	for _, m := range modems {
+		t.Run(m.name, func(t *testing.T) {
+			b := newBroker()
+			device, _ := m.start(t, b)
+			client := connect(t, device)
+
+			if err := client.Publish(context.Background(), "blob", payload, mqtt.AtLeastOnce, false); err != nil {
+				t.Fatalf("Could not publish: %v", err)
+			}
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if len(b.published) != 1 {
+				t.Fatalf("Expected one message at the broker, got %d", len(b.published))
+			}
+			if got := b.published[0].Payload; string(got) != string(payload) {
+				t.Fatalf("Broker got %q", got)
+			}
+		})
+	}
+}
+
+// TestPromptInMessage checks that a message with the prompt character
+// in it isn't split when the line arrives in pieces
+func TestPromptInMessage(t *testing.T) {
+	device, fake := startBG95(t, newBroker())
+	client := connect(t, device)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	messages := make(chan *mqtt.Message, 10)
+	err := client.Subscribe(ctx, "alarms/>limit", mqtt.AtMostOnce, func(msg *mqtt.Message) {
+		messages <- msg
+	})
+	if err != nil {
+		t.Fatalf("Could not subscribe: %v", err)
+	}
+	fake.Write("\r\n+QMTRECV: 0,1,\"alarms/>")
+	time.Sleep(50 * time.Millisecond)
+	fake.Write(fmt.Sprintf("limit\",4,\"%s\"\r\n", hex.EncodeToString([]byte("> 30"))))
+
+	msg := receive(t, messages)
+	if msg.Topic != "alarms/>limit" || string(msg.Payload) != "> 30" {
+		t.Fatalf("Unexpected message %s: %q", msg.Topic, msg.Payload)
+	}
+}
+
+func TestConnectionLost(t *testing.T) {
+	for _, m := range modems {
+		t.Run(m.name, func(t *testing.T) {
+			device, fake := m.start(t, newBroker())
+			client := connect(t, device)
+
+			lost := make(chan struct{})
+			client.OnConnectionLost(func() { close(lost) })
+			fake.Write(fakemodem.Lines(m.lost))
+
+			select {
+			case <-lost:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Lost connection wasn't reported")
+			}
+			if client.IsConnected() {
+				t.Fatal("Client is still connected")
+			}
+			if err := client.Publish(context.Background(), "sensors/temp", nil, mqtt.AtMostOnce, false); err != mqtt.ErrNotConnected {
+				t.Fatalf("Expected ErrNotConnected, got %v", err)
+			}
+		})
+	}
+}
+
+// TestIncompleteMessage checks that a message that is cut short doesn't
+// swallow the lines that follow it
+func TestIncompleteMessage(t *testing.T) {
+	b := newBroker()
+	device, fake := startNRF91(t, b)
+	client := connect(t, device)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The topic and the payload of the first message never turn up
+	fake.Handle("AT#XMQTTSUB=", func(cmd string) string {
+		b.subscribe(fakemodem.Args(cmd)[0])
+		return fakemodem.Lines("#XMQTTMSG: 1,12,5") + fakemodem.OK + fakemodem.Lines("#XMQTTEVT: 7,0")
+	})
+
+	messages := make(chan *mqtt.Message, 10)
+	err := client.Subscribe(ctx, "sensors/#", mqtt.AtMostOnce, func(msg *mqtt.Message) {
+		messages <- msg
+	})
+	if err != nil {
+		t.Fatalf("Could not subscribe: %v", err)
+	}
+	if err := client.Publish(ctx, "sensors/temp", []byte("21.5"), mqtt.AtLeastOnce, false); err != nil {
+		t.Fatalf("Could not publish: %v", err)
+	}
+	msg := receive(t, messages)
+	if msg.Topic != "sensors/temp" || string(msg.Payload) != "21.5" {
+		t.Fatalf("Unexpected message %s: %q", msg.Topic, msg.Payload)
+	}
+	expectNone(t, messages)
+}
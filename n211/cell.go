@@ -0,0 +1,55 @@
+package n211
+
+import (
+	"strings"
+
+	"github.com/lab5e/at"
+)
+
+// cellPrefix is the prefix of the cell lines. Some firmware versions
+// leave out the leading +.
+const cellPrefix = `NUESTATS: "CELL",`
+
+// GetCellInfo reads the cell measurements with AT+NUESTATS="CELL". The
+// serving cell is the primary cell. The command doesn't report the cell
+// identity so it is read with AT+NUESTATS.
+func (d *n211) GetCellInfo() (*at.CellInfo, error) {
+	info := &at.CellInfo{}
+
+	err := d.cmd.Transact(`AT+NUESTATS="CELL"`, func(s string) error {
+		// NUESTATS: "CELL",<earfcn>,<physical_cell_id>,<primary_cell>,
+		// <rsrp>,<rsrq>,<rssi>,<snr>
+		st := strings.TrimPrefix(s, "+")
+		if !strings.HasPrefix(st, cellPrefix) {
+			return nil
+		}
+		fields := strings.Split(strings.TrimPrefix(st, cellPrefix), ",")
+		if len(fields) < 7 {
+			return nil
+		}
+		cell := at.UnknownCell()
+		cell.EARFCN = at.ParseMeasurement(fields[0])
+		cell.PCI = at.ParseMeasurement(fields[1])
+		cell.RSRP = at.ParseMeasurement(fields[3])
+		cell.RSRQ = at.ParseMeasurement(fields[4])
+		cell.SINR = at.ParseMeasurement(fields[6])
+		if strings.TrimSpace(fields[2]) == "1" {
+			info.Serving = &cell
+			return nil
+		}
+		info.Neighbours = append(info.Neighbours, cell)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Serving != nil {
+		stats, err := d.GetStats()
+		if err != nil {
+			return nil, err
+		}
+		info.Serving.CellID = stats.CellID
+	}
+	return info, nil
+}
@@ -20,6 +20,22 @@ func (d *n211) SetDebug(debug bool) {
 	d.cmd.SetDebug(debug)
 }
 
+func (d *n211) CommandMetrics() *at.CommandMetrics {
+	return d.cmd.Metrics()
+}
+
+func (d *n211) SetCommandHook(fn func(at.CommandEvent)) {
+	d.cmd.SetCommandHook(fn)
+}
+
+func (d *n211) CommandInterface() *at.CommandInterface {
+	return d.cmd
+}
+
+func (d *n211) AddInterceptor(i at.Interceptor) {
+	d.cmd.AddInterceptor(i)
+}
+
 func (d *n211) GetIMSI() (string, error) {
 	var imsi string
 
@@ -161,8 +177,51 @@ func (d *n211) SetRadio(on bool) error {
 	return d.cmd.Transact(fmt.Sprintf("AT+CFUN=%d", ind), nil)
 }
 
+func (d *n211) GetRegistration() (at.RegistrationStatus, error) {
+	status := at.RegistrationUnknown
+	err := d.cmd.Transact("AT+CEREG?", func(s string) error {
+		// URCs are passed to the URC handlers and skipped here
+		if !strings.HasPrefix(s, "+CEREG: ") || at.IsRegistrationURC(s) {
+			return nil
+		}
+		var err error
+		status, err = at.ParseRegistration(s)
+		return err
+	})
+	return status, err
+}
+
+func (d *n211) GetDeviceInfo() (*at.DeviceInfo, error) {
+	var err error
+	info := &at.DeviceInfo{}
+	if info.Manufacturer, err = d.infoText("AT+CGMI"); err != nil {
+		return nil, err
+	}
+	if info.Model, err = d.infoText("AT+CGMM"); err != nil {
+		return nil, err
+	}
+	if info.FirmwareVersion, err = d.infoText("AT+CGMR"); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// infoText returns the first line of the information text returned by
+// the command. Lines starting with + are URCs.
+func (d *n211) infoText(cmd string) (string, error) {
+	var text string
+	err := d.cmd.Transact(cmd, func(s string) error {
+		if strings.TrimSpace(s) == "" || text != "" || strings.HasPrefix(s, "+") {
+			return nil
+		}
+		text = strings.TrimSpace(s)
+		return nil
+	})
+	return text, err
+}
+
 func (d *n211) GetStats() (*at.Stats, error) {
-	var stats at.Stats
+	stats := at.UnknownStats()
 
 	err := d.cmd.Transact("AT+NUESTATS", func(s string) error {
 		parts := strings.Split(s, ",")
@@ -229,5 +288,13 @@ func (d *n211) GetStats() (*at.Stats, error) {
 		}
 		return nil
 	})
-	return &stats, err
+	// 255 means the coverage enhancement level is unknown and -32768
+	// that there is no TX power since the module hasn't transmitted
+	if stats.ECL == 255 {
+		stats.ECL = at.Unknown
+	}
+	if stats.TXPower == -32768 {
+		stats.TXPower = at.Unknown
+	}
+	return stats, err
 }
@@ -0,0 +1,44 @@
+package n211
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/lab5e/at"
+)
+
+// resolveTimeout is how long to wait for AT+UDNSRN when the context has no
+// deadline.
+const resolveTimeout = 70 * time.Second
+
+// Resolve resolves the host name with AT+UDNSRN. The module doesn't report
+// the TTL so the results are cached for at.DefaultDNSTTL.
+func (d *n211) Resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if ips := d.dns.Lookup(host); ips != nil {
+		return ips, nil
+	}
+
+	var ips []net.IP
+	err := d.cmd.TransactTimeout(fmt.Sprintf(`AT+UDNSRN=0,"%s"`, host), at.ContextTimeout(ctx, resolveTimeout), func(s string) error {
+		// +UDNSRN: "<ip>"[,"<ip>"...]
+		if st := strings.TrimPrefix(s, "+UDNSRN: "); st != s {
+			for _, field := range strings.Split(st, ",") {
+				if ip := net.ParseIP(at.TrimQuotes(strings.TrimSpace(field))); ip != nil {
+					ips = append(ips, ip)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ips) > 0 {
+		d.dns.Store(host, ips, 0)
+	}
+	return ips, nil
+}
@@ -0,0 +1,107 @@
+package n211
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lab5e/at"
+)
+
+// fotaSegmentSize is the number of package bytes written with each
+// AT+NFWUPD=1 command
+const fotaSegmentSize = 256
+
+// fotaCommandTimeout is the timeout for erasing, validating and
+// upgrading the package which take longer than ordinary commands
+const fotaCommandTimeout = time.Minute
+
+// UpdateFirmware fetches the firmware package and writes it to the module
+// with AT+NFWUPD before validating and upgrading. Packages at http:// and
+// https:// URLs are downloaded through the module itself, file:// URLs are
+// read from the host so units can be updated without network coverage.
+func (d *n211) UpdateFirmware(ctx context.Context, url string, progress func(at.FOTAEvent)) error {
+	progress(at.FOTAEvent{State: at.FOTADownloading, Progress: 0})
+	pkg, err := d.fetchPackage(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	if err := d.cmd.TransactTimeout("AT+NFWUPD=0", fotaCommandTimeout, nil); err != nil {
+		return fmt.Errorf("could not erase firmware package: %v", err)
+	}
+	for sn, offset := 0, 0; offset < len(pkg); sn++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		end := offset + fotaSegmentSize
+		if end > len(pkg) {
+			end = len(pkg)
+		}
+		segment := pkg[offset:end]
+		cmd := fmt.Sprintf("AT+NFWUPD=1,%d,%d,%s,%d", sn, len(segment), strings.ToUpper(hex.EncodeToString(segment)), crc8(segment))
+		if err := d.cmd.Transact(cmd, nil); err != nil {
+			return fmt.Errorf("could not write firmware segment %d: %v", sn, err)
+		}
+		offset = end
+		progress(at.FOTAEvent{State: at.FOTADownloading, Progress: offset * 100 / len(pkg)})
+	}
+	progress(at.FOTAEvent{State: at.FOTADownloaded, Progress: 100})
+
+	if err := d.cmd.TransactTimeout("AT+NFWUPD=4", fotaCommandTimeout, nil); err != nil {
+		return fmt.Errorf("firmware package is invalid: %v", err)
+	}
+
+	booted, unsubscribe := d.cmd.Subscribe("REBOOT_CAUSE", 4)
+	defer unsubscribe()
+
+	progress(at.FOTAEvent{State: at.FOTAUpdating, Progress: -1})
+	if err := d.cmd.TransactTimeout("AT+NFWUPD=5", fotaCommandTimeout, nil); err != nil {
+		return fmt.Errorf("could not start firmware upgrade: %v", err)
+	}
+	progress(at.FOTAEvent{State: at.FOTARebooting, Progress: -1})
+	return at.WaitURC(ctx, booted, at.ContextTimeout(ctx, at.FOTARebootTimeout), func(string) (bool, error) {
+		return true, nil
+	})
+}
+
+// fetchPackage reads the firmware package from the URL
+func (d *n211) fetchPackage(ctx context.Context, url string) ([]byte, error) {
+	if strings.HasPrefix(url, "file://") {
+		return ioutil.ReadFile(strings.TrimPrefix(url, "file://"))
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := at.NewHTTPClient(d).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not download firmware package: %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// crc8 returns the CRC-8 (polynomial 0x07) of the data
+func crc8(data []byte) byte {
+	var crc byte
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -3,6 +3,8 @@
 package n211
 
 import (
+	"sync"
+
 	"github.com/lab5e/at"
 )
 
@@ -10,14 +12,25 @@ const DefaultBaudRate = 9600
 
 // N211 maintains the state for connection to Sara N211
 type n211 struct {
-	cmd *at.CommandInterface
+	cmd       *at.CommandInterface
+	receivers at.ReceiveHandlers
+	dns       at.DNSCache
+
+	mu  sync.Mutex
+	tcp map[int]*tcpSocket
+	udp map[int]bool
 }
 
 // New creates a new instance of the N211 interface
 func New(device string, baudRate int) at.Device {
-	return &n211{
+	d := &n211{
 		cmd: at.NewCommandInterface(device, baudRate),
+		tcp: make(map[int]*tcpSocket),
+		udp: make(map[int]bool),
 	}
+	d.cmd.AddURCHandler("+NSONMI: ", d.handleNSONMI)
+	d.cmd.AddURCHandler("+NSOCLI: ", d.handleNSOCLI)
+	return d
 }
 
 func (d *n211) Start() error {
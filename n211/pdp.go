@@ -0,0 +1,53 @@
+package n211
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lab5e/at"
+)
+
+// The N211 uses the standard commands for PDP contexts except for the
+// Non-IP type and authentication. The module activates CID 0 itself when
+// autoconnect is on and contexts can only be defined and changed with
+// autoconnect off, see SetAPN.
+
+// DefineContext defines the context with AT+CGDCONT. The N211 calls the
+// Non-IP type NONIP.
+func (d *n211) DefineContext(cid int, pdpType string, apn string) error {
+	t, err := at.NormalizePDPType(pdpType)
+	if err != nil {
+		return err
+	}
+	if t == at.PDPTypeNonIP {
+		t = "NONIP"
+	}
+	return d.cmd.Transact(fmt.Sprintf("AT+CGDCONT=%d,\"%s\",\"%s\"", cid, t, apn), nil)
+}
+
+// errNoAuth is returned by SetAuth. The AT command manual of the N211
+// doesn't list AT+CGAUTH or any other command for the authentication.
+var errNoAuth = errors.New("the N211 does not support PDP context authentication")
+
+// SetAuth returns an error since the authentication can't be set on the
+// N211
+func (d *n211) SetAuth(cid int, auth at.AuthType, username string, password string) error {
+	return errNoAuth
+}
+
+func (d *n211) Activate(cid int) error {
+	return d.standard().Activate(cid)
+}
+
+func (d *n211) Deactivate(cid int) error {
+	return d.standard().Deactivate(cid)
+}
+
+func (d *n211) ListContexts() ([]at.PDPContext, error) {
+	return d.standard().ListContexts()
+}
+
+// standard returns the standard implementation of the commands
+func (d *n211) standard() *at.DefaultImplementation {
+	return &at.DefaultImplementation{Cmd: d.cmd}
+}
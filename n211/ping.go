@@ -0,0 +1,77 @@
+package n211
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lab5e/at"
+)
+
+// Packet size limits for AT+NPING
+const (
+	minPingSize = 12
+	maxPingSize = 1500
+)
+
+// pingMargin is how much longer than the ping timeout we wait for the
+// +NPING URC
+const pingMargin = 5 * time.Second
+
+// Ping pings the host with AT+NPING. The module sends one echo request per
+// command and reports the result in a +NPING or +NPINGERR URC. Names are
+// resolved first since the module only accepts addresses.
+func (d *n211) Ping(ctx context.Context, host string, count int, size int) (*at.PingResult, error) {
+	ips, err := at.ResolveHost(ctx, d, host)
+	if err != nil {
+		return nil, err
+	}
+	addr := ips[0].String()
+	if size < minPingSize {
+		size = minPingSize
+	}
+	if size > maxPingSize {
+		size = maxPingSize
+	}
+
+	urcs, unsubscribe := d.cmd.Subscribe("+NPING", 4)
+	defer unsubscribe()
+
+	var replies []at.PingReply
+	sent := 0
+	for ; sent < count; sent++ {
+		cmd := fmt.Sprintf(`AT+NPING="%s",%d,%d`, addr, size, at.DefaultPingTimeout/time.Millisecond)
+		if err := d.cmd.Transact(cmd, nil); err != nil {
+			return nil, err
+		}
+
+		err := at.WaitURC(ctx, urcs, at.DefaultPingTimeout+pingMargin, func(s string) (bool, error) {
+			// +NPINGERR: <err> when there is no reply
+			if strings.HasPrefix(s, "+NPINGERR: ") {
+				return true, nil
+			}
+			// +NPING: <remote_address>,<ttl>,<rtt>
+			fields := strings.Split(strings.TrimPrefix(s, "+NPING: "), ",")
+			if len(fields) != 3 {
+				return false, errors.New("could not parse +NPING URC")
+			}
+			ttl, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+			if err != nil {
+				return false, errors.New("invalid TTL")
+			}
+			rtt, err := strconv.Atoi(strings.TrimSpace(fields[2]))
+			if err != nil {
+				return false, errors.New("invalid RTT")
+			}
+			replies = append(replies, at.PingReply{RTT: time.Duration(rtt) * time.Millisecond, TTL: ttl})
+			return true, nil
+		})
+		if err != nil && err != at.ErrReadTimeout {
+			return nil, err
+		}
+	}
+	return at.NewPingResult(addr, sent, replies), nil
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -32,8 +33,14 @@ func (d *n211) CreateUDPSocket(port int) (int, error) {
 		socket = n
 		return nil
 	})
+	if err != nil {
+		return socket, err
+	}
 
-	return socket, err
+	d.mu.Lock()
+	d.udp[socket] = true
+	d.mu.Unlock()
+	return socket, nil
 }
 
 func (d *n211) SendUDP(socket int, address net.IP, remotePort int, data []byte) (int, error) {
@@ -95,7 +102,12 @@ func (d *n211) ReceiveUDP(socket int, length int) (*at.ReceivedData, error) {
 		}
 
 		// the data is in hex so we have to decode it first
-		data.Data, err = hex.DecodeString(parts[4])
+		data.Data, err = hex.DecodeString(at.TrimQuotes(parts[4]))
+		if err != nil {
+			return err
+		}
+
+		data.Remaining, err = strconv.Atoi(strings.TrimSpace(parts[5]))
 		if err != nil {
 			return err
 		}
@@ -107,5 +119,48 @@ func (d *n211) ReceiveUDP(socket int, length int) (*at.ReceivedData, error) {
 }
 
 func (d *n211) CloseUDPSocket(socket int) error {
+	d.mu.Lock()
+	delete(d.udp, socket)
+	d.mu.Unlock()
 	return d.cmd.Transact(fmt.Sprintf("AT+NSOCL=%d", socket), nil)
 }
+
+// ListSockets returns the sockets opened through the driver
+func (d *n211) ListSockets() []at.SocketInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var ret []at.SocketInfo
+	for socket := range d.udp {
+		ret = append(ret, at.SocketInfo{Socket: socket, Protocol: "udp"})
+	}
+	for socket := range d.tcp {
+		ret = append(ret, at.SocketInfo{Socket: socket, Protocol: "tcp"})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Socket < ret[j].Socket
+	})
+	return ret
+}
+
+// OnReceive registers a handler for the data received on the socket. The
+// data is read when the module issues a +NSONMI URC.
+func (d *n211) OnReceive(socket int, handler func(*at.ReceivedData)) error {
+	d.receivers.Set(socket, handler)
+	return nil
+}
+
+// handleNSONMI handles the +NSONMI: <socket>,<length> URC
+func (d *n211) handleNSONMI(s string) {
+	parts := strings.Split(strings.TrimPrefix(s, "+NSONMI: "), ",")
+	socket, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		log.Printf("Invalid socket in URC: %s", s)
+		return
+	}
+	if t := d.tcpSocket(socket); t != nil {
+		t.DataAvailable()
+		return
+	}
+	d.receivers.Fetch(socket, d.ReceiveUDP)
+}
@@ -0,0 +1,144 @@
+package n211
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lab5e/at"
+)
+
+// connectTimeout is how long to wait for AT+NSOCO when the context has no
+// deadline.
+const connectTimeout = 60 * time.Second
+
+// maxSendSize is the largest payload we send with one command
+const maxSendSize = 512
+
+type tcpSocket struct {
+	at.SocketEvents
+
+	d      *n211
+	socket int
+}
+
+// DialTCP opens a TCP connection. If host is a name it is resolved with
+// AT+UDNSRN first.
+func (d *n211) DialTCP(ctx context.Context, host string, port int) (at.TCPSocket, error) {
+	ips, err := at.ResolveHost(ctx, d, host)
+	if err != nil {
+		return nil, err
+	}
+	ip := ips[0]
+
+	socket := -1
+	err = d.cmd.Transact("AT+NSOCR=\"STREAM\",6,0,1", func(s string) error {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil
+		}
+		socket = n
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if socket < 0 {
+		return nil, errors.New("module did not return a socket")
+	}
+
+	t := &tcpSocket{d: d, socket: socket}
+	d.mu.Lock()
+	d.tcp[socket] = t
+	d.mu.Unlock()
+
+	err = d.cmd.TransactTimeout(fmt.Sprintf("AT+NSOCO=%d,\"%s\",%d", socket, ip.String(), port), at.ContextTimeout(ctx, connectTimeout), nil)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	t.SetState(at.ConnConnected)
+
+	return t, nil
+}
+
+// tcpSocket returns the TCP socket or nil if the socket isn't a TCP socket
+func (d *n211) tcpSocket(socket int) *tcpSocket {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.tcp[socket]
+}
+
+// handleNSOCLI handles the +NSOCLI: <socket> URC that is issued when the
+// remote end closes the connection.
+func (d *n211) handleNSOCLI(s string) {
+	socket, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(s, "+NSOCLI: ")))
+	if err != nil {
+		log.Printf("Invalid socket in URC: %s", s)
+		return
+	}
+	if t := d.tcpSocket(socket); t != nil {
+		t.SetState(at.ConnClosed)
+	}
+}
+
+// MaxSendSize returns 512, the largest payload AT+NSOSD accepts
+func (t *tcpSocket) MaxSendSize() int {
+	return maxSendSize
+}
+
+func (t *tcpSocket) Socket() int {
+	return t.socket
+}
+
+func (t *tcpSocket) Send(data []byte) (int, error) {
+	if t.State() == at.ConnClosed {
+		return 0, at.ErrClosed
+	}
+
+	sent := 0
+	cmd := fmt.Sprintf("AT+NSOSD=%d,%d,\"%x\"", t.socket, len(data), data)
+	err := t.d.cmd.Transact(cmd, func(s string) error {
+		// The response is <socket>,<length>
+		parts := strings.Split(s, ",")
+		if len(parts) != 2 {
+			return nil
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return err
+		}
+		sent = n
+		return nil
+	})
+	return sent, err
+}
+
+func (t *tcpSocket) Receive(length int) ([]byte, error) {
+	// AT+NSORF responds with the same format for TCP and UDP sockets
+	data, err := t.d.ReceiveUDP(t.socket, length)
+	if err != nil {
+		return nil, err
+	}
+	return data.Data, nil
+}
+
+func (t *tcpSocket) Close() error {
+	wasClosed := t.State() == at.ConnClosed
+
+	t.d.mu.Lock()
+	delete(t.d.tcp, t.socket)
+	t.d.mu.Unlock()
+
+	err := t.d.cmd.Transact(fmt.Sprintf("AT+NSOCL=%d", t.socket), nil)
+	t.SetState(at.ConnClosed)
+	if wasClosed {
+		// The module has closed the socket already
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,69 @@
+package nrf91
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lab5e/at"
+)
+
+// cellMeasurementTimeout is how long to wait for the %NCELLMEAS
+// notification
+const cellMeasurementTimeout = 30 * time.Second
+
+// Sizes of the groups of fields in %NCELLMEAS notifications
+const (
+	servingCellFields   = 10
+	neighbourCellFields = 5
+)
+
+// GetCellInfo measures the cells with AT%NCELLMEAS. The modem reports the
+// result in a %NCELLMEAS notification with the serving cell followed by
+// the neighbour cells. It doesn't report the SINR.
+func (d *nrf91) GetCellInfo() (*at.CellInfo, error) {
+	urcs, unsubscribe := d.cmd.Subscribe("%NCELLMEAS: ", 1)
+	defer unsubscribe()
+
+	if err := d.cmd.Transact("AT%NCELLMEAS", nil); err != nil {
+		return nil, err
+	}
+
+	info := &at.CellInfo{}
+	err := at.WaitURC(context.Background(), urcs, cellMeasurementTimeout, func(s string) (bool, error) {
+		// %NCELLMEAS: <status>,<cell_id>,<plmn>,<tac>,<timing_advance>,
+		// <earfcn>,<phys_cell_id>,<rsrp>,<rsrq>,<measurement_time>,
+		// [<n_earfcn>,<n_phys_cell_id>,<n_rsrp>,<n_rsrq>,<time_diff>]...
+		// [,<timing_advance_measurement_time>]
+		fields := strings.Split(strings.TrimPrefix(s, "%NCELLMEAS: "), ",")
+		if status := strings.TrimSpace(fields[0]); status != "0" {
+			return false, fmt.Errorf("cell measurement failed with status %s", status)
+		}
+		if len(fields) < servingCellFields {
+			return true, nil
+		}
+		serving := at.UnknownCell()
+		serving.CellID = at.ParseHexMeasurement(fields[1])
+		serving.TAC = at.ParseHexMeasurement(fields[3])
+		serving.EARFCN = at.ParseMeasurement(fields[5])
+		serving.PCI = at.ParseMeasurement(fields[6])
+		serving.RSRP = at.RSRPFromIndex(at.ParseMeasurement(fields[7]))
+		serving.RSRQ = at.RSRQFromIndex(at.ParseMeasurement(fields[8]))
+		info.Serving = &serving
+
+		for n := fields[servingCellFields:]; len(n) >= neighbourCellFields; n = n[neighbourCellFields:] {
+			cell := at.UnknownCell()
+			cell.EARFCN = at.ParseMeasurement(n[0])
+			cell.PCI = at.ParseMeasurement(n[1])
+			cell.RSRP = at.RSRPFromIndex(at.ParseMeasurement(n[2]))
+			cell.RSRQ = at.RSRQFromIndex(at.ParseMeasurement(n[3]))
+			info.Neighbours = append(info.Neighbours, cell)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
@@ -1,11 +1,18 @@
 package nrf91
 
 import (
+	"context"
 	"errors"
 	"log"
 	"strings"
+	"time"
+
+	"github.com/lab5e/at"
 )
 
+// rebootTimeout is how long Reboot waits for the module to come back
+const rebootTimeout = time.Minute
+
 func (d *nrf91) GetCCID() (string, error) {
 	iccid := ""
 	err := d.cmd.Transact("AT%XICCID", func(s string) error {
@@ -19,3 +26,31 @@ func (d *nrf91) GetCCID() (string, error) {
 	})
 	return iccid, err
 }
+
+// Reboot resets the module with AT#XRESET and waits for the Serial LTE
+// Modem to report Ready. The sockets don't survive the reset.
+func (d *nrf91) Reboot() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ready, unsubscribe := d.cmd.Subscribe("Ready", 1)
+	defer unsubscribe()
+
+	// The module may reset before it responds
+	if err := d.cmd.Transact("AT#XRESET", nil); err != nil && err != at.ErrReadTimeout {
+		return err
+	}
+	for handle, t := range d.tcp {
+		t.SetState(at.ConnClosed)
+		delete(d.tcp, handle)
+	}
+	for handle := range d.sockets {
+		d.receivers.Set(handle, nil)
+		delete(d.sockets, handle)
+	}
+	d.selected = -1
+
+	return at.WaitURC(context.Background(), ready, rebootTimeout, func(string) (bool, error) {
+		return true, nil
+	})
+}
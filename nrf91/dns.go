@@ -0,0 +1,46 @@
+package nrf91
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/lab5e/at"
+)
+
+// resolveTimeout is how long to wait for AT#XGETADDRINFO when the context
+// has no deadline.
+const resolveTimeout = 60 * time.Second
+
+// Resolve resolves the host name with AT#XGETADDRINFO. The module doesn't
+// report the TTL so the results are cached for at.DefaultDNSTTL.
+func (d *nrf91) Resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if ips := d.dns.Lookup(host); ips != nil {
+		return ips, nil
+	}
+
+	var ips []net.IP
+	err := d.cmd.TransactTimeout(fmt.Sprintf(`AT#XGETADDRINFO="%s"`, host), at.ContextTimeout(ctx, resolveTimeout), func(s string) error {
+		// #XGETADDRINFO: "<ip>[ <ip>...]"
+		if st := strings.TrimPrefix(s, "#XGETADDRINFO: "); st != s {
+			for _, field := range strings.FieldsFunc(st, func(r rune) bool {
+				return r == ' ' || r == ',' || r == '"'
+			}) {
+				if ip := net.ParseIP(field); ip != nil {
+					ips = append(ips, ip)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ips) > 0 {
+		d.dns.Store(host, ips, 0)
+	}
+	return ips, nil
+}
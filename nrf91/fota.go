@@ -0,0 +1,96 @@
+package nrf91
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lab5e/at"
+)
+
+// fotaTimeout is how long a firmware update may take when the context has
+// no deadline
+const fotaTimeout = time.Hour
+
+// FOTA stages and statuses in the #XFOTA URC
+const (
+	fotaStageDownload = 1
+	fotaStageApply    = 4
+	fotaStageComplete = 5
+
+	fotaStatusOK = 0
+)
+
+// UpdateFirmware downloads the modem firmware delta with AT#XFOTA and
+// follows the #XFOTA URCs. The delta is applied when the module is reset
+// after the download.
+func (d *nrf91) UpdateFirmware(ctx context.Context, url string, progress func(at.FOTAEvent)) error {
+	urcs, unsubscribe := d.cmd.Subscribe("#XFOTA: ", 16)
+	defer unsubscribe()
+
+	if err := d.cmd.Transact(fmt.Sprintf(`AT#XFOTA=1,"%s"`, url), nil); err != nil {
+		return err
+	}
+	progress(at.FOTAEvent{State: at.FOTADownloading, Progress: 0})
+
+	timeout := at.ContextTimeout(ctx, fotaTimeout)
+	err := at.WaitURC(ctx, urcs, timeout, func(s string) (bool, error) {
+		stage, status, info, err := parseFOTA(s)
+		if err != nil {
+			return false, err
+		}
+		if status != fotaStatusOK {
+			return false, fmt.Errorf("firmware download failed in stage %d with status %d (%d)", stage, status, info)
+		}
+		switch stage {
+		case fotaStageDownload:
+			if info >= 0 {
+				progress(at.FOTAEvent{State: at.FOTADownloading, Progress: info})
+			}
+		case fotaStageApply:
+			return true, nil
+		}
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+	progress(at.FOTAEvent{State: at.FOTADownloaded, Progress: 100})
+
+	// The modem applies the update when it boots
+	progress(at.FOTAEvent{State: at.FOTARebooting, Progress: -1})
+	if err := d.cmd.Transact("AT#XRESET", nil); err != nil && err != at.ErrReadTimeout {
+		return err
+	}
+	return at.WaitURC(ctx, urcs, at.ContextTimeout(ctx, at.FOTARebootTimeout), func(s string) (bool, error) {
+		stage, status, info, err := parseFOTA(s)
+		if err != nil || stage != fotaStageComplete {
+			return false, err
+		}
+		if status != fotaStatusOK {
+			return false, fmt.Errorf("firmware update failed with status %d (%d)", status, info)
+		}
+		return true, nil
+	})
+}
+
+// parseFOTA parses #XFOTA: <stage>,<status>[,<info>]. The info is the
+// download progress or an error code and -1 when it is missing.
+func parseFOTA(s string) (int, int, int, error) {
+	fields := strings.Split(strings.TrimPrefix(s, "#XFOTA: "), ",")
+	if len(fields) < 2 {
+		return 0, 0, 0, fmt.Errorf("invalid FOTA URC: %s", s)
+	}
+	var values [3]int
+	values[2] = -1
+	for i := 0; i < len(fields) && i < 3; i++ {
+		n, err := strconv.Atoi(strings.TrimSpace(fields[i]))
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid FOTA URC: %s", s)
+		}
+		values[i] = n
+	}
+	return values[0], values[1], values[2], nil
+}
@@ -0,0 +1,223 @@
+package nrf91
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lab5e/at"
+	"github.com/lab5e/at/mqtt"
+)
+
+// mqttTimeout is how long to wait for MQTT events when the context has no
+// deadline.
+const mqttTimeout = 60 * time.Second
+
+// MQTT event types reported by #XMQTTEVT
+const (
+	mqttEvtConnAck    = 0
+	mqttEvtDisconnect = 1
+	mqttEvtPubAck     = 3
+	mqttEvtPubComp    = 6
+	mqttEvtSubAck     = 7
+	mqttEvtUnsubAck   = 8
+)
+
+// Data types used by #XMQTTPUB and #XMQTTMSG
+const (
+	dataTypeHex  = 0
+	dataTypeText = 1
+)
+
+// MQTTConnect connects to the broker with AT#XMQTTCON
+func (d *nrf91) MQTTConnect(ctx context.Context, opts *mqtt.Options, onMessage func(*mqtt.Message), onLost func()) error {
+	d.mqttMu.Lock()
+	defer d.mqttMu.Unlock()
+
+	d.mu.Lock()
+	d.mqttOnMessage = onMessage
+	d.mqttOnLost = onLost
+	d.mu.Unlock()
+
+	cmd := fmt.Sprintf(`AT#XMQTTCON=1,"%s","%s","%s","%s",%d`, opts.ClientID, opts.Username, opts.Password, opts.Host, opts.Port)
+	if opts.TLS != nil {
+		cmd += fmt.Sprintf(",%d", opts.TLS.SecurityTag)
+	}
+	return d.mqttTransact(ctx, cmd, mqttEvtConnAck)
+}
+
+// MQTTDisconnect disconnects from the broker
+func (d *nrf91) MQTTDisconnect(ctx context.Context) error {
+	d.mqttMu.Lock()
+	defer d.mqttMu.Unlock()
+
+	d.mu.Lock()
+	d.mqttOnLost = nil
+	d.mu.Unlock()
+
+	return d.mqttTransact(ctx, "AT#XMQTTCON=0", mqttEvtDisconnect)
+}
+
+// MQTTPublish publishes the message with AT#XMQTTPUB. The payload is sent
+// as hex.
+func (d *nrf91) MQTTPublish(ctx context.Context, msg *mqtt.Message) error {
+	d.mqttMu.Lock()
+	defer d.mqttMu.Unlock()
+
+	retain := 0
+	if msg.Retain {
+		retain = 1
+	}
+	cmd := fmt.Sprintf(`AT#XMQTTPUB="%s",%d,"%s",%d,%d`, msg.Topic, dataTypeHex, hex.EncodeToString(msg.Payload), msg.QoS, retain)
+
+	switch msg.QoS {
+	case mqtt.AtMostOnce:
+		// There is no acknowledgement for QoS 0
+		return d.cmd.Transact(cmd, nil)
+	case mqtt.AtLeastOnce:
+		return d.mqttTransact(ctx, cmd, mqttEvtPubAck)
+	default:
+		return d.mqttTransact(ctx, cmd, mqttEvtPubComp)
+	}
+}
+
+// MQTTSubscribe subscribes to the topic with AT#XMQTTSUB
+func (d *nrf91) MQTTSubscribe(ctx context.Context, topic string, qos mqtt.QoS) error {
+	d.mqttMu.Lock()
+	defer d.mqttMu.Unlock()
+
+	return d.mqttTransact(ctx, fmt.Sprintf(`AT#XMQTTSUB="%s",%d`, topic, qos), mqttEvtSubAck)
+}
+
+// MQTTUnsubscribe unsubscribes from the topic with AT#XMQTTUNSUB
+func (d *nrf91) MQTTUnsubscribe(ctx context.Context, topic string) error {
+	d.mqttMu.Lock()
+	defer d.mqttMu.Unlock()
+
+	return d.mqttTransact(ctx, fmt.Sprintf(`AT#XMQTTUNSUB="%s"`, topic), mqttEvtUnsubAck)
+}
+
+// mqttTransact issues the command and waits for the #XMQTTEVT: <evt_type>,<result>
+// event of the given type. The events don't identify the request so the
+// caller must hold d.mqttMu.
+func (d *nrf91) mqttTransact(ctx context.Context, cmd string, evtType int) error {
+	urcs, unsubscribe := d.cmd.Subscribe("#XMQTTEVT: ", 16)
+	defer unsubscribe()
+
+	if err := d.cmd.Transact(cmd, nil); err != nil {
+		return err
+	}
+
+	return at.WaitURC(ctx, urcs, at.ContextTimeout(ctx, mqttTimeout), func(s string) (bool, error) {
+		evt, result, err := parseMQTTEvent(s)
+		if err != nil {
+			return false, err
+		}
+		if evt != evtType {
+			return false, nil
+		}
+		if result != 0 {
+			return false, fmt.Errorf("MQTT operation failed with result %d", result)
+		}
+		return true, nil
+	})
+}
+
+// parseMQTTEvent parses #XMQTTEVT: <evt_type>,<result>
+func parseMQTTEvent(s string) (int, int, error) {
+	fields := strings.Split(strings.TrimPrefix(s, "#XMQTTEVT: "), ",")
+	if len(fields) != 2 {
+		return 0, 0, errors.New("could not parse MQTT event")
+	}
+	evt, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+	if err != nil {
+		return 0, 0, errors.New("invalid MQTT event type")
+	}
+	result, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+	if err != nil {
+		return 0, 0, errors.New("invalid MQTT event result")
+	}
+	return evt, result, nil
+}
+
+// handleXMQTTEVT reports lost connections. Disconnects we asked for are
+// not reported since MQTTDisconnect removes the callback first.
+func (d *nrf91) handleXMQTTEVT(s string) {
+	evt, _, err := parseMQTTEvent(s)
+	if err != nil || evt != mqttEvtDisconnect {
+		return
+	}
+
+	d.mu.Lock()
+	fn := d.mqttOnLost
+	d.mu.Unlock()
+	if fn != nil {
+		fn()
+	}
+}
+
+// mqttMessageLines returns the lines following the
+// #XMQTTMSG: <datatype>,<topic_length>,<message_length> line. The topic
+// and the message are on separate lines and are recognized by their
+// lengths. The length of hex messages may be the length of the data or
+// of the hex string.
+func mqttMessageLines(s string) []func(string) bool {
+	fields := strings.Split(strings.TrimPrefix(s, "#XMQTTMSG: "), ",")
+	if len(fields) != 3 {
+		return nil
+	}
+	topicLength, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+	if err != nil {
+		return nil
+	}
+	messageLength, err := strconv.Atoi(strings.TrimSpace(fields[2]))
+	if err != nil {
+		return nil
+	}
+	hexData := strings.TrimSpace(fields[0]) == strconv.Itoa(dataTypeHex)
+
+	lines := []func(string) bool{
+		func(s string) bool { return len(s) == topicLength },
+	}
+	if messageLength > 0 {
+		lines = append(lines, func(s string) bool {
+			return len(s) == messageLength || (hexData && len(s) == 2*messageLength)
+		})
+	}
+	return lines
+}
+
+// handleXMQTTMSG handles incoming messages
+func (d *nrf91) handleXMQTTMSG(s string) {
+	lines := strings.Split(s, "\r\n")
+	fields := strings.Split(strings.TrimPrefix(lines[0], "#XMQTTMSG: "), ",")
+	if len(fields) != 3 || len(lines) < 2 {
+		log.Printf("Could not parse MQTT message: %s", s)
+		return
+	}
+
+	msg := &mqtt.Message{Topic: lines[1]}
+	if len(lines) > 2 {
+		msg.Payload = []byte(lines[2])
+		if strings.TrimSpace(fields[0]) == strconv.Itoa(dataTypeHex) {
+			payload, err := hex.DecodeString(lines[2])
+			if err != nil {
+				log.Printf("Invalid payload in MQTT message: %s", s)
+				return
+			}
+			msg.Payload = payload
+		}
+	}
+
+	d.mu.Lock()
+	fn := d.mqttOnMessage
+	d.mu.Unlock()
+	if fn != nil {
+		fn(msg)
+	}
+}
@@ -1,19 +1,48 @@
 package nrf91
 
-import "github.com/lab5e/at"
+import (
+	"sync"
+
+	"github.com/lab5e/at"
+	"github.com/lab5e/at/mqtt"
+)
 
 const DefaultBaudRate = 115200
 
 type nrf91 struct {
 	at.DefaultImplementation
 
-	cmd *at.CommandInterface
+	cmd       *at.CommandInterface
+	receivers at.ReceiveHandlers
+	dns       at.DNSCache
+
+	// mu serializes socket operations since the Serial LTE Modem
+	// operates on the currently selected socket.
+	mu       sync.Mutex
+	sockets  map[int]*socket
+	tcp      map[int]*tcpSocket
+	selected int
+	nextPort int
+
+	// mqttMu serializes MQTT operations since the events don't tell
+	// which request they belong to
+	mqttMu        sync.Mutex
+	mqttOnMessage func(*mqtt.Message)
+	mqttOnLost    func()
 }
 
 func New(serialDevice string, baudRate int) at.Device {
 	cmdIF := at.NewCommandInterface(serialDevice, baudRate)
-	return &nrf91{
+	d := &nrf91{
 		DefaultImplementation: at.DefaultImplementation{Cmd: cmdIF},
 		cmd:                   cmdIF,
+		sockets:               make(map[int]*socket),
+		tcp:                   make(map[int]*tcpSocket),
+		selected:              -1,
+		nextPort:              firstEphemeralPort,
 	}
+	cmdIF.AddURCHandler("#XAPOLL: ", d.handleXAPOLL)
+	cmdIF.AddURCHandler("#XMQTTEVT: ", d.handleXMQTTEVT)
+	cmdIF.AddMultilineURCHandler("#XMQTTMSG: ", mqttMessageLines, d.handleXMQTTMSG)
+	return d
 }
@@ -0,0 +1,59 @@
+package nrf91
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lab5e/at"
+)
+
+// pingInterval is the interval between echo requests
+const pingInterval = time.Second
+
+// pingMargin is how much longer than the ping timeouts we wait for the
+// #XPING notifications
+const pingMargin = 10 * time.Second
+
+// Ping pings the host with AT#XPING. The Serial LTE Modem reports the round
+// trip time of each reply in seconds and doesn't report the TTL.
+func (d *nrf91) Ping(ctx context.Context, host string, count int, size int) (*at.PingResult, error) {
+	urcs, unsubscribe := d.cmd.Subscribe("#XPING: ", count+1)
+	defer unsubscribe()
+
+	cmd := fmt.Sprintf(`AT#XPING="%s",%d,%d,%d,%d`, host, size, at.DefaultPingTimeout/time.Millisecond, count, pingInterval/time.Millisecond)
+	if err := d.cmd.Transact(cmd, nil); err != nil {
+		return nil, err
+	}
+
+	// #XPING: <rtt> seconds for each reply, #XPING: timeout for lost
+	// requests and #XPING: average <rtt> seconds at the end
+	var replies []at.PingReply
+	answered := 0
+	wait := time.Duration(count)*(at.DefaultPingTimeout+pingInterval) + pingMargin
+	err := at.WaitURC(ctx, urcs, at.ContextTimeout(ctx, wait), func(s string) (bool, error) {
+		fields := strings.Fields(strings.TrimPrefix(s, "#XPING: "))
+		switch {
+		case len(fields) > 0 && fields[0] == "average":
+			return true, nil
+		case len(fields) == 2 && fields[1] == "seconds":
+			seconds, err := strconv.ParseFloat(fields[0], 64)
+			if err != nil {
+				return false, errors.New("invalid RTT")
+			}
+			replies = append(replies, at.PingReply{RTT: time.Duration(seconds * float64(time.Second)), TTL: -1})
+		case len(fields) == 1 && fields[0] == "timeout":
+		default:
+			return false, fmt.Errorf("ping failed: %s", strings.TrimPrefix(s, "#XPING: "))
+		}
+		answered++
+		return answered >= count, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return at.NewPingResult(host, count, replies), nil
+}
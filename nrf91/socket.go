@@ -6,103 +6,408 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/lab5e/at"
 )
 
-// Note: There is only a single socket in the LTE modem. The port parameter may be 0, then the
-// socket won't be bound to a port.
-func (d *nrf91) CreateUDPSocket(port int) (int, error) {
+// The Serial LTE Modem doesn't tell us which port an unbound socket ends up
+// on so sockets created without a port are bound to a port from the dynamic
+// range instead.
+const (
+	firstEphemeralPort = 49152
+	lastEphemeralPort  = 65535
+)
+
+// Socket types and protocols used with AT#XSOCKET
+const (
+	socketTypeStream = 1
+	socketTypeDgram  = 2
+)
+
+// Poll events reported by #XAPOLL
+const (
+	pollIn  = 0x01
+	pollErr = 0x08
+	pollHup = 0x10
+)
+
+// socket holds the state the driver keeps for each socket handle
+type socket struct {
+	handle      int
+	socketType  int
+	localPort   int
+	recvTimeout time.Duration
+}
+
+var errUnknownSocket = errors.New("unknown socket ID")
+
+// openSocket opens a new IPv4 client socket and returns the handle the
+// module assigned to it. The new socket becomes the selected socket. The
+// caller must hold d.mu.
+func (d *nrf91) openSocket(socketType int) (*socket, error) {
 	// Parameters:
 	// #1: 0 - close, 1 - open ipv4, 2 - open ipv6
 	// #2: 1 - TCP, 2 - UDP
 	// #3: 0 - client, 1- server
+	return d.openSocketWith(fmt.Sprintf("AT#XSOCKET=1,%d,0", socketType), "#XSOCKET: ", socketType)
+}
 
-	err := d.cmd.Transact("AT#XSOCKET=1,2,0", func(s string) error {
-		// This will just return "OK"
+// openSocketWith opens a socket using cmd, which responds with
+// <prefix><handle>,... The caller must hold d.mu.
+func (d *nrf91) openSocketWith(cmd string, prefix string, socketType int) (*socket, error) {
+	handle := -1
+	err := d.cmd.Transact(cmd, func(s string) error {
+		// The response is <prefix><handle>,<type>,<protocol>
+		if st := strings.TrimPrefix(s, prefix); st != s {
+			n, err := strconv.Atoi(strings.TrimSpace(strings.Split(st, ",")[0]))
+			if err != nil {
+				log.Printf("Could not parse socket handle from %s", s)
+				return errors.New("could not parse socket handle")
+			}
+			handle = n
+		}
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	if handle < 0 {
+		return nil, errors.New("module did not return a socket handle")
+	}
+
+	s := &socket{
+		handle:     handle,
+		socketType: socketType,
+	}
+	d.sockets[handle] = s
+	d.selected = handle
+	return s, nil
+}
+
+// selectSocket makes the socket the active socket in the module. The
+// caller must hold d.mu.
+func (d *nrf91) selectSocket(handle int) (*socket, error) {
+	s, ok := d.sockets[handle]
+	if !ok {
+		return nil, errUnknownSocket
+	}
+	if d.selected == handle {
+		return s, nil
+	}
+	if err := d.cmd.Transact(fmt.Sprintf("AT#XSOCKETSELECT=%d", handle), nil); err != nil {
+		return nil, err
+	}
+	d.selected = handle
+	return s, nil
+}
+
+// closeSocket closes the socket and forgets about it. The caller must hold
+// d.mu.
+func (d *nrf91) closeSocket(handle int) error {
+	if _, err := d.selectSocket(handle); err != nil {
+		return err
+	}
+	err := d.cmd.Transact("AT#XSOCKET=0", nil)
+	delete(d.sockets, handle)
+	d.selected = -1
+	return err
+}
+
+// allocatePort returns the next port from the dynamic range that isn't in
+// use by another socket. The caller must hold d.mu.
+func (d *nrf91) allocatePort() int {
+	for {
+		port := d.nextPort
+		d.nextPort++
+		if d.nextPort > lastEphemeralPort {
+			d.nextPort = firstEphemeralPort
+		}
+		inUse := false
+		for _, s := range d.sockets {
+			if s.localPort == port {
+				inUse = true
+				break
+			}
+		}
+		if !inUse {
+			return port
+		}
+	}
+}
+
+// CreateUDPSocket opens a new UDP socket and binds it to port. If port is 0
+// the socket is bound to a free port from the dynamic range. Use LocalPort
+// to find out which port was used.
+func (d *nrf91) CreateUDPSocket(port int) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s, err := d.openSocket(socketTypeDgram)
 	if err != nil {
 		return 0, err
 	}
 
-	// Bind to a port if a port is set
-	if port != 0 {
-		err = d.cmd.Transact(fmt.Sprintf("AT#XBIND=%d", port), func(s string) error {
-			// This returns just OK
-			return nil
-		})
+	if port == 0 {
+		port = d.allocatePort()
 	}
+	if err := d.cmd.Transact(fmt.Sprintf("AT#XBIND=%d", port), nil); err != nil {
+		d.closeSocket(s.handle)
+		return 0, err
+	}
+	s.localPort = port
 
-	// Set the receive timeout (SO_RCVTIMEO) to 5 seconds
-	if err := d.cmd.Transact("AT#XSOCKETOPT=1,20,5", func(s string) error {
-		return nil
-	}); err != nil {
-		log.Fatalf("Could not set receive timeout: %v", err)
+	return s.handle, nil
+}
+
+// LocalPort returns the local port the socket is bound to.
+func (d *nrf91) LocalPort(socket int) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s, ok := d.sockets[socket]
+	if !ok {
+		return 0, errUnknownSocket
+	}
+	return s.localPort, nil
+}
+
+// SetReceiveTimeout sets the receive timeout (SO_RCVTIMEO) for the socket.
+// The timeout is rounded up to whole seconds. A timeout of 0 removes the
+// timeout, which is how new sockets start out.
+func (d *nrf91) SetReceiveTimeout(socket int, timeout time.Duration) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s, err := d.selectSocket(socket)
+	if err != nil {
+		return err
 	}
-	return 1, err
+	seconds := 0
+	if timeout > 0 {
+		seconds = int((timeout + time.Second - 1) / time.Second)
+	}
+	if err := d.cmd.Transact(fmt.Sprintf("AT#XSOCKETOPT=1,20,%d", seconds), nil); err != nil {
+		return err
+	}
+	s.recvTimeout = time.Duration(seconds) * time.Second
+	return nil
 }
 
 func (d *nrf91) SendUDP(socket int, address net.IP, remotePort int, data []byte) (int, error) {
-	if socket != 1 {
-		return 0, errors.New("unknown socket ID")
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.selectSocket(socket); err != nil {
+		return 0, err
 	}
+
 	var bytesSent = 0
 	var err error
 	err = d.cmd.Transact(
 		fmt.Sprintf(`AT#XSENDTO="%s",%d,0,"%s"`, address.String(), remotePort, hex.EncodeToString(data)),
 		func(s string) error {
-			if strings.TrimSpace(s) == "" {
-				return nil
-			}
-			parts := strings.Split(s, ":")
-			if len(parts) == 2 {
-				bytesSent, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+			// The response is #XSENDTO: <size>. Ignore anything else since
+			// URCs may turn up while we wait.
+			if st := strings.TrimPrefix(s, "#XSENDTO: "); st != s {
+				bytesSent, err = strconv.Atoi(strings.TrimSpace(st))
 				if err != nil {
-					log.Printf("Could not parse byte count from %s", parts[1])
+					log.Printf("Could not parse byte count from %s", st)
 					return errors.New("could not parse number of bytes")
 				}
-				return nil
 			}
-			log.Printf("Could not parse response from modem: %s", s)
-			return errors.New("uknown response")
+			return nil
 		})
 	return bytesSent, err
 }
 
-// Note: Receive has a 30 second timeout
+// ReceiveUDP blocks until data arrives on the socket or the receive timeout
+// set with SetReceiveTimeout expires. Without a timeout AT#XRECVFROM would
+// block the module until data arrives so it returns no data right away if
+// there is nothing waiting.
 func (d *nrf91) ReceiveUDP(socket int, length int) (*at.ReceivedData, error) {
-	var data at.ReceivedData
-
-	err := d.cmd.Transact("AT#XRECVFROM", func(s string) error {
-		// We'll recive at least two lines - first the data, then a line with #XRECVFROM=<size>,"<ip>"
-		if strings.HasPrefix(s, "#XRECVFROM:") {
-			parts := strings.Split(s, "FROM:")
-			if len(parts) != 2 {
-				return errors.New("could not parse recvfrom response")
-			}
-			sizeAddr := strings.Split(parts[1], ",")
-			if len(sizeAddr) != 2 {
-				return errors.New("could not parse size and addr in recvfrom response")
-			}
-			var err error
-			data.Length, err = strconv.Atoi(strings.TrimSpace(sizeAddr[1]))
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s, err := d.selectSocket(socket)
+	if err != nil {
+		return nil, err
+	}
+
+	data := at.ReceivedData{Socket: socket}
+	if s.recvTimeout == 0 {
+		revents, err := d.pollSocket(socket)
+		if err != nil {
+			return nil, err
+		}
+		if revents&pollIn == 0 {
+			return &data, nil
+		}
+	}
+
+	// The data follows a line with #XRECVFROM: <size>,"<ip>"[,<port>]
+	// and is read as is
+	data.Data, err = d.cmd.TransactSizedData("AT#XRECVFROM", dataSize("#XRECVFROM: "), at.DefaultLineTimeout+s.recvTimeout, func(s string) error {
+		st := strings.TrimPrefix(s, "#XRECVFROM: ")
+		if st == s {
+			return nil
+		}
+		fields := strings.Split(st, ",")
+		if len(fields) < 2 {
+			return errors.New("could not parse size and addr in recvfrom response")
+		}
+		var err error
+		data.Length, err = strconv.Atoi(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return err
+		}
+		data.IP = at.TrimQuotes(strings.TrimSpace(fields[1]))
+		if len(fields) > 2 {
+			data.Port, err = strconv.Atoi(strings.TrimSpace(fields[2]))
 			if err != nil {
 				return err
 			}
-			data.IP = at.TrimQuotes(sizeAddr[1])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// dataSize returns a function that reads the size of the data that
+// follows the <prefix><size>[,...] line of #XRECV and #XRECVFROM
+func dataSize(prefix string) func(string) (int, bool) {
+	return func(s string) (int, bool) {
+		st := strings.TrimPrefix(s, prefix)
+		if st == s {
+			return 0, false
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(strings.Split(st, ",")[0]))
+		if err != nil || n < 0 {
+			return 0, false
+		}
+		return n, true
+	}
+}
+
+// pollSocket returns the events (revents) of the socket right now with
+// AT#XPOLL. The caller must hold d.mu.
+func (d *nrf91) pollSocket(handle int) (int, error) {
+	revents := 0
+	err := d.cmd.Transact(fmt.Sprintf("AT#XPOLL=0,%d", handle), func(s string) error {
+		// #XPOLL: <handle>,<revents>
+		st := strings.TrimPrefix(s, "#XPOLL: ")
+		if st == s {
 			return nil
 		}
-		data.Data = append(data.Data, []byte(s)...)
-		data.Socket = 1
+		fields := strings.Split(st, ",")
+		if len(fields) != 2 || strings.TrimSpace(fields[0]) != strconv.Itoa(handle) {
+			return nil
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return fmt.Errorf("invalid events in %s", s)
+		}
+		revents = n
 		return nil
 	})
+	return revents, err
+}
+
+// ListSockets returns the sockets opened through the driver
+func (d *nrf91) ListSockets() []at.SocketInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	return &data, err
+	var ret []at.SocketInfo
+	for handle, s := range d.sockets {
+		protocol := "udp"
+		if s.socketType == socketTypeStream {
+			protocol = "tcp"
+		}
+		ret = append(ret, at.SocketInfo{Socket: handle, Protocol: protocol})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Socket < ret[j].Socket
+	})
+	return ret
 }
 
 func (d *nrf91) CloseUDPSocket(socket int) error {
-	return d.cmd.Transact("AT#XSOCKET=0", nil)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.receivers.Get(socket) != nil {
+		d.receivers.Set(socket, nil)
+		if err := d.updatePoll(); err != nil {
+			log.Printf("Could not update polled sockets: %v", err)
+		}
+	}
+	return d.closeSocket(socket)
+}
+
+// OnReceive registers a handler for the data received on the socket. The
+// module polls the sockets with handlers asynchronously (AT#XAPOLL) and the
+// data is read when it reports that the socket is readable.
+func (d *nrf91) OnReceive(socket int, handler func(*at.ReceivedData)) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.sockets[socket]; !ok {
+		return errUnknownSocket
+	}
+	d.receivers.Set(socket, handler)
+	return d.updatePoll()
+}
+
+// updatePoll sets the sockets the module polls to the sockets that have a
+// receive handler. The caller must hold d.mu.
+func (d *nrf91) updatePoll() error {
+	handles := d.receivers.Sockets()
+	for h := range d.tcp {
+		handles = append(handles, h)
+	}
+	if len(handles) == 0 {
+		return d.cmd.Transact("AT#XAPOLL=0", nil)
+	}
+	cmd := fmt.Sprintf("AT#XAPOLL=1,%d", pollIn)
+	for _, h := range handles {
+		cmd += fmt.Sprintf(",%d", h)
+	}
+	return d.cmd.Transact(cmd, nil)
+}
+
+// handleXAPOLL handles the #XAPOLL: <handle>,<revents> URC
+func (d *nrf91) handleXAPOLL(s string) {
+	fields := strings.Split(strings.TrimPrefix(s, "#XAPOLL: "), ",")
+	if len(fields) != 2 {
+		return
+	}
+	handle, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+	if err != nil {
+		log.Printf("Invalid handle in URC: %s", s)
+		return
+	}
+	revents, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+	if err != nil {
+		log.Printf("Invalid events in URC: %s", s)
+		return
+	}
+
+	d.mu.Lock()
+	t := d.tcp[handle]
+	d.mu.Unlock()
+	if t != nil {
+		t.handleEvents(revents)
+		return
+	}
+
+	if revents&pollIn != 0 {
+		d.receivers.Fetch(handle, d.ReceiveUDP)
+	}
 }
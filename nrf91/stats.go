@@ -0,0 +1,83 @@
+package nrf91
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/lab5e/at"
+)
+
+// GetStats reads RSRP and RSRQ with AT+CESQ, the values the modem also
+// reports in %CESQ notifications, SNR and coverage enhancement level with
+// AT%XSNRSQ? and the serving cell with AT%XMONITOR.
+func (d *nrf91) GetStats() (*at.Stats, error) {
+	stats := at.UnknownStats()
+
+	err := d.cmd.Transact("AT+CESQ", func(s string) error {
+		// +CESQ: <rxlev>,<ber>,<rscp>,<ecno>,<rsrq>,<rsrp>
+		st := strings.TrimPrefix(s, "+CESQ: ")
+		if st == s {
+			return nil
+		}
+		fields := strings.Split(st, ",")
+		if len(fields) != 6 {
+			return errors.New("could not parse AT+CESQ response")
+		}
+		stats.RSRQ = at.RSRQFromIndex(at.ParseMeasurement(fields[4]))
+		stats.SignalPower = at.RSRPFromIndex(at.ParseMeasurement(fields[5]))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.cmd.Transact("AT%XSNRSQ?", func(s string) error {
+		// %XSNRSQ: <snr>,<srxlev>,<ce_level>
+		st := strings.TrimPrefix(s, "%XSNRSQ: ")
+		if st == s {
+			return nil
+		}
+		fields := strings.Split(st, ",")
+		if len(fields) != 3 {
+			return errors.New("could not parse AT%XSNRSQ response")
+		}
+		stats.SNR = snrFromIndex(at.ParseMeasurement(fields[0]))
+		if ecl := at.ParseMeasurement(fields[2]); ecl >= 0 && ecl <= 3 {
+			stats.ECL = ecl
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.cmd.Transact("AT%XMONITOR", func(s string) error {
+		// %XMONITOR: <reg_status>[,<full_name>,<short_name>,<plmn>,<tac>,
+		// <AcT>,<band>,<cell_id>,<phys_cell_id>,<EARFCN>,<rsrp>,<snr>,...]
+		st := strings.TrimPrefix(s, "%XMONITOR: ")
+		if st == s {
+			return nil
+		}
+		fields := strings.Split(st, ",")
+		if len(fields) < 10 {
+			return nil
+		}
+		stats.CellID = at.ParseHexMeasurement(fields[7])
+		stats.PCI = at.ParseMeasurement(fields[8])
+		stats.EARFCN = at.ParseMeasurement(fields[9])
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// snrFromIndex converts the SNR index (0-49) to tenths of dB. Other
+// values, like 127, are unknown.
+func snrFromIndex(index int) int {
+	if index < 0 || index > 49 {
+		return at.Unknown
+	}
+	return (index - 24) * 10
+}
@@ -0,0 +1,221 @@
+package nrf91
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lab5e/at"
+)
+
+// connectTimeout is how long to wait for AT#XCONNECT when the context has
+// no deadline.
+const connectTimeout = 60 * time.Second
+
+// errSocketError is returned when the module reports an error on the
+// connection, ie when it has been reset
+var errSocketError = errors.New("socket error reported by the module")
+
+// maxSendSize is the largest payload we send with one command
+const maxSendSize = 512
+
+type tcpSocket struct {
+	at.SocketEvents
+
+	d      *nrf91
+	handle int
+
+	// readable is set when the module reports that there is data to
+	// read and cleared when a read comes back short. Checking the socket
+	// costs a command so we only check it after the module has told us
+	// there is something there, or when lastRead is more than
+	// at.ConnPollInterval ago in case a report went missing.
+	mu       sync.Mutex
+	readable bool
+	lastRead time.Time
+}
+
+// DialTCP opens a TCP connection. The module resolves host if it is a
+// name.
+func (d *nrf91) DialTCP(ctx context.Context, host string, port int) (at.TCPSocket, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s, err := d.openSocket(socketTypeStream)
+	if err != nil {
+		return nil, err
+	}
+	return d.connect(ctx, s, host, port)
+}
+
+// connect connects the socket to the host and starts polling it. The
+// socket is closed if the connection fails. The caller must hold d.mu.
+func (d *nrf91) connect(ctx context.Context, s *socket, host string, port int) (at.TCPSocket, error) {
+	connected := false
+	err := d.cmd.TransactTimeout(fmt.Sprintf(`AT#XCONNECT="%s",%d`, host, port), at.ContextTimeout(ctx, connectTimeout), func(s string) error {
+		// #XCONNECT: 1 when connected and 0 when not
+		if st := strings.TrimPrefix(s, "#XCONNECT: "); st != s {
+			connected = strings.TrimSpace(st) == "1"
+		}
+		return nil
+	})
+	if err == nil && !connected {
+		err = errors.New("connection failed")
+	}
+	if err != nil {
+		d.closeSocket(s.handle)
+		return nil, err
+	}
+
+	t := &tcpSocket{d: d, handle: s.handle}
+	t.SetState(at.ConnConnected)
+	d.tcp[s.handle] = t
+
+	// Have the module tell us when there is data or the connection is
+	// closed
+	if err := d.updatePoll(); err != nil {
+		log.Printf("Could not poll socket %d: %v", s.handle, err)
+	}
+	return t, nil
+}
+
+// handleEvents handles the poll events reported for the socket
+func (t *tcpSocket) handleEvents(revents int) {
+	if revents&pollIn != 0 {
+		t.mu.Lock()
+		t.readable = true
+		t.mu.Unlock()
+		t.DataAvailable()
+	}
+	if revents&(pollHup|pollErr) != 0 {
+		t.SetState(at.ConnClosed)
+	}
+}
+
+// MaxSendSize returns 512. AT#XSEND carries the data as hex so each byte
+// takes two characters of the AT command buffer.
+func (t *tcpSocket) MaxSendSize() int {
+	return maxSendSize
+}
+
+func (t *tcpSocket) Socket() int {
+	return t.handle
+}
+
+func (t *tcpSocket) Send(data []byte) (int, error) {
+	if t.State() == at.ConnClosed {
+		return 0, at.ErrClosed
+	}
+
+	t.d.mu.Lock()
+	defer t.d.mu.Unlock()
+
+	if _, err := t.d.selectSocket(t.handle); err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	err := t.d.cmd.Transact(fmt.Sprintf(`AT#XSEND=0,"%s"`, hex.EncodeToString(data)), func(s string) error {
+		if st := strings.TrimPrefix(s, "#XSEND: "); st != s {
+			n, err := strconv.Atoi(strings.TrimSpace(st))
+			if err != nil {
+				log.Printf("Could not parse byte count from %s", s)
+				return errors.New("could not parse number of bytes")
+			}
+			sent = n
+		}
+		return nil
+	})
+	return sent, err
+}
+
+// Receive reads data from the connection. The socket is read when the
+// module has reported it as readable and polled every at.ConnPollInterval
+// otherwise.
+func (t *tcpSocket) Receive(length int) ([]byte, error) {
+	t.mu.Lock()
+	readable := t.readable
+	poll := time.Since(t.lastRead) >= at.ConnPollInterval
+	if !readable && !poll {
+		t.mu.Unlock()
+		return nil, nil
+	}
+	// Events reported while we read set readable again
+	t.readable = false
+	t.lastRead = time.Now()
+	t.mu.Unlock()
+
+	data, err := t.receive(length)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) >= length {
+		// A full read means there may be more data waiting
+		t.mu.Lock()
+		t.readable = true
+		t.mu.Unlock()
+	}
+	return data, nil
+}
+
+// receive reads up to length bytes with AT#XRECV. AT#XRECV waits for data
+// so the socket is polled first and only read if there is data, which
+// also makes a read after a stale event return nothing rather than block.
+// The connection is closed when the module has closed the socket or the
+// read fails.
+func (t *tcpSocket) receive(length int) ([]byte, error) {
+	t.d.mu.Lock()
+	defer t.d.mu.Unlock()
+
+	sock, err := t.d.selectSocket(t.handle)
+	if err != nil {
+		return nil, err
+	}
+
+	revents, err := t.d.pollSocket(t.handle)
+	if err != nil {
+		return nil, err
+	}
+	if revents&pollIn == 0 {
+		if revents&(pollHup|pollErr) != 0 {
+			t.SetState(at.ConnClosed)
+		}
+		if revents&pollErr != 0 {
+			return nil, errSocketError
+		}
+		return nil, nil
+	}
+
+	// The data follows a line with #XRECV: <size> and is read as is
+	data, err := t.d.cmd.TransactSizedData(fmt.Sprintf("AT#XRECV=%d", length), dataSize("#XRECV: "), at.DefaultLineTimeout+sock.recvTimeout, nil)
+	if err != nil {
+		// The socket was readable so this is not a timeout
+		t.SetState(at.ConnClosed)
+		return nil, err
+	}
+	if len(data) == 0 {
+		// Readable with no data is the end of the stream
+		t.SetState(at.ConnClosed)
+		return nil, nil
+	}
+	return data, nil
+}
+
+func (t *tcpSocket) Close() error {
+	t.d.mu.Lock()
+	defer t.d.mu.Unlock()
+
+	delete(t.d.tcp, t.handle)
+	if err := t.d.updatePoll(); err != nil {
+		log.Printf("Could not update polled sockets: %v", err)
+	}
+	err := t.d.closeSocket(t.handle)
+	t.SetState(at.ConnClosed)
+	return err
+}
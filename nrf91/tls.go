@@ -0,0 +1,112 @@
+package nrf91
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lab5e/at"
+)
+
+// Peer verification levels for AT#XSSLSOCKET
+const (
+	peerVerifyNone     = 0
+	peerVerifyRequired = 2
+)
+
+// DialTLS opens a TLS connection using the TLS stack in the modem. The
+// credentials are the ones stored with the security tag in the config.
+func (d *nrf91) DialTLS(ctx context.Context, host string, port int, config *at.TLSConfig) (at.TCPSocket, error) {
+	if config == nil {
+		return nil, errors.New("missing TLS configuration")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	verify := peerVerifyRequired
+	if config.InsecureSkipVerify {
+		verify = peerVerifyNone
+	}
+	serverName := config.ServerName
+	if serverName == "" {
+		serverName = host
+	}
+
+	// Parameters:
+	// #1: 0 - close, 1 - open ipv4, 2 - open ipv6
+	// #2: 1 - TCP
+	// #3: 0 - client, 1- server
+	// #4: security tag
+	// #5: peer verification
+	// #6: host name used for SNI and verification
+	s, err := d.openSocketWith(
+		fmt.Sprintf(`AT#XSSLSOCKET=1,%d,0,%d,%d,"%s"`, socketTypeStream, config.SecurityTag, verify, serverName),
+		"#XSSLSOCKET: ", socketTypeStream)
+	if err != nil {
+		return nil, err
+	}
+	return d.connect(ctx, s, host, port)
+}
+
+// Credential types used by AT%CMNG
+var cmngTypes = map[at.CredentialType]int{
+	at.CredentialCACert:     0,
+	at.CredentialClientCert: 1,
+	at.CredentialClientKey:  2,
+}
+
+// ListCredentials lists the credentials stored in the modem with AT%CMNG.
+// PSK credentials and other types not covered by at.CredentialType are
+// left out.
+func (d *nrf91) ListCredentials() ([]at.Credential, error) {
+	var ret []at.Credential
+	err := d.cmd.Transact("AT%CMNG=1", func(s string) error {
+		// %CMNG: <sec_tag>,<type>[,<sha256>]
+		st := strings.TrimPrefix(s, "%CMNG: ")
+		if st == s {
+			return nil
+		}
+		fields := strings.Split(st, ",")
+		if len(fields) < 2 {
+			return errors.New("could not parse AT%CMNG response")
+		}
+		tag, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return errors.New("invalid security tag")
+		}
+		cmngType, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return errors.New("invalid credential type")
+		}
+		for t, n := range cmngTypes {
+			if n == cmngType {
+				ret = append(ret, at.Credential{Tag: tag, Type: t})
+			}
+		}
+		return nil
+	})
+	return ret, err
+}
+
+// WriteCredential stores the credential with AT%CMNG. The modem must be
+// offline (AT+CFUN=4) when credentials are written.
+func (d *nrf91) WriteCredential(tag int, credentialType at.CredentialType, pem []byte) error {
+	cmngType, ok := cmngTypes[credentialType]
+	if !ok {
+		return errors.New("unsupported credential type")
+	}
+	return d.cmd.Transact(fmt.Sprintf(`AT%%CMNG=0,%d,%d,"%s"`, tag, cmngType, pem), nil)
+}
+
+// DeleteCredential removes the credential with AT%CMNG. The modem must
+// be offline (AT+CFUN=4) when credentials are deleted.
+func (d *nrf91) DeleteCredential(tag int, credentialType at.CredentialType) error {
+	cmngType, ok := cmngTypes[credentialType]
+	if !ok {
+		return errors.New("unsupported credential type")
+	}
+	return d.cmd.Transact(fmt.Sprintf("AT%%CMNG=3,%d,%d", tag, cmngType), nil)
+}
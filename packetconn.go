@@ -0,0 +1,243 @@
+package at
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PacketPollInterval is how often ListenPacket connections poll the device
+// for data when the device can't signal that data has arrived.
+const PacketPollInterval = time.Second
+
+// packetQueueSize is the number of received messages a packet connection
+// buffers before it starts dropping them.
+const packetQueueSize = 16
+
+// ErrClosed is returned when using a connection that has been closed
+var ErrClosed = errors.New("use of closed connection")
+
+// LocalPorter is implemented by devices that can report the local port a
+// socket is bound to.
+type LocalPorter interface {
+	// LocalPort returns the local port the socket is bound to
+	LocalPort(socket int) (int, error)
+}
+
+// packetConn is a net.PacketConn on top of the UDP sockets of a device
+type packetConn struct {
+	device Device
+	socket int
+	local  *net.UDPAddr
+	recv   chan *ReceivedData
+	closed chan struct{}
+	once   sync.Once
+
+	mu              sync.Mutex
+	readDeadline    time.Time
+	writeDeadline   time.Time
+	deadlineChanged chan struct{}
+}
+
+// ListenPacket creates an UDP socket on the device bound to port and
+// returns it as a net.PacketConn. If the device implements ReceiveNotifier
+// incoming data is delivered as it arrives, otherwise the device is polled
+// every PacketPollInterval.
+func ListenPacket(device Device, port int) (net.PacketConn, error) {
+	socket, err := device.CreateUDPSocket(port)
+	if err != nil {
+		return nil, err
+	}
+
+	if lp, ok := device.(LocalPorter); ok {
+		if p, err := lp.LocalPort(socket); err == nil {
+			port = p
+		}
+	}
+
+	local := &net.UDPAddr{Port: port}
+	if _, addr, err := device.GetAddr(); err == nil {
+		local.IP = net.ParseIP(addr)
+	}
+
+	c := &packetConn{
+		device:          device,
+		socket:          socket,
+		local:           local,
+		recv:            make(chan *ReceivedData, packetQueueSize),
+		closed:          make(chan struct{}),
+		deadlineChanged: make(chan struct{}),
+	}
+
+	if notifier, ok := device.(ReceiveNotifier); ok {
+		if err := notifier.OnReceive(socket, c.enqueue); err != nil {
+			device.CloseUDPSocket(socket)
+			return nil, err
+		}
+	} else {
+		go c.poll()
+	}
+
+	return c, nil
+}
+
+// enqueue queues received data for ReadFrom. Data is dropped if the queue
+// is full, just like the network would do.
+func (c *packetConn) enqueue(data *ReceivedData) {
+	select {
+	case c.recv <- data:
+	case <-c.closed:
+	default:
+	}
+}
+
+// poll reads from the device until the connection is closed
+func (c *packetConn) poll() {
+	for {
+		data, err := c.device.ReceiveUDP(c.socket, ReceiveChunkSize)
+		if err == nil && len(data.Data) > 0 {
+			c.enqueue(data)
+			continue
+		}
+
+		select {
+		case <-time.After(PacketPollInterval):
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// ReadFrom reads a packet from the connection. If p is smaller than the
+// packet the rest of the packet is discarded.
+func (c *packetConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline := c.readDeadline
+		changed := c.deadlineChanged
+		c.mu.Unlock()
+
+		timeout, stop := deadlineTimer(deadline)
+
+		select {
+		case data := <-c.recv:
+			stop()
+			addr := &net.UDPAddr{IP: net.ParseIP(data.IP), Port: data.Port}
+			return copy(p, data.Data), addr, nil
+
+		case <-c.closed:
+			stop()
+			return 0, nil, c.opError("read", nil, ErrClosed)
+
+		case <-timeout:
+			return 0, nil, c.opError("read", nil, os.ErrDeadlineExceeded)
+
+		case <-changed:
+			stop()
+		}
+	}
+}
+
+// deadlineTimer returns a channel that fires when the deadline passes and a
+// function that releases the timer. The channel is nil if there is no
+// deadline.
+func deadlineTimer(deadline time.Time) (<-chan time.Time, func()) {
+	if deadline.IsZero() {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	return timer.C, func() { timer.Stop() }
+}
+
+// WriteTo writes a packet to addr. If the address is a host name it is
+// resolved by the device.
+func (c *packetConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, c.opError("write", addr, ErrClosed)
+	default:
+	}
+
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, c.opError("write", addr, os.ErrDeadlineExceeded)
+	}
+
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		host, portStr, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return 0, c.opError("write", addr, err)
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return 0, c.opError("write", addr, err)
+		}
+		ips, err := ResolveHost(context.Background(), c.device, host)
+		if err != nil {
+			return 0, c.opError("write", addr, err)
+		}
+		udpAddr = &net.UDPAddr{IP: ips[0], Port: port}
+	}
+
+	n, err := c.device.SendUDP(c.socket, udpAddr.IP, udpAddr.Port, p)
+	if err != nil {
+		return n, c.opError("write", addr, err)
+	}
+	return n, nil
+}
+
+// Close closes the socket on the device
+func (c *packetConn) Close() error {
+	err := ErrClosed
+	c.once.Do(func() {
+		close(c.closed)
+		if notifier, ok := c.device.(ReceiveNotifier); ok {
+			notifier.OnReceive(c.socket, nil)
+		}
+		err = c.device.CloseUDPSocket(c.socket)
+	})
+	return err
+}
+
+// LocalAddr returns the address the device has been allocated and the
+// local port of the socket.
+func (c *packetConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *packetConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return c.SetReadDeadline(t)
+}
+
+func (c *packetConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	// Wake up any readers so they pick up the new deadline
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+func (c *packetConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeDeadline = t
+	return nil
+}
+
+func (c *packetConn) opError(op string, addr net.Addr, err error) error {
+	return &net.OpError{Op: op, Net: "udp", Source: c.local, Addr: addr, Err: err}
+}
@@ -0,0 +1,237 @@
+package at
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PDP types for DefineContext
+const (
+	PDPTypeIP     = "IP"
+	PDPTypeIPv6   = "IPV6"
+	PDPTypeIPv4v6 = "IPV4V6"
+	PDPTypeNonIP  = "Non-IP"
+)
+
+// AuthType is the authentication protocol for a PDP context. The values
+// are the ones AT+CGAUTH uses.
+type AuthType int
+
+// Authentication protocols
+const (
+	AuthNone AuthType = 0
+	AuthPAP  AuthType = 1
+	AuthCHAP AuthType = 2
+)
+
+func (a AuthType) String() string {
+	switch a {
+	case AuthNone:
+		return "none"
+	case AuthPAP:
+		return "PAP"
+	case AuthCHAP:
+		return "CHAP"
+	default:
+		return "unknown"
+	}
+}
+
+// ContextActivationTimeout is the time to wait for the network when a PDP
+// context is activated or deactivated. 3GPP TS 27.007 allows the network
+// up to 150 seconds.
+const ContextActivationTimeout = 150 * time.Second
+
+// ErrInvalidPDPType is returned for PDP types the module doesn't know
+var ErrInvalidPDPType = errors.New("invalid PDP type")
+
+// PDPContext is a PDP context defined on the module
+type PDPContext struct {
+	CID int
+	// Type is one of the PDPType constants or the type the module reports
+	Type   string
+	APN    string
+	Active bool
+	// Addresses are the addresses allocated to the context. Contexts with
+	// the IPV4V6 type have an IPv4 and an IPv6 address. It is empty for
+	// inactive and Non-IP contexts.
+	Addresses []string
+}
+
+// ContextManager is implemented by devices that can manage several PDP
+// contexts
+type ContextManager interface {
+	// DefineContext defines the PDP context with the type and APN. This
+	// (usually) invokes the AT+CGDCONT command.
+	DefineContext(cid int, pdpType string, apn string) error
+
+	// SetAuth sets the authentication protocol, user name and password
+	// for the PDP context. The user name and password are ignored for
+	// AuthNone.
+	SetAuth(cid int, auth AuthType, username string, password string) error
+
+	// Activate activates the PDP context
+	Activate(cid int) error
+
+	// Deactivate deactivates the PDP context
+	Deactivate(cid int) error
+
+	// ListContexts returns the PDP contexts with their state and
+	// addresses sorted by CID
+	ListContexts() ([]PDPContext, error)
+}
+
+// NormalizePDPType returns the PDP type as the PDPType constant or
+// ErrInvalidPDPType. The type is matched without regard to case and
+// NONIP is accepted for Non-IP.
+func NormalizePDPType(pdpType string) (string, error) {
+	switch strings.ToUpper(pdpType) {
+	case "IP", "IPV4":
+		return PDPTypeIP, nil
+	case "IPV6":
+		return PDPTypeIPv6, nil
+	case "IPV4V6":
+		return PDPTypeIPv4v6, nil
+	case "NON-IP", "NONIP":
+		return PDPTypeNonIP, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrInvalidPDPType, pdpType)
+}
+
+func (d *DefaultImplementation) DefineContext(cid int, pdpType string, apn string) error {
+	t, err := NormalizePDPType(pdpType)
+	if err != nil {
+		return err
+	}
+	return d.Cmd.Transact(fmt.Sprintf("AT+CGDCONT=%d,\"%s\",\"%s\"", cid, t, apn), nil)
+}
+
+func (d *DefaultImplementation) SetAuth(cid int, auth AuthType, username string, password string) error {
+	switch auth {
+	case AuthNone:
+		return d.Cmd.Transact(fmt.Sprintf("AT+CGAUTH=%d,0", cid), nil)
+	case AuthPAP, AuthCHAP:
+		return d.Cmd.Transact(fmt.Sprintf("AT+CGAUTH=%d,%d,\"%s\",\"%s\"", cid, auth, username, password), nil)
+	}
+	return fmt.Errorf("invalid authentication protocol %d", auth)
+}
+
+func (d *DefaultImplementation) Activate(cid int) error {
+	return d.Cmd.TransactTimeout(fmt.Sprintf("AT+CGACT=1,%d", cid), ContextActivationTimeout, nil)
+}
+
+func (d *DefaultImplementation) Deactivate(cid int) error {
+	return d.Cmd.TransactTimeout(fmt.Sprintf("AT+CGACT=0,%d", cid), ContextActivationTimeout, nil)
+}
+
+// ListContexts reads the contexts with AT+CGDCONT?, the state with
+// AT+CGACT? and the addresses with AT+CGPADDR
+func (d *DefaultImplementation) ListContexts() ([]PDPContext, error) {
+	var contexts []PDPContext
+	index := make(map[int]int)
+
+	err := d.Cmd.Transact("AT+CGDCONT?", func(s string) error {
+		st := strings.TrimPrefix(s, "+CGDCONT: ")
+		if st == s {
+			return nil
+		}
+		parts := strings.Split(st, ",")
+		if len(parts) < 3 {
+			return errors.New("missing some fields in response")
+		}
+		cid, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return errors.New("invalid CID")
+		}
+		ctx := PDPContext{CID: cid, Type: TrimQuotes(parts[1]), APN: TrimQuotes(parts[2])}
+		if t, err := NormalizePDPType(ctx.Type); err == nil {
+			ctx.Type = t
+		}
+		index[cid] = len(contexts)
+		contexts = append(contexts, ctx)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.Cmd.Transact("AT+CGACT?", func(s string) error {
+		st := strings.TrimPrefix(s, "+CGACT: ")
+		if st == s {
+			return nil
+		}
+		parts := strings.Split(st, ",")
+		if len(parts) < 2 {
+			return errors.New("missing field in response")
+		}
+		cid, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return errors.New("invalid CID")
+		}
+		if i, ok := index[cid]; ok {
+			contexts[i].Active = strings.TrimSpace(parts[1]) == "1"
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.Cmd.Transact("AT+CGPADDR", func(s string) error {
+		st := strings.TrimPrefix(s, "+CGPADDR: ")
+		if st == s {
+			return nil
+		}
+		parts := strings.Split(st, ",")
+		cid, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return errors.New("invalid CID")
+		}
+		i, ok := index[cid]
+		if !ok {
+			return nil
+		}
+		for _, p := range parts[1:] {
+			if addr := ParsePDPAddress(p); addr != "" {
+				contexts[i].Addresses = append(contexts[i].Addresses, addr)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(contexts, func(i, j int) bool {
+		return contexts[i].CID < contexts[j].CID
+	})
+	return contexts, nil
+}
+
+// ParsePDPAddress parses an address from AT+CGPADDR or AT+CGDCONT?. IPv6
+// addresses in the dotted format 3GPP TS 27.007 uses by default (16
+// decimal bytes) are returned in the usual format. Empty and all zero
+// addresses are returned as an empty string.
+func ParsePDPAddress(s string) string {
+	s = TrimQuotes(strings.TrimSpace(s))
+	if parts := strings.Split(s, "."); len(parts) == 16 {
+		ip := make(net.IP, 16)
+		for i, p := range parts {
+			b, err := strconv.Atoi(p)
+			if err != nil || b < 0 || b > 255 {
+				return s
+			}
+			ip[i] = byte(b)
+		}
+		s = ip.String()
+	}
+	if ip := net.ParseIP(s); ip != nil && ip.IsUnspecified() {
+		return ""
+	}
+	return s
+}
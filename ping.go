@@ -0,0 +1,97 @@
+package at
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Ping defaults
+const (
+	DefaultPingCount   = 4
+	DefaultPingSize    = 32
+	DefaultPingTimeout = 10 * time.Second
+)
+
+// ErrPingNotSupported is returned when the device can't ping hosts
+var ErrPingNotSupported = errors.New("device does not support ping")
+
+// PingReply is a reply to an echo request
+type PingReply struct {
+	// RTT is the round trip time
+	RTT time.Duration
+	// TTL is the time to live of the reply or -1 if the module doesn't
+	// report it
+	TTL int
+}
+
+// PingResult is the result of pinging a host
+type PingResult struct {
+	// Addr is the address that was pinged
+	Addr string
+	// Sent is the number of echo requests sent
+	Sent int
+	// Replies are the replies received
+	Replies []PingReply
+	// MinRTT, AvgRTT and MaxRTT are the round trip time statistics for
+	// the replies
+	MinRTT time.Duration
+	AvgRTT time.Duration
+	MaxRTT time.Duration
+}
+
+// NewPingResult returns the result with the statistics for the replies
+func NewPingResult(addr string, sent int, replies []PingReply) *PingResult {
+	r := &PingResult{Addr: addr, Sent: sent, Replies: replies}
+	var total time.Duration
+	for i, reply := range replies {
+		if i == 0 || reply.RTT < r.MinRTT {
+			r.MinRTT = reply.RTT
+		}
+		if reply.RTT > r.MaxRTT {
+			r.MaxRTT = reply.RTT
+		}
+		total += reply.RTT
+	}
+	if len(replies) > 0 {
+		r.AvgRTT = total / time.Duration(len(replies))
+	}
+	return r
+}
+
+// Received returns the number of replies received
+func (r *PingResult) Received() int {
+	return len(r.Replies)
+}
+
+// Loss returns the fraction of echo requests that weren't answered
+func (r *PingResult) Loss() float64 {
+	if r.Sent == 0 {
+		return 0
+	}
+	return float64(r.Sent-len(r.Replies)) / float64(r.Sent)
+}
+
+// Pinger is implemented by devices that can ping hosts from the module
+type Pinger interface {
+	// Ping sends count ICMP echo requests with size bytes of data to the
+	// host and returns the replies. Requests that aren't answered are
+	// counted as lost rather than returned as errors.
+	Ping(ctx context.Context, host string, count int, size int) (*PingResult, error)
+}
+
+// Ping pings the host from the device. A count or size of 0 uses
+// DefaultPingCount and DefaultPingSize. The device must implement Pinger.
+func Ping(ctx context.Context, device Device, host string, count int, size int) (*PingResult, error) {
+	pinger, ok := device.(Pinger)
+	if !ok {
+		return nil, ErrPingNotSupported
+	}
+	if count <= 0 {
+		count = DefaultPingCount
+	}
+	if size <= 0 {
+		size = DefaultPingSize
+	}
+	return pinger.Ping(ctx, host, count, size)
+}
@@ -0,0 +1,58 @@
+//go:build linux
+// +build linux
+
+package at_test
+
+import (
+	"testing"
+
+	"github.com/lab5e/at"
+	"github.com/lab5e/at/bg95"
+	"github.com/lab5e/at/internal/fakemodem"
+)
+
+func TestRebootBG95(t *testing.T) {
+	modem := fakemodem.New(t)
+	device := bg95.New(modem.Path(), bg95.DefaultBaudRate)
+	if err := device.Start(); err != nil {
+		t.Fatalf("Could not start device: %v", err)
+	}
+	t.Cleanup(device.Close)
+
+	// The module comes back with the defaults, ie echo on
+	modem.Handle("AT+CFUN=1,1", func(string) string {
+		modem.SetEcho(true)
+		return fakemodem.OK + fakemodem.Lines("RDY")
+	})
+	if err := device.(at.Rebooter).Reboot(); err != nil {
+		t.Fatalf("Could not reboot: %v", err)
+	}
+
+	commands := modem.Commands()
+	for i, cmd := range commands {
+		if cmd != "AT+CFUN=1,1" {
+			continue
+		}
+		after := commands[i+1:]
+		if len(after) != 2 || after[0] != "ATE0" || after[1] != `AT+QICFG="dataformat",0,1` {
+			t.Fatalf("Expected the module to be configured after the reboot, got %v", after)
+		}
+		return
+	}
+	t.Fatalf("The module wasn't rebooted: %v", commands)
+}
+
+func TestRebootNRF91(t *testing.T) {
+	device, modem := startNRF91(t)
+	if _, err := device.CreateUDPSocket(0); err != nil {
+		t.Fatalf("Could not create socket: %v", err)
+	}
+
+	modem.Reply("AT#XRESET", fakemodem.OK+fakemodem.Lines("Ready"))
+	if err := device.(at.Rebooter).Reboot(); err != nil {
+		t.Fatalf("Could not reboot: %v", err)
+	}
+	if sockets := device.(at.SocketLister).ListSockets(); len(sockets) != 0 {
+		t.Fatalf("Expected the sockets to be gone after the reboot, got %v", sockets)
+	}
+}
@@ -0,0 +1,90 @@
+package at
+
+import (
+	"log"
+	"sync"
+)
+
+// ReceiveChunkSize is the number of bytes requested from the device per
+// read when payloads are fetched for receive handlers.
+const ReceiveChunkSize = 512
+
+// ReceiveHandlers keeps track of the handlers registered through
+// OnReceive. Drivers use it to implement the ReceiveNotifier interface.
+type ReceiveHandlers struct {
+	mu       sync.Mutex
+	handlers map[int]func(*ReceivedData)
+}
+
+// Set registers the handler for the socket. A nil handler removes the
+// current handler.
+func (r *ReceiveHandlers) Set(socket int, handler func(*ReceivedData)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.handlers == nil {
+		r.handlers = make(map[int]func(*ReceivedData))
+	}
+	if handler == nil {
+		delete(r.handlers, socket)
+		return
+	}
+	r.handlers[socket] = handler
+}
+
+// Get returns the handler for the socket or nil if there is none.
+func (r *ReceiveHandlers) Get(socket int) func(*ReceivedData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.handlers[socket]
+}
+
+// Sockets returns the sockets that have a handler.
+func (r *ReceiveHandlers) Sockets() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var ret []int
+	for socket := range r.handlers {
+		ret = append(ret, socket)
+	}
+	return ret
+}
+
+// Fetch reads one message from the socket using receive and passes it to
+// the handler registered for the socket. If the device reports that there
+// are bytes remaining they are read and appended before the handler is
+// called. Fetch returns false if there is no handler, no data or the read
+// failed.
+func (r *ReceiveHandlers) Fetch(socket int, receive func(socket int, length int) (*ReceivedData, error)) bool {
+	handler := r.Get(socket)
+	if handler == nil {
+		return false
+	}
+
+	data, err := receive(socket, ReceiveChunkSize)
+	if err != nil {
+		log.Printf("Error reading from socket %d: %v", socket, err)
+		return false
+	}
+	if len(data.Data) == 0 {
+		return false
+	}
+
+	for data.Remaining > 0 {
+		more, err := receive(socket, ReceiveChunkSize)
+		if err != nil {
+			log.Printf("Error reading remaining %d bytes from socket %d: %v", data.Remaining, socket, err)
+			break
+		}
+		if len(more.Data) == 0 {
+			break
+		}
+		data.Data = append(data.Data, more.Data...)
+		data.Length += more.Length
+		data.Remaining = more.Remaining
+	}
+
+	handler(data)
+	return true
+}
@@ -0,0 +1,80 @@
+package at
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// RegistrationStatus is the EPS network registration status reported by
+// AT+CEREG
+type RegistrationStatus int
+
+// Registration states
+const (
+	NotRegistered       RegistrationStatus = 0
+	RegisteredHome      RegistrationStatus = 1
+	Searching           RegistrationStatus = 2
+	RegistrationDenied  RegistrationStatus = 3
+	RegistrationUnknown RegistrationStatus = 4
+	RegisteredRoaming   RegistrationStatus = 5
+)
+
+func (s RegistrationStatus) String() string {
+	switch s {
+	case NotRegistered:
+		return "not registered"
+	case RegisteredHome:
+		return "registered (home)"
+	case Searching:
+		return "searching"
+	case RegistrationDenied:
+		return "registration denied"
+	case RegisteredRoaming:
+		return "registered (roaming)"
+	default:
+		return "unknown"
+	}
+}
+
+// Registered reports whether the device is registered in the home network
+// or roaming
+func (s RegistrationStatus) Registered() bool {
+	return s == RegisteredHome || s == RegisteredRoaming
+}
+
+// RegistrationReader is implemented by devices that report the network
+// registration status.
+type RegistrationReader interface {
+	// GetRegistration returns the registration status. This (usually)
+	// invokes the AT+CEREG? command.
+	GetRegistration() (RegistrationStatus, error)
+}
+
+// ParseRegistration parses the status from the response to AT+CEREG?,
+// ie "+CEREG: 0,1". URCs are rejected, see IsRegistrationURC.
+func ParseRegistration(s string) (RegistrationStatus, error) {
+	fields := strings.Split(strings.TrimPrefix(s, "+CEREG: "), ",")
+	if len(fields) < 2 {
+		return RegistrationUnknown, errors.New("could not parse AT+CEREG response")
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+	if err != nil || n < 0 || n > 5 {
+		return RegistrationUnknown, errors.New("could not parse AT+CEREG response")
+	}
+	stat, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+	if err != nil {
+		return RegistrationUnknown, errors.New("invalid registration status")
+	}
+	return RegistrationStatus(stat), nil
+}
+
+// IsRegistrationURC reports whether the +CEREG line is a URC rather than
+// the response to AT+CEREG?. The response starts with the URC setting
+// (0-5) and the status while the URC starts with the status, followed by
+// the quoted TAC for the settings above 1. URCs can arrive in the middle
+// of the response.
+func IsRegistrationURC(s string) bool {
+	_, err := ParseRegistration(s)
+	return err != nil
+}
@@ -0,0 +1,783 @@
+package at
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultWaitTimeout is the time wait statements wait for a line unless
+// the script sets a timeout
+const DefaultWaitTimeout = time.Minute
+
+// defaultRetryDelay is the delay between attempts of send statements
+// with retries
+const defaultRetryDelay = time.Second
+
+// Script is a sequence of AT commands with expectations in the style of
+// chat(8). A script is parsed from text with one statement per line:
+//
+//	# Turn on the radio and wait for the module to register
+//	set timeout 10s
+//	send AT+CFUN=1
+//	send AT+CEREG=1
+//	wait +CEREG: 1|+CEREG: 5 timeout 3m
+//	send AT+CGSN=1
+//	expect /\+CGSN: "(?P<imei>\d+)"/
+//	try send AT+CGDCONT=1,"IP","${apn}" retry 3
+//	if failed fail could not set the APN for ${imei}
+//
+// The statements are
+//
+//	send <command> [timeout <d>] [retry <n>] [delay <d>]
+//	    Send the command and wait for the final result code. The
+//	    statement fails on ERROR, +CME ERROR and timeouts. It is retried
+//	    up to n times with the delay (1s) in between.
+//	expect <pattern>
+//	    Check that a line in the response to the last command, including
+//	    the final result code, matches the pattern.
+//	wait <pattern> [timeout <d>]
+//	    Wait for a line that matches the pattern. The lines the module
+//	    sent since the last command are checked first, so URCs that
+//	    arrive right after the final result code aren't missed.
+//	set <name> <value>
+//	    Set a variable. The timeout variable sets the default timeout of
+//	    send and wait.
+//	sleep <d>
+//	label <name>
+//	goto <name>
+//	if <condition> <statement>
+//	    Run the statement if the condition holds. The conditions are ok,
+//	    failed, error and timeout for the result of the last send, expect
+//	    or wait and <a> == <b> and <a> != <b> to compare values.
+//	try <send, expect or wait statement>
+//	    Run the statement without stopping the script if it fails.
+//	fail <message>
+//	    Stop the script with an error.
+//	end
+//	    Stop the script.
+//
+// Patterns are regular expressions between slashes or alternatives
+// separated by | that match the start of a line. Named groups in regular
+// expressions set variables and the match variable is set to the line
+// that matched. ${name} is replaced by the value of the variable in
+// commands, patterns, values and messages. Lines starting with # are
+// comments.
+type Script struct {
+	statements []*statement
+	labels     map[string]int
+}
+
+// statementKind is the keyword of a statement
+type statementKind int
+
+const (
+	stmtSend statementKind = iota
+	stmtExpect
+	stmtWait
+	stmtSet
+	stmtSleep
+	stmtLabel
+	stmtGoto
+	stmtIf
+	stmtFail
+	stmtEnd
+)
+
+var statementKinds = map[string]statementKind{
+	"send":   stmtSend,
+	"expect": stmtExpect,
+	"wait":   stmtWait,
+	"set":    stmtSet,
+	"sleep":  stmtSleep,
+	"label":  stmtLabel,
+	"goto":   stmtGoto,
+	"if":     stmtIf,
+	"fail":   stmtFail,
+	"end":    stmtEnd,
+}
+
+// statement is a parsed statement
+type statement struct {
+	line int
+	text string
+	kind statementKind
+	// try is set if the script continues when the statement fails
+	try bool
+	// arg is the command, pattern, message, label or variable name
+	arg string
+	// value is the value of set statements
+	value   string
+	timeout time.Duration
+	retries int
+	delay   time.Duration
+	// cond and then are the condition and statement of if statements
+	cond *condition
+	then *statement
+}
+
+// condition is the condition of an if statement. Either result is set
+// or a and b are compared.
+type condition struct {
+	result string
+	a, op  string
+	b      string
+}
+
+// ScriptError is returned for errors in the script and by fail
+// statements
+type ScriptError struct {
+	Line    int
+	Message string
+}
+
+func (e *ScriptError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// ParseScript parses the script
+func ParseScript(src string) (*Script, error) {
+	s := &Script{labels: make(map[string]int)}
+	scanner := bufio.NewScanner(strings.NewReader(src))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		stmt, err := parseStatement(line, text)
+		if err != nil {
+			return nil, err
+		}
+		if stmt.kind == stmtLabel {
+			if _, ok := s.labels[stmt.arg]; ok {
+				return nil, &ScriptError{line, fmt.Sprintf("duplicate label %s", stmt.arg)}
+			}
+			s.labels[stmt.arg] = len(s.statements)
+		}
+		s.statements = append(s.statements, stmt)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, stmt := range s.statements {
+		target := stmt
+		if stmt.kind == stmtIf {
+			target = stmt.then
+		}
+		if target.kind != stmtGoto {
+			continue
+		}
+		if _, ok := s.labels[target.arg]; !ok {
+			return nil, &ScriptError{stmt.line, fmt.Sprintf("unknown label %s", target.arg)}
+		}
+	}
+	return s, nil
+}
+
+// optionRegex matches an option at the end of a statement
+var optionRegex = regexp.MustCompile(`\s+(timeout|retry|delay)\s+(\S+)$`)
+
+func parseStatement(line int, text string) (*statement, error) {
+	stmt := &statement{line: line, text: text}
+	keyword, rest := splitWord(text)
+
+	if keyword == "try" {
+		keyword, rest = splitWord(rest)
+		stmt.try = true
+		stmt.text = strings.TrimSpace(strings.TrimPrefix(text, "try"))
+		if keyword != "send" && keyword != "expect" && keyword != "wait" {
+			return nil, &ScriptError{line, "try must be followed by send, expect or wait"}
+		}
+	}
+
+	kind, ok := statementKinds[keyword]
+	if !ok {
+		return nil, &ScriptError{line, fmt.Sprintf("unknown statement %s", keyword)}
+	}
+	stmt.kind = kind
+
+	// Options are taken from the end of send and wait statements
+	if kind == stmtSend || kind == stmtWait {
+		for {
+			m := optionRegex.FindStringSubmatchIndex(rest)
+			if m == nil {
+				break
+			}
+			name, value := rest[m[2]:m[3]], rest[m[4]:m[5]]
+			if err := stmt.setOption(name, value); err != nil {
+				return nil, &ScriptError{line, err.Error()}
+			}
+			rest = rest[:m[0]]
+		}
+		if kind == stmtWait && (stmt.retries != 0 || stmt.delay != 0) {
+			return nil, &ScriptError{line, "wait only has a timeout option"}
+		}
+	}
+
+	switch kind {
+	case stmtSend, stmtExpect, stmtWait, stmtFail:
+		if rest == "" {
+			return nil, &ScriptError{line, fmt.Sprintf("%s needs an argument", keyword)}
+		}
+		stmt.arg = rest
+		if kind == stmtExpect || kind == stmtWait {
+			if !strings.Contains(rest, "${") {
+				if _, err := compilePattern(rest); err != nil {
+					return nil, &ScriptError{line, err.Error()}
+				}
+			}
+		}
+
+	case stmtSet:
+		name, value := splitWord(rest)
+		if name == "" {
+			return nil, &ScriptError{line, "set needs a variable name"}
+		}
+		stmt.arg, stmt.value = name, value
+
+	case stmtSleep:
+		d, err := time.ParseDuration(rest)
+		if err != nil {
+			return nil, &ScriptError{line, fmt.Sprintf("invalid duration %s", rest)}
+		}
+		stmt.timeout = d
+
+	case stmtLabel, stmtGoto:
+		if rest == "" || strings.ContainsAny(rest, " \t") {
+			return nil, &ScriptError{line, fmt.Sprintf("%s needs a name", keyword)}
+		}
+		stmt.arg = rest
+
+	case stmtIf:
+		cond, then, err := parseCondition(rest)
+		if err != nil {
+			return nil, &ScriptError{line, err.Error()}
+		}
+		stmt.cond = cond
+		stmt.then, err = parseStatement(line, then)
+		if err != nil {
+			return nil, err
+		}
+		if stmt.then.kind == stmtIf || stmt.then.kind == stmtLabel {
+			return nil, &ScriptError{line, "if can't be followed by if or label"}
+		}
+
+	case stmtEnd:
+		if rest != "" {
+			return nil, &ScriptError{line, "end takes no arguments"}
+		}
+	}
+	return stmt, nil
+}
+
+func (stmt *statement) setOption(name string, value string) error {
+	switch name {
+	case "retry":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid retry count %s", value)
+		}
+		stmt.retries = n
+	default:
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid %s %s", name, value)
+		}
+		if name == "timeout" {
+			stmt.timeout = d
+		} else {
+			stmt.delay = d
+		}
+	}
+	return nil
+}
+
+// parseCondition parses the condition of an if statement and returns the
+// statement that follows it
+func parseCondition(s string) (*condition, string, error) {
+	word, rest := splitWord(s)
+	switch word {
+	case "ok", "failed", "error", "timeout":
+		if rest == "" {
+			return nil, "", errors.New("if needs a statement")
+		}
+		return &condition{result: word}, rest, nil
+	}
+
+	op, rest := splitWord(rest)
+	b, rest := splitWord(rest)
+	if word == "" || (op != "==" && op != "!=") || b == "" {
+		return nil, "", errors.New("the condition must be ok, failed, error, timeout or <a> == <b> or <a> != <b>")
+	}
+	if rest == "" {
+		return nil, "", errors.New("if needs a statement")
+	}
+	return &condition{a: word, op: op, b: b}, rest, nil
+}
+
+// splitWord returns the first word and the rest of the string
+func splitWord(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexAny(s, " \t")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i:])
+}
+
+// pattern matches lines from the module
+type pattern struct {
+	re           *regexp.Regexp
+	alternatives []string
+}
+
+// compilePattern compiles a regular expression between slashes or a list
+// of alternatives separated by |
+func compilePattern(s string) (*pattern, error) {
+	if len(s) >= 2 && s[0] == '/' && s[len(s)-1] == '/' {
+		re, err := regexp.Compile(s[1 : len(s)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %v", s, err)
+		}
+		return &pattern{re: re}, nil
+	}
+	p := &pattern{}
+	for _, alt := range strings.Split(s, "|") {
+		if alt = strings.TrimSpace(alt); alt != "" {
+			p.alternatives = append(p.alternatives, alt)
+		}
+	}
+	if len(p.alternatives) == 0 {
+		return nil, fmt.Errorf("empty pattern")
+	}
+	return p, nil
+}
+
+// match returns true and the captured groups if the line matches
+func (p *pattern) match(line string) (bool, map[string]string) {
+	line = strings.TrimSpace(line)
+	if p.re == nil {
+		for _, alt := range p.alternatives {
+			if strings.HasPrefix(line, alt) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	m := p.re.FindStringSubmatch(line)
+	if m == nil {
+		return false, nil
+	}
+	groups := make(map[string]string)
+	for i, name := range p.re.SubexpNames() {
+		if name != "" {
+			groups[name] = m[i]
+		}
+	}
+	return true, groups
+}
+
+// ScriptStep is a statement that was run
+type ScriptStep struct {
+	Line      int
+	Statement string
+	// Command is the command that send statements sent
+	Command string
+	// Lines are the response to send statements, including the final
+	// result code, and the line that matched for expect and wait
+	Lines []string
+	// Attempts is the number of times a send statement was tried
+	Attempts int
+	// Err is set if the statement failed
+	Err      error
+	Start    time.Time
+	Duration time.Duration
+}
+
+// ScriptReport is what happened when a script ran
+type ScriptReport struct {
+	Steps []ScriptStep
+	// Vars are the variables when the script ended
+	Vars map[string]string
+	// Err is the error that stopped the script
+	Err      error
+	Duration time.Duration
+}
+
+func (r *ScriptReport) String() string {
+	var sb strings.Builder
+	for _, s := range r.Steps {
+		result := "ok"
+		if s.Err != nil {
+			result = s.Err.Error()
+		}
+		if s.Attempts > 1 {
+			result += fmt.Sprintf(" (%d attempts)", s.Attempts)
+		}
+		fmt.Fprintf(&sb, "%4d %-40s %8.3fs %s\n", s.Line, s.Statement, s.Duration.Seconds(), result)
+		if s.Command != "" {
+			fmt.Fprintf(&sb, "     > %s\n", s.Command)
+		}
+		for _, line := range s.Lines {
+			fmt.Fprintf(&sb, "     < %s\n", line)
+		}
+	}
+	if r.Err != nil {
+		fmt.Fprintf(&sb, "Failed after %.3fs: %v\n", r.Duration.Seconds(), r.Err)
+	} else {
+		fmt.Fprintf(&sb, "Completed in %.3fs\n", r.Duration.Seconds())
+	}
+	return sb.String()
+}
+
+// scriptRun is the state of a running script
+type scriptRun struct {
+	script *Script
+	cmd    *CommandInterface
+	vars   map[string]string
+	report *ScriptReport
+
+	// lines receives every line from the module and received holds the
+	// lines received since the last command was sent
+	lines    <-chan string
+	received []string
+	// response is the response to the last command
+	response []string
+	// lastErr is the result of the last send, expect or wait
+	lastErr error
+}
+
+// Run runs the script on the command interface. The variables are the
+// initial values of the variables, ie the APN. The report describes what
+// happened whether the script succeeded or not and the error is the
+// error in the report.
+func (s *Script) Run(ctx context.Context, cmd *CommandInterface, vars map[string]string) (*ScriptReport, error) {
+	lines, remove := cmd.Subscribe("", 256)
+	defer remove()
+
+	r := &scriptRun{
+		script: s,
+		cmd:    cmd,
+		vars:   make(map[string]string),
+		report: &ScriptReport{},
+		lines:  lines,
+	}
+	for k, v := range vars {
+		r.vars[k] = v
+	}
+
+	start := time.Now()
+	err := r.run(ctx)
+	r.report.Vars = r.vars
+	r.report.Err = err
+	r.report.Duration = time.Since(start)
+	return r.report, err
+}
+
+// errEnd stops the script without an error
+var errEnd = errors.New("end of script")
+
+func (r *scriptRun) run(ctx context.Context) error {
+	pc := 0
+	for pc < len(r.script.statements) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		stmt := r.script.statements[pc]
+		pc++
+
+		if stmt.kind == stmtIf {
+			ok, err := r.evaluate(stmt.cond)
+			if err != nil {
+				return &ScriptError{stmt.line, err.Error()}
+			}
+			if !ok {
+				continue
+			}
+			stmt = stmt.then
+		}
+
+		next, err := r.execute(ctx, stmt)
+		if err == errEnd {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if next >= 0 {
+			pc = next
+		}
+	}
+	return nil
+}
+
+// execute runs the statement and returns the index of the next statement
+// for goto or -1
+func (r *scriptRun) execute(ctx context.Context, stmt *statement) (int, error) {
+	switch stmt.kind {
+	case stmtLabel:
+		return -1, nil
+	case stmtGoto:
+		return r.script.labels[stmt.arg], nil
+	case stmtEnd:
+		return -1, errEnd
+	case stmtFail:
+		msg, err := r.expand(stmt.arg)
+		if err != nil {
+			return -1, &ScriptError{stmt.line, err.Error()}
+		}
+		return -1, &ScriptError{stmt.line, msg}
+	case stmtSet:
+		value, err := r.expand(stmt.value)
+		if err != nil {
+			return -1, &ScriptError{stmt.line, err.Error()}
+		}
+		if stmt.arg == "timeout" {
+			if _, err := time.ParseDuration(value); err != nil {
+				return -1, &ScriptError{stmt.line, fmt.Sprintf("invalid timeout %s", value)}
+			}
+		}
+		r.vars[stmt.arg] = value
+		return -1, nil
+	case stmtSleep:
+		select {
+		case <-time.After(stmt.timeout):
+		case <-ctx.Done():
+			return -1, ctx.Err()
+		}
+		return -1, nil
+	}
+
+	step := ScriptStep{Line: stmt.line, Statement: stmt.text, Start: time.Now()}
+	var err error
+	switch stmt.kind {
+	case stmtSend:
+		err = r.send(ctx, stmt, &step)
+	case stmtExpect:
+		err = r.expect(stmt, &step)
+	case stmtWait:
+		err = r.wait(ctx, stmt, &step)
+	}
+	step.Duration = time.Since(step.Start)
+	if err != nil {
+		if _, ok := err.(*ScriptError); ok {
+			return -1, err
+		}
+		step.Err = err
+	}
+	r.report.Steps = append(r.report.Steps, step)
+	r.lastErr = step.Err
+
+	if step.Err != nil && !stmt.try {
+		return -1, fmt.Errorf("line %d: %s: %w", stmt.line, stmt.text, step.Err)
+	}
+	return -1, nil
+}
+
+// timeout returns the timeout of the statement
+func (r *scriptRun) timeout(stmt *statement, def time.Duration) time.Duration {
+	if stmt.timeout != 0 {
+		return stmt.timeout
+	}
+	if d, err := time.ParseDuration(r.vars["timeout"]); err == nil {
+		return d
+	}
+	return def
+}
+
+func (r *scriptRun) send(ctx context.Context, stmt *statement, step *ScriptStep) error {
+	command, err := r.expand(stmt.arg)
+	if err != nil {
+		return &ScriptError{stmt.line, err.Error()}
+	}
+	step.Command = command
+	delay := stmt.delay
+	if delay == 0 {
+		delay = defaultRetryDelay
+	}
+
+	for {
+		step.Attempts++
+		r.drain()
+		r.received = nil
+
+		var response []string
+		err = r.cmd.TransactTimeout(command, r.timeout(stmt, r.cmd.lineTimeout), func(s string) error {
+			if s != "" {
+				response = append(response, s)
+			}
+			return nil
+		})
+
+		// The final result code is part of the response
+		var cme *CMEError
+		switch {
+		case err == nil:
+			response = append(response, "OK")
+		case errors.As(err, &cme):
+			response = append(response, cmePrefix+" "+cmeCode(cme))
+		case err == ErrATError:
+			response = append(response, "ERROR")
+		}
+		r.response = response
+		step.Lines = response
+
+		if err == nil || step.Attempts > stmt.retries {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// cmeCode returns the code of the CME error as the module reported it
+func cmeCode(e *CMEError) string {
+	if e.Code < 0 {
+		return e.Text
+	}
+	return strconv.Itoa(e.Code)
+}
+
+func (r *scriptRun) expect(stmt *statement, step *ScriptStep) error {
+	p, err := r.pattern(stmt)
+	if err != nil {
+		return err
+	}
+	for _, line := range r.response {
+		if r.match(p, line) {
+			step.Lines = []string{line}
+			return nil
+		}
+	}
+	return fmt.Errorf("no line in the response matches %s", stmt.arg)
+}
+
+func (r *scriptRun) wait(ctx context.Context, stmt *statement, step *ScriptStep) error {
+	p, err := r.pattern(stmt)
+	if err != nil {
+		return err
+	}
+
+	// Check the lines that have arrived since the last command first
+	r.drain()
+	for i, line := range r.received {
+		if r.match(p, line) {
+			r.received = r.received[i+1:]
+			step.Lines = []string{line}
+			return nil
+		}
+	}
+	r.received = nil
+
+	timer := time.NewTimer(r.timeout(stmt, DefaultWaitTimeout))
+	defer timer.Stop()
+	for {
+		select {
+		case line := <-r.lines:
+			if r.match(p, line) {
+				step.Lines = []string{line}
+				return nil
+			}
+		case <-timer.C:
+			return ErrReadTimeout
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// drain moves the lines that have arrived to received
+func (r *scriptRun) drain() {
+	for {
+		select {
+		case line := <-r.lines:
+			if line != "" {
+				r.received = append(r.received, line)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// pattern expands and compiles the pattern of the statement
+func (r *scriptRun) pattern(stmt *statement) (*pattern, error) {
+	s, err := r.expand(stmt.arg)
+	if err != nil {
+		return nil, &ScriptError{stmt.line, err.Error()}
+	}
+	p, err := compilePattern(s)
+	if err != nil {
+		return nil, &ScriptError{stmt.line, err.Error()}
+	}
+	return p, nil
+}
+
+// match matches the line and sets the captured variables
+func (r *scriptRun) match(p *pattern, line string) bool {
+	ok, groups := p.match(line)
+	if !ok {
+		return false
+	}
+	for name, value := range groups {
+		r.vars[name] = value
+	}
+	r.vars["match"] = line
+	return true
+}
+
+// evaluate evaluates the condition
+func (r *scriptRun) evaluate(c *condition) (bool, error) {
+	switch c.result {
+	case "ok":
+		return r.lastErr == nil, nil
+	case "failed":
+		return r.lastErr != nil, nil
+	case "error":
+		return errors.Is(r.lastErr, ErrATError), nil
+	case "timeout":
+		return errors.Is(r.lastErr, ErrReadTimeout), nil
+	}
+
+	a, err := r.expand(c.a)
+	if err != nil {
+		return false, err
+	}
+	b, err := r.expand(c.b)
+	if err != nil {
+		return false, err
+	}
+	if c.op == "==" {
+		return a == b, nil
+	}
+	return a != b, nil
+}
+
+// variableRegex matches variable references
+var variableRegex = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expand replaces variable references with the values
+func (r *scriptRun) expand(s string) (string, error) {
+	var err error
+	ret := variableRegex.ReplaceAllStringFunc(s, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+		value, ok := r.vars[name]
+		if !ok && err == nil {
+			err = fmt.Errorf("undefined variable %s", name)
+		}
+		return value
+	})
+	return ret, err
+}
@@ -0,0 +1,232 @@
+//go:build linux
+// +build linux
+
+package at_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lab5e/at"
+	"github.com/lab5e/at/internal/fakemodem"
+)
+
+func TestParseScript(t *testing.T) {
+	for _, src := range []string{
+		"",
+		"# Just a comment\n\n",
+		"send AT\nexpect OK",
+		"send AT+CFUN=1 timeout 10s retry 3 delay 2s",
+		"wait +CEREG: 1|+CEREG: 5 timeout 3m",
+		`expect /\+CGSN: "(?P<imei>\d+)"/`,
+		"set apn internet\nsend AT+CGDCONT=1,\"IP\",\"${apn}\"",
+		"expect /${pattern}/",
+		"sleep 100ms",
+		"label start\ntry send AT\nif failed goto start\nend",
+		"goto done\nfail not reached\nlabel done",
+		"if ${a} == ${b} fail the values are the same",
+		"if ${a} != 1 end",
+		"try wait RDY timeout 1s\nif timeout fail no RDY",
+	} {
+		if _, err := at.ParseScript(src); err != nil {
+			t.Errorf("Could not parse %q: %v", src, err)
+		}
+	}
+}
+
+func TestParseScriptErrors(t *testing.T) {
+	for _, test := range []struct {
+		src  string
+		line int
+		msg  string
+	}{
+		{"bogus", 1, "unknown statement bogus"},
+		{"send AT\n\n# Comment\nsend", 4, "send needs an argument"},
+		{"expect", 1, "expect needs an argument"},
+		{"send AT timeout soon", 1, "invalid timeout soon"},
+		{"send AT retry -1", 1, "invalid retry count -1"},
+		{"send AT delay 1x", 1, "invalid delay 1x"},
+		{"wait RDY retry 3", 1, "wait only has a timeout option"},
+		{"expect /(/", 1, "invalid pattern"},
+		{"expect |", 1, "empty pattern"},
+		{"set", 1, "set needs a variable name"},
+		{"sleep forever", 1, "invalid duration forever"},
+		{"label", 1, "label needs a name"},
+		{"goto a b", 1, "goto needs a name"},
+		{"label a\nlabel a", 2, "duplicate label a"},
+		{"send AT\ngoto nowhere", 2, "unknown label nowhere"},
+		{"send AT\nif ok goto nowhere", 2, "unknown label nowhere"},
+		{"if ok", 1, "if needs a statement"},
+		{"if a < b end", 1, "the condition must be"},
+		{"if ok if ok end", 1, "if can't be followed by if or label"},
+		{"if ok label a", 1, "if can't be followed by if or label"},
+		{"try set a b", 1, "try must be followed by send, expect or wait"},
+		{"end now", 1, "end takes no arguments"},
+	} {
+		_, err := at.ParseScript(test.src)
+		var se *at.ScriptError
+		if !errors.As(err, &se) {
+			t.Errorf("Expected a script error for %q, got %v", test.src, err)
+			continue
+		}
+		if se.Line != test.line || !strings.HasPrefix(se.Message, test.msg) {
+			t.Errorf("Expected line %d: %s for %q, got %v", test.line, test.msg, test.src, err)
+		}
+	}
+}
+
+// runScript runs the script on a command interface talking to the fake
+// modem
+func runScript(t *testing.T, modem *fakemodem.Modem, src string, vars map[string]string) (*at.ScriptReport, error) {
+	t.Helper()
+	script, err := at.ParseScript(src)
+	if err != nil {
+		t.Fatalf("Could not parse script: %v", err)
+	}
+	cmd := at.NewCommandInterface(modem.Path(), 115200)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Could not start command interface: %v", err)
+	}
+	defer cmd.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return script.Run(ctx, cmd, vars)
+}
+
+func TestRunScriptVariables(t *testing.T) {
+	modem := fakemodem.New(t)
+	modem.Reply("AT+CGSN=1", fakemodem.Lines(`+CGSN: "352656100000001"`, "OK"))
+
+	report, err := runScript(t, modem, `
+send AT+CGSN=1
+expect /\+CGSN: "(?P<imei>\d+)"/
+set id urn:imei:${imei}
+send AT+CGDCONT=1,"IP","${apn}"
+`, map[string]string{"apn": "internet"})
+	if err != nil {
+		t.Fatalf("Script failed: %v\n%s", err, report)
+	}
+	if report.Vars["imei"] != "352656100000001" || report.Vars["id"] != "urn:imei:352656100000001" {
+		t.Fatalf("Unexpected variables: %v", report.Vars)
+	}
+	if report.Vars["match"] != `+CGSN: "352656100000001"` {
+		t.Fatalf("Expected the matching line in match, got %q", report.Vars["match"])
+	}
+	commands := modem.Commands()
+	if commands[len(commands)-1] != `AT+CGDCONT=1,"IP","internet"` {
+		t.Fatalf("The variable wasn't substituted: %v", commands)
+	}
+
+	// Undefined variables stop the script
+	_, err = runScript(t, modem, "send AT\nsend AT+CGDCONT=1,\"IP\",\"${apn}\"", nil)
+	var se *at.ScriptError
+	if !errors.As(err, &se) || se.Line != 2 || se.Message != "undefined variable apn" {
+		t.Fatalf("Expected an undefined variable on line 2, got %v", err)
+	}
+}
+
+func TestRunScriptTimeouts(t *testing.T) {
+	modem := fakemodem.New(t)
+	// The module never answers
+	modem.Reply("AT+COPS=?", "")
+	modem.Reply("AT+CEREG=1", fakemodem.OK+fakemodem.Lines("+CEREG: 5"))
+
+	start := time.Now()
+	_, err := runScript(t, modem, "send AT+COPS=? timeout 100ms", nil)
+	if !errors.Is(err, at.ErrReadTimeout) {
+		t.Fatalf("Expected the send to time out, got %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatalf("The send didn't use the timeout, it took %v", time.Since(start))
+	}
+
+	_, err = runScript(t, modem, "set timeout 100ms\nwait RDY", nil)
+	if !errors.Is(err, at.ErrReadTimeout) {
+		t.Fatalf("Expected the wait to time out, got %v", err)
+	}
+
+	// The URC that arrives right after the OK is seen by the wait
+	report, err := runScript(t, modem, `
+send AT+CEREG=1
+wait +CEREG: 1|+CEREG: 5 timeout 1s
+try wait RDY timeout 100ms
+if timeout set result timeout
+if ok set result ok
+`, nil)
+	if err != nil {
+		t.Fatalf("Script failed: %v\n%s", err, report)
+	}
+	if report.Vars["match"] != "+CEREG: 5" || report.Vars["result"] != "timeout" {
+		t.Fatalf("Unexpected variables: %v", report.Vars)
+	}
+}
+
+func TestRunScriptControlFlow(t *testing.T) {
+	modem := fakemodem.New(t)
+	polls := 0
+	modem.Handle("AT+CEREG?", func(string) string {
+		polls++
+		if polls < 3 {
+			return fakemodem.Lines("+CEREG: 0,2", "OK")
+		}
+		return fakemodem.Lines("+CEREG: 0,1", "OK")
+	})
+	modem.Reply("AT+CGDCONT", fakemodem.Lines("ERROR"))
+
+	report, err := runScript(t, modem, `
+label poll
+send AT+CEREG?
+expect /\+CEREG: \d,(?P<stat>\d)/
+if ${stat} != 1 goto poll
+try send AT+CGDCONT=1,"IP","internet"
+if error goto failed
+end
+label failed
+fail could not set the APN
+`, nil)
+	var se *at.ScriptError
+	if !errors.As(err, &se) || se.Line != 10 || se.Message != "could not set the APN" {
+		t.Fatalf("Expected the fail statement on line 10, got %v\n%s", err, report)
+	}
+	if sent := filterCommands(modem.Commands(), "AT+CEREG?"); len(sent) != 3 {
+		t.Fatalf("Expected 3 polls, got %d", len(sent))
+	}
+	last := report.Steps[len(report.Steps)-1]
+	if last.Err == nil || len(last.Lines) != 1 || last.Lines[0] != "ERROR" {
+		t.Fatalf("Expected the failed send in the report, got %+v", last)
+	}
+
+	// Failures stop the script unless the statement is tried
+	_, err = runScript(t, modem, "send AT+CEREG?\nexpect +CEREG: 1,1\nfail not reached", nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "line 2: expect +CEREG: 1,1: ") {
+		t.Fatalf("Expected the expect to fail, got %v", err)
+	}
+	report, err = runScript(t, modem, "send AT+CEREG?\ntry expect +CEREG: 1,1\nif failed end\nfail not reached", nil)
+	if err != nil {
+		t.Fatalf("Expected end to stop the script, got %v\n%s", err, report)
+	}
+}
+
+func TestRunScriptRetry(t *testing.T) {
+	modem := fakemodem.New(t)
+	attempts := 0
+	modem.Handle("AT+CFUN=1", func(string) string {
+		attempts++
+		if attempts < 3 {
+			return fakemodem.Lines("+CME ERROR: 14")
+		}
+		return fakemodem.OK
+	})
+
+	report, err := runScript(t, modem, "send AT+CFUN=1 retry 2 delay 10ms", nil)
+	if err != nil {
+		t.Fatalf("Script failed: %v\n%s", err, report)
+	}
+	if step := report.Steps[0]; step.Attempts != 3 || step.Err != nil {
+		t.Fatalf("Expected success after 3 attempts, got %+v", step)
+	}
+}
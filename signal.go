@@ -0,0 +1,46 @@
+package at
+
+// UnknownStats returns statistics where all the values are Unknown.
+// Drivers fill in the values they get from the module.
+func UnknownStats() *Stats {
+	return &Stats{
+		SignalPower: Unknown,
+		TotalPower:  Unknown,
+		TXPower:     Unknown,
+		TXTime:      Unknown,
+		RXTime:      Unknown,
+		CellID:      Unknown,
+		ECL:         Unknown,
+		SNR:         Unknown,
+		EARFCN:      Unknown,
+		PCI:         Unknown,
+		RSRQ:        Unknown,
+	}
+}
+
+// RSRPFromIndex converts the RSRP index (0-97) reported by AT+CESQ to
+// tenths of dBm. Other values, like 255, are Unknown.
+func RSRPFromIndex(index int) int {
+	if index < 0 || index > 97 {
+		return Unknown
+	}
+	return (index - 140) * 10
+}
+
+// RSRQFromIndex converts the RSRQ index (0-34) reported by AT+CESQ to
+// tenths of dB. Other values, like 255, are Unknown.
+func RSRQFromIndex(index int) int {
+	if index < 0 || index > 34 {
+		return Unknown
+	}
+	return index*5 - 195
+}
+
+// RSSIFromCSQ converts the RSSI (0-31) reported by AT+CSQ to tenths of
+// dBm. Other values, like 99, are Unknown.
+func RSSIFromCSQ(rssi int) int {
+	if rssi < 0 || rssi > 31 {
+		return Unknown
+	}
+	return (2*rssi - 113) * 10
+}
@@ -0,0 +1,57 @@
+//go:build linux
+// +build linux
+
+package at_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// receiveTimeoutSetter is implemented by the nRF91 driver
+type receiveTimeoutSetter interface {
+	SetReceiveTimeout(socket int, timeout time.Duration) error
+}
+
+func TestReceiveTimeout(t *testing.T) {
+	device, modem := startNRF91(t)
+	socket, err := device.CreateUDPSocket(0)
+	if err != nil {
+		t.Fatalf("Could not create socket: %v", err)
+	}
+
+	options := func() []string {
+		var ret []string
+		for _, cmd := range modem.Commands() {
+			if strings.HasPrefix(cmd, "AT#XSOCKETOPT=") {
+				ret = append(ret, cmd)
+			}
+		}
+		return ret
+	}
+	if opts := options(); len(opts) != 0 {
+		t.Fatalf("Expected no receive timeout on a new socket, got %v", opts)
+	}
+
+	// Without a timeout there is nothing to wait for
+	start := time.Now()
+	data, err := device.ReceiveUDP(socket, 512)
+	if err != nil || len(data.Data) != 0 {
+		t.Fatalf("Expected no data, got %v %v", data, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Receive without a timeout waited for %v", time.Since(start))
+	}
+
+	setter := device.(receiveTimeoutSetter)
+	if err := setter.SetReceiveTimeout(socket, 1500*time.Millisecond); err != nil {
+		t.Fatalf("Could not set the timeout: %v", err)
+	}
+	if err := setter.SetReceiveTimeout(socket, 0); err != nil {
+		t.Fatalf("Could not clear the timeout: %v", err)
+	}
+	if opts := options(); len(opts) != 2 || opts[0] != "AT#XSOCKETOPT=1,20,2" || opts[1] != "AT#XSOCKETOPT=1,20,0" {
+		t.Fatalf("Expected the timeout to be set and cleared, got %v", opts)
+	}
+}
@@ -0,0 +1,133 @@
+package at
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ConnState is the state of a TCP connection on the device
+type ConnState int
+
+// Connection states
+const (
+	ConnConnecting ConnState = iota
+	ConnConnected
+	ConnClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnConnecting:
+		return "connecting"
+	case ConnConnected:
+		return "connected"
+	case ConnClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// TCPSocket is a TCP client connection on the device
+type TCPSocket interface {
+	// Socket returns the socket or connection identifier used by the
+	// device
+	Socket() int
+
+	// Send writes data to the connection. Returns the number of bytes
+	// the device accepted.
+	Send(data []byte) (int, error)
+
+	// Receive reads up to length bytes of the data the device has
+	// buffered for the connection. An empty slice is returned if there
+	// is no data waiting.
+	Receive(length int) ([]byte, error)
+
+	// Close closes the connection
+	Close() error
+
+	// State returns the current state of the connection
+	State() ConnState
+
+	// OnStateChange registers a function that is called when the state
+	// of the connection changes, ie when the remote end closes it.
+	OnStateChange(fn func(ConnState))
+
+	// OnData registers a function that is called when the device
+	// signals that data has arrived on the connection.
+	OnData(fn func())
+}
+
+// TCPDialer is implemented by devices that can open TCP connections
+type TCPDialer interface {
+	// DialTCP connects to port on host. The host can be an IP address
+	// or a name if the device can resolve names. The context limits how
+	// long to wait for the connection to be established.
+	DialTCP(ctx context.Context, host string, port int) (TCPSocket, error)
+}
+
+// SocketEvents keeps track of the state of a connection and the functions
+// registered to be notified about it. Drivers embed it in their TCPSocket
+// implementations.
+type SocketEvents struct {
+	mu      sync.Mutex
+	state   ConnState
+	onState func(ConnState)
+	onData  func()
+}
+
+// State returns the current state of the connection
+func (e *SocketEvents) State() ConnState {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.state
+}
+
+// OnStateChange registers the function called when the state changes
+func (e *SocketEvents) OnStateChange(fn func(ConnState)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.onState = fn
+}
+
+// OnData registers the function called when data arrives
+func (e *SocketEvents) OnData(fn func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.onData = fn
+}
+
+// SetState changes the state of the connection and notifies the
+// registered function if the state changed.
+func (e *SocketEvents) SetState(state ConnState) {
+	e.mu.Lock()
+	changed := e.state != state
+	e.state = state
+	fn := e.onState
+	e.mu.Unlock()
+
+	if changed && fn != nil {
+		fn(state)
+	}
+}
+
+// DataAvailable notifies the registered function that data has arrived
+func (e *SocketEvents) DataAvailable() {
+	e.mu.Lock()
+	fn := e.onData
+	e.mu.Unlock()
+
+	if fn != nil {
+		fn()
+	}
+}
+
+// ContextTimeout returns the time left until the deadline of the context
+// or def if the context has no deadline.
+func ContextTimeout(ctx context.Context, def time.Duration) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		return time.Until(deadline)
+	}
+	return def
+}
@@ -0,0 +1,88 @@
+package at
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// CredentialType is the type of a credential stored in the device
+type CredentialType int
+
+// Credential types
+const (
+	CredentialCACert CredentialType = iota
+	CredentialClientCert
+	CredentialClientKey
+)
+
+func (t CredentialType) String() string {
+	switch t {
+	case CredentialCACert:
+		return "ca-cert"
+	case CredentialClientCert:
+		return "client-cert"
+	case CredentialClientKey:
+		return "client-key"
+	default:
+		return "unknown"
+	}
+}
+
+// Credential is a credential stored in the device. Credentials are
+// grouped by security tag and a TLS connection uses the credentials with
+// the tag given in TLSConfig.
+type Credential struct {
+	Tag  int
+	Type CredentialType
+}
+
+// CredentialStore is implemented by devices that store TLS credentials
+// for use with modem-offloaded TLS.
+type CredentialStore interface {
+	// ListCredentials returns the credentials stored in the device
+	ListCredentials() ([]Credential, error)
+
+	// WriteCredential stores the PEM encoded credential with the tag,
+	// replacing any existing credential of the same type.
+	WriteCredential(tag int, credentialType CredentialType, pem []byte) error
+
+	// DeleteCredential removes the credential from the device
+	DeleteCredential(tag int, credentialType CredentialType) error
+}
+
+// TLSConfig is the configuration for a TLS connection made by the module
+type TLSConfig struct {
+	// SecurityTag selects the credentials the module uses
+	SecurityTag int
+
+	// ServerName is the name used for SNI and to verify the server
+	// certificate. If it is empty the host name is used.
+	ServerName string
+
+	// InsecureSkipVerify turns off verification of the server
+	// certificate.
+	InsecureSkipVerify bool
+}
+
+// TLSDialer is implemented by devices that can make TLS connections using
+// the TLS stack in the module.
+type TLSDialer interface {
+	// DialTLS connects to port on host and does the TLS handshake in the
+	// module. The connection is used like a TCP connection.
+	DialTLS(ctx context.Context, host string, port int, config *TLSConfig) (TCPSocket, error)
+}
+
+// DialTLS connects to the address through the device using the TLS stack
+// in the module and returns the connection as a net.Conn. Data read and
+// written on the connection is plain text. The device must implement
+// TLSDialer.
+func DialTLS(ctx context.Context, device Device, network, address string, config *TLSConfig) (net.Conn, error) {
+	dialer, ok := device.(TLSDialer)
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("device does not support TLS")}
+	}
+	return dial(ctx, device, network, address, func(ctx context.Context, host string, port int) (TCPSocket, error) {
+		return dialer.DialTLS(ctx, host, port, config)
+	})
+}
@@ -0,0 +1,75 @@
+//go:build linux
+// +build linux
+
+package at_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lab5e/at"
+	"github.com/lab5e/at/bg95"
+	"github.com/lab5e/at/internal/fakemodem"
+)
+
+func TestBG95TLSRead(t *testing.T) {
+	// The data is read as is so result codes, URCs and line breaks in it
+	// are data like everything else
+	payload := []byte("OK\r\nERROR\r\n+QSSLURC: \"closed\",0\r\n\r\n\n\r")
+	for i := 0; i < 256; i++ {
+		payload = append(payload, byte(i))
+	}
+
+	var mu sync.Mutex
+	pending := payload
+	modem := fakemodem.New(t)
+	modem.Handle("AT+QSSLOPEN=", func(cmd string) string {
+		return fakemodem.OK + fakemodem.Lines(fmt.Sprintf("+QSSLOPEN: %s,0", fakemodem.Args(cmd)[2]))
+	})
+	modem.Handle("AT+QSSLRECV=", func(cmd string) string {
+		length, _ := strconv.Atoi(fakemodem.Args(cmd)[1])
+		mu.Lock()
+		defer mu.Unlock()
+		if length > len(pending) {
+			length = len(pending)
+		}
+		data := pending[:length]
+		pending = pending[length:]
+		return fakemodem.Lines(fmt.Sprintf("+QSSLRECV: %d", len(data))) + string(data) + fakemodem.OK
+	})
+
+	device := bg95.New(modem.Path(), bg95.DefaultBaudRate)
+	if err := device.Start(); err != nil {
+		t.Fatalf("Could not start device: %v", err)
+	}
+	t.Cleanup(device.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := at.DialTLS(ctx, device, "tcp", "example.com:443", &at.TLSConfig{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	data := make([]byte, len(payload))
+	if _, err := io.ReadFull(c, data); err != nil {
+		t.Fatalf("Could not read: %v", err)
+	}
+	if !bytes.Equal(data, payload) {
+		t.Fatalf("Data was mangled:\n%q\n%q", data, payload)
+	}
+	for _, cmd := range modem.Commands() {
+		if strings.HasPrefix(cmd, `AT+QSSLCFG="dataformat"`) {
+			t.Fatalf("AT+QSSLCFG has no data format setting: %s", cmd)
+		}
+	}
+}
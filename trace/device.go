@@ -0,0 +1,171 @@
+package trace
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/lab5e/at"
+)
+
+// Device is a device where each call is traced
+type Device struct {
+	device at.Device
+	tracer *Tracer
+}
+
+// Device returns a device that creates a span for each call on the
+// device. If the device is at.Interceptable the AT commands sent during a
+// call become child spans of the call. Commands sent by URC handlers are
+// root spans if the device is an at.Commander.
+//
+// The traced device only implements at.Device. Use Unwrap to reach the
+// optional interfaces and Start to trace calls on them, ie
+//
+//	span := tracer.Start("GetStats")
+//	stats, err := traced.Unwrap().(at.StatsReader).GetStats()
+//	span.Finish(err)
+func (t *Tracer) Device(device at.Device) *Device {
+	if i, ok := device.(at.Interceptable); ok {
+		var cmdIF *at.CommandInterface
+		if c, ok := device.(at.Commander); ok {
+			cmdIF = c.CommandInterface()
+		}
+		i.AddInterceptor(t.interceptor(cmdIF))
+	}
+	return &Device{device: device, tracer: t}
+}
+
+// Unwrap returns the traced device
+func (d *Device) Unwrap() at.Device {
+	return d.device
+}
+
+// Start opens the serial port and starts the reader goroutine
+func (d *Device) Start() error {
+	span := d.tracer.Start("Start")
+	err := d.device.Start()
+	span.Finish(err)
+	return err
+}
+
+// Close closes the serial port
+func (d *Device) Close() {
+	span := d.tracer.Start("Close")
+	d.device.Close()
+	span.Finish(nil)
+}
+
+// SetDebug turns on debugging if debug is true. It isn't traced.
+func (d *Device) SetDebug(debug bool) {
+	d.device.SetDebug(debug)
+}
+
+// AT sends an AT command
+func (d *Device) AT() error {
+	span := d.tracer.Start("AT")
+	err := d.device.AT()
+	span.Finish(err)
+	return err
+}
+
+// GetIMSI reads the IMSI from the device
+func (d *Device) GetIMSI() (string, error) {
+	span := d.tracer.Start("GetIMSI")
+	imsi, err := d.device.GetIMSI()
+	span.Finish(err)
+	return imsi, err
+}
+
+// GetIMEI reads the IMEI from the device
+func (d *Device) GetIMEI() (string, error) {
+	span := d.tracer.Start("GetIMEI")
+	imei, err := d.device.GetIMEI()
+	span.Finish(err)
+	return imei, err
+}
+
+// GetCCID returns the CCID of the SIM
+func (d *Device) GetCCID() (string, error) {
+	span := d.tracer.Start("GetCCID")
+	ccid, err := d.device.GetCCID()
+	span.Finish(err)
+	return ccid, err
+}
+
+// SetAPN sets the APN
+func (d *Device) SetAPN(apn string) error {
+	span := d.tracer.Start("SetAPN")
+	span.SetAttribute("apn", apn)
+	err := d.device.SetAPN(apn)
+	span.Finish(err)
+	return err
+}
+
+// GetAPN returns the current APN settings
+func (d *Device) GetAPN() (*at.APN, error) {
+	span := d.tracer.Start("GetAPN")
+	apn, err := d.device.GetAPN()
+	span.Finish(err)
+	return apn, err
+}
+
+// GetAddr returns the context identifier and the address of the device
+func (d *Device) GetAddr() (int, string, error) {
+	span := d.tracer.Start("GetAddr")
+	cid, addr, err := d.device.GetAddr()
+	span.Finish(err)
+	return cid, addr, err
+}
+
+// SetRadio turns the radio on or off
+func (d *Device) SetRadio(on bool) error {
+	span := d.tracer.Start("SetRadio")
+	span.SetAttribute("on", strconv.FormatBool(on))
+	err := d.device.SetRadio(on)
+	span.Finish(err)
+	return err
+}
+
+// CreateUDPSocket creates an UDP socket
+func (d *Device) CreateUDPSocket(port int) (int, error) {
+	span := d.tracer.Start("CreateUDPSocket")
+	span.SetAttribute("port", strconv.Itoa(port))
+	socket, err := d.device.CreateUDPSocket(port)
+	if err == nil {
+		span.SetAttribute("socket", strconv.Itoa(socket))
+	}
+	span.Finish(err)
+	return socket, err
+}
+
+// SendUDP sends an UDP packet
+func (d *Device) SendUDP(socket int, address net.IP, remotePort int, data []byte) (int, error) {
+	span := d.tracer.Start("SendUDP")
+	span.SetAttribute("socket", strconv.Itoa(socket))
+	span.SetAttribute("address", net.JoinHostPort(address.String(), strconv.Itoa(remotePort)))
+	span.SetAttribute("length", strconv.Itoa(len(data)))
+	n, err := d.device.SendUDP(socket, address, remotePort, data)
+	span.Finish(err)
+	return n, err
+}
+
+// ReceiveUDP reads data from a socket
+func (d *Device) ReceiveUDP(socket int, length int) (*at.ReceivedData, error) {
+	span := d.tracer.Start("ReceiveUDP")
+	span.SetAttribute("socket", strconv.Itoa(socket))
+	data, err := d.device.ReceiveUDP(socket, length)
+	if data != nil {
+		span.SetAttribute("length", strconv.Itoa(data.Length))
+	}
+	span.Finish(err)
+	return data, err
+}
+
+// CloseUDPSocket closes the socket
+func (d *Device) CloseUDPSocket(socket int) error {
+	span := d.tracer.Start("CloseUDPSocket")
+	span.SetAttribute("socket", strconv.Itoa(socket))
+	err := d.device.CloseUDPSocket(socket)
+	span.Finish(err)
+	return err
+}
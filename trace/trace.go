@@ -0,0 +1,228 @@
+// Package trace records the AT transactions of a device as spans in the
+// style of OpenTelemetry. Each call on a traced device becomes a span and
+// each AT command sent during the call becomes a child span, so the
+// modem hop can be followed in the same way as the rest of a traced
+// system.
+//
+// Example:
+//
+//	exporter := trace.NewInMemoryExporter()
+//	tracer := trace.NewTracer(exporter)
+//	device := tracer.Device(n211.New("/dev/ttyUSB0", n211.DefaultBaudRate))
+//	...
+//	_, err := device.SendUDP(socket, ip, 1234, data)
+//	for _, span := range exporter.Spans() {
+//	    log.Printf("%s %s %v", span.SpanID, span.Name, span.Duration())
+//	}
+//
+// The exporter receives the spans as they end. Implement Exporter to hand
+// them on to a tracing system.
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lab5e/at"
+)
+
+// Event is something that happened during a span, ie a response line
+type Event struct {
+	Time time.Time
+	Name string
+}
+
+// Span is a timed operation. Spans for device calls are named after the
+// method, ie SendUDP, and spans for AT commands after the command verb,
+// ie AT+NSOST.
+type Span struct {
+	// TraceID is shared by the spans of a trace. IDs are hex encoded.
+	TraceID string
+	SpanID  string
+	// ParentID is empty for root spans
+	ParentID   string
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Events     []Event
+	// Err is the error the operation ended with
+	Err error
+
+	tracer   *Tracer
+	parent   *Span
+	finished bool
+}
+
+// Duration returns the duration of the span
+func (s *Span) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+// SetAttribute sets an attribute on the span
+func (s *Span) SetAttribute(key string, value string) {
+	s.Attributes[key] = value
+}
+
+// AddEvent adds an event to the span
+func (s *Span) AddEvent(name string) {
+	s.Events = append(s.Events, Event{Time: time.Now(), Name: name})
+}
+
+// Finish ends the span with the error and hands it to the exporter
+func (s *Span) Finish(err error) {
+	s.End = time.Now()
+	s.Err = err
+	s.tracer.finish(s)
+}
+
+// Exporter receives the spans as they end
+type Exporter interface {
+	Export(span *Span)
+}
+
+// InMemoryExporter keeps the spans in memory. It is intended for tests.
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+// NewInMemoryExporter creates an empty exporter
+func NewInMemoryExporter() *InMemoryExporter {
+	return &InMemoryExporter{}
+}
+
+// Export adds the span
+func (e *InMemoryExporter) Export(span *Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+// Spans returns the spans in the order they ended
+func (e *InMemoryExporter) Spans() []*Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*Span(nil), e.spans...)
+}
+
+// Reset removes the spans
+func (e *InMemoryExporter) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = nil
+}
+
+// Tracer creates spans and hands them to the exporter when they end. The
+// tracer keeps track of the active span and new spans become children of
+// it. A device has one command interface so the spans of concurrent
+// calls on the same tracer may end up with the wrong parent. Spans for AT
+// commands never become the active span, and commands sent by URC
+// handlers are traced as root spans since they aren't part of the call in
+// progress.
+type Tracer struct {
+	mu       sync.Mutex
+	exporter Exporter
+	active   *Span
+}
+
+// NewTracer creates a tracer that exports to the exporter
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+// Start starts a span. The span is a child of the active span if there is
+// one and becomes the active span until it is finished.
+func (t *Tracer) Start(name string) *Span {
+	return t.start(name, true, true)
+}
+
+// start starts a span that is a child of the active span if child is set
+// and becomes the active span if activate is set
+func (t *Tracer) start(name string, child bool, activate bool) *Span {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := &Span{
+		SpanID:     newID(8),
+		Name:       name,
+		Start:      time.Now(),
+		Attributes: make(map[string]string),
+		tracer:     t,
+	}
+	if child && t.active != nil {
+		s.parent = t.active
+		s.TraceID = t.active.TraceID
+		s.ParentID = t.active.SpanID
+	} else {
+		s.TraceID = newID(16)
+	}
+	if activate {
+		t.active = s
+	}
+	return s
+}
+
+// finish makes the nearest ancestor of the span that is still running the
+// active span if the span is the active span. Spans may finish out of
+// order when calls overlap and a finished span must not become the parent
+// of new spans.
+func (t *Tracer) finish(s *Span) {
+	t.mu.Lock()
+	s.finished = true
+	if t.active == s {
+		p := s.parent
+		for p != nil && p.finished {
+			p = p.parent
+		}
+		t.active = p
+	}
+	t.mu.Unlock()
+
+	if t.exporter != nil {
+		t.exporter.Export(s)
+	}
+}
+
+// Interceptor returns an interceptor that creates a span for each AT
+// command. The command is set as the at.command attribute, the code of
+// +CME ERROR responses as the at.cme_error attribute and each response
+// line that isn't empty is added as an event.
+func (t *Tracer) Interceptor() at.Interceptor {
+	return t.interceptor(nil)
+}
+
+// interceptor returns the interceptor for the command interface. Commands
+// sent while its URC handlers run don't get the active span as the
+// parent. The command interface may be nil.
+func (t *Tracer) interceptor(cmdIF *at.CommandInterface) at.Interceptor {
+	return func(cmd string, fn func(string) error, invoke at.Invoker) error {
+		span := t.start(at.CommandVerb(cmd), cmdIF == nil || !cmdIF.HandlingURC(), false)
+		span.SetAttribute("at.command", cmd)
+		err := invoke(cmd, func(s string) error {
+			if s != "" {
+				span.AddEvent(s)
+			}
+			return fn(s)
+		})
+		var cme *at.CMEError
+		if errors.As(err, &cme) {
+			span.SetAttribute("at.cme_error", strconv.Itoa(cme.Code))
+		}
+		span.Finish(err)
+		return err
+	}
+}
+
+// newID returns a random ID of n bytes
+func newID(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,94 @@
+//go:build linux
+// +build linux
+
+package trace_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lab5e/at"
+	"github.com/lab5e/at/internal/fakemodem"
+	"github.com/lab5e/at/nrf91"
+	"github.com/lab5e/at/trace"
+)
+
+// spanNamed returns the span with the name or nil
+func spanNamed(spans []*trace.Span, name string) *trace.Span {
+	for _, s := range spans {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func TestCommandParents(t *testing.T) {
+	modem := fakemodem.New(t)
+	exporter := trace.NewInMemoryExporter()
+	device := nrf91.New(modem.Path(), nrf91.DefaultBaudRate)
+	traced := trace.NewTracer(exporter).Device(device)
+	if err := traced.Start(); err != nil {
+		t.Fatalf("Could not start device: %v", err)
+	}
+	defer traced.Close()
+
+	// The URC arrives in the middle of SetAPN and the handler sends a
+	// command of its own
+	cmdIF := device.(at.Commander).CommandInterface()
+	cmdIF.AddURCHandler("+TEST", func(string) {
+		cmdIF.Transact("AT+CSQ", nil)
+	})
+	modem.Handle("AT+CGDCONT=", func(string) string {
+		modem.Write(fakemodem.Lines("+TEST"))
+		time.Sleep(100 * time.Millisecond)
+		return fakemodem.OK
+	})
+
+	if err := traced.SetAPN("internet"); err != nil {
+		t.Fatalf("Could not set APN: %v", err)
+	}
+	var spans []*trace.Span
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		spans = exporter.Spans()
+		if spanNamed(spans, "AT+CSQ") != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("The URC handler didn't send its command")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	call := spanNamed(spans, "SetAPN")
+	if s := spanNamed(spans, "AT+CGDCONT"); s == nil || s.ParentID != call.SpanID || s.TraceID != call.TraceID {
+		t.Fatalf("Expected AT+CGDCONT to be a child of the call: %+v", s)
+	}
+	// Commands sent while the handlers run may lose their parent but they
+	// never get the wrong one
+	if s := spanNamed(spans, "AT+CGACT"); s == nil || (s.ParentID != call.SpanID && s.ParentID != "") {
+		t.Fatalf("Expected AT+CGACT to be a child of the call or a root span: %+v", s)
+	}
+	if s := spanNamed(spans, "AT+CSQ"); s.ParentID != "" || s.TraceID == call.TraceID {
+		t.Fatalf("Expected the command from the URC handler to be a root span: %+v", s)
+	}
+
+	// Command spans don't become the parent of the next call
+	if err := traced.AT(); err != nil {
+		t.Fatalf("AT failed: %v", err)
+	}
+	var calls, commands []*trace.Span
+	for _, s := range exporter.Spans() {
+		if s.Name != "AT" {
+			continue
+		}
+		if _, ok := s.Attributes["at.command"]; ok {
+			commands = append(commands, s)
+		} else {
+			calls = append(calls, s)
+		}
+	}
+	if len(calls) != 1 || len(commands) != 1 || calls[0].ParentID != "" || commands[0].ParentID != calls[0].SpanID {
+		t.Fatalf("Expected the call to be a root span with the command as its child: %+v %+v", calls, commands)
+	}
+}